@@ -42,9 +42,39 @@ exports.sentimentsToBQ = functions.firestore
         count: document.count,
         fetchedAt: document.fetchedAt,
         lastSeenID: document.lastSeenID,
+        runID: document.runID,
+        partial: document.partial,
+        group: document.group,
         score: document.score,
         variance: document.variance,
         stdDev: document.stdDev,
+        stdErr: document.stdErr,
+        ciLower: document.ciLower,
+        ciUpper: document.ciUpper,
+        minSamples: document.minSamples,
+        lowConfidence: document.lowConfidence,
+        smoothedScore: document.smoothedScore,
+        priorScore: document.priorScore,
+        priorStrength: document.priorStrength,
+        magnitude: document.magnitude,
+        magnitudeStdDev: document.magnitudeStdDev,
+        magnitudeVariance: document.magnitudeVariance,
+        mixedCount: document.mixedCount,
+        entityCount: document.entityCount,
+        entityScore: document.entityScore,
+        entityStdDev: document.entityStdDev,
+        entityVariance: document.entityVariance,
+        median: document.median,
+        p10: document.p10,
+        p90: document.p90,
+        histogram: document.histogram,
+        positiveCount: document.positiveCount,
+        neutralCount: document.neutralCount,
+        negativeCount: document.negativeCount,
+        positiveRatio: document.positiveRatio,
+        neutralRatio: document.neutralRatio,
+        negativeRatio: document.negativeRatio,
+        netSentiment: document.netSentiment,
         searchTerm: document.searchTerm,
         query: document.query,
         topic: document.topic,
@@ -2,8 +2,11 @@ package centiment
 
 import (
 	"context"
+	"math"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/gosimple/slug"
 	"github.com/pkg/errors"
 )
 
@@ -11,66 +14,650 @@ import (
 type Aggregator struct {
 	logger log.Logger
 	db     DB
+
+	mixedMaxScore     float64
+	mixedMinMagnitude float64
+	rollups           *Rollups
+	detector          *Detector
+	alerter           *Alerter
+	spool             *Spool
+	maxSaveRetries    int
+	saveRetryDelay    time.Duration
+	saveTimeout       time.Duration
+	sideEffectTimeout time.Duration
+	partialRuns       PartialRunPolicy
+	tweets            *TweetRecorder
+	smoother          *Smoother
+	groups            []*topicGroup
+	groupErr          error
+	exemplars         int
+	keywords          *KeywordExtractor
+}
+
+// PartialRunPolicy determines what happens to the results collected by a run
+// that is cancelled (e.g. on shutdown) before it completes.
+type PartialRunPolicy int
+
+const (
+	// DiscardPartialRuns discards the results of cancelled runs: the next run
+	// searches from the last saved checkpoint, and analyzes the tweets again.
+	DiscardPartialRuns PartialRunPolicy = iota
+	// SavePartialRuns saves the results collected before cancellation, marked
+	// as Partial. Tweets that were fetched, but not yet analyzed, are skipped.
+	SavePartialRuns
+)
+
+func (p PartialRunPolicy) String() string {
+	switch p {
+	case SavePartialRuns:
+		return "save"
+	default:
+		return "discard"
+	}
+}
+
+// ParsePartialRunPolicy parses a PartialRunPolicy from its name: "discard" or
+// "save".
+func ParsePartialRunPolicy(name string) (PartialRunPolicy, error) {
+	switch name {
+	case "discard":
+		return DiscardPartialRuns, nil
+	case "save":
+		return SavePartialRuns, nil
+	default:
+		return DiscardPartialRuns, errors.Errorf("invalid partial run policy %q: must be discard or save", name)
+	}
+}
+
+// AggregatorOption configures an Aggregator.
+type AggregatorOption func(*Aggregator)
+
+// WithMixedThresholds sets the thresholds for counting a tweet as "mixed": its
+// score is within ±maxScore of zero, and its magnitude is at least
+// minMagnitude.
+func WithMixedThresholds(maxScore float64, minMagnitude float64) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.mixedMaxScore = maxScore
+		ag.mixedMinMagnitude = minMagnitude
+	}
+}
+
+// WithRollups updates the given rollups with each Sentiment saved.
+func WithRollups(rollups *Rollups) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.rollups = rollups
+	}
+}
+
+// WithDetector checks each Sentiment saved for anomalies, using the given
+// Detector.
+func WithDetector(detector *Detector) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.detector = detector
+	}
+}
+
+// WithAlerter evaluates the alert rules for each Sentiment saved, and for the
+// anomalies detected in it (see WithDetector), using the given Alerter.
+func WithAlerter(alerter *Alerter) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.alerter = alerter
+	}
+}
+
+// WithSaveRetries sets the number of times a failed (transient) save is
+// retried, and the base delay between retries, which grows exponentially.
+//
+// Providing maxRetries of 0 disables retries.
+func WithSaveRetries(maxRetries int, baseDelay time.Duration) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.maxSaveRetries = maxRetries
+		ag.saveRetryDelay = baseDelay
+	}
+}
+
+// WithSpool spools the Sentiments that could not be saved (after retries) to
+// the given Spool. Run RunDrainer to replay them once the DB recovers.
+func WithSpool(spool *Spool) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.spool = spool
+	}
+}
+
+// WithPartialRuns sets the policy for the results of cancelled runs. Partial
+// runs are discarded by default.
+func WithPartialRuns(policy PartialRunPolicy) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.partialRuns = policy
+	}
+}
+
+// WithSaveTimeout sets the grace period for saving a run's results once the
+// run is cancelled (e.g. on shutdown). Saves are not otherwise bounded.
+func WithSaveTimeout(timeout time.Duration) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.saveTimeout = timeout
+	}
+}
+
+// WithSideEffectTimeout bounds the work done for each Sentiment alongside its
+// save: smoothing, keyword lift, tweet records, rollups, and anomaly detection
+// and alerting (which share a single timeout). A slow side effect for one
+// topic cannot delay the saves of the others beyond it.
+func WithSideEffectTimeout(timeout time.Duration) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.sideEffectTimeout = timeout
+	}
+}
+
+// WithTweetRecorder records the analysis of each tweet in a saved run, using
+// the given TweetRecorder.
+func WithTweetRecorder(recorder *TweetRecorder) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.tweets = recorder
+	}
+}
+
+// WithSmoother sets a smoothed score on each run before it is saved, using the
+// given Smoother.
+func WithSmoother(smoother *Smoother) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.smoother = smoother
+	}
+}
+
+// WithGroups produces a group-level Sentiment for each of the given topic
+// groups every run, by merging the Sentiments of the group's topics. Groups
+// are validated against the search terms: see TopicGroup.
+func WithGroups(groups []*TopicGroup, terms []*SearchTerm) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.groups, ag.groupErr = resolveGroups(groups, terms)
+	}
+}
+
+// WithExemplars sets the number of exemplar tweets (see Exemplar) kept per
+// topic in each run, for each of the most positive, most negative and most
+// intense tweets, up to 50. Providing 0 disables exemplars.
+func WithExemplars(k int) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.exemplars = k
+	}
+}
+
+// WithKeywords extracts the keywords of each topic in a run, and computes their
+// lift before saving, using the given KeywordExtractor.
+func WithKeywords(extractor *KeywordExtractor) AggregatorOption {
+	return func(ag *Aggregator) {
+		ag.keywords = extractor
+	}
 }
 
 // NewAggregator creates a new Aggregator: call Run to collect results and save
 // them to the given DB.
-func NewAggregator(logger log.Logger, db DB) (*Aggregator, error) {
+func NewAggregator(logger log.Logger, db DB, opts ...AggregatorOption) (*Aggregator, error) {
 	agg := &Aggregator{
-		db:     db,
-		logger: logger,
+		db:                db,
+		logger:            logger,
+		mixedMaxScore:     0.15,
+		mixedMinMagnitude: 0.6,
+		maxSaveRetries:    3,
+		saveRetryDelay:    time.Millisecond * 500,
+		saveTimeout:       time.Second * 30,
+		sideEffectTimeout: time.Second * 30,
+		exemplars:         5,
+	}
+
+	for _, opt := range opts {
+		opt(agg)
+	}
+
+	if agg.mixedMaxScore < 0 || agg.mixedMinMagnitude < 0 {
+		return nil, errors.New("aggregator: mixed thresholds must be >= 0")
+	}
+
+	if agg.maxSaveRetries < 0 || agg.saveRetryDelay < 0 {
+		return nil, errors.New("aggregator: save retries and retry delay must be >= 0")
+	}
+
+	if agg.saveTimeout <= 0 || agg.sideEffectTimeout <= 0 {
+		return nil, errors.New("aggregator: save and side effect timeouts must be > 0")
+	}
+
+	if agg.exemplars < 0 || agg.exemplars > maxExemplars {
+		return nil, errors.Errorf("aggregator: exemplars must be between 0 and %d", maxExemplars)
+	}
+
+	if agg.groupErr != nil {
+		return nil, errors.Wrap(agg.groupErr, "aggregator")
 	}
 
 	return agg, nil
 }
 
-// Run an aggregatation on the provided results.
+// Run an aggregatation on the provided results, and save the aggregates to the
+// DB. If the context is cancelled before results is closed, the aggregates
+// collected so far are saved or discarded according to the PartialRunPolicy.
+//
+// Use Collect and Save directly when the results of a run may need to be
+// discarded (e.g. when an analysis run is aborted).
 func (ag *Aggregator) Run(ctx context.Context, results <-chan *AnalyzerResult) error {
-	var sentiments = make(map[string]*Sentiment)
+	sentiments, err := ag.Collect(ctx, results)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ag.SavePartial(ctx, sentiments)
+		}
 
-	// TODO(matt): Handle cancellation. Use for-select here with two cases.
-	for res := range results {
-		topic := res.SearchTerm.Topic
-		if sentiments[topic] == nil {
-			sentiments[topic] = &Sentiment{}
+		return err
+	}
+
+	return ag.Save(ctx, sentiments)
+}
+
+// Collect aggregates the provided results per topic, returning the finalized
+// Sentiments once results is closed.
+func (ag *Aggregator) Collect(ctx context.Context, results <-chan *AnalyzerResult) ([]*Sentiment, error) {
+	var aggregates = make(map[string]*topicAggregate)
+
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				return ag.finalize(ctx, aggregates, false), nil
+			}
+
+			ag.collect(ctx, aggregates, res)
+		case <-ctx.Done():
+			// Return what was collected before cancellation: the caller decides
+			// whether to save it (see SavePartial).
+			return ag.finalize(ctx, aggregates, true), ctx.Err()
 		}
+	}
+}
+
+func (ag *Aggregator) collect(ctx context.Context, aggregates map[string]*topicAggregate, res *AnalyzerResult) {
+	topic := res.SearchTerm.Topic
+	if aggregates[topic] == nil {
+		aggregates[topic] = newTopicAggregate()
+	}
+
+	// Update the rolling aggregate for each topic.
+	agg := aggregates[topic]
+	agg.sentiment = ag.updateAggregate(
+		res.Score,
+		res.Magnitude,
+		res.TweetID,
+		agg.sentiment,
+	)
+	agg.sentiment.addPolarity(res.Polarity())
+	agg.addEntities(res.Entities)
+	if ag.exemplars > 0 {
+		if agg.exemplars == nil {
+			agg.exemplars = newExemplarSet(ag.exemplars)
+		}
+		agg.exemplars.add(res)
+	}
+	if ag.keywords != nil {
+		if agg.keywords == nil {
+			agg.keywords = make(keywordCounter)
+			agg.topicTerms = topicTerms(res.SearchTerm)
+		}
+		agg.keywords.add(res.Content, agg.topicTerms)
+	}
+
+	agg.sentiment.populateWithSearch(res.SearchTerm)
 
-		// Update the rolling aggregate for each topic.
-		sentiments[topic] = ag.updateAggregate(
-			res.Score,
-			res.Magnitude,
-			res.TweetID,
-			sentiments[topic],
+	if ag.tweets != nil {
+		agg.tweets = append(agg.tweets, newTweetAnalysis(
+			RunIDFromContext(ctx),
+			slug.Make(agg.sentiment.Topic),
+			res,
+			ag.tweets.withText,
+		))
+	}
+}
+
+func (ag *Aggregator) finalize(ctx context.Context, aggregates map[string]*topicAggregate, partial bool) []*Sentiment {
+	runID := RunIDFromContext(ctx)
+	collected := make([]*Sentiment, 0, len(aggregates))
+	for _, agg := range aggregates {
+		sentiment := agg.finalize()
+		sentiment.RunID = runID
+		sentiment.Partial = partial
+		sentiment.tweets = agg.tweets
+		if agg.keywords != nil {
+			sentiment.Keywords = agg.keywords.top(ag.keywords.n, sentiment.Count)
+		}
+		collected = append(collected, sentiment)
+	}
+
+	for _, group := range ag.aggregateGroups(collected) {
+		group.RunID = runID
+		group.Partial = partial
+		collected = append(collected, group)
+	}
+
+	return collected
+}
+
+// aggregateGroups produces the group-level Sentiments for the topic Sentiments
+// collected by a run (see WithGroups).
+func (ag *Aggregator) aggregateGroups(collected []*Sentiment) []*Sentiment {
+	if len(ag.groups) == 0 {
+		return nil
+	}
+
+	bySlug := make(map[string]*Sentiment, len(collected)+len(ag.groups))
+	for _, sentiment := range collected {
+		bySlug[sentiment.Slug] = sentiment
+	}
+
+	var groups []*Sentiment
+	// Nested groups are ordered before the groups they are nested in, so their
+	// Sentiments are available to break the outer groups down by.
+	for _, tg := range ag.groups {
+		group := tg.aggregate(bySlug)
+		if group == nil {
+			continue
+		}
+
+		bySlug[group.Slug] = group
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// SavePartial saves, or discards, the Sentiments collected by a cancelled run,
+// according to the Aggregator's PartialRunPolicy (see WithPartialRuns).
+func (ag *Aggregator) SavePartial(ctx context.Context, sentiments []*Sentiment) error {
+	if ag.partialRuns == DiscardPartialRuns {
+		ag.logger.Log(
+			"state", "discarded",
+			"topics", len(sentiments),
+			"policy", ag.partialRuns,
 		)
 
-		sentiments[topic].populateWithSearch(res.SearchTerm)
+		return nil
 	}
 
-	for topic, sentiment := range sentiments {
-		sentiment.finalize()
-		id, err := ag.db.SaveSentiment(ctx, *sentiment)
-		if err != nil {
-			// TODO(matt): Implement retry logic w/ back-off.
+	for _, sentiment := range sentiments {
+		sentiment.Partial = true
+	}
+
+	return ag.Save(ctx, sentiments)
+}
+
+// Save saves the provided (collected) Sentiments to the DB. Failed saves are
+// retried with back-off (see WithSaveRetries): Sentiments that still cannot be
+// saved are spooled, if a Spool is configured (see WithSpool), and replayed in
+// order once the DB recovers.
+//
+// Save runs to completion even if the context is cancelled (until the save
+// timeout elapses; see WithSaveTimeout), so that a run's results are not lost
+// mid-save on shutdown.
+func (ag *Aggregator) Save(ctx context.Context, sentiments []*Sentiment) error {
+	// Saves are not interrupted when the context is cancelled (e.g. on shutdown),
+	// but are given the save timeout to complete from then on.
+	ctx, cancel := withGrace(ctx, ag.saveTimeout)
+	defer cancel()
+
+	// Replay any previously spooled Sentiments first, so that Sentiments are
+	// saved in the order they were collected.
+	if ag.spool != nil && ag.spool.Len() > 0 {
+		ag.drain(ctx)
+	}
+
+	for _, sentiment := range sentiments {
+		ag.smooth(ctx, sentiment)
+		ag.liftKeywords(ctx, sentiment)
+
+		if ag.spool != nil && ag.spool.Len() > 0 {
+			// The DB is still failing: queue behind the spooled Sentiments.
+			ag.spoolSentiment(sentiment, nil)
+			continue
+		}
+
+		if err := ag.save(ctx, sentiment); err != nil {
+			if ag.spool != nil {
+				ag.spoolSentiment(sentiment, err)
+				continue
+			}
+
 			ag.logger.Log(
 				"err", errors.Wrap(err, "failed to save topic"),
-				"topic", topic,
+				"topic", sentiment.Topic,
 			)
-			continue
 		}
+	}
+
+	return nil
+}
+
+// smooth sets the smoothed score of a Sentiment, if enabled.
+func (ag *Aggregator) smooth(ctx context.Context, sentiment *Sentiment) {
+	if ag.smoother == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ag.sideEffectTimeout)
+	defer cancel()
 
+	if err := ag.smoother.Smooth(ctx, sentiment); err != nil {
 		ag.logger.Log(
-			"state", "saved",
+			"err", err,
 			"topic", sentiment.Topic,
-			"slug", sentiment.Slug,
-			"id", id,
-			"score", sentiment.Score,
-			"count", sentiment.Count,
-			"stddev", sentiment.StdDev,
-			"variance", sentiment.Variance,
 		)
 	}
+}
 
-	return nil
+// liftKeywords computes the lift of the keywords of a Sentiment, if enabled.
+func (ag *Aggregator) liftKeywords(ctx context.Context, sentiment *Sentiment) {
+	if ag.keywords == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ag.sideEffectTimeout)
+	defer cancel()
+
+	if err := ag.keywords.Lift(ctx, sentiment); err != nil {
+		ag.logger.Log(
+			"err", err,
+			"topic", sentiment.Topic,
+		)
+	}
+}
+
+// recordTweets records the analysis of each tweet in a Sentiment, if enabled.
+func (ag *Aggregator) recordTweets(ctx context.Context, sentiment *Sentiment) {
+	if ag.tweets == nil || len(sentiment.tweets) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ag.sideEffectTimeout)
+	defer cancel()
+
+	if err := ag.tweets.Record(ctx, sentiment.tweets); err != nil {
+		ag.logger.Log(
+			"err", err,
+			"topic", sentiment.Topic,
+		)
+	}
+}
+
+// RunDrainer periodically replays any spooled Sentiments (see WithSpool) until
+// the context is cancelled.
+func (ag *Aggregator) RunDrainer(ctx context.Context, interval time.Duration) error {
+	if ag.spool == nil {
+		return errors.New("aggregator: no spool is configured")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ag.spool.Len() > 0 {
+				ag.drain(ctx)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drain replays the spooled Sentiments, making a single attempt to save each:
+// the drain interval spaces out the retries.
+func (ag *Aggregator) drain(ctx context.Context) {
+	n, err := ag.spool.Drain(ctx, func(ctx context.Context, sentiment *Sentiment) error {
+		id, err := ag.db.SaveSentiment(ctx, *sentiment)
+		if err != nil {
+			return err
+		}
+		sentiment.ID = id
+		ag.saved(ctx, sentiment)
+
+		return nil
+	})
+
+	ag.logger.Log(
+		"state", "drained",
+		"saved", n,
+		"spooled", ag.spool.Len(),
+		"err", err,
+	)
+}
+
+func (ag *Aggregator) spoolSentiment(sentiment *Sentiment, saveErr error) {
+	if err := ag.spool.Append(sentiment); err != nil {
+		ag.logger.Log(
+			"err", errors.Wrap(err, "failed to spool topic"),
+			"saveErr", saveErr,
+			"topic", sentiment.Topic,
+		)
+		return
+	}
+
+	ag.logger.Log(
+		"state", "spooled",
+		"topic", sentiment.Topic,
+		"lastSeenID", sentiment.LastSeenID,
+		"err", saveErr,
+	)
+}
+
+// save saves a Sentiment, retrying transient failures.
+func (ag *Aggregator) save(ctx context.Context, sentiment *Sentiment) error {
+	for attempt := 0; ; attempt++ {
+		id, err := ag.db.SaveSentiment(ctx, *sentiment)
+		if err == nil {
+			sentiment.ID = id
+			ag.saved(ctx, sentiment)
+			return nil
+		}
+
+		if attempt >= ag.maxSaveRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := backoff(ag.saveRetryDelay, attempt)
+		ag.logger.Log(
+			"msg", "retrying save",
+			"topic", sentiment.Topic,
+			"err", err,
+			"attempt", attempt+1,
+			"delay", delay,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// saved logs a saved Sentiment, records it (and its tweets) against its run,
+// and updates its rollups, anomalies and alerts. Partial Sentiments are not
+// checked for anomalies or alerts: their volume (and so their other metrics)
+// reflect the cancellation, not the topic.
+func (ag *Aggregator) saved(ctx context.Context, sentiment *Sentiment) {
+	runTrackerFromContext(ctx).saved(sentiment)
+	ag.recordTweets(ctx, sentiment)
+
+	ag.logger.Log(
+		"state", "saved",
+		"topic", sentiment.Topic,
+		"slug", sentiment.Slug,
+		"id", sentiment.ID,
+		"runID", sentiment.RunID,
+		"score", sentiment.Score,
+		"count", sentiment.Count,
+		"stddev", sentiment.StdDev,
+		"variance", sentiment.Variance,
+		"magnitude", sentiment.Magnitude,
+		"mixed", sentiment.MixedCount,
+		"median", sentiment.Median,
+		"netSentiment", sentiment.NetSentiment,
+	)
+
+	ag.updateRollups(ctx, sentiment)
+	if sentiment.Partial {
+		return
+	}
+
+	ag.detectAndAlert(ctx, sentiment)
+}
+
+// updateRollups updates the rollups of a saved Sentiment, if enabled.
+func (ag *Aggregator) updateRollups(ctx context.Context, sentiment *Sentiment) {
+	if ag.rollups == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ag.sideEffectTimeout)
+	defer cancel()
+
+	if err := ag.rollups.Update(ctx, sentiment); err != nil {
+		ag.logger.Log(
+			"err", errors.Wrap(err, "failed to update rollups"),
+			"topic", sentiment.Topic,
+		)
+	}
+}
+
+// detectAndAlert checks a saved Sentiment for anomalies, and evaluates its
+// alert rules, if enabled.
+func (ag *Aggregator) detectAndAlert(ctx context.Context, sentiment *Sentiment) {
+	if ag.detector == nil && ag.alerter == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ag.sideEffectTimeout)
+	defer cancel()
+
+	var anomalies []*Anomaly
+	if ag.detector != nil {
+		detected, err := ag.detector.Detect(ctx, sentiment)
+		if err != nil {
+			ag.logger.Log(
+				"err", errors.Wrap(err, "failed to detect anomalies"),
+				"topic", sentiment.Topic,
+			)
+		}
+		anomalies = detected
+	}
+
+	if ag.alerter != nil {
+		if _, err := ag.alerter.Evaluate(ctx, sentiment, anomalies); err != nil {
+			ag.logger.Log(
+				"err", errors.Wrap(err, "failed to evaluate alerts"),
+				"topic", sentiment.Topic,
+			)
+		}
+	}
 }
 
 func (ag *Aggregator) updateAggregate(score float32, magnitude float32, tweetID int64, sentiment *Sentiment) *Sentiment {
@@ -85,6 +672,32 @@ func (ag *Aggregator) updateAggregate(score float32, magnitude float32, tweetID
 		sentiment.Count,
 	)
 
+	oldMagnitude := sentiment.Magnitude
+	sentiment.Magnitude = updateAverage(magnitude, sentiment.Magnitude, sentiment.Count)
+	sentiment.MagnitudeVariance = updateVariance(
+		magnitude,
+		sentiment.MagnitudeVariance,
+		oldMagnitude,
+		sentiment.Magnitude,
+		sentiment.Count,
+	)
+
+	if sentiment.Histogram == nil {
+		sentiment.Histogram = make([]int64, HistogramBuckets)
+	}
+	sentiment.Histogram[histogramBucket(score)]++
+
+	if sentiment.Digest == nil {
+		sentiment.Digest = NewDigest()
+	}
+	sentiment.Digest.Add(float64(score), 1)
+
+	// Compare at float32 precision (as in classify), so that a score or
+	// magnitude equal to a threshold is counted as mixed.
+	if float32(math.Abs(float64(score))) <= float32(ag.mixedMaxScore) && magnitude >= float32(ag.mixedMinMagnitude) {
+		sentiment.MixedCount++
+	}
+
 	// Record the largest (newest) Tweet ID we've seen across our results for this
 	// topic, as the checkpoint for future searches.
 	if tweetID > sentiment.LastSeenID {
@@ -94,6 +707,67 @@ func (ag *Aggregator) updateAggregate(score float32, magnitude float32, tweetID
 	return sentiment
 }
 
+// topicAggregate accumulates the results for a single topic within a run.
+type topicAggregate struct {
+	sentiment  *Sentiment
+	coEntities coEntityCounter
+	exemplars  *exemplarSet
+	keywords   keywordCounter
+	topicTerms map[string]bool
+	tweets     []*TweetAnalysis
+}
+
+func newTopicAggregate() *topicAggregate {
+	return &topicAggregate{
+		sentiment:  &Sentiment{},
+		coEntities: make(coEntityCounter),
+	}
+}
+
+// addEntities updates the entity-level aggregate with the sentiment expressed
+// towards the entities matching the topic in a tweet, and records any
+// co-mentioned entities.
+func (ta *topicAggregate) addEntities(entities []EntityResult) {
+	if len(entities) == 0 {
+		return
+	}
+
+	ta.coEntities.add(entities)
+
+	score, _, ok := matchedEntitySentiment(entities)
+	if !ok {
+		return
+	}
+
+	s := ta.sentiment
+	s.EntityCount++
+	oldAverage := s.EntityScore
+	s.EntityScore = updateAverage(score, s.EntityScore, s.EntityCount)
+	s.EntityVariance = updateVariance(
+		score,
+		s.EntityVariance,
+		oldAverage,
+		s.EntityScore,
+		s.EntityCount,
+	)
+}
+
+// finalize returns the finalized Sentiment for the topic.
+func (ta *topicAggregate) finalize() *Sentiment {
+	if len(ta.coEntities) > 0 {
+		ta.sentiment.CoEntities = ta.coEntities.top(maxCoEntities)
+	}
+
+	if ta.exemplars != nil {
+		ta.sentiment.MostPositive = ta.exemplars.positive.sorted()
+		ta.sentiment.MostNegative = ta.exemplars.negative.sorted()
+		ta.sentiment.MostIntense = ta.exemplars.intense.sorted()
+	}
+
+	ta.sentiment.finalize()
+	return ta.sentiment
+}
+
 func updateAverage(value float32, currentAverage float64, count int64) float64 {
 	return currentAverage + ((float64(value) - currentAverage) / float64(count))
 }
@@ -101,3 +775,54 @@ func updateAverage(value float32, currentAverage float64, count int64) float64 {
 func updateVariance(value float32, variance float64, oldAverage float64, newAverage float64, count int64) float64 {
 	return variance + (float64(value)-oldAverage)*(float64(value)-newAverage)
 }
+
+// detachedContext carries the values of its parent, but not its deadline or
+// cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+// detach returns a context with the values of ctx, that is never cancelled.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (dc detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (dc detachedContext) Err() error {
+	return nil
+}
+
+func (dc detachedContext) Value(key interface{}) interface{} {
+	return dc.parent.Value(key)
+}
+
+// withGrace returns a context that is not cancelled with its parent, but only
+// once grace has elapsed after the parent is done (or when the returned
+// CancelFunc is called). It carries the parent's values.
+func withGrace(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(detach(parent))
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
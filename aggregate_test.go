@@ -0,0 +1,260 @@
+package centiment
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestAggregatorCancellation(t *testing.T) {
+	var tests = []struct {
+		name    string
+		policy  PartialRunPolicy
+		partial bool
+	}{
+		{"discard", DiscardPartialRuns, false},
+		{"save", SavePartialRuns, true},
+	}
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemoryDB()
+			ag, err := NewAggregator(log.NewNopLogger(), db, WithPartialRuns(tt.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The results channel is never closed: the run ends when it is
+			// cancelled.
+			results := make(chan *AnalyzerResult)
+			done := make(chan error, 1)
+			go func() {
+				done <- ag.Run(ctx, results)
+			}()
+
+			for _, res := range randomResults(rand.New(rand.NewSource(1)), term, 5) {
+				results <- res
+			}
+			cancel()
+
+			if err := <-done; err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+
+			// Partial runs are saved despite the cancelled context.
+			saved, err := db.GetSentimentsBySlug(context.Background(), "bitcoin", 0)
+			if !tt.partial {
+				if err != ErrNoResultsFound {
+					t.Fatalf("partial run was saved: %+v", saved)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to fetch sentiments: %v", err)
+			}
+
+			if len(saved) != 1 || !saved[0].Partial || saved[0].Count != 5 {
+				t.Errorf("unexpected sentiments: %+v", saved)
+			}
+		})
+	}
+}
+
+func TestAggregatorPartialAnomalies(t *testing.T) {
+	rcv := newReceiver(t, 0, 0)
+	defer rcv.Close()
+
+	db := newMemoryDB()
+	saveBaseline(t, db, 20, false)
+
+	detector, err := NewDetector(log.NewNopLogger(), db, WithAnomalyBaseline(20, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alerter := newTestAlerter(t, db, rcv.URL, AlertRule{Name: "bearish", Metric: MetricScore, Condition: ConditionBelow, Value: -0.3})
+	ag, err := NewAggregator(log.NewNopLogger(), db, WithDetector(detector), WithAlerter(alerter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A partial run's score drop is neither an anomaly, nor alerted on.
+	partial := &Sentiment{Topic: "Bitcoin", Slug: "bitcoin", Count: 3, Score: -0.5, FetchedAt: time.Now(), Partial: true}
+	if err := ag.Save(context.Background(), []*Sentiment{partial}); err != nil {
+		t.Fatal(err)
+	}
+
+	if anomalies, err := db.GetAnomaliesBySlug(context.Background(), "bitcoin", 0); err != ErrNoResultsFound {
+		t.Errorf("unexpected anomalies for a partial run: %+v (err %v)", anomalies, err)
+	}
+
+	if delivered := rcv.delivered(); len(delivered) != 0 {
+		t.Errorf("unexpected alerts for a partial run: %+v", delivered)
+	}
+
+	// A complete run is checked against a baseline that excludes the partial
+	// run.
+	complete := &Sentiment{Topic: "Bitcoin", Slug: "bitcoin", Count: 52, Score: -0.5, Magnitude: 0.55, FetchedAt: time.Now().Add(time.Minute)}
+	if err := ag.Save(context.Background(), []*Sentiment{complete}); err != nil {
+		t.Fatal(err)
+	}
+
+	anomalies, err := db.GetAnomaliesBySlug(context.Background(), "bitcoin", 0)
+	if err != nil || len(anomalies) != 1 || anomalies[0].Metric != MetricScore || anomalies[0].Baseline != 20 {
+		t.Errorf("unexpected anomalies for a complete run: %+v (err %v)", anomalies, err)
+	}
+
+	if delivered := rcv.delivered(); len(delivered) != 1 {
+		t.Errorf("alert count mismatch: got %d want 1", len(delivered))
+	}
+}
+
+func TestAggregatorSlowSideEffects(t *testing.T) {
+	// The webhook hangs until the test completes.
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	db := newMemoryDB()
+	alerter := newTestAlerter(t, db, srv.URL, AlertRule{Name: "any", Metric: MetricScore, Condition: ConditionAbove, Value: -1})
+	ag, err := NewAggregator(
+		log.NewNopLogger(),
+		db,
+		WithAlerter(alerter),
+		WithSaveTimeout(time.Millisecond*50),
+		WithSideEffectTimeout(time.Millisecond*20),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The alerts of the first topic cannot use up the time allowed for saving
+	// the second.
+	sentiments := []*Sentiment{
+		{Topic: "Bitcoin", Slug: "bitcoin", Count: 10, FetchedAt: time.Now()},
+		{Topic: "Ethereum", Slug: "ethereum", Count: 10, FetchedAt: time.Now()},
+	}
+	if err := ag.Save(context.Background(), sentiments); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topicSlug := range []string{"bitcoin", "ethereum"} {
+		if _, err := db.GetSentimentsBySlug(context.Background(), topicSlug, 0); err != nil {
+			t.Errorf("%s was not saved: %v", topicSlug, err)
+		}
+	}
+}
+
+func TestWithGrace(t *testing.T) {
+	parent, cancelParent := context.WithCancel(ContextWithRunID(context.Background(), "run"))
+	ctx, cancel := withGrace(parent, time.Millisecond*20)
+	defer cancel()
+
+	if RunIDFromContext(ctx) != "run" {
+		t.Error("expected the parent's values to be carried")
+	}
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("cancelled before the parent")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	cancelParent()
+	start := time.Now()
+	<-ctx.Done()
+	if elapsed := time.Since(start); elapsed < time.Millisecond*20 {
+		t.Errorf("cancelled %v after the parent: want at least the grace period", elapsed)
+	}
+}
+
+func TestAggregatorCollect(t *testing.T) {
+	ag, err := NewAggregator(log.NewNopLogger(), newMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan *AnalyzerResult, 5)
+	for _, res := range randomResults(rand.New(rand.NewSource(1)), &SearchTerm{Topic: "Bitcoin"}, 5) {
+		results <- res
+	}
+	close(results)
+
+	sentiments, err := ag.Collect(context.Background(), results)
+	if err != nil {
+		t.Fatalf("failed to collect: %v", err)
+	}
+
+	if len(sentiments) != 1 || sentiments[0].Partial || sentiments[0].Count != 5 {
+		t.Errorf("unexpected sentiments: %+v", sentiments)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ag.Collect(ctx, make(chan *AnalyzerResult)); err != context.Canceled {
+		t.Errorf("error mismatch: got %v want %v", err, context.Canceled)
+	}
+}
+
+func TestAggregatorMagnitude(t *testing.T) {
+	ag, err := NewAggregator(log.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the default thresholds, a tweet is mixed when |score| <= 0.15 and
+	// magnitude >= 0.6.
+	var results = []struct {
+		score     float32
+		magnitude float32
+		mixed     bool
+	}{
+		{0.1, 0.6, true},    // At the magnitude threshold
+		{-0.15, 0.8, true},  // At the score threshold
+		{0.15, 0.59, false}, // Below the magnitude threshold
+		{0.16, 1.0, false},  // Above the score threshold
+		{-0.16, 1.0, false}, // Below the (negative) score threshold
+		{0.0, 0.2, false},
+	}
+
+	sentiment := &Sentiment{}
+	var wantMixed int64
+	for i, res := range results {
+		ag.updateAggregate(res.score, res.magnitude, int64(i+1), sentiment)
+		if res.mixed {
+			wantMixed++
+		}
+
+		if sentiment.MixedCount != wantMixed {
+			t.Errorf("mixed count mismatch after (%v, %v): got %v want %v", res.score, res.magnitude, sentiment.MixedCount, wantMixed)
+		}
+	}
+	sentiment.finalize()
+
+	// Magnitudes: 0.6, 0.8, 0.59, 1.0, 1.0, 0.2 (mean 0.698333).
+	if !approxEqual(sentiment.Magnitude, 0.698333) {
+		t.Errorf("magnitude mismatch: got %v want %v", sentiment.Magnitude, 0.698333)
+	}
+
+	// Sample standard deviation: sqrt(0.462083 / 5).
+	if !approxEqual(sentiment.MagnitudeStdDev, 0.304001) {
+		t.Errorf("magnitude std. dev. mismatch: got %v want %v", sentiment.MagnitudeStdDev, 0.304001)
+	}
+
+	if sentiment.MixedCount != 2 || sentiment.Count != int64(len(results)) {
+		t.Errorf("count mismatch: got %v mixed of %v, want %v of %v", sentiment.MixedCount, sentiment.Count, 2, len(results))
+	}
+}
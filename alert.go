@@ -0,0 +1,538 @@
+package centiment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gosimple/slug"
+	"github.com/pkg/errors"
+)
+
+// The conditions an AlertRule can test.
+const (
+	// The metric is above (or below) the rule's value.
+	ConditionAbove = "above"
+	ConditionBelow = "below"
+	// The ratio of the metric to its average over the rule's window is above
+	// (or below) the rule's value: e.g. a ratio of 2 for volume doubling.
+	ConditionRatioAbove = "ratio_above"
+	ConditionRatioBelow = "ratio_below"
+	// An anomaly was detected in the metric (or any metric, if none is set).
+	ConditionAnomaly = "anomaly"
+)
+
+// SignatureHeader is the header containing the signature of a webhook: the
+// hex-encoded HMAC-SHA256 of the request body, keyed with the webhook secret,
+// in the form "sha256=<signature>".
+const SignatureHeader = "X-Centiment-Signature"
+
+// AlertRule is a condition on a topic's sentiment to alert on, configured per
+// SearchTerm.
+type AlertRule struct {
+	// The name of the rule, unique per topic.
+	Name string
+	// The metric to test: one of "score", "volume", "magnitude" or
+	// "netSentiment". Optional for anomaly rules.
+	Metric string
+	// The condition to test (e.g. ConditionBelow), and the value to test the
+	// metric against.
+	Condition string
+	Value     float64
+	// The number of consecutive runs the condition must hold for (default 1).
+	// Applies to the "above" and "below" conditions.
+	Runs int
+	// The window the average is computed over for ratio conditions, as a
+	// duration (e.g. "24h"; the default).
+	Window string
+	// How long to wait after alerting before the rule can alert again (e.g.
+	// "1h"; the default).
+	Cooldown string
+
+	window   time.Duration
+	cooldown time.Duration
+}
+
+// validate checks the rule, and parses its durations.
+func (ar *AlertRule) validate() error {
+	if strings.TrimSpace(ar.Name) == "" {
+		return errors.New("alert rules must have a name")
+	}
+
+	switch ar.Condition {
+	case ConditionAbove, ConditionBelow, ConditionRatioAbove, ConditionRatioBelow:
+		if _, ok := alertMetrics[ar.Metric]; !ok {
+			return errors.Errorf("alert rule %q: invalid metric %q", ar.Name, ar.Metric)
+		}
+	case ConditionAnomaly:
+		if ar.Metric != "" && ar.Metric != MetricScore && ar.Metric != MetricVolume && ar.Metric != MetricMagnitude {
+			return errors.Errorf("alert rule %q: anomalies are not detected for metric %q", ar.Name, ar.Metric)
+		}
+	default:
+		return errors.Errorf("alert rule %q: invalid condition %q", ar.Name, ar.Condition)
+	}
+
+	if ar.Runs < 0 {
+		return errors.Errorf("alert rule %q: runs must be >= 0", ar.Name)
+	}
+
+	var err error
+	ar.window = time.Hour * 24
+	if ar.Window != "" {
+		if ar.window, err = time.ParseDuration(ar.Window); err != nil || ar.window <= 0 {
+			return errors.Errorf("alert rule %q: invalid window %q", ar.Name, ar.Window)
+		}
+	}
+
+	ar.cooldown = time.Hour
+	if ar.Cooldown != "" {
+		if ar.cooldown, err = time.ParseDuration(ar.Cooldown); err != nil || ar.cooldown < 0 {
+			return errors.Errorf("alert rule %q: invalid cooldown %q", ar.Name, ar.Cooldown)
+		}
+	}
+
+	return nil
+}
+
+// alertMetrics are the metrics of a Sentiment that can be alerted on.
+var alertMetrics = map[string]func(s *Sentiment) float64{
+	MetricScore:     func(s *Sentiment) float64 { return s.Score },
+	MetricVolume:    func(s *Sentiment) float64 { return float64(s.Count) },
+	MetricMagnitude: func(s *Sentiment) float64 { return s.Magnitude },
+	"netSentiment":  func(s *Sentiment) float64 { return s.NetSentiment },
+}
+
+// Alert is a triggered AlertRule, delivered as the body of a webhook.
+type Alert struct {
+	// The ID of the alert, which is deterministic for a rule and Sentiment:
+	// receivers can use it to de-duplicate deliveries.
+	ID    string `json:"id" firestore:"id,omitempty"`
+	Topic string `json:"topic" firestore:"topic"`
+	Slug  string `json:"slug" firestore:"slug"`
+	Rule  string `json:"rule" firestore:"rule"`
+	// The rule's metric and condition, the value of the metric that triggered
+	// the alert, and the threshold it was tested against.
+	Metric    string  `json:"metric" firestore:"metric"`
+	Condition string  `json:"condition" firestore:"condition"`
+	Value     float64 `json:"value" firestore:"value"`
+	Threshold float64 `json:"threshold" firestore:"threshold"`
+	// The Sentiment, and for anomaly rules the Anomaly, that triggered the
+	// alert.
+	SentimentID string    `json:"sentimentID" firestore:"sentimentID"`
+	Anomaly     *Anomaly  `json:"anomaly,omitempty" firestore:"anomaly,omitempty"`
+	TriggeredAt time.Time `json:"triggeredAt" firestore:"triggeredAt"`
+
+	// Delivery status.
+	Delivered bool   `json:"delivered" firestore:"delivered"`
+	Attempts  int    `json:"attempts" firestore:"attempts"`
+	Error     string `json:"error,omitempty" firestore:"error,omitempty"`
+}
+
+// webhookAlert is the body of a webhook delivery: an Alert, without its
+// delivery status, which isn't known until the delivery completes.
+type webhookAlert struct {
+	*Alert
+	Delivered *struct{} `json:"delivered,omitempty"`
+	Attempts  *struct{} `json:"attempts,omitempty"`
+	Error     *struct{} `json:"error,omitempty"`
+}
+
+// Alerter evaluates the alert rules for each saved Sentiment, and delivers the
+// resulting alerts to a webhook. Each delivery is signed (see SignatureHeader),
+// retried on failure, and recorded in the DB.
+type Alerter struct {
+	logger     log.Logger
+	db         DB
+	client     *http.Client
+	webhookURL string
+	secret     []byte
+	maxRetries int
+	retryDelay time.Duration
+	rules      map[string][]AlertRule
+
+	// The time each rule (keyed by slug and rule name) last alerted, and a
+	// sync.Once per rule for loading it from the DB. loads is not modified
+	// after NewAlerter returns.
+	mu          sync.Mutex
+	lastAlerted map[string]time.Time
+	loads       map[string]*sync.Once
+}
+
+// AlerterOption configures an Alerter.
+type AlerterOption func(*Alerter)
+
+// WithAlertHTTPClient sets the HTTP client used to deliver webhooks.
+func WithAlertHTTPClient(client *http.Client) AlerterOption {
+	return func(al *Alerter) {
+		al.client = client
+	}
+}
+
+// WithAlertRetries sets the number of times a failed delivery is retried, and
+// the base delay between retries.
+func WithAlertRetries(maxRetries int, baseDelay time.Duration) AlerterOption {
+	return func(al *Alerter) {
+		al.maxRetries = maxRetries
+		al.retryDelay = baseDelay
+	}
+}
+
+// NewAlerter creates a new Alerter for the alert rules of the given search
+// terms, delivering alerts to webhookURL, signed with secret.
+func NewAlerter(logger log.Logger, db DB, terms []*SearchTerm, webhookURL string, secret string, opts ...AlerterOption) (*Alerter, error) {
+	if db == nil {
+		return nil, errors.New("alerter: db must not be nil")
+	}
+
+	if !strings.HasPrefix(webhookURL, "http://") && !strings.HasPrefix(webhookURL, "https://") {
+		return nil, errors.Errorf("alerter: invalid webhook URL %q", webhookURL)
+	}
+
+	if secret == "" {
+		return nil, errors.New("alerter: the webhook secret must not be empty")
+	}
+
+	al := &Alerter{
+		logger:      logger,
+		db:          db,
+		client:      &http.Client{Timeout: time.Second * 10},
+		webhookURL:  webhookURL,
+		secret:      []byte(secret),
+		maxRetries:  3,
+		retryDelay:  time.Second,
+		rules:       make(map[string][]AlertRule),
+		lastAlerted: make(map[string]time.Time),
+		loads:       make(map[string]*sync.Once),
+	}
+
+	for _, opt := range opts {
+		opt(al)
+	}
+
+	for _, term := range terms {
+		topicSlug := slug.Make(term.Topic)
+		names := make(map[string]bool)
+		for _, rule := range term.Alerts {
+			if err := rule.validate(); err != nil {
+				return nil, errors.Wrapf(err, "alerter: topic %q", term.Topic)
+			}
+
+			if names[rule.Name] {
+				return nil, errors.Errorf("alerter: topic %q has more than one alert rule named %q", term.Topic, rule.Name)
+			}
+			names[rule.Name] = true
+
+			al.rules[topicSlug] = append(al.rules[topicSlug], rule)
+			al.loads[topicSlug+"/"+rule.Name] = &sync.Once{}
+		}
+	}
+
+	return al, nil
+}
+
+// Evaluate tests the alert rules for a (saved) Sentiment's topic, and delivers
+// any alerts triggered, returning them. anomalies are the anomalies detected
+// in the Sentiment, if any.
+//
+// Rules that have alerted within their cooldown are skipped.
+func (al *Alerter) Evaluate(ctx context.Context, sentiment *Sentiment, anomalies []*Anomaly) ([]*Alert, error) {
+	var (
+		alerts []*Alert
+		errs   []string
+	)
+
+	for _, rule := range al.rules[sentiment.Slug] {
+		if al.coolingDown(ctx, sentiment.Slug, rule) {
+			continue
+		}
+
+		alert, err := al.test(ctx, sentiment, anomalies, rule)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		if alert == nil {
+			continue
+		}
+
+		al.setLastAlerted(sentiment.Slug, rule.Name, alert.TriggeredAt)
+		if err := al.deliver(ctx, alert); err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	if len(errs) > 0 {
+		return alerts, errors.Errorf("alerter: %s", strings.Join(errs, "; "))
+	}
+
+	return alerts, nil
+}
+
+// test tests a rule against a Sentiment, and returns the resulting alert, or
+// nil if the rule was not triggered.
+func (al *Alerter) test(ctx context.Context, sentiment *Sentiment, anomalies []*Anomaly, rule AlertRule) (*Alert, error) {
+	alert := &Alert{
+		ID:          alertID(sentiment, rule),
+		Topic:       sentiment.Topic,
+		Slug:        sentiment.Slug,
+		Rule:        rule.Name,
+		Metric:      rule.Metric,
+		Condition:   rule.Condition,
+		Threshold:   rule.Value,
+		SentimentID: sentiment.ID,
+		TriggeredAt: time.Now().UTC(),
+	}
+
+	switch rule.Condition {
+	case ConditionAnomaly:
+		for _, anomaly := range anomalies {
+			if rule.Metric == "" || anomaly.Metric == rule.Metric {
+				alert.Metric = anomaly.Metric
+				alert.Value = anomaly.Value
+				alert.Threshold = anomaly.Median
+				alert.Anomaly = anomaly
+				return alert, nil
+			}
+		}
+
+		return nil, nil
+	case ConditionAbove, ConditionBelow:
+		alert.Value = alertMetrics[rule.Metric](sentiment)
+		if !compare(rule.Condition, alert.Value, rule.Value) {
+			return nil, nil
+		}
+
+		runs := rule.Runs
+		if runs <= 1 {
+			return alert, nil
+		}
+
+		// The condition must also hold for the previous runs.
+		history, err := al.db.GetSentimentsBySlug(ctx, sentiment.Slug, runs)
+		if err != nil && errors.Cause(err) != ErrNoResultsFound {
+			return nil, errors.Wrapf(err, "rule %q: failed to fetch history", rule.Name)
+		}
+
+		held := 1
+		for _, s := range history {
+			if s.ID == sentiment.ID || held == runs {
+				continue
+			}
+
+			if !compare(rule.Condition, alertMetrics[rule.Metric](s), rule.Value) {
+				break
+			}
+			held++
+		}
+
+		if held < runs {
+			return nil, nil
+		}
+
+		return alert, nil
+	default:
+		// Ratio conditions compare against the average over the window before
+		// the Sentiment.
+		value := alertMetrics[rule.Metric](sentiment)
+		history, err := al.db.GetSentimentsInRange(
+			ctx,
+			sentiment.Slug,
+			sentiment.FetchedAt.Add(-rule.window),
+			sentiment.FetchedAt,
+			0,
+		)
+		if err != nil {
+			if errors.Cause(err) == ErrNoResultsFound {
+				return nil, nil
+			}
+
+			return nil, errors.Wrapf(err, "rule %q: failed to fetch history", rule.Name)
+		}
+
+		var (
+			sum float64
+			n   int
+		)
+		for _, s := range history {
+			if s.ID == sentiment.ID {
+				continue
+			}
+			sum += alertMetrics[rule.Metric](s)
+			n++
+		}
+
+		if n == 0 || sum == 0 {
+			return nil, nil
+		}
+
+		alert.Value = value / (sum / float64(n))
+		condition := ConditionAbove
+		if rule.Condition == ConditionRatioBelow {
+			condition = ConditionBelow
+		}
+
+		if !compare(condition, alert.Value, rule.Value) {
+			return nil, nil
+		}
+
+		return alert, nil
+	}
+}
+
+func compare(condition string, value float64, threshold float64) bool {
+	if condition == ConditionBelow {
+		return value < threshold
+	}
+
+	return value > threshold
+}
+
+// coolingDown reports whether the rule has alerted within its cooldown. The
+// rule's last alert is loaded from the alert history on first use, so that
+// cooldowns persist across restarts. Concurrent callers wait for the load to
+// complete.
+func (al *Alerter) coolingDown(ctx context.Context, topicSlug string, rule AlertRule) bool {
+	key := topicSlug + "/" + rule.Name
+	if once, ok := al.loads[key]; ok {
+		once.Do(func() {
+			alerts, err := al.db.GetAlertsBySlug(ctx, topicSlug, rule.Name, 1)
+			if err != nil {
+				if errors.Cause(err) != ErrNoResultsFound {
+					al.logger.Log("err", errors.Wrap(err, "failed to load alert history"), "slug", topicSlug, "rule", rule.Name)
+				}
+				return
+			}
+
+			al.setLastAlerted(topicSlug, rule.Name, alerts[0].TriggeredAt)
+		})
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	last, ok := al.lastAlerted[key]
+	return ok && time.Since(last) < rule.cooldown
+}
+
+func (al *Alerter) setLastAlerted(topicSlug string, rule string, at time.Time) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	key := topicSlug + "/" + rule
+	if at.After(al.lastAlerted[key]) {
+		al.lastAlerted[key] = at
+	}
+}
+
+// deliver delivers an alert to the webhook, retrying failures, and records the
+// outcome in the alert history.
+func (al *Alerter) deliver(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(webhookAlert{Alert: alert})
+	if err != nil {
+		return err
+	}
+
+	var sendErr error
+	for attempt := 0; attempt <= al.maxRetries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff(al.retryDelay, attempt-1))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+
+			if ctx.Err() != nil {
+				sendErr = ctx.Err()
+				break
+			}
+		}
+
+		alert.Attempts++
+		var retry bool
+		retry, sendErr = al.send(ctx, body)
+		if sendErr == nil || !retry {
+			break
+		}
+	}
+
+	alert.Delivered = sendErr == nil
+	if sendErr != nil {
+		alert.Error = sendErr.Error()
+	}
+
+	al.logger.Log(
+		"state", "alert",
+		"topic", alert.Topic,
+		"rule", alert.Rule,
+		"value", alert.Value,
+		"delivered", alert.Delivered,
+		"attempts", alert.Attempts,
+		"err", sendErr,
+	)
+
+	if err := al.db.SaveAlert(ctx, *alert); err != nil {
+		return errors.Wrapf(err, "failed to save alert %s", alert.ID)
+	}
+
+	if sendErr != nil {
+		return errors.Wrapf(sendErr, "failed to deliver alert %s", alert.ID)
+	}
+
+	return nil
+}
+
+// send makes a single delivery attempt, and reports whether a failed attempt
+// should be retried.
+func (al *Alerter) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, al.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(SignatureHeader, "sha256="+Sign(al.secret, body))
+
+	resp, err := al.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, errors.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, errors.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of body, keyed with secret, as sent
+// in the SignatureHeader of each webhook.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// alertID returns the deterministic ID of the alert for a rule and Sentiment.
+func alertID(sentiment *Sentiment, rule AlertRule) string {
+	return fmt.Sprintf("%s-%s-%s", sentiment.Slug, slug.Make(rule.Name), sentiment.ID)
+}
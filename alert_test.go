@@ -0,0 +1,359 @@
+package centiment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const testWebhookSecret = "sekrit"
+
+// receiver is a webhook receiver that records the alerts delivered to it, and
+// fails the first failures deliveries with status.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	alerts   []*Alert
+	requests int
+	failures int
+	status   int
+}
+
+func newReceiver(t *testing.T, failures int, status int) *receiver {
+	rcv := &receiver{failures: failures, status: status}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+
+		rcv.requests++
+		if rcv.requests <= rcv.failures {
+			w.WriteHeader(rcv.status)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read webhook: %v", err)
+			return
+		}
+
+		if got, want := r.Header.Get(SignatureHeader), "sha256="+Sign([]byte(testWebhookSecret), body); got != want {
+			t.Errorf("signature mismatch: got %q want %q", got, want)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var alert *Alert
+		if err := json.Unmarshal(body, &alert); err != nil {
+			t.Errorf("failed to decode webhook: %v", err)
+			return
+		}
+
+		// The delivery status is recorded in the alert history, but is not
+		// part of the webhook.
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			t.Errorf("failed to decode webhook: %v", err)
+			return
+		}
+
+		for _, field := range []string{"delivered", "attempts", "error"} {
+			if _, ok := fields[field]; ok {
+				t.Errorf("webhook contains the delivery status field %q: %s", field, body)
+			}
+		}
+
+		rcv.alerts = append(rcv.alerts, alert)
+	}))
+
+	return rcv
+}
+
+func (rcv *receiver) delivered() []*Alert {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	return rcv.alerts
+}
+
+// saveScores saves a run for each of the given scores and volumes, ten minutes
+// apart and ending now, and returns the last (most recent) run.
+func saveScores(t *testing.T, db DB, scores []float64, volumes []int64) *Sentiment {
+	t.Helper()
+
+	var last Sentiment
+	start := time.Now().Add(-time.Minute * 10 * time.Duration(len(scores)-1))
+	for i, score := range scores {
+		last = Sentiment{
+			Topic:     "Bitcoin",
+			Slug:      "bitcoin",
+			Score:     score,
+			Count:     volumes[i],
+			FetchedAt: start.Add(time.Minute * 10 * time.Duration(i)),
+		}
+
+		id, err := db.SaveSentiment(context.Background(), last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last.ID = id
+	}
+
+	return &last
+}
+
+func newTestAlerter(t *testing.T, db DB, url string, rules ...AlertRule) *Alerter {
+	t.Helper()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin", Alerts: rules}
+	alerter, err := NewAlerter(
+		log.NewNopLogger(),
+		db,
+		[]*SearchTerm{term},
+		url,
+		testWebhookSecret,
+		WithAlertRetries(3, time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return alerter
+}
+
+func TestAlerterRules(t *testing.T) {
+	sustained := AlertRule{Name: "sustained", Metric: MetricScore, Condition: ConditionBelow, Value: -0.3, Runs: 3}
+	spike := AlertRule{Name: "spike", Metric: MetricVolume, Condition: ConditionRatioAbove, Value: 2}
+	anomaly := AlertRule{Name: "anomaly", Metric: MetricScore, Condition: ConditionAnomaly}
+
+	var tests = []struct {
+		name      string
+		rule      AlertRule
+		scores    []float64
+		volumes   []int64
+		anomalies []*Anomaly
+		value     float64
+		alerted   bool
+	}{
+		{"consecutive", sustained, []float64{0.1, -0.4, -0.5, -0.6}, []int64{50, 50, 50, 50}, nil, -0.6, true},
+		{"not consecutive", sustained, []float64{-0.4, 0.1, -0.5, -0.6}, []int64{50, 50, 50, 50}, nil, 0, false},
+		{"too few runs", sustained, []float64{-0.5, -0.6}, []int64{50, 50}, nil, 0, false},
+		{"volume doubles", spike, []float64{0, 0, 0, 0}, []int64{40, 50, 60, 120}, nil, 2.4, true},
+		{"volume steady", spike, []float64{0, 0, 0, 0}, []int64{40, 50, 60, 90}, nil, 0, false},
+		{"no history", spike, []float64{0}, []int64{120}, nil, 0, false},
+		{"anomaly", anomaly, []float64{0}, []int64{50}, []*Anomaly{{Metric: MetricVolume, Value: 200}, {Metric: MetricScore, Value: -0.8}}, -0.8, true},
+		{"other anomaly", anomaly, []float64{0}, []int64{50}, []*Anomaly{{Metric: MetricVolume, Value: 200}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newReceiver(t, 0, 0)
+			defer rcv.Close()
+
+			db := newMemoryDB()
+			sentiment := saveScores(t, db, tt.scores, tt.volumes)
+			alerter := newTestAlerter(t, db, rcv.URL, tt.rule)
+
+			alerts, err := alerter.Evaluate(context.Background(), sentiment, tt.anomalies)
+			if err != nil {
+				t.Fatalf("failed to evaluate: %v", err)
+			}
+
+			if !tt.alerted {
+				if len(alerts) != 0 || len(rcv.delivered()) != 0 {
+					t.Fatalf("unexpected alerts: %+v", alerts)
+				}
+				return
+			}
+
+			delivered := rcv.delivered()
+			if len(alerts) != 1 || len(delivered) != 1 {
+				t.Fatalf("alert count mismatch: got %d (%d delivered) want 1", len(alerts), len(delivered))
+			}
+
+			got := delivered[0]
+			if got.ID != alerts[0].ID || got.Rule != tt.rule.Name || got.SentimentID != sentiment.ID {
+				t.Errorf("unexpected alert: %+v", got)
+			}
+
+			if !approxEqual(got.Value, tt.value) {
+				t.Errorf("value mismatch: got %v want %v", got.Value, tt.value)
+			}
+
+			saved, err := db.GetAlertsBySlug(context.Background(), "bitcoin", "", 0)
+			if err != nil {
+				t.Fatalf("failed to fetch alerts: %v", err)
+			}
+
+			if len(saved) != 1 || !saved[0].Delivered || saved[0].Attempts != 1 {
+				t.Errorf("unexpected alert history: %+v", saved)
+			}
+		})
+	}
+}
+
+func TestAlerterRetries(t *testing.T) {
+	var tests = []struct {
+		name      string
+		failures  int
+		status    int
+		attempts  int
+		delivered bool
+	}{
+		{"server error", 2, http.StatusBadGateway, 3, true},
+		{"rate limited", 1, http.StatusTooManyRequests, 2, true},
+		{"gives up", 10, http.StatusInternalServerError, 4, false},
+		{"not retried", 10, http.StatusBadRequest, 1, false},
+	}
+
+	rule := AlertRule{Name: "negative", Metric: MetricScore, Condition: ConditionBelow, Value: -0.3}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newReceiver(t, tt.failures, tt.status)
+			defer rcv.Close()
+
+			db := newMemoryDB()
+			sentiment := saveScores(t, db, []float64{-0.5}, []int64{50})
+			alerter := newTestAlerter(t, db, rcv.URL, rule)
+
+			_, err := alerter.Evaluate(context.Background(), sentiment, nil)
+			if tt.delivered && err != nil {
+				t.Fatalf("failed to evaluate: %v", err)
+			}
+
+			if !tt.delivered && err == nil {
+				t.Fatal("expected a delivery error")
+			}
+
+			saved, err := db.GetAlertsBySlug(context.Background(), "bitcoin", "", 0)
+			if err != nil {
+				t.Fatalf("failed to fetch alerts: %v", err)
+			}
+
+			if got := saved[0]; got.Delivered != tt.delivered || got.Attempts != tt.attempts {
+				t.Errorf("delivery mismatch: got %t/%d want %t/%d", got.Delivered, got.Attempts, tt.delivered, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestAlerterCooldown(t *testing.T) {
+	rcv := newReceiver(t, 0, 0)
+	defer rcv.Close()
+
+	rule := AlertRule{Name: "negative", Metric: MetricScore, Condition: ConditionBelow, Value: -0.3, Cooldown: "1h"}
+	db := newMemoryDB()
+	first := saveScores(t, db, []float64{-0.5}, []int64{50})
+	alerter := newTestAlerter(t, db, rcv.URL, rule)
+
+	if _, err := alerter.Evaluate(context.Background(), first, nil); err != nil {
+		t.Fatalf("failed to evaluate: %v", err)
+	}
+
+	// The next run is within the cooldown, including for a new Alerter (e.g.
+	// after a restart), which loads the alert history.
+	second := saveScores(t, db, []float64{-0.6}, []int64{50})
+	restarted := newTestAlerter(t, db, rcv.URL, rule)
+	for _, al := range []*Alerter{alerter, restarted} {
+		alerts, err := al.Evaluate(context.Background(), second, nil)
+		if err != nil {
+			t.Fatalf("failed to evaluate: %v", err)
+		}
+
+		if len(alerts) != 0 {
+			t.Errorf("alerted during cooldown: %+v", alerts)
+		}
+	}
+
+	if n := len(rcv.delivered()); n != 1 {
+		t.Errorf("delivery count mismatch: got %d want 1", n)
+	}
+}
+
+func TestAlerterCooldownHistory(t *testing.T) {
+	rcv := newReceiver(t, 0, 0)
+	defer rcv.Close()
+
+	negative := AlertRule{Name: "negative", Metric: MetricScore, Condition: ConditionBelow, Value: -0.3, Cooldown: "1h"}
+	spike := AlertRule{Name: "spike", Metric: MetricVolume, Condition: ConditionRatioAbove, Value: 100}
+
+	// The rule last alerted within its cooldown, and has since been buried
+	// under the alerts of another rule.
+	db := newMemoryDB()
+	now := time.Now()
+	history := []Alert{{ID: "negative", Slug: "bitcoin", Rule: negative.Name, TriggeredAt: now.Add(-time.Minute * 30)}}
+	for i := 0; i < 150; i++ {
+		history = append(history, Alert{
+			ID:          fmt.Sprintf("spike-%d", i),
+			Slug:        "bitcoin",
+			Rule:        spike.Name,
+			TriggeredAt: now.Add(-time.Second * time.Duration(i)),
+		})
+	}
+
+	for _, alert := range history {
+		if err := db.SaveAlert(context.Background(), alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Concurrent evaluations all wait for the history to be loaded.
+	sentiment := saveScores(t, db, []float64{-0.5}, []int64{50})
+	alerter := newTestAlerter(t, db, rcv.URL, negative, spike)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			alerts, err := alerter.Evaluate(context.Background(), sentiment, nil)
+			if err != nil {
+				t.Errorf("failed to evaluate: %v", err)
+			}
+
+			if len(alerts) != 0 {
+				t.Errorf("alerted during cooldown: %+v", alerts)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(rcv.delivered()); n != 0 {
+		t.Errorf("delivery count mismatch: got %d want 0", n)
+	}
+}
+
+func TestNewAlerter(t *testing.T) {
+	var tests = []struct {
+		name  string
+		url   string
+		rules []AlertRule
+		ok    bool
+	}{
+		{"valid", "https://example.com/hook", []AlertRule{{Name: "a", Metric: MetricScore, Condition: ConditionBelow, Window: "12h", Cooldown: "0s"}}, true},
+		{"invalid URL", "example.com/hook", nil, false},
+		{"unnamed", "https://example.com/hook", []AlertRule{{Metric: MetricScore, Condition: ConditionBelow}}, false},
+		{"invalid metric", "https://example.com/hook", []AlertRule{{Name: "a", Metric: "mood", Condition: ConditionBelow}}, false},
+		{"invalid condition", "https://example.com/hook", []AlertRule{{Name: "a", Metric: MetricScore, Condition: "under"}}, false},
+		{"invalid window", "https://example.com/hook", []AlertRule{{Name: "a", Metric: MetricVolume, Condition: ConditionRatioAbove, Window: "a day"}}, false},
+		{"duplicate names", "https://example.com/hook", []AlertRule{{Name: "a", Metric: MetricScore, Condition: ConditionBelow}, {Name: "a", Metric: MetricScore, Condition: ConditionAbove}}, false},
+	}
+
+	for _, tt := range tests {
+		term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin", Alerts: tt.rules}
+		_, err := NewAlerter(log.NewNopLogger(), newMemoryDB(), []*SearchTerm{term}, tt.url, testWebhookSecret)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got err %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
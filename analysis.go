@@ -2,13 +2,25 @@ package centiment
 
 import (
 	"context"
+	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	nl "cloud.google.com/go/language/apiv1"
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// ErrErrorBudgetExceeded is returned from an analysis run when the proportion
+// of failed analyses exceeds the configured error budget. The results of an
+// aborted run are incomplete (and likely biased), and should be discarded.
+var ErrErrorBudgetExceeded = errors.New("analyzer: error budget exceeded")
+
 // Analyzer holds the configuration for running analyses against a Natural
 // Language API. An Analyzer should only be initialized via NewAnalyzer.
 type Analyzer struct {
@@ -17,6 +29,23 @@ type Analyzer struct {
 	logger     log.Logger
 	wg         sync.WaitGroup
 	numWorkers int
+
+	maxRetries    int
+	retryDelay    time.Duration
+	breaker       *circuitBreaker
+	maxErrorRate  float64
+	minErrorCount int
+	budget        *Budget
+	batchSize     int
+	batchWait     time.Duration
+	entities      bool
+
+	minWorkers    int
+	maxWorkers    int
+	scaleInterval time.Duration
+	maxLatency    time.Duration
+	latency       latencyTracker
+	quotaErrors   int64
 }
 
 // AnalyzerResult is the result from natural language analysis of a tweet.
@@ -25,15 +54,137 @@ type AnalyzerResult struct {
 	Score      float32
 	Magnitude  float32
 	SearchTerm *SearchTerm
+	// The text of the tweet, when it was created, and the provider (e.g.
+	// ProviderNaturalLanguage) that analyzed it.
+	Content   string
+	CreatedAt time.Time
+	Provider  string
+	// Entities holds the entity-level sentiment for the tweet, when entity
+	// sentiment analysis is enabled.
+	Entities []EntityResult
+}
+
+// AnalyzerOption configures an Analyzer.
+type AnalyzerOption func(*Analyzer)
+
+// WithRetries sets the number of times a failed request to the Natural
+// Language API is retried, and the base delay between attempts. Only
+// retryable errors (e.g. Unavailable, ResourceExhausted) are retried; the
+// delay grows exponentially (with jitter) with each attempt.
+//
+// Providing maxRetries of 0 disables retries.
+func WithRetries(maxRetries int, baseDelay time.Duration) AnalyzerOption {
+	return func(az *Analyzer) {
+		az.maxRetries = maxRetries
+		az.retryDelay = baseDelay
+	}
+}
+
+// WithCircuitBreaker pauses requests to the Natural Language API for cooldown
+// after threshold consecutive retryable failures, before allowing a trial
+// request through. Providing a threshold of 0 disables the circuit breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) AnalyzerOption {
+	return func(az *Analyzer) {
+		az.breaker = newCircuitBreaker(threshold, cooldown)
+	}
+}
+
+// WithErrorBudget aborts a run when the proportion of failed analyses exceeds
+// maxErrorRate (0.0 - 1.0). The budget is only enforced once at least
+// minErrors analyses have failed, so that a single early failure does not
+// abort a run. Providing a maxErrorRate of 0 disables the error budget.
+//
+// Only failures that reflect the health of the API (those that are retried,
+// such as Unavailable or ResourceExhausted) count against the budget: tweets
+// that fail permanently (e.g. with an unsupported language) are logged and
+// skipped.
+func WithErrorBudget(maxErrorRate float64, minErrors int) AnalyzerOption {
+	return func(az *Analyzer) {
+		az.maxErrorRate = maxErrorRate
+		az.minErrorCount = minErrors
+	}
+}
+
+// WithBudget enforces the spending limits of the given Budget: once a limit is
+// reached, the remaining search results in a run are not analyzed.
+func WithBudget(budget *Budget) AnalyzerOption {
+	return func(az *Analyzer) {
+		az.budget = budget
+	}
+}
+
+// WithBatching packs up to size tweets into each request to the Natural
+// Language API, waiting up to wait for a batch to fill. Sentence-level
+// sentiment is mapped back to each tweet: if the mapping is ambiguous, the
+// tweets in the batch are analyzed individually.
+//
+// Batching reduces the number of billable units (charged per 1,000
+// characters) for short tweets. Providing a size of 1 (or less) disables
+// batching.
+func WithBatching(size int, wait time.Duration) AnalyzerOption {
+	return func(az *Analyzer) {
+		az.batchSize = size
+		az.batchWait = wait
+	}
+}
+
+// WithEntitySentiment additionally analyzes the sentiment expressed towards
+// each entity in a tweet, so that sentiment can be attributed to the entities
+// matching a topic (see SearchTerm.Aliases) rather than the tweet as a whole.
+//
+// Entity sentiment analysis is billed separately, and requires a request per
+// tweet (regardless of batching).
+func WithEntitySentiment() AnalyzerOption {
+	return func(az *Analyzer) {
+		az.entities = true
+	}
 }
 
 // NewAnalyzer instantiates an Analyzer. Call the Run method to start an analysis.
-func NewAnalyzer(logger log.Logger, client *nl.Client, numWorkers int) (*Analyzer, error) {
+func NewAnalyzer(logger log.Logger, client *nl.Client, numWorkers int, opts ...AnalyzerOption) (*Analyzer, error) {
+	if numWorkers < 1 {
+		return nil, errors.New("analyzer: numWorkers must be > 0")
+	}
+
 	ap := &Analyzer{
-		nlClient:   client,
-		httpClient: &http.Client{},
-		logger:     logger,
-		numWorkers: numWorkers,
+		nlClient:      client,
+		httpClient:    &http.Client{},
+		logger:        logger,
+		numWorkers:    numWorkers,
+		maxRetries:    3,
+		retryDelay:    time.Millisecond * 250,
+		breaker:       newCircuitBreaker(5, time.Second*30),
+		maxErrorRate:  0.2,
+		minErrorCount: 5,
+		batchSize:     1,
+		minWorkers:    numWorkers,
+		maxWorkers:    numWorkers,
+	}
+
+	for _, opt := range opts {
+		opt(ap)
+	}
+
+	if ap.minWorkers < 1 || ap.maxWorkers < ap.minWorkers {
+		return nil, errors.Errorf("analyzer: worker bounds must satisfy 0 < min <= max (got min=%d, max=%d)", ap.minWorkers, ap.maxWorkers)
+	}
+
+	if ap.numWorkers < ap.minWorkers || ap.numWorkers > ap.maxWorkers {
+		return nil, errors.Errorf("analyzer: the number of workers (%d) must be within the worker bounds (min=%d, max=%d)", ap.numWorkers, ap.minWorkers, ap.maxWorkers)
+	}
+
+	if ap.maxErrorRate < 0 || ap.maxErrorRate > 1 {
+		return nil, errors.Errorf("analyzer: maxErrorRate must be between 0 and 1 (got %f)", ap.maxErrorRate)
+	}
+
+	if ap.breaker != nil {
+		ap.breaker.onStateChange = func(from, to breakerState) {
+			ap.logger.Log(
+				"msg", "circuit breaker state changed",
+				"from", from,
+				"to", to,
+			)
+		}
 	}
 
 	return ap, nil
@@ -45,56 +196,525 @@ func NewAnalyzer(logger log.Logger, client *nl.Client, numWorkers int) (*Analyze
 // Run returns when analyses have completed, and can be cancelled by wrapping
 // the provided context with context.WithCancel and calling the provided
 // CancelFunc.
+//
+// Run returns ErrErrorBudgetExceeded if the run was aborted due to too many
+// failed analyses: any results already sent on analyzed should be discarded.
+// The analyzed channel is closed when Run returns.
 func (az *Analyzer) Run(ctx context.Context, searched <-chan *SearchResult, analyzed chan<- *AnalyzerResult) error {
-	az.wg.Add(az.numWorkers)
+	// Abort any in-flight requests when the error budget is exceeded.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	run := &analysisRun{
+		errors: errorBudget{
+			maxErrorRate: az.maxErrorRate,
+			minErrors:    int64(az.minErrorCount),
+		},
+		abort: cancel,
+	}
+
+	if az.budget != nil {
+		az.budget.StartRun(RunIDFromContext(ctx))
+	}
+
+	run.pool.target = int64(az.numWorkers)
 	for i := 0; i < az.numWorkers; i++ {
 		// Spawn worker, pass context.
-		go az.analyze(ctx, searched, analyzed)
+		az.spawn(runCtx, run, searched, analyzed)
+	}
+	az.setPoolMetrics(int64(az.numWorkers), 0, len(searched), az.latency.value())
+
+	if az.adaptive() {
+		az.wg.Add(1)
+		go az.scale(runCtx, run, searched, analyzed)
 	}
 
 	// We block until we've processed all results.
 	az.wg.Wait()
 	close(analyzed)
 
+	if az.adaptive() {
+		az.logger.Log(
+			"msg", "worker pool finished",
+			"workers", atomic.LoadInt64(&run.pool.target),
+			"latency", az.latency.value(),
+		)
+	}
+
+	if az.budget != nil {
+		az.flushBudget(ctx)
+	}
+
+	if run.errors.exceeded() {
+		attempts, failures := run.errors.counts()
+		az.logger.Log(
+			"err", ErrErrorBudgetExceeded,
+			"attempts", attempts,
+			"failures", failures,
+		)
+		return ErrErrorBudgetExceeded
+	}
+
 	return nil
 }
 
-func (az *Analyzer) analyze(ctx context.Context, searched <-chan *SearchResult, analyzed chan<- *AnalyzerResult) {
+// analysisRun holds the state of a single analysis run, shared between
+// workers.
+type analysisRun struct {
+	errors errorBudget
+	// abort cancels in-flight requests.
+	abort context.CancelFunc
+	// overBudget is set once the spending limit has been reached.
+	overBudget int32
+	pool       poolState
+}
+
+// skip reports whether the remaining search results in the run should be
+// drained without analysis.
+func (r *analysisRun) skip() bool {
+	return r.errors.exceeded() || atomic.LoadInt32(&r.overBudget) == 1
+}
+
+func (az *Analyzer) analyze(ctx context.Context, run *analysisRun, searched <-chan *SearchResult, analyzed chan<- *AnalyzerResult) {
 	defer az.wg.Done()
 
 	for {
+		// Exit if the pool has been shrunk.
+		if run.pool.retire() {
+			return
+		}
+
+		batch, ok := az.next(ctx, searched)
+		if !ok {
+			if ctx.Err() != nil && run.errors.exceeded() {
+				// The run was aborted: keep draining the search results.
+				ctx = context.Background()
+				continue
+			}
+
+			if ctx.Err() != nil {
+				az.logger.Log("status", "closing", "err", ctx.Err())
+			} else {
+				atomic.StoreInt32(&run.pool.drained, 1)
+			}
+
+			atomic.AddInt64(&run.pool.workers, -1)
+			return
+		}
+
+		// Once the run has been aborted (or has reached its spending limit),
+		// drain the remaining search results without analyzing them, so that
+		// the Searcher can complete.
+		if run.skip() {
+			continue
+		}
+
+		start := time.Now()
+		if len(batch) > 1 {
+			az.analyzeBatch(ctx, run, batch, analyzed)
+		} else if result, ok := az.analyzeOne(ctx, run, batch[0]); ok {
+			az.emit(ctx, run, batch[0], result, analyzed)
+		}
+		run.pool.addBusy(time.Since(start))
+	}
+}
+
+// next receives the next batch of search results from searched. When batching
+// is disabled, batches contain a single result. It returns false once searched
+// has been closed & drained, or the context is done.
+func (az *Analyzer) next(ctx context.Context, searched <-chan *SearchResult) ([]*SearchResult, bool) {
+	var batch []*SearchResult
+
+	select {
+	case st, ok := <-searched:
+		if !ok {
+			return nil, false
+		}
+		batch = append(batch, st)
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	if az.batchSize <= 1 {
+		return batch, true
+	}
+
+	timer := time.NewTimer(az.batchWait)
+	defer timer.Stop()
+
+	for len(batch) < az.batchSize {
 		select {
 		case st, ok := <-searched:
 			if !ok {
-				return
+				return batch, true
 			}
+			batch = append(batch, st)
+		case <-timer.C:
+			return batch, true
+		case <-ctx.Done():
+			return batch, true
+		}
+	}
 
-			resp, err := az.nlClient.AnalyzeSentiment(ctx, st.sentimentRequest())
-			if err != nil {
-				az.logger.Log(
-					"err", err,
-					"topic", st.searchTerm.Topic,
-					"content", st.content,
-				)
-				// TODO(matt): Implement retry logic.
-				// TODO(matt): Count errors & fail closed if errors approaches some % of
-				// seen results
-				continue
+	return batch, true
+}
+
+// analyzeOne analyzes a single search result, and reports whether the analysis
+// succeeded.
+func (az *Analyzer) analyzeOne(ctx context.Context, run *analysisRun, st *SearchResult) (*AnalyzerResult, bool) {
+	req := st.sentimentRequest()
+	units := map[string]int64{
+		st.searchTerm.Topic: billableUnits(req.GetDocument().GetContent()),
+	}
+	if !az.reserve(ctx, run, FeatureSentiment, units) {
+		return nil, false
+	}
+
+	var resp *languagepb.AnalyzeSentimentResponse
+	err := az.withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = az.nlClient.AnalyzeSentiment(ctx, req)
+		return err
+	})
+	if cancelled(ctx, err) {
+		// The run was cancelled (e.g. on shutdown): the failure says nothing
+		// about the API, and isn't counted against the error budget.
+		az.refund(FeatureSentiment, units)
+		return nil, false
+	}
+
+	if run.errors.record(err) {
+		run.abort()
+	}
+
+	if err != nil {
+		az.refund(FeatureSentiment, units)
+		runTrackerFromContext(ctx).apiError(st.searchTerm.Topic)
+		az.logger.Log(
+			"err", err,
+			"topic", st.searchTerm.Topic,
+			"content", st.content,
+		)
+		return nil, false
+	}
+
+	return newAnalyzerResult(
+		st,
+		resp.DocumentSentiment.GetScore(),
+		resp.DocumentSentiment.GetMagnitude(),
+	), true
+}
+
+// analyzeBatch analyzes a batch of search results with a single request,
+// falling back to analyzing each result individually if the sentences in the
+// response cannot be mapped back to each result.
+func (az *Analyzer) analyzeBatch(ctx context.Context, run *analysisRun, batch []*SearchResult, analyzed chan<- *AnalyzerResult) {
+	sb := newSentimentBatch(batch)
+	units := sb.unitsByTopic()
+	if !az.reserve(ctx, run, FeatureSentiment, units) {
+		return
+	}
+
+	var resp *languagepb.AnalyzeSentimentResponse
+	err := az.withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = az.nlClient.AnalyzeSentiment(ctx, sb.request())
+		return err
+	})
+	if cancelled(ctx, err) {
+		az.refund(FeatureSentiment, units)
+		return
+	}
+
+	if run.errors.record(err) {
+		run.abort()
+	}
+
+	if err != nil {
+		az.refund(FeatureSentiment, units)
+		for topic := range units {
+			runTrackerFromContext(ctx).apiError(topic)
+		}
+		az.logger.Log(
+			"err", err,
+			"msg", "batch analysis failed",
+			"size", len(batch),
+		)
+		return
+	}
+
+	results, err := sb.split(resp)
+	if err != nil {
+		az.logger.Log(
+			"err", err,
+			"msg", "falling back to individual analysis",
+			"size", len(batch),
+		)
+
+		for _, st := range batch {
+			if run.skip() {
+				return
 			}
 
-			result := &AnalyzerResult{
-				TweetID:    st.tweetID,
-				Score:      resp.DocumentSentiment.GetScore(),
-				Magnitude:  resp.DocumentSentiment.GetMagnitude(),
-				SearchTerm: st.searchTerm,
+			if result, ok := az.analyzeOne(ctx, run, st); ok {
+				az.emit(ctx, run, st, result, analyzed)
 			}
+		}
+
+		return
+	}
+
+	for i, result := range results {
+		az.emit(ctx, run, batch[i], result, analyzed)
+	}
+}
+
+// emit sends a result on analyzed, first adding entity-level sentiment (if
+// enabled).
+func (az *Analyzer) emit(ctx context.Context, run *analysisRun, st *SearchResult, result *AnalyzerResult, analyzed chan<- *AnalyzerResult) {
+	if az.entities && !run.skip() {
+		result.Entities = az.analyzeEntities(ctx, run, st)
+	}
+
+	// Don't block if the run was cancelled, and results are no longer being
+	// collected.
+	select {
+	case analyzed <- result:
+		runTrackerFromContext(ctx).analyzed(st.searchTerm.Topic)
+	case <-ctx.Done():
+	}
+}
+
+// analyzeEntities analyzes the entity-level sentiment of a search result. A
+// failed analysis is logged, and returns no entities: the document-level
+// result is still used.
+func (az *Analyzer) analyzeEntities(ctx context.Context, run *analysisRun, st *SearchResult) []EntityResult {
+	req := st.entitySentimentRequest()
+	units := map[string]int64{
+		st.searchTerm.Topic: billableUnits(req.GetDocument().GetContent()),
+	}
+	if !az.reserve(ctx, run, FeatureEntitySentiment, units) {
+		return nil
+	}
+
+	var resp *languagepb.AnalyzeEntitySentimentResponse
+	err := az.withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = az.nlClient.AnalyzeEntitySentiment(ctx, req)
+		return err
+	})
+	if cancelled(ctx, err) {
+		az.refund(FeatureEntitySentiment, units)
+		return nil
+	}
+
+	if run.errors.record(err) {
+		run.abort()
+	}
+
+	if err != nil {
+		az.refund(FeatureEntitySentiment, units)
+		runTrackerFromContext(ctx).apiError(st.searchTerm.Topic)
+		az.logger.Log(
+			"err", err,
+			"msg", "entity analysis failed",
+			"topic", st.searchTerm.Topic,
+			"content", st.content,
+		)
+		return nil
+	}
+
+	return newEntityResults(st.searchTerm, resp.GetEntities())
+}
+
+func newAnalyzerResult(st *SearchResult, score float32, magnitude float32) *AnalyzerResult {
+	return &AnalyzerResult{
+		TweetID:    st.tweetID,
+		Score:      score,
+		Magnitude:  magnitude,
+		SearchTerm: st.searchTerm,
+		Content:    st.content,
+		CreatedAt:  st.createdAt,
+		Provider:   ProviderNaturalLanguage,
+	}
+}
+
+// reserve reserves the billable units of a feature for a request against the
+// budget (if any), and reports whether the request should proceed.
+func (az *Analyzer) reserve(ctx context.Context, run *analysisRun, feature string, units map[string]int64) bool {
+	if az.budget == nil {
+		return true
+	}
+
+	err := az.budget.reserve(ctx, feature, units)
+	if err == nil {
+		return true
+	}
+
+	if errors.Cause(err) == ErrBudgetExhausted {
+		// Only log the first time the limit is reached in a run.
+		if atomic.CompareAndSwapInt32(&run.overBudget, 0, 1) {
+			az.logger.Log(
+				"status", "stopping",
+				"err", err,
+				"msg", "spending limit reached: skipping remaining analyses",
+			)
+		}
+
+		return false
+	}
+
+	// Fail open if the budget could not be loaded.
+	az.logger.Log("err", err, "msg", "budget unavailable")
+	return true
+}
+
+func (az *Analyzer) refund(feature string, units map[string]int64) {
+	if az.budget != nil {
+		az.budget.refund(feature, units)
+	}
+}
+
+// flushBudget persists the budget's usage at the end of a run, and records the
+// run's usage against it (see Run). A separate context is used so that usage
+// is still persisted if the run was cancelled.
+func (az *Analyzer) flushBudget(ctx context.Context) {
+	usage := az.budget.RunUsage()
+	runTrackerFromContext(ctx).usage(usage)
+	az.logger.Log(
+		"msg", "run usage",
+		"units", usage.Units,
+		"requests", usage.Requests,
+	)
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if err := az.budget.Flush(flushCtx); err != nil {
+		az.logger.Log("err", err)
+	}
+}
+
+// withRetry calls fn, retrying retryable errors with an exponential back-off
+// up to the configured number of retries. Calls are gated by the circuit
+// breaker.
+func (az *Analyzer) withRetry(ctx context.Context, fn func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		if err := az.breaker.wait(ctx); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err := fn(ctx)
+		if cancelled(ctx, err) {
+			// Neither a success nor a failure of the API.
+			az.breaker.cancel()
+			return err
+		}
+
+		az.latency.observe(time.Since(start))
+		if status.Code(errors.Cause(err)) == codes.ResourceExhausted {
+			atomic.AddInt64(&az.quotaErrors, 1)
+		}
+
+		if err == nil || !isRetryable(err) {
+			// Non-retryable errors (e.g. an unsupported language) are not a sign
+			// that the API is unhealthy.
+			az.breaker.success()
+			return err
+		}
+
+		az.breaker.failure()
+		if attempt >= az.maxRetries {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt+1)
+		}
 
-			analyzed <- result
+		delay := backoff(az.retryDelay, attempt)
+		az.logger.Log(
+			"msg", "retrying request",
+			"err", err,
+			"attempt", attempt+1,
+			"delay", delay,
+		)
 
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
 		case <-ctx.Done():
-			az.logger.Log("status", "closing", "err", ctx.Err())
-			return
+			timer.Stop()
+			return err
 		}
 	}
+}
+
+// cancelled reports whether a request failed because its context was cancelled,
+// rather than because of the API.
+func cancelled(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != nil
+}
+
+// isRetryable reports whether err (from a gRPC call) is transient, and the
+// request can be retried.
+func isRetryable(err error) bool {
+	switch status.Code(errors.Cause(err)) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Aborted, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the given retry attempt (starting from 0):
+// an exponential back-off from base, with up to 50% jitter.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if attempt > 10 {
+		attempt = 10
+	}
+
+	delay := base * time.Duration(1<<uint(attempt))
+	if delay <= 0 {
+		return base
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// errorBudget tracks the proportion of failed analyses within a run.
+type errorBudget struct {
+	attempts     int64
+	failures     int64
+	aborted      int32
+	maxErrorRate float64
+	minErrors    int64
+}
+
+// record records the outcome of an analysis, and returns true if this outcome
+// caused the budget to be exceeded. Permanent (non-retryable) errors are not
+// counted as failures: they are specific to the request, and say nothing
+// about the API.
+func (eb *errorBudget) record(err error) bool {
+	attempts := atomic.AddInt64(&eb.attempts, 1)
+	if err == nil || !isRetryable(err) {
+		return false
+	}
+
+	failures := atomic.AddInt64(&eb.failures, 1)
+	if eb.maxErrorRate <= 0 || failures < eb.minErrors {
+		return false
+	}
+
+	if float64(failures)/float64(attempts) > eb.maxErrorRate {
+		return atomic.CompareAndSwapInt32(&eb.aborted, 0, 1)
+	}
+
+	return false
+}
+
+func (eb *errorBudget) exceeded() bool {
+	return atomic.LoadInt32(&eb.aborted) == 1
+}
 
+func (eb *errorBudget) counts() (attempts int64, failures int64) {
+	return atomic.LoadInt64(&eb.attempts), atomic.LoadInt64(&eb.failures)
 }
@@ -0,0 +1,571 @@
+package centiment
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/elithrar/centiment/nltest"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"google.golang.org/grpc/codes"
+)
+
+var testScores = nltest.KeywordScores(map[string]float32{
+	"moon":   0.8,
+	"great":  0.6,
+	"dump":   -0.7,
+	"scam":   -0.9,
+	"boring": -0.1,
+})
+
+func newTestAnalyzer(t *testing.T, srv *nltest.Server, opts ...AnalyzerOption) *Analyzer {
+	t.Helper()
+
+	client, err := srv.Client(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	opts = append([]AnalyzerOption{WithRetries(3, time.Millisecond)}, opts...)
+	az, err := NewAnalyzer(log.NewNopLogger(), client, 2, opts...)
+	if err != nil {
+		t.Fatalf("failed to create analyzer: %v", err)
+	}
+
+	return az
+}
+
+func newTestServer(t *testing.T, opts ...nltest.Option) *nltest.Server {
+	t.Helper()
+
+	srv, err := nltest.NewServer(opts...)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	return srv
+}
+
+func newSearchResults(term *SearchTerm, texts ...string) []*SearchResult {
+	results := make([]*SearchResult, 0, len(texts))
+	for i, text := range texts {
+		results = append(results, &SearchResult{
+			searchTerm: term,
+			tweetID:    int64(i + 1),
+			content:    text,
+		})
+	}
+
+	return results
+}
+
+// runAnalyzer runs the analyzer over the given search results, returning the
+// results keyed by tweet ID.
+func runAnalyzer(az *Analyzer, results []*SearchResult) (map[int64]*AnalyzerResult, error) {
+	searched := make(chan *SearchResult, len(results))
+	analyzed := make(chan *AnalyzerResult)
+	for _, res := range results {
+		searched <- res
+	}
+	close(searched)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- az.Run(context.Background(), searched, analyzed)
+	}()
+
+	byID := make(map[int64]*AnalyzerResult)
+	for res := range analyzed {
+		byID[res.TweetID] = res
+	}
+
+	return byID, <-done
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestAnalyzerRun(t *testing.T) {
+	srv := newTestServer(t, nltest.WithScores(testScores))
+	defer srv.Close()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	var tests = []struct {
+		text      string
+		score     float32
+		magnitude float32
+	}{
+		{"bitcoin to the moon", 0.8, 0.8},
+		{"bitcoin is a scam", -0.9, 0.9},
+		{"bitcoin is great. Also a scam.", -0.15, 1.5},
+		{"bitcoin", 0, 0},
+	}
+
+	texts := make([]string, 0, len(tests))
+	for _, tt := range tests {
+		texts = append(texts, tt.text)
+	}
+
+	az := newTestAnalyzer(t, srv)
+	results, err := runAnalyzer(az, newSearchResults(term, texts...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, tt := range tests {
+		res, ok := results[int64(i+1)]
+		if !ok {
+			t.Errorf("no result for %q", tt.text)
+			continue
+		}
+
+		if !approxEqual(float64(res.Score), float64(tt.score)) {
+			t.Errorf("score mismatch for %q: got %v want %v", tt.text, res.Score, tt.score)
+		}
+
+		if !approxEqual(float64(res.Magnitude), float64(tt.magnitude)) {
+			t.Errorf("magnitude mismatch for %q: got %v want %v", tt.text, res.Magnitude, tt.magnitude)
+		}
+
+		if res.SearchTerm != term {
+			t.Errorf("search term mismatch for %q: got %v want %v", tt.text, res.SearchTerm, term)
+		}
+	}
+}
+
+func TestAnalyzerRetries(t *testing.T) {
+	// ResourceExhausted is not retried by the client library itself, so each
+	// failure is observed by the Analyzer.
+	srv := newTestServer(t,
+		nltest.WithScores(testScores),
+		nltest.WithErrors(nltest.FailFirst(2, codes.ResourceExhausted)),
+	)
+	defer srv.Close()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	az := newTestAnalyzer(t, srv, WithErrorBudget(0, 0))
+	results, err := runAnalyzer(az, newSearchResults(term, "moon", "scam", "great"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("result count mismatch: got %d want %d", len(results), 3)
+	}
+
+	if got, want := srv.Requests(nltest.MethodAnalyzeSentiment), 5; got != want {
+		t.Fatalf("request count mismatch: got %d want %d", got, want)
+	}
+}
+
+func TestAnalyzerNonRetryableErrors(t *testing.T) {
+	srv := newTestServer(t, nltest.WithErrors(nltest.FailAll(codes.InvalidArgument)))
+	defer srv.Close()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	az := newTestAnalyzer(t, srv, WithErrorBudget(0, 0))
+	results, err := runAnalyzer(az, newSearchResults(term, "moon", "scam"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != 0 {
+		t.Fatalf("result count mismatch: got %d want %d", len(results), 0)
+	}
+
+	if got, want := srv.Requests(nltest.MethodAnalyzeSentiment), 2; got != want {
+		t.Fatalf("non-retryable errors should not be retried: got %d requests want %d", got, want)
+	}
+}
+
+func TestAnalyzerErrorBudget(t *testing.T) {
+	var tests = []struct {
+		name    string
+		code    codes.Code
+		aborted bool
+	}{
+		{"api errors", codes.ResourceExhausted, true},
+		{"permanent errors", codes.InvalidArgument, false},
+	}
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	texts := make([]string, 50)
+	for i := range texts {
+		texts[i] = "to the moon"
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, nltest.WithErrors(nltest.FailAll(tt.code)))
+			defer srv.Close()
+
+			az := newTestAnalyzer(t, srv, WithRetries(0, time.Millisecond), WithErrorBudget(0.2, 3))
+			_, err := runAnalyzer(az, newSearchResults(term, texts...))
+			if !tt.aborted {
+				// Each tweet that fails permanently is skipped, but the run
+				// completes.
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if got := srv.Requests(nltest.MethodAnalyzeSentiment); got != len(texts) {
+					t.Fatalf("request count mismatch: got %d want %d", got, len(texts))
+				}
+				return
+			}
+
+			if err != ErrErrorBudgetExceeded {
+				t.Fatalf("error mismatch: got %v want %v", err, ErrErrorBudgetExceeded)
+			}
+
+			// The remaining search results should be drained without analysis.
+			if got := srv.Requests(nltest.MethodAnalyzeSentiment); got >= len(texts) {
+				t.Fatalf("expected the run to be aborted early: got %d requests for %d tweets", got, len(texts))
+			}
+		})
+	}
+}
+
+func TestAnalyzerBatching(t *testing.T) {
+	srv := newTestServer(t, nltest.WithScores(testScores))
+	defer srv.Close()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	texts := []string{
+		"bitcoin to the moon",
+		"bitcoin is a scam!",
+		"bitcoin is great.\nBut a scam",
+		"bitcoin",
+		"boring day for bitcoin",
+		"dump it",
+	}
+	want := map[int64]float32{1: 0.8, 2: -0.9, 3: -0.15, 4: 0, 5: -0.1, 6: -0.7}
+
+	az := newTestAnalyzer(t, srv, WithBatching(len(texts), time.Second))
+	results, err := runAnalyzer(az, newSearchResults(term, texts...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != len(texts) {
+		t.Fatalf("result count mismatch: got %d want %d", len(results), len(texts))
+	}
+
+	for id, score := range want {
+		if got := results[id].Score; !approxEqual(float64(got), float64(score)) {
+			t.Errorf("score mismatch for %q: got %v want %v", texts[id-1], got, score)
+		}
+	}
+
+	if got := srv.Requests(nltest.MethodAnalyzeSentiment); got >= len(texts) {
+		t.Fatalf("expected tweets to be batched: got %d requests for %d tweets", got, len(texts))
+	}
+}
+
+func TestSentimentBatchSplit(t *testing.T) {
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	batch := newSentimentBatch(newSearchResults(term, "to the moon", "a scam"))
+
+	sentence := func(content string, begin int32, score float32) *languagepb.Sentence {
+		return &languagepb.Sentence{
+			Text:      &languagepb.TextSpan{Content: content, BeginOffset: begin},
+			Sentiment: &languagepb.Sentiment{Score: score, Magnitude: score},
+		}
+	}
+
+	var tests = []struct {
+		name      string
+		sentences []*languagepb.Sentence
+		err       error
+	}{
+		{
+			name: "mapped",
+			sentences: []*languagepb.Sentence{
+				sentence("to the moon.", 0, 0.8),
+				sentence("a scam.", 14, -0.9),
+			},
+		},
+		{
+			name: "spans tweets",
+			sentences: []*languagepb.Sentence{
+				sentence("to the moon.\n\na scam.", 0, 0.1),
+			},
+			err: errAmbiguousBatch,
+		},
+		{
+			name: "missing tweet",
+			sentences: []*languagepb.Sentence{
+				sentence("to the moon.", 0, 0.8),
+			},
+			err: errAmbiguousBatch,
+		},
+		{
+			name: "missing offsets",
+			sentences: []*languagepb.Sentence{
+				sentence("to the moon.", -1, 0.8),
+				sentence("a scam.", -1, -0.9),
+			},
+			err: errAmbiguousBatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := batch.split(&languagepb.AnalyzeSentimentResponse{Sentences: tt.sentences})
+			if errors.Cause(err) != tt.err {
+				t.Fatalf("error mismatch: got %v want %v", err, tt.err)
+			}
+
+			if err == nil && len(results) != 2 {
+				t.Fatalf("result count mismatch: got %d want %d", len(results), 2)
+			}
+		})
+	}
+}
+
+func TestAnalyzerEntitySentiment(t *testing.T) {
+	entities := func(content string) []*languagepb.Entity {
+		return []*languagepb.Entity{
+			{
+				Name:      "ETH",
+				Type:      languagepb.Entity_OTHER,
+				Sentiment: &languagepb.Sentiment{Score: -0.8, Magnitude: 0.8},
+			},
+			{
+				Name:      "BTC",
+				Type:      languagepb.Entity_OTHER,
+				Sentiment: &languagepb.Sentiment{Score: 0.9, Magnitude: 0.9},
+			},
+		}
+	}
+
+	srv := newTestServer(t, nltest.WithScores(testScores), nltest.WithEntities(entities))
+	defer srv.Close()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin", Aliases: []string{"#BTC"}}
+	az := newTestAnalyzer(t, srv, WithEntitySentiment())
+	results, err := runAnalyzer(az, newSearchResults(term, "ETH is dying, BTC to the moon"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res := results[1]
+	if len(res.Entities) != 2 {
+		t.Fatalf("entity count mismatch: got %d want %d", len(res.Entities), 2)
+	}
+
+	score, _, ok := matchedEntitySentiment(res.Entities)
+	if !ok {
+		t.Fatalf("expected an entity to match the topic: %#v", res.Entities)
+	}
+
+	if !approxEqual(float64(score), 0.9) {
+		t.Fatalf("entity score mismatch: got %v want %v", score, 0.9)
+	}
+}
+
+func TestAnalyzerPipeline(t *testing.T) {
+	srv := newTestServer(t, nltest.WithScores(testScores))
+	defer srv.Close()
+
+	bitcoin := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin", PositiveThreshold: threshold(0.7)}
+	ethereum := &SearchTerm{Topic: "Ethereum", Query: "ethereum"}
+	results := append(
+		newSearchResults(bitcoin, "moon", "great", "scam"),
+		newSearchResults(ethereum, "dump", "dump")...,
+	)
+
+	az := newTestAnalyzer(t, srv)
+	ag, err := NewAggregator(log.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatalf("failed to create aggregator: %v", err)
+	}
+
+	searched := make(chan *SearchResult, len(results))
+	analyzed := make(chan *AnalyzerResult)
+	for _, res := range results {
+		searched <- res
+	}
+	close(searched)
+
+	collected := make(chan []*Sentiment, 1)
+	go func() {
+		sentiments, err := ag.Collect(context.Background(), analyzed)
+		if err != nil {
+			t.Errorf("failed to collect results: %v", err)
+		}
+		collected <- sentiments
+	}()
+
+	if err := az.Run(context.Background(), searched, analyzed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sentiments := make(map[string]*Sentiment)
+	for _, s := range <-collected {
+		sentiments[s.Slug] = s
+	}
+
+	var tests = []struct {
+		slug     string
+		count    int64
+		score    float64
+		polarity [3]int64 // positive, neutral, negative
+		net      float64
+	}{
+		// "great" (0.6) is below Bitcoin's positive threshold.
+		{"bitcoin", 3, (0.8 + 0.6 - 0.9) / 3, [3]int64{1, 1, 1}, 0},
+		{"ethereum", 2, -0.7, [3]int64{0, 0, 2}, -1},
+	}
+
+	for _, tt := range tests {
+		s, ok := sentiments[tt.slug]
+		if !ok {
+			t.Errorf("no sentiment for %s", tt.slug)
+			continue
+		}
+
+		if s.Count != tt.count {
+			t.Errorf("count mismatch for %s: got %d want %d", tt.slug, s.Count, tt.count)
+		}
+
+		if !approxEqual(s.Score, tt.score) {
+			t.Errorf("score mismatch for %s: got %v want %v", tt.slug, s.Score, tt.score)
+		}
+
+		if got := [3]int64{s.PositiveCount, s.NeutralCount, s.NegativeCount}; got != tt.polarity {
+			t.Errorf("polarity counts mismatch for %s: got %v want %v", tt.slug, got, tt.polarity)
+		}
+
+		if !approxEqual(s.NetSentiment, tt.net) {
+			t.Errorf("net sentiment mismatch for %s: got %v want %v", tt.slug, s.NetSentiment, tt.net)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker(2, time.Millisecond*20)
+
+	cb.failure()
+	if d := cb.allow(); d != 0 {
+		t.Fatalf("breaker should be closed after 1 failure: got delay %v", d)
+	}
+
+	cb.failure()
+	if d := cb.allow(); d == 0 {
+		t.Fatal("breaker should be open after 2 failures")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Waiting past the cooldown allows a single trial call through.
+	if err := cb.wait(ctx); err != nil {
+		t.Fatalf("unexpected error waiting for breaker: %v", err)
+	}
+
+	if cb.state != breakerHalfOpen {
+		t.Fatalf("breaker state mismatch: got %v want %v", cb.state, breakerHalfOpen)
+	}
+
+	if d := cb.allow(); d == 0 {
+		t.Fatal("only one trial call should be allowed when half-open")
+	}
+
+	cb.success()
+	if d := cb.allow(); d != 0 {
+		t.Fatalf("breaker should be closed after a successful trial: got delay %v", d)
+	}
+}
+
+func TestCircuitBreakerCancel(t *testing.T) {
+	cb := newCircuitBreaker(1, time.Millisecond*20)
+	cb.failure()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := cb.wait(ctx); err != nil {
+		t.Fatalf("unexpected error waiting for breaker: %v", err)
+	}
+
+	// A cancelled trial neither closes nor re-opens the breaker, but allows
+	// another trial through.
+	cb.cancel()
+	if cb.state != breakerHalfOpen {
+		t.Fatalf("breaker state mismatch: got %v want %v", cb.state, breakerHalfOpen)
+	}
+
+	if d := cb.allow(); d != 0 {
+		t.Fatalf("another trial should be allowed after a cancelled trial: got delay %v", d)
+	}
+}
+
+func TestAnalyzerCancelled(t *testing.T) {
+	// Requests don't complete until they're cancelled.
+	srv := newTestServer(t, nltest.WithScores(testScores), nltest.WithLatency(time.Minute))
+	defer srv.Close()
+
+	az := newTestAnalyzer(t, srv, WithErrorBudget(0.1, 1), WithCircuitBreaker(2, time.Minute))
+	// A retryable failure has already been observed.
+	az.breaker.failure()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	results := newSearchResults(term, "moon", "scam", "great", "dump")
+	searched := make(chan *SearchResult, len(results))
+	analyzed := make(chan *AnalyzerResult)
+	for _, res := range results {
+		searched <- res
+	}
+	close(searched)
+
+	tracker := NewRunTracker(time.Now())
+	ctx, cancel := context.WithCancel(ContextWithRun(context.Background(), tracker))
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- az.Run(ctx, searched, analyzed)
+	}()
+
+	// Shut down once both workers have a request in flight.
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Requests(nltest.MethodAnalyzeSentiment) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for requests")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	for res := range analyzed {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("cancelled requests should not exceed the error budget: got %v", err)
+	}
+
+	// The cancelled requests aren't retried, and aren't API errors.
+	if got := srv.Requests(nltest.MethodAnalyzeSentiment); got != 2 {
+		t.Errorf("request count mismatch: got %d want 2", got)
+	}
+
+	for _, term := range tracker.Run().Terms {
+		if term.APIErrors != 0 {
+			t.Errorf("API error count mismatch for %s: got %d want 0", term.Slug, term.APIErrors)
+		}
+	}
+
+	// Nor are they a success that resets the breaker's failure count.
+	az.breaker.mu.Lock()
+	failures := az.breaker.failures
+	az.breaker.mu.Unlock()
+	if failures != 1 {
+		t.Errorf("breaker failure count mismatch: got %d want 1", failures)
+	}
+}
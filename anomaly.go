@@ -0,0 +1,231 @@
+package centiment
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// The metrics of a Sentiment that are checked for anomalies.
+const (
+	MetricScore     = "score"
+	MetricVolume    = "volume"
+	MetricMagnitude = "magnitude"
+)
+
+// Anomaly is an abnormal movement in a metric of a topic's sentiment, relative
+// to the topic's recent history.
+type Anomaly struct {
+	ID    string `json:"id" firestore:"id,omitempty"`
+	Topic string `json:"topic" firestore:"topic"`
+	Slug  string `json:"slug" firestore:"slug"`
+	// The ID of the Sentiment the anomaly was detected in.
+	SentimentID string `json:"sentimentID" firestore:"sentimentID"`
+	// The metric (e.g. MetricScore) that moved, its value, and the median &
+	// median absolute deviation of the metric over the baseline.
+	Metric    string  `json:"metric" firestore:"metric"`
+	Value     float64 `json:"value" firestore:"value"`
+	Median    float64 `json:"median" firestore:"median"`
+	Deviation float64 `json:"deviation" firestore:"deviation"`
+	// The (robust) z-score of the value: positive when the metric rose, and
+	// negative when it fell.
+	ZScore float64 `json:"zScore" firestore:"zScore"`
+	// The number of Sentiments in the baseline.
+	Baseline   int       `json:"baseline" firestore:"baseline"`
+	DetectedAt time.Time `json:"detectedAt" firestore:"detectedAt"`
+}
+
+// Detector detects anomalies in newly saved Sentiments, by comparing them
+// against a rolling baseline of the topic's previous Sentiments.
+//
+// Each metric is scored with the modified z-score (Iglewicz & Hoaglin), using
+// the median and median absolute deviation (MAD) of the baseline: these are
+// robust to previous anomalies in the baseline, unlike the mean and standard
+// deviation.
+type Detector struct {
+	logger      log.Logger
+	db          DB
+	window      int
+	minBaseline int
+	threshold   float64
+}
+
+// DetectorOption configures a Detector.
+type DetectorOption func(*Detector)
+
+// WithAnomalyBaseline sets the number of previous Sentiments used as the
+// baseline (window), and the minimum number required before anomalies are
+// detected.
+func WithAnomalyBaseline(window int, minBaseline int) DetectorOption {
+	return func(d *Detector) {
+		d.window = window
+		d.minBaseline = minBaseline
+	}
+}
+
+// WithAnomalyThreshold sets the absolute (modified) z-score at or above which
+// a metric is considered anomalous.
+func WithAnomalyThreshold(threshold float64) DetectorOption {
+	return func(d *Detector) {
+		d.threshold = threshold
+	}
+}
+
+// NewDetector creates a new Detector. By default, the baseline is the previous
+// 144 Sentiments (a day, at 10 minute intervals) with a minimum of 12, and
+// the threshold is 3.5.
+func NewDetector(logger log.Logger, db DB, opts ...DetectorOption) (*Detector, error) {
+	if db == nil {
+		return nil, errors.New("detector: db must not be nil")
+	}
+
+	d := &Detector{
+		logger:      logger,
+		db:          db,
+		window:      144,
+		minBaseline: 12,
+		threshold:   3.5,
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.minBaseline < 2 || d.window < d.minBaseline {
+		return nil, errors.New("detector: the baseline window must be >= the minimum baseline, which must be >= 2")
+	}
+
+	if d.threshold <= 0 {
+		return nil, errors.New("detector: threshold must be > 0")
+	}
+
+	return d, nil
+}
+
+// Detect checks a (saved) Sentiment for anomalies, and saves & returns any
+// that are found. Sentiments are only checked once the topic has a baseline
+// of at least the minimum number of previous Sentiments. Partial Sentiments
+// (from cancelled runs) are excluded from the baseline.
+func (d *Detector) Detect(ctx context.Context, sentiment *Sentiment) ([]*Anomaly, error) {
+	// Fetch extra Sentiments, as the baseline may include the Sentiment being
+	// checked, and excludes any partial Sentiments.
+	history, err := d.db.GetSentimentsBySlug(ctx, sentiment.Slug, d.window*2+1)
+	if err != nil && errors.Cause(err) != ErrNoResultsFound {
+		return nil, errors.Wrap(err, "failed to fetch baseline")
+	}
+
+	baseline := make([]*Sentiment, 0, d.window)
+	for _, s := range history {
+		if (sentiment.ID != "" && s.ID == sentiment.ID) || s.Partial || len(baseline) == d.window {
+			continue
+		}
+		baseline = append(baseline, s)
+	}
+
+	if len(baseline) < d.minBaseline {
+		return nil, nil
+	}
+
+	metrics := []struct {
+		name  string
+		value func(s *Sentiment) float64
+	}{
+		{MetricScore, func(s *Sentiment) float64 { return s.Score }},
+		{MetricVolume, func(s *Sentiment) float64 { return float64(s.Count) }},
+		{MetricMagnitude, func(s *Sentiment) float64 { return s.Magnitude }},
+	}
+
+	var anomalies []*Anomaly
+	for _, metric := range metrics {
+		values := make([]float64, len(baseline))
+		for i, s := range baseline {
+			values[i] = metric.value(s)
+		}
+
+		value := metric.value(sentiment)
+		z, median, deviation, ok := robustZScore(value, values)
+		if !ok || math.Abs(z) < d.threshold {
+			continue
+		}
+
+		anomaly := &Anomaly{
+			Topic:       sentiment.Topic,
+			Slug:        sentiment.Slug,
+			SentimentID: sentiment.ID,
+			Metric:      metric.name,
+			Value:       value,
+			Median:      median,
+			Deviation:   deviation,
+			ZScore:      z,
+			Baseline:    len(baseline),
+			DetectedAt:  time.Now().UTC(),
+		}
+
+		id, err := d.db.SaveAnomaly(ctx, *anomaly)
+		if err != nil {
+			return anomalies, errors.Wrapf(err, "failed to save %s anomaly", metric.name)
+		}
+		anomaly.ID = id
+
+		d.logger.Log(
+			"state", "anomaly",
+			"topic", anomaly.Topic,
+			"metric", anomaly.Metric,
+			"value", anomaly.Value,
+			"median", anomaly.Median,
+			"zScore", anomaly.ZScore,
+		)
+
+		anomalies = append(anomalies, anomaly)
+	}
+
+	return anomalies, nil
+}
+
+// robustZScore returns the modified z-score of value relative to values, and
+// the median and median absolute deviation (MAD) of values. When more than
+// half of the values are identical (a MAD of zero), the mean absolute
+// deviation is used instead. ok is false if values have no spread at all.
+//
+// Ref: Iglewicz, B. & Hoaglin, D. (1993), "How to Detect and Handle Outliers".
+func robustZScore(value float64, values []float64) (z float64, median float64, deviation float64, ok bool) {
+	median = medianOf(values)
+
+	deviations := make([]float64, len(values))
+	var meanDeviation float64
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+		meanDeviation += deviations[i]
+	}
+	meanDeviation /= float64(len(values))
+
+	deviation = medianOf(deviations)
+	switch {
+	case deviation > 0:
+		z = 0.6745 * (value - median) / deviation
+	case meanDeviation > 0:
+		z = (value - median) / (1.253314 * meanDeviation)
+	default:
+		return 0, median, deviation, false
+	}
+
+	return z, median, deviation, true
+}
+
+// medianOf returns the median of values, which must not be empty.
+func medianOf(values []float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,126 @@
+package centiment
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// saveBaseline saves n Sentiments with slightly varying score, volume and
+// magnitude, marked as partial if partial is set.
+func saveBaseline(t *testing.T, db DB, n int, partial bool) {
+	t.Helper()
+
+	start := time.Now().Add(-time.Hour * 24)
+	for i := 0; i < n; i++ {
+		s := Sentiment{
+			Topic:     "bitcoin",
+			Slug:      "bitcoin",
+			Count:     int64(50 + i%5),
+			Score:     0.1 + float64(i%5)*0.02,
+			Magnitude: 0.5 + float64(i%3)*0.05,
+			FetchedAt: start.Add(time.Minute * 10 * time.Duration(i)),
+			Partial:   partial,
+		}
+		if _, err := db.SaveSentiment(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDetectorDetect(t *testing.T) {
+	var tests = []struct {
+		name      string
+		baseline  int
+		partials  int
+		sentiment Sentiment
+		metrics   []string
+	}{
+		{"normal", 20, 0, Sentiment{Count: 52, Score: 0.13, Magnitude: 0.55}, nil},
+		{"score drop", 20, 0, Sentiment{Count: 52, Score: -0.5, Magnitude: 0.55}, []string{MetricScore}},
+		{"volume & magnitude spike", 20, 0, Sentiment{Count: 200, Score: 0.13, Magnitude: 2}, []string{MetricVolume, MetricMagnitude}},
+		{"insufficient baseline", 5, 0, Sentiment{Count: 52, Score: -0.5, Magnitude: 0.55}, nil},
+		// Partial runs don't count towards the baseline.
+		{"partial baseline", 5, 15, Sentiment{Count: 52, Score: -0.5, Magnitude: 0.55}, nil},
+		{"partial runs skipped", 20, 15, Sentiment{Count: 52, Score: -0.5, Magnitude: 0.55}, []string{MetricScore}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemoryDB()
+			saveBaseline(t, db, tt.baseline, false)
+			saveBaseline(t, db, tt.partials, true)
+
+			sentiment := tt.sentiment
+			sentiment.Topic, sentiment.Slug = "bitcoin", "bitcoin"
+			sentiment.FetchedAt = time.Now()
+			id, err := db.SaveSentiment(context.Background(), sentiment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sentiment.ID = id
+
+			detector, err := NewDetector(log.NewNopLogger(), db, WithAnomalyBaseline(20, 10))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			anomalies, err := detector.Detect(context.Background(), &sentiment)
+			if err != nil {
+				t.Fatalf("failed to detect anomalies: %v", err)
+			}
+
+			if len(anomalies) != len(tt.metrics) {
+				t.Fatalf("anomaly count mismatch: got %d want %d (%+v)", len(anomalies), len(tt.metrics), anomalies)
+			}
+
+			for i, anomaly := range anomalies {
+				if anomaly.Metric != tt.metrics[i] {
+					t.Errorf("metric mismatch: got %s want %s", anomaly.Metric, tt.metrics[i])
+				}
+
+				if anomaly.SentimentID != id || anomaly.Baseline != 20 {
+					t.Errorf("unexpected anomaly: %+v", anomaly)
+				}
+			}
+
+			if len(tt.metrics) == 0 {
+				return
+			}
+
+			saved, err := db.GetAnomaliesBySlug(context.Background(), "bitcoin", 0)
+			if err != nil {
+				t.Fatalf("failed to fetch anomalies: %v", err)
+			}
+
+			if len(saved) != len(tt.metrics) {
+				t.Errorf("saved anomaly count mismatch: got %d want %d", len(saved), len(tt.metrics))
+			}
+		})
+	}
+}
+
+func TestRobustZScore(t *testing.T) {
+	var tests = []struct {
+		value  float64
+		values []float64
+		z      float64
+		ok     bool
+	}{
+		{5, []float64{1, 2, 3, 4, 5}, 0.6745 * 2, true},
+		{1, []float64{1, 2, 3, 4, 5}, -0.6745 * 2, true},
+		// More than half of the values are identical: the MAD is zero.
+		{3, []float64{1, 1, 1, 1, 2}, 2 / (1.253314 * 0.2), true},
+		{3, []float64{1, 1, 1}, 0, false},
+	}
+
+	for _, tt := range tests {
+		z, _, _, ok := robustZScore(tt.value, tt.values)
+		if ok != tt.ok || math.Abs(z-tt.z) > 1e-9 {
+			t.Errorf("z-score mismatch for %v in %v: got %v/%t want %v/%t", tt.value, tt.values, z, ok, tt.z, tt.ok)
+		}
+	}
+}
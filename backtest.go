@@ -0,0 +1,518 @@
+package centiment
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The conditions a BacktestRule can test, in addition to ConditionAbove,
+// ConditionBelow and ConditionAnomaly: the metric crossed above (or below) the
+// rule's value since the previous Sentiment.
+const (
+	ConditionCrossesAbove = "crosses_above"
+	ConditionCrossesBelow = "crosses_below"
+)
+
+// The positions a BacktestRule can take.
+const (
+	PositionLong  = "long"
+	PositionShort = "short"
+	PositionFlat  = "flat"
+)
+
+// positions maps each position to its exposure to the price.
+var positions = map[string]float64{
+	PositionLong:  1,
+	PositionShort: -1,
+	PositionFlat:  0,
+}
+
+// backtestMetrics are the metrics of a Sentiment that can be backtested.
+var backtestMetrics = map[string]func(s *Sentiment) float64{
+	MetricScore:     func(s *Sentiment) float64 { return s.Score },
+	"smoothedScore": func(s *Sentiment) float64 { return s.SmoothedScore },
+	MetricVolume:    func(s *Sentiment) float64 { return float64(s.Count) },
+	MetricMagnitude: func(s *Sentiment) float64 { return s.Magnitude },
+	"netSentiment":  func(s *Sentiment) float64 { return s.NetSentiment },
+}
+
+// The default (absolute) z-score of anomaly rules, and the fewest previous
+// Sentiments their baseline is computed from: as for a Detector.
+const (
+	defaultAnomalyZScore = 3.5
+	minAnomalyBaseline   = 12
+)
+
+// BacktestRule is a trading signal derived from a topic's sentiment: when its
+// condition holds for a Sentiment, the backtest takes the rule's position.
+type BacktestRule struct {
+	// The name of the rule, unique per backtest.
+	Name string
+	// The metric to test: one of "score", "smoothedScore", "volume",
+	// "magnitude" or "netSentiment". Defaults to "score" for anomaly rules.
+	Metric string
+	// The condition to test (e.g. ConditionCrossesAbove), and the value to test
+	// the metric against. For anomaly rules, the value is the (robust) z-score
+	// at or beyond which the metric is anomalous: positive to trigger on rises,
+	// negative on falls, and 0 for either (beyond 3.5).
+	Condition string
+	Value     float64
+	// The position to take: "long", "short" or "flat".
+	Position string
+	// How long to hold the position for (e.g. "24h"), after which it is closed.
+	// By default, positions are held until another rule changes them.
+	Hold string
+	// The number of previous Sentiments the baseline of an anomaly rule is
+	// computed from (default 144).
+	Window int
+
+	hold time.Duration
+}
+
+// validate checks the rule, and parses its hold duration.
+func (br *BacktestRule) validate() error {
+	if strings.TrimSpace(br.Name) == "" {
+		return errors.New("backtest rules must have a name")
+	}
+
+	switch br.Condition {
+	case ConditionAbove, ConditionBelow, ConditionCrossesAbove, ConditionCrossesBelow:
+	case ConditionAnomaly:
+		if br.Metric == "" {
+			br.Metric = MetricScore
+		}
+	default:
+		return errors.Errorf("backtest rule %q: invalid condition %q", br.Name, br.Condition)
+	}
+
+	if _, ok := backtestMetrics[br.Metric]; !ok {
+		return errors.Errorf("backtest rule %q: invalid metric %q", br.Name, br.Metric)
+	}
+
+	if _, ok := positions[br.Position]; !ok {
+		return errors.Errorf("backtest rule %q: invalid position %q", br.Name, br.Position)
+	}
+
+	if br.Hold != "" {
+		var err error
+		if br.hold, err = time.ParseDuration(br.Hold); err != nil || br.hold <= 0 {
+			return errors.Errorf("backtest rule %q: invalid hold %q", br.Name, br.Hold)
+		}
+	}
+
+	if br.Window < 0 {
+		return errors.Errorf("backtest rule %q: window must be >= 0", br.Name)
+	}
+
+	if br.Window == 0 {
+		br.Window = 144
+	}
+
+	if br.Condition == ConditionAnomaly && br.Window < minAnomalyBaseline {
+		return errors.Errorf("backtest rule %q: window must be >= %d", br.Name, minAnomalyBaseline)
+	}
+
+	return nil
+}
+
+// triggered reports whether the rule's condition holds for a Sentiment, given
+// the Sentiments evaluated before it (oldest first).
+func (br *BacktestRule) triggered(sentiment *Sentiment, history []*Sentiment) bool {
+	metric := backtestMetrics[br.Metric]
+	value := metric(sentiment)
+
+	switch br.Condition {
+	case ConditionCrossesAbove, ConditionCrossesBelow:
+		if len(history) == 0 {
+			return false
+		}
+
+		previous := metric(history[len(history)-1])
+		if br.Condition == ConditionCrossesAbove {
+			return previous <= br.Value && value > br.Value
+		}
+
+		return previous >= br.Value && value < br.Value
+	case ConditionAnomaly:
+		if len(history) > br.Window {
+			history = history[len(history)-br.Window:]
+		}
+
+		if len(history) < minAnomalyBaseline {
+			return false
+		}
+
+		values := make([]float64, len(history))
+		for i, s := range history {
+			values[i] = metric(s)
+		}
+
+		z, _, _, ok := robustZScore(value, values)
+		switch {
+		case !ok:
+			return false
+		case br.Value > 0:
+			return z >= br.Value
+		case br.Value < 0:
+			return z <= br.Value
+		default:
+			return math.Abs(z) >= defaultAnomalyZScore
+		}
+	default:
+		return compare(br.Condition, value, br.Value)
+	}
+}
+
+// BacktestTrade is a position taken (and closed) during a backtest.
+type BacktestTrade struct {
+	// The rule that opened the position.
+	Rule     string `json:"rule"`
+	Position string `json:"position"`
+	// When the position was opened & closed (the start of the bar it was traded
+	// in), and at what price.
+	EntryTime  time.Time `json:"entryTime"`
+	ExitTime   time.Time `json:"exitTime"`
+	EntryPrice float64   `json:"entryPrice"`
+	ExitPrice  float64   `json:"exitPrice"`
+	// The return of the trade, net of trading costs.
+	Return float64 `json:"return"`
+}
+
+// BacktestReport is the outcome of a backtest.
+type BacktestReport struct {
+	// The period backtested: the start of the first and last price bars.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// The number of Sentiments evaluated & price bars traded over, and the
+	// number of times each rule triggered.
+	Sentiments int             `json:"sentiments"`
+	Bars       int             `json:"bars"`
+	Signals    map[string]int  `json:"signals"`
+	Trades     []BacktestTrade `json:"trades"`
+	// The total return of the strategy, net of trading costs, and its largest
+	// peak-to-trough fall, as fractions.
+	Return      float64 `json:"return"`
+	MaxDrawdown float64 `json:"maxDrawdown"`
+	// The share of trades with a positive return, and the share of bars with an
+	// open position.
+	HitRate  float64 `json:"hitRate"`
+	Exposure float64 `json:"exposure"`
+	// The return & maximum drawdown of buying at the start of the period and
+	// selling at the end, and the strategy's return in excess of it.
+	BuyAndHoldReturn   float64 `json:"buyAndHoldReturn"`
+	BuyAndHoldDrawdown float64 `json:"buyAndHoldDrawdown"`
+	ExcessReturn       float64 `json:"excessReturn"`
+}
+
+// Backtest evaluates BacktestRules against the Sentiment history of a topic
+// and the price series of a symbol, entirely offline.
+//
+// Sentiments are evaluated in the order they were fetched, and the rules of
+// each in the order configured: when several trigger, the last takes
+// precedence. A change in position is executed at the opening price of the
+// first bar opening after the Sentiment that signalled it, so that the
+// backtest never trades on prices from before the signal.
+type Backtest struct {
+	rules             []*BacktestRule
+	cost              float64
+	skipLowConfidence bool
+}
+
+// BacktestOption configures a Backtest.
+type BacktestOption func(*Backtest)
+
+// WithTradingCost sets the cost of each trade (entering or exiting a
+// position), as a fraction of its value: e.g. 0.001 for 0.1%.
+func WithTradingCost(cost float64) BacktestOption {
+	return func(bt *Backtest) {
+		bt.cost = cost
+	}
+}
+
+// WithLowConfidenceSkipped skips the Sentiments flagged as LowConfidence, so
+// that they never trigger a rule.
+func WithLowConfidenceSkipped() BacktestOption {
+	return func(bt *Backtest) {
+		bt.skipLowConfidence = true
+	}
+}
+
+// NewBacktest creates a new Backtest of the given rules.
+func NewBacktest(rules []*BacktestRule, opts ...BacktestOption) (*Backtest, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("backtest: rules must not be empty")
+	}
+
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, errors.Wrap(err, "backtest")
+		}
+
+		if names[rule.Name] {
+			return nil, errors.Errorf("backtest: duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	bt := &Backtest{rules: rules}
+	for _, opt := range opts {
+		opt(bt)
+	}
+
+	if bt.cost < 0 || bt.cost >= 1 {
+		return nil, errors.New("backtest: trading cost must be >= 0 and < 1")
+	}
+
+	return bt, nil
+}
+
+// Run backtests the rules against a topic's Sentiments and the price bars of a
+// symbol (in any order), over the bars opening between the first and last
+// Sentiment. A position still open at the end is closed at the last close.
+func (bt *Backtest) Run(sentiments []*Sentiment, prices []*Price) (*BacktestReport, error) {
+	if len(sentiments) == 0 {
+		return nil, errors.New("backtest: no sentiments to evaluate")
+	}
+
+	sentiments = append([]*Sentiment{}, sentiments...)
+	sort.SliceStable(sentiments, func(i, j int) bool {
+		return sentiments[i].FetchedAt.Before(sentiments[j].FetchedAt)
+	})
+
+	first, last := sentiments[0].FetchedAt, sentiments[len(sentiments)-1].FetchedAt
+	var bars []*Price
+	for _, p := range prices {
+		if p.Time.Before(first) || p.Time.After(last) {
+			continue
+		}
+
+		if p.Open <= 0 || p.Close <= 0 {
+			return nil, errors.Errorf("backtest: invalid price at %s: prices must be > 0", p.Time.Format(time.RFC3339))
+		}
+		bars = append(bars, p)
+	}
+
+	if len(bars) == 0 {
+		return nil, errors.New("backtest: no prices overlap the sentiments")
+	}
+
+	sort.SliceStable(bars, func(i, j int) bool {
+		return bars[i].Time.Before(bars[j].Time)
+	})
+
+	// Only the trailing window of the longest rule is kept as history.
+	var maxWindow int
+	for _, rule := range bt.rules {
+		if rule.Window > maxWindow {
+			maxWindow = rule.Window
+		}
+	}
+
+	report := &BacktestReport{
+		Start:   bars[0].Time,
+		End:     bars[len(bars)-1].Time,
+		Bars:    len(bars),
+		Signals: make(map[string]int, len(bt.rules)),
+		Trades:  []BacktestTrade{},
+	}
+	for _, r := range bt.rules {
+		report.Signals[r.Name] = 0
+	}
+
+	var (
+		strategy = newEquityCurve(1)
+		position float64
+		target   float64
+		// The position (e.g. PositionLong) & rule that set the target.
+		side string
+		rule string
+		// When the position taken by a rule with a hold is closed.
+		holdUntil time.Time
+		open      *BacktestTrade
+		history   []*Sentiment
+		next      int
+		exposed   int
+	)
+
+	expire := func(t time.Time) {
+		if !holdUntil.IsZero() && !t.Before(holdUntil) {
+			target, side, rule, holdUntil = 0, PositionFlat, "", time.Time{}
+		}
+	}
+
+	closeTrade := func(t time.Time, price float64) {
+		if open == nil {
+			return
+		}
+
+		open.ExitTime, open.ExitPrice = t, price
+		open.Return = positions[open.Position]*(price/open.EntryPrice-1) - 2*bt.cost
+		report.Trades = append(report.Trades, *open)
+		open = nil
+	}
+
+	for i, bar := range bars {
+		// Evaluate the Sentiments fetched before the bar opened.
+		for ; next < len(sentiments) && !sentiments[next].FetchedAt.After(bar.Time); next++ {
+			sentiment := sentiments[next]
+			if bt.skipLowConfidence && sentiment.LowConfidence {
+				continue
+			}
+
+			expire(sentiment.FetchedAt)
+			for _, r := range bt.rules {
+				if !r.triggered(sentiment, history) {
+					continue
+				}
+
+				report.Signals[r.Name]++
+				target, side, rule, holdUntil = positions[r.Position], r.Position, r.Name, time.Time{}
+				if r.hold > 0 && target != 0 {
+					holdUntil = sentiment.FetchedAt.Add(r.hold)
+				}
+			}
+
+			history = append(history, sentiment)
+			if len(history) > maxWindow {
+				history = history[1:]
+			}
+			report.Sentiments++
+		}
+		expire(bar.Time)
+
+		// Carry the position over any gap since the previous close, then trade
+		// at the open.
+		if i > 0 {
+			strategy.grow(position * (bar.Open/bars[i-1].Close - 1))
+		}
+
+		if target != position {
+			closeTrade(bar.Time, bar.Open)
+			strategy.grow(-bt.cost * math.Abs(target-position))
+			position = target
+
+			if position != 0 {
+				open = &BacktestTrade{Rule: rule, Position: side, EntryTime: bar.Time, EntryPrice: bar.Open}
+			}
+		}
+
+		strategy.grow(position * (bar.Close/bar.Open - 1))
+		if position != 0 {
+			exposed++
+		}
+	}
+
+	end := bars[len(bars)-1]
+	if position != 0 {
+		closeTrade(end.Time, end.Close)
+		strategy.grow(-bt.cost * math.Abs(position))
+	}
+
+	var wins int
+	for _, trade := range report.Trades {
+		if trade.Return > 0 {
+			wins++
+		}
+	}
+
+	if len(report.Trades) > 0 {
+		report.HitRate = float64(wins) / float64(len(report.Trades))
+	}
+
+	report.Return = strategy.equity - 1
+	report.MaxDrawdown = strategy.maxDrawdown
+	report.Exposure = float64(exposed) / float64(len(bars))
+
+	// Buying & holding pays the same costs to enter and exit.
+	hold := newEquityCurve(1 - bt.cost)
+	for _, bar := range bars {
+		hold.set((1 - bt.cost) * bar.Close / bars[0].Open)
+	}
+	hold.grow(-bt.cost)
+
+	report.BuyAndHoldReturn = hold.equity - 1
+	report.BuyAndHoldDrawdown = hold.maxDrawdown
+	report.ExcessReturn = report.Return - report.BuyAndHoldReturn
+
+	return report, nil
+}
+
+// equityCurve tracks the value of a portfolio (starting from 1), and its
+// maximum drawdown.
+type equityCurve struct {
+	equity      float64
+	peak        float64
+	maxDrawdown float64
+}
+
+func newEquityCurve(equity float64) *equityCurve {
+	ec := &equityCurve{peak: 1}
+	ec.set(equity)
+
+	return ec
+}
+
+// grow applies a (simple) return to the portfolio. A portfolio cannot lose
+// more than its value.
+func (ec *equityCurve) grow(ret float64) {
+	ec.set(ec.equity * (1 + ret))
+}
+
+func (ec *equityCurve) set(equity float64) {
+	ec.equity = math.Max(0, equity)
+	if ec.equity > ec.peak {
+		ec.peak = ec.equity
+	}
+
+	if drawdown := 1 - ec.equity/ec.peak; drawdown > ec.maxDrawdown {
+		ec.maxDrawdown = drawdown
+	}
+}
+
+// ParseSentimentsJSON parses Sentiments from JSON, as served by the
+// /sentiments endpoint: either arrays of Sentiments (or Rollups), or a stream
+// of Sentiments (e.g. one per line).
+func ParseSentimentsJSON(r io.Reader) ([]*Sentiment, error) {
+	dec := json.NewDecoder(r)
+
+	var sentiments []*Sentiment
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to decode sentiments")
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			var batch []*Sentiment
+			if err := json.Unmarshal(raw, &batch); err != nil {
+				return nil, errors.Wrap(err, "failed to decode sentiments")
+			}
+			sentiments = append(sentiments, batch...)
+			continue
+		}
+
+		var sentiment *Sentiment
+		if err := json.Unmarshal(raw, &sentiment); err != nil {
+			return nil, errors.Wrap(err, "failed to decode sentiment")
+		}
+		sentiments = append(sentiments, sentiment)
+	}
+
+	for i, s := range sentiments {
+		if s == nil || s.FetchedAt.IsZero() {
+			return nil, errors.Errorf("sentiment %d has no fetchedAt time", i)
+		}
+	}
+
+	return sentiments, nil
+}
@@ -0,0 +1,243 @@
+package centiment
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBacktestRun(t *testing.T) {
+	start := time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)
+	day := func(n float64) time.Time {
+		return start.Add(time.Duration(n * float64(time.Hour*24)))
+	}
+
+	sentiments := []*Sentiment{
+		{Score: 0.3, FetchedAt: day(0.5)},
+		{Score: 0.1, FetchedAt: day(-0.1)},
+		{Score: -0.1, FetchedAt: day(2.5)},
+		// Would cross above 0.2, but is skipped.
+		{Score: 0.5, FetchedAt: day(3.5), LowConfidence: true},
+		{Score: 0, FetchedAt: day(4)},
+	}
+
+	prices := []*Price{
+		{Time: day(-1), Open: 50, Close: 100},
+		{Time: day(0), Open: 100, Close: 100},
+		{Time: day(1), Open: 100, Close: 110},
+		{Time: day(2), Open: 110, Close: 99},
+		{Time: day(3), Open: 99, Close: 120},
+		{Time: day(4), Open: 120, Close: 130},
+		{Time: day(5), Open: 130, Close: 200},
+	}
+
+	bt, err := NewBacktest([]*BacktestRule{
+		{Name: "bullish", Metric: MetricScore, Condition: ConditionCrossesAbove, Value: 0.2, Position: PositionLong},
+		{Name: "bearish", Metric: MetricScore, Condition: ConditionCrossesBelow, Value: 0, Position: PositionFlat},
+	}, WithLowConfidenceSkipped())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := bt.Run(sentiments, prices)
+	if err != nil {
+		t.Fatalf("failed to run backtest: %v", err)
+	}
+
+	// The long position is entered at the open after the first sentiment
+	// crosses above 0.2 (day 1), and exited at the open after it crosses back
+	// below 0 (day 3).
+	if len(report.Trades) != 1 {
+		t.Fatalf("trade count mismatch: got %d want 1 (%+v)", len(report.Trades), report.Trades)
+	}
+
+	trade := report.Trades[0]
+	if !trade.EntryTime.Equal(day(1)) || !trade.ExitTime.Equal(day(3)) || trade.Position != PositionLong || trade.Rule != "bullish" {
+		t.Errorf("unexpected trade: %+v", trade)
+	}
+
+	var tests = []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"trade return", trade.Return, -0.01},
+		{"return", report.Return, -0.01},
+		{"max drawdown", report.MaxDrawdown, 1 - 0.99/1.1},
+		{"hit rate", report.HitRate, 0},
+		{"exposure", report.Exposure, 2.0 / 5},
+		{"buy & hold return", report.BuyAndHoldReturn, 0.3},
+		{"buy & hold drawdown", report.BuyAndHoldDrawdown, 1 - 0.99/1.1},
+		{"excess return", report.ExcessReturn, -0.31},
+	}
+
+	for _, tt := range tests {
+		if !approxEqual(tt.got, tt.want) {
+			t.Errorf("%s mismatch: got %v want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if report.Sentiments != 4 || report.Bars != 5 || !report.Start.Equal(day(0)) || !report.End.Equal(day(4)) {
+		t.Errorf("unexpected period: %+v", report)
+	}
+
+	if report.Signals["bullish"] != 1 || report.Signals["bearish"] != 1 {
+		t.Errorf("unexpected signals: %v", report.Signals)
+	}
+}
+
+func TestBacktestAnomalyHold(t *testing.T) {
+	start := time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)
+	hour := func(n int) time.Time {
+		return start.Add(time.Hour * time.Duration(n))
+	}
+
+	// A run of ordinary sentiment, with a collapse in the score at 20:30.
+	var sentiments []*Sentiment
+	for h := 0; h < 26; h++ {
+		score := 0.1 + 0.1*float64(h%2)
+		if h == 20 {
+			score = -0.9
+		}
+		sentiments = append(sentiments, &Sentiment{Score: score, FetchedAt: hour(h).Add(time.Minute * 30)})
+	}
+
+	// Hourly bars, with the price falling from 100 to 90 over 21:00 - 23:00.
+	level := func(h int) float64 {
+		switch {
+		case h <= 21:
+			return 100
+		case h == 22:
+			return 95
+		default:
+			return 90
+		}
+	}
+
+	var prices []*Price
+	for h := 0; h < 30; h++ {
+		prices = append(prices, &Price{Time: hour(h), Open: level(h), Close: level(h + 1)})
+	}
+
+	cost := 0.001
+	bt, err := NewBacktest([]*BacktestRule{
+		{Name: "collapse", Condition: ConditionAnomaly, Value: -3.5, Position: PositionShort, Hold: "2h"},
+	}, WithTradingCost(cost))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := bt.Run(sentiments, prices)
+	if err != nil {
+		t.Fatalf("failed to run backtest: %v", err)
+	}
+
+	// The short is entered at the 21:00 open, and closed when the hold expires
+	// at 22:30: at the 23:00 open.
+	if len(report.Trades) != 1 {
+		t.Fatalf("trade count mismatch: got %d want 1 (%+v)", len(report.Trades), report.Trades)
+	}
+
+	trade := report.Trades[0]
+	if !trade.EntryTime.Equal(hour(21)) || !trade.ExitTime.Equal(hour(23)) || trade.Position != PositionShort {
+		t.Errorf("unexpected trade: %+v", trade)
+	}
+
+	if want := 0.1 - 2*cost; !approxEqual(trade.Return, want) {
+		t.Errorf("trade return mismatch: got %v want %v", trade.Return, want)
+	}
+
+	// The short is rebalanced each bar: +5% over 21:00, then +5/95 over 22:00.
+	if want := (1-cost)*1.05*(1+5.0/95)*(1-cost) - 1; !approxEqual(report.Return, want) {
+		t.Errorf("return mismatch: got %v want %v", report.Return, want)
+	}
+
+	if report.HitRate != 1 || report.Signals["collapse"] != 1 {
+		t.Errorf("unexpected hit rate or signals: %v, %v", report.HitRate, report.Signals)
+	}
+
+	if want := (1-cost)*(1-cost)*0.9 - 1; !approxEqual(report.BuyAndHoldReturn, want) {
+		t.Errorf("buy & hold return mismatch: got %v want %v", report.BuyAndHoldReturn, want)
+	}
+}
+
+func TestNewBacktest(t *testing.T) {
+	valid := func() *BacktestRule {
+		return &BacktestRule{Name: "bullish", Metric: "smoothedScore", Condition: ConditionAbove, Value: 0.2, Position: PositionLong}
+	}
+
+	var tests = []struct {
+		name   string
+		modify func(r *BacktestRule)
+		opts   []BacktestOption
+		valid  bool
+	}{
+		{"valid", func(r *BacktestRule) {}, nil, true},
+		{"anomaly defaults to score", func(r *BacktestRule) { r.Condition, r.Metric = ConditionAnomaly, "" }, nil, true},
+		{"no name", func(r *BacktestRule) { r.Name = " " }, nil, false},
+		{"invalid metric", func(r *BacktestRule) { r.Metric = "price" }, nil, false},
+		{"invalid condition", func(r *BacktestRule) { r.Condition = "ratio_above" }, nil, false},
+		{"invalid position", func(r *BacktestRule) { r.Position = "buy" }, nil, false},
+		{"invalid hold", func(r *BacktestRule) { r.Hold = "a day" }, nil, false},
+		{"small anomaly window", func(r *BacktestRule) { r.Condition, r.Window = ConditionAnomaly, 5 }, nil, false},
+		{"invalid cost", func(r *BacktestRule) {}, []BacktestOption{WithTradingCost(-0.1)}, false},
+	}
+
+	for _, tt := range tests {
+		rule := valid()
+		tt.modify(rule)
+		if _, err := NewBacktest([]*BacktestRule{rule}, tt.opts...); (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	if _, err := NewBacktest([]*BacktestRule{valid(), valid()}); err == nil {
+		t.Error("expected duplicate rules to be invalid")
+	}
+
+	if _, err := NewBacktest(nil); err == nil {
+		t.Error("expected no rules to be invalid")
+	}
+}
+
+func TestParseSentimentsJSON(t *testing.T) {
+	var tests = []struct {
+		name    string
+		json    string
+		want    int
+		wantErr bool
+	}{
+		{
+			"array",
+			`[{"slug": "bitcoin", "score": 0.1, "fetchedAt": "2018-02-12T05:24:16Z"}, {"slug": "bitcoin", "score": 0.2, "fetchedAt": "2018-02-12T05:34:16Z"}]`,
+			2,
+			false,
+		},
+		{
+			"one per line",
+			"{\"slug\": \"bitcoin\", \"fetchedAt\": \"2018-02-12T05:24:16Z\"}\n{\"slug\": \"bitcoin\", \"fetchedAt\": \"2018-02-12T05:34:16Z\"}\n",
+			2,
+			false,
+		},
+		{
+			"rollups",
+			`[{"slug": "bitcoin", "fetchedAt": "2018-02-12T23:54:16Z", "resolution": "day", "periodStart": "2018-02-12T00:00:00Z", "runs": 144}]`,
+			1,
+			false,
+		},
+		{"no fetchedAt", `[{"slug": "bitcoin", "score": 0.1}]`, 0, true},
+		{"invalid", `[{"slug": "bitcoin"`, 0, true},
+	}
+
+	for _, tt := range tests {
+		sentiments, err := ParseSentimentsJSON(strings.NewReader(tt.json))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+
+		if len(sentiments) != tt.want {
+			t.Errorf("%s: sentiment count mismatch: got %d want %d", tt.name, len(sentiments), tt.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package centiment
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+)
+
+// errAmbiguousBatch is returned when the sentences in a batched response
+// cannot be unambiguously mapped back to the tweets in the batch.
+var errAmbiguousBatch = errors.New("analyzer: ambiguous sentence mapping for batch")
+
+// batchDelimiter separates tweets within a batched document. Each tweet is
+// also terminated with punctuation (if it isn't already) so that the API
+// treats it as a separate sentence.
+const batchDelimiter = "\n\n"
+
+// sentimentBatch packs multiple search results into a single document, so that
+// they can be analyzed with a single request. The per-sentence sentiment in
+// the response is mapped back to each result using the byte offsets of each
+// result within the document.
+type sentimentBatch struct {
+	results []*SearchResult
+	spans   []textSpan
+	content string
+}
+
+// textSpan is a half-open [begin, end) range of byte offsets.
+type textSpan struct {
+	begin int
+	end   int
+}
+
+func newSentimentBatch(results []*SearchResult) *sentimentBatch {
+	b := &sentimentBatch{
+		results: results,
+		spans:   make([]textSpan, 0, len(results)),
+	}
+
+	var content strings.Builder
+	for i, res := range results {
+		if i > 0 {
+			content.WriteString(batchDelimiter)
+		}
+
+		text := batchText(res.content)
+		begin := content.Len()
+		content.WriteString(text)
+		b.spans = append(b.spans, textSpan{begin: begin, end: content.Len()})
+	}
+	b.content = content.String()
+
+	return b
+}
+
+// batchText prepares the content of a tweet for batching: whitespace (including
+// newlines) is collapsed, and the text is terminated as a sentence.
+func batchText(content string) string {
+	text := strings.Join(strings.Fields(norm.NFC.String(content)), " ")
+	last, _ := utf8.DecodeLastRuneInString(text)
+	if text == "" || !isSentenceTerminal(last) {
+		text += "."
+	}
+
+	return text
+}
+
+func isSentenceTerminal(r rune) bool {
+	switch r {
+	case '.', '!', '?', '…':
+		return true
+	default:
+		return unicode.Is(unicode.Sentence_Terminal, r)
+	}
+}
+
+// request returns a request for sentiment analysis of the batched document.
+// Offsets in the response are returned as UTF-8 byte offsets.
+func (b *sentimentBatch) request() *languagepb.AnalyzeSentimentRequest {
+	return &languagepb.AnalyzeSentimentRequest{
+		Document: &languagepb.Document{
+			Source: &languagepb.Document_Content{
+				Content: b.content,
+			},
+			Type:     languagepb.Document_PLAIN_TEXT,
+			Language: "en",
+		},
+		EncodingType: languagepb.EncodingType_UTF8,
+	}
+}
+
+// unitsByTopic splits the billable units for the batched document between the
+// topics in the batch, in proportion to their share of the content. Any
+// remainder is attributed to the topic with the largest share.
+func (b *sentimentBatch) unitsByTopic() map[string]int64 {
+	total := billableUnits(b.content)
+	chars := make(map[string]int)
+	var totalChars int
+	for i, res := range b.results {
+		n := b.spans[i].end - b.spans[i].begin
+		chars[res.searchTerm.Topic] += n
+		totalChars += n
+	}
+
+	units := make(map[string]int64, len(chars))
+	var (
+		allocated int64
+		largest   string
+	)
+	for topic, n := range chars {
+		share := total * int64(n) / int64(totalChars)
+		units[topic] = share
+		allocated += share
+		if largest == "" || n > chars[largest] {
+			largest = topic
+		}
+	}
+	units[largest] += total - allocated
+
+	return units
+}
+
+// split maps the sentences in the response back to each result in the batch.
+// A result's score is the mean of its sentence scores, and its magnitude the
+// sum of its sentence magnitudes, matching the document-level sentiment the
+// API returns for a single tweet.
+//
+// errAmbiguousBatch is returned if any sentence spans more than one result,
+// or any result has no sentences.
+func (b *sentimentBatch) split(resp *languagepb.AnalyzeSentimentResponse) ([]*AnalyzerResult, error) {
+	var (
+		scores     = make([]float32, len(b.results))
+		magnitudes = make([]float32, len(b.results))
+		counts     = make([]int, len(b.results))
+	)
+
+	for _, sentence := range resp.GetSentences() {
+		text := sentence.GetText()
+		if text == nil || text.GetBeginOffset() < 0 {
+			return nil, errors.Wrap(errAmbiguousBatch, "missing sentence offsets")
+		}
+
+		span := textSpan{
+			begin: int(text.GetBeginOffset()),
+			end:   int(text.GetBeginOffset()) + len(text.GetContent()),
+		}
+
+		i := b.indexOf(span)
+		if i < 0 {
+			return nil, errors.Wrapf(errAmbiguousBatch, "sentence %q does not map to a single tweet", text.GetContent())
+		}
+
+		scores[i] += sentence.GetSentiment().GetScore()
+		magnitudes[i] += sentence.GetSentiment().GetMagnitude()
+		counts[i]++
+	}
+
+	results := make([]*AnalyzerResult, 0, len(b.results))
+	for i, res := range b.results {
+		if counts[i] == 0 {
+			return nil, errors.Wrapf(errAmbiguousBatch, "no sentences for tweet %d", res.tweetID)
+		}
+
+		results = append(results, newAnalyzerResult(
+			res,
+			scores[i]/float32(counts[i]),
+			magnitudes[i],
+		))
+	}
+
+	return results, nil
+}
+
+// indexOf returns the index of the result that wholly contains the given span,
+// or -1 if there is none.
+func (b *sentimentBatch) indexOf(span textSpan) int {
+	for i, s := range b.spans {
+		if span.begin >= s.begin && span.end <= s.end {
+			return i
+		}
+	}
+
+	return -1
+}
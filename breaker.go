@@ -0,0 +1,173 @@
+package centiment
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (bs breakerState) String() string {
+	switch bs {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker pauses calls to a failing dependency. It opens after
+// threshold consecutive failures, and stays open for cooldown before allowing
+// a single trial call through (half-open). A successful trial closes the
+// breaker; a failed trial re-opens it.
+//
+// A circuitBreaker is safe for concurrent use.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	// trial is true when a half-open trial call is in flight.
+	trial bool
+	// onStateChange, if non-nil, is called (with mu held) when the state
+	// changes.
+	onStateChange func(from, to breakerState)
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// wait blocks until the breaker allows a call through, or the context is
+// cancelled. A breaker with a threshold of zero (or less) is disabled and never
+// blocks.
+func (cb *circuitBreaker) wait(ctx context.Context) error {
+	if cb == nil || cb.threshold <= 0 {
+		return nil
+	}
+
+	for {
+		delay := cb.allow()
+		if delay == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// allow reports whether a call may proceed (a zero duration), or how long the
+// caller should wait before asking again.
+func (cb *circuitBreaker) allow() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		remaining := cb.cooldown - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return remaining
+		}
+
+		cb.setState(breakerHalfOpen)
+		cb.trial = true
+		return 0
+	case breakerHalfOpen:
+		if cb.trial {
+			// Only one trial call is allowed at a time: poll until it resolves.
+			return cb.pollInterval()
+		}
+
+		cb.trial = true
+		return 0
+	default:
+		return 0
+	}
+}
+
+func (cb *circuitBreaker) pollInterval() time.Duration {
+	interval := cb.cooldown / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	return interval
+}
+
+// success records a successful call, closing the breaker.
+func (cb *circuitBreaker) success() {
+	if cb == nil || cb.threshold <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	cb.trial = false
+	cb.setState(breakerClosed)
+}
+
+// failure records a failed call, opening the breaker once the threshold of
+// consecutive failures is reached, or if a half-open trial fails.
+func (cb *circuitBreaker) failure() {
+	if cb == nil || cb.threshold <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.trial = false
+		cb.openedAt = time.Now()
+		cb.setState(breakerOpen)
+	}
+}
+
+// cancel records a call that was cancelled before it completed. Its outcome is
+// unknown, so the breaker's state is unchanged: only a half-open trial is
+// released, so that another call can be tried.
+func (cb *circuitBreaker) cancel() {
+	if cb == nil || cb.threshold <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.trial = false
+}
+
+func (cb *circuitBreaker) setState(to breakerState) {
+	if cb.state == to {
+		return
+	}
+
+	from := cb.state
+	cb.state = to
+	if cb.onStateChange != nil {
+		cb.onStateChange(from, to)
+	}
+}
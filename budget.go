@@ -0,0 +1,436 @@
+package centiment
+
+import (
+	"context"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// ErrBudgetExhausted is returned when a request to the Natural Language API
+// would exceed the configured monthly or daily spending limit.
+var ErrBudgetExhausted = errors.New("budget: spending limit reached")
+
+const (
+	// unitSize is the number of (Unicode) characters in a billable Natural
+	// Language API unit.
+	// Ref: https://cloud.google.com/natural-language/pricing
+	unitSize = 1000
+
+	monthPeriodFormat = "2006-01"
+	dayPeriodFormat   = "2006-01-02"
+)
+
+// The Natural Language API features that are budgeted. Each is billed
+// separately, at its own price per unit.
+const (
+	FeatureSentiment       = "sentiment"
+	FeatureEntitySentiment = "entitySentiment"
+)
+
+// Usage records the billable Natural Language API units consumed within a
+// period (a calendar month or day, in UTC).
+type Usage struct {
+	// The period: formatted as "2006-01" for months, or "2006-01-02" for days.
+	// The usage of a run (see Run) has the run's ID as its period.
+	Period string `json:"period" firestore:"period"`
+	// The total billable units consumed.
+	Units int64 `json:"units" firestore:"units"`
+	// The number of requests made.
+	Requests int64 `json:"requests" firestore:"requests"`
+	// The billable units consumed, keyed by topic.
+	Topics map[string]int64 `json:"topics" firestore:"topics"`
+	// The billable units consumed, keyed by feature (e.g. FeatureSentiment).
+	// Units recorded before features were tracked are document sentiment.
+	Features  map[string]int64 `json:"features" firestore:"features"`
+	UpdatedAt time.Time        `json:"updatedAt" firestore:"updatedAt"`
+}
+
+func newUsage(period string) *Usage {
+	return &Usage{
+		Period:   period,
+		Topics:   make(map[string]int64),
+		Features: make(map[string]int64),
+	}
+}
+
+func (u *Usage) add(feature string, topic string, units int64) {
+	if u.Topics == nil {
+		u.Topics = make(map[string]int64)
+	}
+
+	if u.Features == nil {
+		u.Features = make(map[string]int64)
+	}
+
+	u.Units += units
+	u.Topics[topic] += units
+	u.Features[feature] += units
+}
+
+// featureUnits returns the units consumed by each feature.
+func (u *Usage) featureUnits() map[string]int64 {
+	units := make(map[string]int64, len(u.Features)+1)
+	var tracked int64
+	for feature, n := range u.Features {
+		units[feature] = n
+		tracked += n
+	}
+	units[FeatureSentiment] += u.Units - tracked
+
+	return units
+}
+
+func (u *Usage) copy() *Usage {
+	c := *u
+	c.Topics = make(map[string]int64, len(u.Topics))
+	for topic, units := range u.Topics {
+		c.Topics[topic] = units
+	}
+
+	c.Features = make(map[string]int64, len(u.Features))
+	for feature, units := range u.Features {
+		c.Features[feature] = units
+	}
+
+	return &c
+}
+
+// Spend summarizes the current spend against the configured limits.
+type Spend struct {
+	Month        *Usage `json:"month"`
+	Day          *Usage `json:"day"`
+	MonthlyLimit int64  `json:"monthlyLimit"`
+	DailyLimit   int64  `json:"dailyLimit"`
+	// The price per unit of document & entity sentiment analysis.
+	UnitPrice       float64 `json:"unitPrice"`
+	EntityUnitPrice float64 `json:"entityUnitPrice"`
+	MonthlyCost     float64 `json:"monthlyCost"`
+	DailyCost       float64 `json:"dailyCost"`
+}
+
+// Budget tracks the billable Natural Language API units consumed per topic,
+// feature, run, day and calendar month, and enforces spending limits. Usage is
+// persisted to the DB when Flush is called.
+//
+// A Budget should only be initialized via NewBudget, and is safe for concurrent
+// use.
+type Budget struct {
+	mu           sync.Mutex
+	db           DB
+	logger       log.Logger
+	monthlyLimit int64
+	dailyLimit   int64
+	// The price per unit of each feature.
+	prices map[string]float64
+
+	month *Usage
+	day   *Usage
+	run   *Usage
+	dirty bool
+}
+
+// BudgetOption configures a Budget.
+type BudgetOption func(*Budget)
+
+// WithEntityUnitPrice sets the price of a single unit of entity sentiment
+// analysis, which is billed separately from (and by default at twice the
+// price of) document sentiment analysis.
+func WithEntityUnitPrice(price float64) BudgetOption {
+	return func(b *Budget) {
+		b.prices[FeatureEntitySentiment] = price
+	}
+}
+
+// NewBudget creates a new Budget. Limits are expressed in billable units of
+// document sentiment analysis (1,000 characters per document); a limit of 0 is
+// unlimited. unitPrice is the cost of a single unit, and is used to estimate
+// spend.
+//
+// Units of other features count towards the limits in proportion to their
+// price, so that the limits cap spend: at the default prices, a unit of entity
+// sentiment analysis counts as two units.
+func NewBudget(logger log.Logger, db DB, monthlyLimit int64, dailyLimit int64, unitPrice float64, opts ...BudgetOption) (*Budget, error) {
+	if monthlyLimit < 0 || dailyLimit < 0 {
+		return nil, errors.New("budget: limits must be >= 0")
+	}
+
+	b := &Budget{
+		db:           db,
+		logger:       logger,
+		monthlyLimit: monthlyLimit,
+		dailyLimit:   dailyLimit,
+		prices: map[string]float64{
+			FeatureSentiment:       unitPrice,
+			FeatureEntitySentiment: unitPrice * 2,
+		},
+		run: newUsage(""),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	for _, price := range b.prices {
+		if price < 0 {
+			return nil, errors.New("budget: unit prices must be >= 0")
+		}
+	}
+
+	return b, nil
+}
+
+// weight returns the number of (document sentiment) units that a unit of a
+// feature counts as towards the limits.
+func (b *Budget) weight(feature string) float64 {
+	base := b.prices[FeatureSentiment]
+	if feature == FeatureSentiment || base == 0 {
+		return 1
+	}
+
+	return b.prices[feature] / base
+}
+
+// limitUnits returns the usage counted towards the limits.
+func (b *Budget) limitUnits(u *Usage) float64 {
+	var units float64
+	for feature, n := range u.featureUnits() {
+		units += float64(n) * b.weight(feature)
+	}
+
+	return units
+}
+
+// cost returns the estimated cost of the usage.
+func (b *Budget) cost(u *Usage) float64 {
+	var cost float64
+	for feature, n := range u.featureUnits() {
+		cost += float64(n) * b.prices[feature]
+	}
+
+	return cost
+}
+
+// billableUnits returns the number of billable units for a document: each
+// (started) block of 1,000 characters is a unit.
+func billableUnits(content string) int64 {
+	chars := int64(utf8.RuneCountInString(content))
+	units := (chars + unitSize - 1) / unitSize
+	if units < 1 {
+		units = 1
+	}
+
+	return units
+}
+
+// Reserve records units of a feature (e.g. FeatureSentiment) against the
+// budget for the given topic, before a request is made. It returns
+// ErrBudgetExhausted (and records nothing) if the request would exceed the
+// monthly or daily limit.
+//
+// Call Refund if the request fails.
+func (b *Budget) Reserve(ctx context.Context, feature string, topic string, units int64) error {
+	return b.reserve(ctx, feature, map[string]int64{topic: units})
+}
+
+// reserve records the units for a single request, split across topics.
+func (b *Budget) reserve(ctx context.Context, feature string, units map[string]int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.prices[feature]; !ok {
+		return errors.Errorf("budget: unknown feature %q", feature)
+	}
+
+	if err := b.load(ctx, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, n := range units {
+		total += n
+	}
+	requested := float64(total) * b.weight(feature)
+
+	if b.monthlyLimit > 0 && b.limitUnits(b.month)+requested > float64(b.monthlyLimit) {
+		return errors.Wrapf(ErrBudgetExhausted, "monthly limit of %d units", b.monthlyLimit)
+	}
+
+	if b.dailyLimit > 0 && b.limitUnits(b.day)+requested > float64(b.dailyLimit) {
+		return errors.Wrapf(ErrBudgetExhausted, "daily limit of %d units", b.dailyLimit)
+	}
+
+	b.record(feature, units, 1)
+	return nil
+}
+
+// Refund returns units of a feature previously reserved for a (failed) request
+// to the budget.
+func (b *Budget) Refund(feature string, topic string, units int64) {
+	b.refund(feature, map[string]int64{topic: units})
+}
+
+func (b *Budget) refund(feature string, units map[string]int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	negated := make(map[string]int64, len(units))
+	for topic, n := range units {
+		negated[topic] = -n
+	}
+
+	b.record(feature, negated, -1)
+}
+
+// record adds units of a feature (split across topics) and requests to the
+// loaded usage. b.mu must be held.
+func (b *Budget) record(feature string, units map[string]int64, requests int64) {
+	for _, u := range []*Usage{b.month, b.day, b.run} {
+		if u == nil {
+			continue
+		}
+
+		for topic, n := range units {
+			u.add(feature, topic, n)
+		}
+		u.Requests += requests
+	}
+
+	b.dirty = true
+}
+
+// StartRun resets the per-run usage counters for the run with the given ID.
+func (b *Budget) StartRun(runID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.run = newUsage(runID)
+}
+
+// RunUsage returns the usage recorded since the last call to StartRun.
+func (b *Budget) RunUsage() *Usage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	usage := b.run.copy()
+	usage.UpdatedAt = time.Now().UTC()
+	return usage
+}
+
+// Flush persists the current monthly & daily usage to the DB.
+func (b *Budget) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush(ctx)
+}
+
+// Spend returns the current spend against the configured limits.
+func (b *Budget) Spend(ctx context.Context) (*Spend, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.load(ctx, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	spend := &Spend{
+		Month:           b.month.copy(),
+		Day:             b.day.copy(),
+		MonthlyLimit:    b.monthlyLimit,
+		DailyLimit:      b.dailyLimit,
+		UnitPrice:       b.prices[FeatureSentiment],
+		EntityUnitPrice: b.prices[FeatureEntitySentiment],
+		MonthlyCost:     b.cost(b.month),
+		DailyCost:       b.cost(b.day),
+	}
+
+	return spend, nil
+}
+
+// load ensures the usage for the current month and day is loaded, flushing
+// the usage for any elapsed periods. b.mu must be held.
+func (b *Budget) load(ctx context.Context, now time.Time) error {
+	month := now.Format(monthPeriodFormat)
+	day := now.Format(dayPeriodFormat)
+
+	if b.month != nil && b.month.Period == month && b.day != nil && b.day.Period == day {
+		return nil
+	}
+
+	// Persist the usage for the elapsed period before moving on.
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+
+	if b.month != nil {
+		b.logger.Log(
+			"msg", "budget period elapsed",
+			"month", b.month.Period,
+			"monthUnits", b.month.Units,
+			"day", b.day.Period,
+			"dayUnits", b.day.Units,
+		)
+	}
+
+	var err error
+	if b.month == nil || b.month.Period != month {
+		if b.month, err = b.getUsage(ctx, month); err != nil {
+			return err
+		}
+	}
+
+	if b.day == nil || b.day.Period != day {
+		if b.day, err = b.getUsage(ctx, day); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Budget) getUsage(ctx context.Context, period string) (*Usage, error) {
+	usage, err := b.db.GetUsage(ctx, period)
+	if err == ErrNoResultsFound {
+		return newUsage(period), nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "budget: failed to load usage for %s", period)
+	}
+
+	if usage.Topics == nil {
+		usage.Topics = make(map[string]int64)
+	}
+
+	if usage.Features == nil {
+		usage.Features = make(map[string]int64)
+	}
+
+	return usage, nil
+}
+
+// flush persists the loaded usage. b.mu must be held.
+func (b *Budget) flush(ctx context.Context) error {
+	if !b.dirty {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	for _, u := range []*Usage{b.month, b.day} {
+		if u == nil {
+			continue
+		}
+
+		u.UpdatedAt = now
+		if err := b.db.SaveUsage(ctx, *u); err != nil {
+			return errors.Wrapf(err, "budget: failed to save usage for %s", u.Period)
+		}
+	}
+
+	b.dirty = false
+	return nil
+}
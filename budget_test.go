@@ -0,0 +1,274 @@
+package centiment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+func newTestBudget(t *testing.T, db DB, monthlyLimit int64, dailyLimit int64, opts ...BudgetOption) *Budget {
+	t.Helper()
+
+	b, err := NewBudget(log.NewNopLogger(), db, monthlyLimit, dailyLimit, 0.001, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestBudgetReserve(t *testing.T) {
+	type step struct {
+		feature   string
+		units     int64
+		refund    bool
+		exhausted bool
+	}
+
+	var tests = []struct {
+		name         string
+		monthlyLimit int64
+		dailyLimit   int64
+		steps        []step
+		wantUnits    int64
+		wantRequests int64
+	}{
+		{
+			"unlimited",
+			0, 0,
+			[]step{
+				{feature: FeatureSentiment, units: 1000},
+				{feature: FeatureEntitySentiment, units: 1000},
+			},
+			2000, 2,
+		},
+		{
+			"monthly limit",
+			10, 0,
+			[]step{
+				{feature: FeatureSentiment, units: 6},
+				{feature: FeatureSentiment, units: 5, exhausted: true},
+				{feature: FeatureSentiment, units: 4},
+				{feature: FeatureSentiment, units: 1, exhausted: true},
+			},
+			10, 2,
+		},
+		{
+			"daily limit",
+			100, 3,
+			[]step{
+				{feature: FeatureSentiment, units: 2},
+				{feature: FeatureSentiment, units: 2, exhausted: true},
+				{feature: FeatureSentiment, units: 1},
+			},
+			3, 2,
+		},
+		{
+			"refund",
+			10, 0,
+			[]step{
+				{feature: FeatureSentiment, units: 8},
+				{feature: FeatureSentiment, units: 8, refund: true},
+				{feature: FeatureSentiment, units: 10},
+			},
+			10, 1,
+		},
+		{
+			// Entity sentiment costs twice as much, and so counts twice towards
+			// the limits.
+			"entity sentiment",
+			10, 0,
+			[]step{
+				{feature: FeatureEntitySentiment, units: 4},
+				{feature: FeatureSentiment, units: 3, exhausted: true},
+				{feature: FeatureSentiment, units: 2},
+				{feature: FeatureEntitySentiment, units: 1, exhausted: true},
+			},
+			6, 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBudget(t, newMemoryDB(), tt.monthlyLimit, tt.dailyLimit)
+			ctx := context.Background()
+
+			for i, s := range tt.steps {
+				if s.refund {
+					b.Refund(s.feature, "bitcoin", s.units)
+					continue
+				}
+
+				err := b.Reserve(ctx, s.feature, "bitcoin", s.units)
+				if exhausted := errors.Cause(err) == ErrBudgetExhausted; exhausted != s.exhausted {
+					t.Fatalf("step %d: got error %v, want exhausted %v", i, err, s.exhausted)
+				}
+			}
+
+			spend, err := b.Spend(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, u := range []*Usage{spend.Month, spend.Day, b.RunUsage()} {
+				if u.Units != tt.wantUnits || u.Requests != tt.wantRequests || u.Topics["bitcoin"] != tt.wantUnits {
+					t.Errorf("usage mismatch: got %+v want %d units over %d requests", u, tt.wantUnits, tt.wantRequests)
+				}
+			}
+		})
+	}
+
+	b := newTestBudget(t, newMemoryDB(), 0, 0)
+	if err := b.Reserve(context.Background(), "classification", "bitcoin", 1); err == nil {
+		t.Error("expected an unknown feature to be rejected")
+	}
+}
+
+func TestBudgetSpend(t *testing.T) {
+	b := newTestBudget(t, newMemoryDB(), 1000, 0, WithEntityUnitPrice(0.003))
+	ctx := context.Background()
+
+	if err := b.Reserve(ctx, FeatureSentiment, "bitcoin", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Reserve(ctx, FeatureEntitySentiment, "ethereum", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	spend, err := b.Spend(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := 0.1 + 0.03; !approxEqual(spend.MonthlyCost, want) || !approxEqual(spend.DailyCost, want) {
+		t.Errorf("cost mismatch: got %v (monthly), %v (daily) want %v", spend.MonthlyCost, spend.DailyCost, want)
+	}
+
+	if spend.Month.Features[FeatureSentiment] != 100 || spend.Month.Features[FeatureEntitySentiment] != 10 {
+		t.Errorf("feature usage mismatch: got %v", spend.Month.Features)
+	}
+
+	if spend.UnitPrice != 0.001 || spend.EntityUnitPrice != 0.003 {
+		t.Errorf("price mismatch: got %v & %v", spend.UnitPrice, spend.EntityUnitPrice)
+	}
+
+	// Usage recorded before features were tracked is document sentiment.
+	legacy := &Usage{Units: 50}
+	if got := b.cost(legacy); !approxEqual(got, 0.05) {
+		t.Errorf("legacy cost mismatch: got %v want %v", got, 0.05)
+	}
+}
+
+func TestBudgetFlush(t *testing.T) {
+	db := newMemoryDB()
+	ctx := context.Background()
+
+	b := newTestBudget(t, db, 100, 0)
+	if err := b.Reserve(ctx, FeatureSentiment, "bitcoin", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Reserve(ctx, FeatureEntitySentiment, "bitcoin", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is persisted until the budget is flushed.
+	month := time.Now().UTC().Format(monthPeriodFormat)
+	if _, err := db.GetUsage(ctx, month); err != ErrNoResultsFound {
+		t.Fatalf("expected no usage before flushing: got %v", err)
+	}
+
+	if err := b.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	// A new Budget picks up where the last left off.
+	loaded := newTestBudget(t, db, 100, 0)
+	spend, err := loaded.Spend(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spend.Month.Units != 70 || spend.Month.Requests != 2 || spend.Day.Units != 70 {
+		t.Errorf("loaded usage mismatch: got %+v & %+v", spend.Month, spend.Day)
+	}
+
+	if spend.Month.Features[FeatureEntitySentiment] != 10 || spend.Month.UpdatedAt.IsZero() {
+		t.Errorf("unexpected loaded usage: %+v", spend.Month)
+	}
+
+	// 60 + 10*2 units are counted towards the limit.
+	if err := loaded.Reserve(ctx, FeatureSentiment, "bitcoin", 21); errors.Cause(err) != ErrBudgetExhausted {
+		t.Errorf("expected the loaded usage to count towards the limit: got %v", err)
+	}
+
+	if err := loaded.Reserve(ctx, FeatureSentiment, "bitcoin", 20); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBudgetRollover(t *testing.T) {
+	db := newMemoryDB()
+	ctx := context.Background()
+	b := newTestBudget(t, db, 0, 0)
+
+	record := func(now time.Time, units int64) {
+		t.Helper()
+		if err := b.load(ctx, now); err != nil {
+			t.Fatalf("failed to load usage for %v: %v", now, err)
+		}
+		b.record(FeatureSentiment, map[string]int64{"bitcoin": units}, 1)
+	}
+
+	record(time.Date(2018, 1, 31, 12, 0, 0, 0, time.UTC), 5)
+	record(time.Date(2018, 1, 31, 23, 0, 0, 0, time.UTC), 5)
+	// A new day and month: January's usage is flushed.
+	record(time.Date(2018, 2, 1, 1, 0, 0, 0, time.UTC), 3)
+	// A new day in the same month.
+	record(time.Date(2018, 2, 2, 1, 0, 0, 0, time.UTC), 4)
+
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		period string
+		units  int64
+	}{
+		{"2018-01", 10},
+		{"2018-01-31", 10},
+		{"2018-02", 7},
+		{"2018-02-01", 3},
+		{"2018-02-02", 4},
+	}
+
+	for _, tt := range tests {
+		usage, err := db.GetUsage(ctx, tt.period)
+		if err != nil {
+			t.Errorf("failed to get usage for %s: %v", tt.period, err)
+			continue
+		}
+
+		if usage.Units != tt.units || usage.Topics["bitcoin"] != tt.units {
+			t.Errorf("usage mismatch for %s: got %+v want %d units", tt.period, usage, tt.units)
+		}
+	}
+}
+
+func TestNewBudget(t *testing.T) {
+	if _, err := NewBudget(log.NewNopLogger(), newMemoryDB(), -1, 0, 0.001); err == nil {
+		t.Error("expected a negative limit to be invalid")
+	}
+
+	if _, err := NewBudget(log.NewNopLogger(), newMemoryDB(), 0, 0, -0.001); err == nil {
+		t.Error("expected a negative price to be invalid")
+	}
+
+	if _, err := NewBudget(log.NewNopLogger(), newMemoryDB(), 0, 0, 0.001, WithEntityUnitPrice(-1)); err == nil {
+		t.Error("expected a negative entity price to be invalid")
+	}
+}
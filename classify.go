@@ -0,0 +1,87 @@
+package centiment
+
+import "github.com/pkg/errors"
+
+// The default thresholds for classifying a score as positive or negative.
+// Scores between them are considered neutral.
+//
+// Ref: https://cloud.google.com/natural-language/docs/basics#interpreting_sentiment_analysis_values
+const (
+	DefaultPositiveThreshold = 0.25
+	DefaultNegativeThreshold = -0.25
+)
+
+// Polarity is the classification of a score as negative, neutral or positive.
+type Polarity int
+
+// The polarities a score can be classified as.
+const (
+	Neutral Polarity = iota
+	Positive
+	Negative
+)
+
+func (p Polarity) String() string {
+	switch p {
+	case Positive:
+		return "positive"
+	case Negative:
+		return "negative"
+	default:
+		return "neutral"
+	}
+}
+
+// thresholds returns the (positive, negative) classification thresholds for the
+// search term, using the defaults for any that are unset.
+func (st *SearchTerm) thresholds() (float64, float64) {
+	positive, negative := DefaultPositiveThreshold, DefaultNegativeThreshold
+	if st.PositiveThreshold != nil {
+		positive = *st.PositiveThreshold
+	}
+
+	if st.NegativeThreshold != nil {
+		negative = *st.NegativeThreshold
+	}
+
+	return positive, negative
+}
+
+// validateThresholds checks that the search term's thresholds are within
+// [-1, 1], and that the negative threshold is below the positive threshold.
+func (st *SearchTerm) validateThresholds() error {
+	positive, negative := st.thresholds()
+	if positive < -1 || positive > 1 || negative < -1 || negative > 1 {
+		return errors.Errorf("thresholds must be within [-1, 1]: topic %q has thresholds of %v, %v", st.Topic, negative, positive)
+	}
+
+	if negative >= positive {
+		return errors.Errorf("the negative threshold must be below the positive threshold: topic %q has thresholds of %v, %v", st.Topic, negative, positive)
+	}
+
+	return nil
+}
+
+// classify returns the polarity of a score, using the search term's
+// thresholds: scores at or above the positive threshold are positive, and at
+// or below the negative threshold are negative.
+//
+// Scores are compared at the float32 precision they're returned in, so that a
+// score equal to a threshold (e.g. 0.7) is classified as at the threshold.
+func (st *SearchTerm) classify(score float32) Polarity {
+	positive, negative := st.thresholds()
+	switch {
+	case score >= float32(positive):
+		return Positive
+	case score <= float32(negative):
+		return Negative
+	default:
+		return Neutral
+	}
+}
+
+// Polarity classifies the result as negative, neutral or positive, using the
+// thresholds of its search term.
+func (ar *AnalyzerResult) Polarity() Polarity {
+	return ar.SearchTerm.classify(ar.Score)
+}
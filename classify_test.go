@@ -0,0 +1,68 @@
+package centiment
+
+import "testing"
+
+// threshold returns a pointer to v, for setting a SearchTerm's thresholds.
+func threshold(v float64) *float64 {
+	return &v
+}
+
+func TestClassify(t *testing.T) {
+	defaults := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	custom := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin", PositiveThreshold: threshold(0.7), NegativeThreshold: threshold(-0.3)}
+
+	var tests = []struct {
+		name  string
+		term  *SearchTerm
+		score float32
+		want  Polarity
+	}{
+		{"default positive", defaults, 0.25, Positive},
+		{"default neutral", defaults, 0.2, Neutral},
+		{"default negative", defaults, -0.25, Negative},
+		{"at the positive threshold", custom, 0.7, Positive},
+		{"below the positive threshold", custom, 0.69, Neutral},
+		{"at the negative threshold", custom, -0.3, Negative},
+		{"above the negative threshold", custom, -0.29, Neutral},
+		{"at 0.3", &SearchTerm{PositiveThreshold: threshold(0.3), NegativeThreshold: threshold(-0.7)}, 0.3, Positive},
+		{"at -0.7", &SearchTerm{PositiveThreshold: threshold(0.3), NegativeThreshold: threshold(-0.7)}, -0.7, Negative},
+		{"zero positive threshold", &SearchTerm{PositiveThreshold: threshold(0)}, 0, Positive},
+		{"zero negative threshold", &SearchTerm{NegativeThreshold: threshold(0)}, 0, Negative},
+	}
+
+	for _, tt := range tests {
+		if got := tt.term.classify(tt.score); got != tt.want {
+			t.Errorf("%s: polarity mismatch for %v: got %v want %v", tt.name, tt.score, got, tt.want)
+		}
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	// An unset threshold uses the default, but a threshold of 0 is respected.
+	st := &SearchTerm{Topic: "Bitcoin", NegativeThreshold: threshold(-0.5)}
+	if positive, negative := st.thresholds(); positive != DefaultPositiveThreshold || negative != -0.5 {
+		t.Errorf("threshold mismatch: got %v, %v want %v, %v", positive, negative, DefaultPositiveThreshold, -0.5)
+	}
+
+	st = &SearchTerm{Topic: "Bitcoin", PositiveThreshold: threshold(0)}
+	if positive, negative := st.thresholds(); positive != 0 || negative != DefaultNegativeThreshold {
+		t.Errorf("threshold mismatch: got %v, %v want %v, %v", positive, negative, 0, DefaultNegativeThreshold)
+	}
+
+	var tests = []struct {
+		name  string
+		term  SearchTerm
+		valid bool
+	}{
+		{"defaults", SearchTerm{}, true},
+		{"custom", SearchTerm{PositiveThreshold: threshold(0.7), NegativeThreshold: threshold(-0.3)}, true},
+		{"out of range", SearchTerm{PositiveThreshold: threshold(1.5)}, false},
+		{"inverted", SearchTerm{PositiveThreshold: threshold(-0.5), NegativeThreshold: threshold(-0.1)}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.term.validateThresholds(); (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elithrar/centiment"
+	"github.com/gosimple/slug"
+	"github.com/pkg/errors"
+)
+
+// runBacktest backtests the configured rules against a file of Sentiments and
+// a price CSV, and writes the report to w.
+func runBacktest(w io.Writer, conf *config) error {
+	bc, err := parseBacktestConfig(conf.backtest.rulesPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse backtest rules")
+	}
+
+	opts := []centiment.BacktestOption{centiment.WithTradingCost(bc.Cost)}
+	if bc.SkipLowConfidence {
+		opts = append(opts, centiment.WithLowConfidenceSkipped())
+	}
+
+	backtest, err := centiment.NewBacktest(bc.Rules, opts...)
+	if err != nil {
+		return err
+	}
+
+	sentiments, err := readSentiments(conf.backtest.sentimentsPath, conf.backtest.topic)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(conf.backtest.pricesPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	prices, err := centiment.ParsePriceCSV(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse prices from %s", conf.backtest.pricesPath)
+	}
+
+	report, err := backtest.Run(sentiments, prices)
+	if err != nil {
+		return err
+	}
+
+	if conf.backtest.json {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	return writeBacktestReport(w, report)
+}
+
+// readSentiments reads the Sentiments of a topic from a JSON file. The topic
+// may be omitted if the file only contains one.
+func readSentiments(fpath string, topic string) ([]*centiment.Sentiment, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	all, err := centiment.ParseSentimentsJSON(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse sentiments from %s", fpath)
+	}
+
+	topicSlug := slug.Make(topic)
+	slugs := make(map[string]bool)
+	var sentiments []*centiment.Sentiment
+	for _, s := range all {
+		slugs[s.Slug] = true
+		if topic == "" || s.Slug == topicSlug {
+			sentiments = append(sentiments, s)
+		}
+	}
+
+	if topic == "" && len(slugs) > 1 {
+		return nil, errors.Errorf("%s contains sentiments for %d topics: choose one with --topic", fpath, len(slugs))
+	}
+
+	if len(sentiments) == 0 {
+		return nil, errors.Errorf("no sentiments found in %s", fpath)
+	}
+
+	return sentiments, nil
+}
+
+// writeBacktestReport writes a human-readable summary of a backtest.
+func writeBacktestReport(w io.Writer, report *centiment.BacktestReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	percent := func(v float64) string {
+		return fmt.Sprintf("%.2f%%", v*100)
+	}
+
+	fmt.Fprintf(tw, "Period\t%s - %s\n", report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Sentiments\t%d\n", report.Sentiments)
+	fmt.Fprintf(tw, "Price bars\t%d\n", report.Bars)
+	fmt.Fprintf(tw, "Trades\t%d\n", len(report.Trades))
+	fmt.Fprintf(tw, "Hit rate\t%s\n", percent(report.HitRate))
+	fmt.Fprintf(tw, "Exposure\t%s\n", percent(report.Exposure))
+	fmt.Fprintf(tw, "\t\n")
+	fmt.Fprintf(tw, "\tStrategy\tBuy & hold\n")
+	fmt.Fprintf(tw, "Return\t%s\t%s\n", percent(report.Return), percent(report.BuyAndHoldReturn))
+	fmt.Fprintf(tw, "Max drawdown\t%s\t%s\n", percent(report.MaxDrawdown), percent(report.BuyAndHoldDrawdown))
+	fmt.Fprintf(tw, "Excess return\t%s\t\n", percent(report.ExcessReturn))
+	fmt.Fprintf(tw, "\t\n")
+
+	rules := make([]string, 0, len(report.Signals))
+	for rule := range report.Signals {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	fmt.Fprintf(tw, "Rule\tSignals\t\n")
+	for _, rule := range rules {
+		fmt.Fprintf(tw, "%s\t%d\t\n", rule, report.Signals[rule])
+	}
+
+	if len(report.Trades) > 0 {
+		fmt.Fprintf(tw, "\t\n")
+		fmt.Fprintf(tw, "Entry\tExit\tPosition\tRule\tReturn\n")
+		for _, trade := range report.Trades {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				trade.EntryTime.Format(time.RFC3339),
+				trade.ExitTime.Format(time.RFC3339),
+				trade.Position,
+				trade.Rule,
+				percent(trade.Return),
+			)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -12,6 +13,11 @@ import (
 )
 
 type config struct {
+	command          string
+	timezone         string
+	location         *time.Location
+	backfillTopics   []string
+	backtest         backtestFlags
 	accessSecret     string
 	accessToken      string
 	consumerKey      string
@@ -20,45 +26,178 @@ type config struct {
 	listenAddress    string
 	maxTweets        int
 	numWorkers       int
+	adaptiveWorkers  bool
+	minWorkers       int
+	maxWorkers       int
+	queueSize        int
+	scaleInterval    time.Duration
+	maxLatency       time.Duration
+	maxRetries       int
+	retryDelay       time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	maxErrorRate     float64
+	minErrors        int
+	batchSize        int
+	batchWait        time.Duration
+	entitySentiment  bool
+	monthlyUnitLimit int64
+	dailyUnitLimit   int64
+	unitPrice        float64
+	entityUnitPrice  float64
+	anomalyWindow    int
+	anomalyBaseline  int
+	anomalyThreshold float64
+	alertWebhookURL  string
+	alertSecret      string
+	saveMaxRetries   int
+	saveRetryDelay   time.Duration
+	spoolDir         string
+	spoolDrain       time.Duration
 	projectID        string
 	runInterval      time.Duration
 	searchConfigPath string
 	shutdownWait     time.Duration
+	partialPolicy    string
+	partialRuns      centiment.PartialRunPolicy
+	recordTweets     bool
+	tweetText        bool
+	tweetRetention   time.Duration
+	tweetPrune       time.Duration
+	priorStrength    float64
+	globalPrior      float64
+	priorWindow      int
+	priorMinTweets   int64
+	exemplars        int
+	keywords         bool
+	keywordCount     int
+	keywordBaseline  int
+	priceInterval    time.Duration
 }
 
 func parseConfig() (*config, error) {
 	cmd := kingpin.New("centiment", "⚡️ Centiment is a service that performs sentiment analysis of tweets using Google's Natural Language APIs.")
 	conf := &config{}
 
+	serve := cmd.Command("serve", "Run analyses and serve the REST API (the default)").Default()
+	backfill := cmd.Command("backfill", "Recompute the hourly and daily rollups from all saved sentiments, and exit")
+	backtest := cmd.Command("backtest", "Backtest sentiment-driven trading rules against exported sentiments and a price CSV, offline, and exit")
+
+	// Shared config
+	cmd.Flag("timezone", "The time zone (e.g. America/New_York) in which day boundaries are computed for daily rollups").Default("UTC").Envar("CENTIMENT_TIMEZONE").StringVar(&conf.timezone)
+
+	// Backfill config
+	backfill.Flag("topic", "A topic to backfill: may be repeated (defaults to every topic in the search config)").StringsVar(&conf.backfillTopics)
+
+	// Backtest config
+	backtest.Flag("sentiments", "The path to a JSON file of sentiments, as served by /sentiments (an array, or one per line)").Required().StringVar(&conf.backtest.sentimentsPath)
+	backtest.Flag("prices", "The path to a CSV file of prices (time, open, high, low & close columns)").Required().StringVar(&conf.backtest.pricesPath)
+	backtest.Flag("rules", "The path to the TOML file containing the rules to backtest").Default("./backtest.toml").StringVar(&conf.backtest.rulesPath)
+	backtest.Flag("topic", "The topic to backtest, if the sentiments file contains several").StringVar(&conf.backtest.topic)
+	backtest.Flag("json", "Print the report as JSON").Default("false").BoolVar(&conf.backtest.json)
+
 	// Application config
-	cmd.Flag("listen", "The address (IP:port) to listen on").Default("0.0.0.0:8080").Envar("CENTIMENT_ADDRESS").StringVar(&conf.listenAddress)
-	cmd.Flag("max-tweets", "The maximum number of tweets to fetch per given topic").Default("50").Envar("CENTIMENT_MAX_TWEETS").IntVar(&conf.maxTweets)
-	cmd.Flag("analysis-workers", "The number of workers used to process requests against the Natural Language API").Default("10").Envar("CENTIMENT_ANALYSIS_WORKERS").IntVar(&conf.numWorkers)
-	cmd.Flag("project-id", "The Google Cloud project ID to use for Firestore").Required().Envar("CENTIMENT_PROJECT_ID").StringVar(&conf.projectID)
-	cmd.Flag("run-interval", "How often an analysis run occurs").Default("10m").Envar("CENTIMENT_RUN_INTERVAL").DurationVar(&conf.runInterval)
+	serve.Flag("listen", "The address (IP:port) to listen on").Default("0.0.0.0:8080").Envar("CENTIMENT_ADDRESS").StringVar(&conf.listenAddress)
+	serve.Flag("max-tweets", "The maximum number of tweets to fetch per given topic").Default("50").Envar("CENTIMENT_MAX_TWEETS").IntVar(&conf.maxTweets)
+	serve.Flag("analysis-workers", "The (initial) number of workers used to process requests against the Natural Language API").Default("10").Envar("CENTIMENT_ANALYSIS_WORKERS").IntVar(&conf.numWorkers)
+	serve.Flag("analysis-adaptive-workers", "Grow and shrink the analysis worker pool with the backlog, latency and quota errors, starting from --analysis-workers").Default("false").Envar("CENTIMENT_ANALYSIS_ADAPTIVE_WORKERS").BoolVar(&conf.adaptiveWorkers)
+	serve.Flag("analysis-min-workers", "The minimum number of analysis workers when adaptively sizing the worker pool").Default("1").Envar("CENTIMENT_ANALYSIS_MIN_WORKERS").IntVar(&conf.minWorkers)
+	serve.Flag("analysis-max-workers", "The maximum number of analysis workers when adaptively sizing the worker pool: must be at least --analysis-workers").Default("25").Envar("CENTIMENT_ANALYSIS_MAX_WORKERS").IntVar(&conf.maxWorkers)
+	serve.Flag("analysis-queue-size", "The number of search results buffered for analysis, which the worker pool grows to drain").Default("100").Envar("CENTIMENT_ANALYSIS_QUEUE_SIZE").IntVar(&conf.queueSize)
+	serve.Flag("analysis-scale-interval", "How often the analysis worker pool is resized").Default("2s").Envar("CENTIMENT_ANALYSIS_SCALE_INTERVAL").DurationVar(&conf.scaleInterval)
+	serve.Flag("analysis-max-latency", "The average Natural Language API latency above which the worker pool shrinks").Default("2s").Envar("CENTIMENT_ANALYSIS_MAX_LATENCY").DurationVar(&conf.maxLatency)
+	serve.Flag("analysis-max-retries", "The number of times a failed Natural Language API request is retried").Default("3").Envar("CENTIMENT_ANALYSIS_MAX_RETRIES").IntVar(&conf.maxRetries)
+	serve.Flag("analysis-retry-delay", "The base delay between retries of failed Natural Language API requests").Default("250ms").Envar("CENTIMENT_ANALYSIS_RETRY_DELAY").DurationVar(&conf.retryDelay)
+	serve.Flag("analysis-breaker-threshold", "The number of consecutive Natural Language API failures before pausing requests (0 to disable)").Default("5").Envar("CENTIMENT_ANALYSIS_BREAKER_THRESHOLD").IntVar(&conf.breakerThreshold)
+	serve.Flag("analysis-breaker-cooldown", "How long to pause Natural Language API requests for after repeated failures").Default("30s").Envar("CENTIMENT_ANALYSIS_BREAKER_COOLDOWN").DurationVar(&conf.breakerCooldown)
+	serve.Flag("analysis-max-error-rate", "The proportion (0.0 - 1.0) of analyses failed by (retryable) API errors at which a run is aborted (0 to disable)").Default("0.2").Envar("CENTIMENT_ANALYSIS_MAX_ERROR_RATE").Float64Var(&conf.maxErrorRate)
+	serve.Flag("analysis-min-errors", "The minimum number of failed analyses before the error rate is enforced").Default("5").Envar("CENTIMENT_ANALYSIS_MIN_ERRORS").IntVar(&conf.minErrors)
+	serve.Flag("analysis-batch-size", "The maximum number of tweets to pack into each Natural Language API request (1 disables batching)").Default("1").Envar("CENTIMENT_ANALYSIS_BATCH_SIZE").IntVar(&conf.batchSize)
+	serve.Flag("analysis-batch-wait", "How long to wait for a batch of tweets to fill before analyzing it").Default("500ms").Envar("CENTIMENT_ANALYSIS_BATCH_WAIT").DurationVar(&conf.batchWait)
+	serve.Flag("entity-sentiment", "Also analyze the sentiment expressed towards each topic's entities (billed separately)").Default("false").Envar("CENTIMENT_ENTITY_SENTIMENT").BoolVar(&conf.entitySentiment)
+	serve.Flag("anomaly-window", "The number of previous runs used as the baseline when detecting anomalies").Default("144").Envar("CENTIMENT_ANOMALY_WINDOW").IntVar(&conf.anomalyWindow)
+	serve.Flag("anomaly-min-baseline", "The minimum number of previous runs required before detecting anomalies").Default("12").Envar("CENTIMENT_ANOMALY_MIN_BASELINE").IntVar(&conf.anomalyBaseline)
+	serve.Flag("anomaly-threshold", "The (robust) z-score at or beyond which a run's score, volume or magnitude is anomalous").Default("3.5").Envar("CENTIMENT_ANOMALY_THRESHOLD").Float64Var(&conf.anomalyThreshold)
+	serve.Flag("alert-webhook-url", "The URL to deliver alerts to, as a signed JSON POST (alerting is disabled if empty)").Envar("CENTIMENT_ALERT_WEBHOOK_URL").StringVar(&conf.alertWebhookURL)
+	serve.Flag("alert-webhook-secret", "The secret used to sign (HMAC-SHA256) alert webhooks").Envar("CENTIMENT_ALERT_WEBHOOK_SECRET").StringVar(&conf.alertSecret)
+	serve.Flag("exemplars", "The number of most positive, most negative and most intense tweets kept per topic in each run (0 to disable)").Default("5").Envar("CENTIMENT_EXEMPLARS").IntVar(&conf.exemplars)
+	serve.Flag("keywords", "Extract the most common words, phrases, hashtags, cashtags and mentions of each topic in each run").Default("true").Envar("CENTIMENT_KEYWORDS").BoolVar(&conf.keywords)
+	serve.Flag("keyword-count", "The number of keywords of each kind stored per topic in each run").Default("10").Envar("CENTIMENT_KEYWORD_COUNT").IntVar(&conf.keywordCount)
+	serve.Flag("keyword-baseline", "The number of previous runs that the lift of keywords is computed against").Default("144").Envar("CENTIMENT_KEYWORD_BASELINE").IntVar(&conf.keywordBaseline)
+	serve.Flag("price-ingest-interval", "How often the price feeds in the search config are ingested").Default("1h").Envar("CENTIMENT_PRICE_INGEST_INTERVAL").DurationVar(&conf.priceInterval)
+	serve.Flag("smoothing-prior-strength", "The strength, in tweets, of the prior each run's score is shrunk towards to compute its smoothed score (0 to disable smoothing)").Default("0").Envar("CENTIMENT_SMOOTHING_PRIOR_STRENGTH").Float64Var(&conf.priorStrength)
+	serve.Flag("smoothing-global-prior", "The prior score used for topics with too little history").Default("0").Envar("CENTIMENT_SMOOTHING_GLOBAL_PRIOR").Float64Var(&conf.globalPrior)
+	serve.Flag("smoothing-window", "The number of previous runs a topic's long-run mean score is computed from (0 to always use the global prior)").Default("144").Envar("CENTIMENT_SMOOTHING_WINDOW").IntVar(&conf.priorWindow)
+	serve.Flag("smoothing-min-tweets", "The minimum number of tweets in a topic's previous runs for its long-run mean to be used as the prior").Default("100").Envar("CENTIMENT_SMOOTHING_MIN_TWEETS").Int64Var(&conf.priorMinTweets)
+	serve.Flag("save-max-retries", "The number of times a failed save of a run's sentiment is retried").Default("3").Envar("CENTIMENT_SAVE_MAX_RETRIES").IntVar(&conf.saveMaxRetries)
+	serve.Flag("save-retry-delay", "The base delay between retries of failed saves").Default("500ms").Envar("CENTIMENT_SAVE_RETRY_DELAY").DurationVar(&conf.saveRetryDelay)
+	serve.Flag("spool-dir", "The directory to spool sentiments that could not be saved to, for replay once the database recovers (spooling is disabled if empty)").Envar("CENTIMENT_SPOOL_DIR").StringVar(&conf.spoolDir)
+	serve.Flag("spool-drain-interval", "How often spooled sentiments are replayed").Default("1m").Envar("CENTIMENT_SPOOL_DRAIN_INTERVAL").DurationVar(&conf.spoolDrain)
+	serve.Flag("nl-monthly-unit-limit", "The maximum number of billable Natural Language API units (1,000 characters) to use per calendar month (0 for unlimited)").Default("0").Envar("CENTIMENT_NL_MONTHLY_UNIT_LIMIT").Int64Var(&conf.monthlyUnitLimit)
+	serve.Flag("nl-daily-unit-limit", "The maximum number of billable Natural Language API units (1,000 characters) to use per day (0 for unlimited)").Default("0").Envar("CENTIMENT_NL_DAILY_UNIT_LIMIT").Int64Var(&conf.dailyUnitLimit)
+	serve.Flag("nl-unit-price", "The price (in USD) per billable Natural Language API unit, used to estimate spend").Default("0.001").Envar("CENTIMENT_NL_UNIT_PRICE").Float64Var(&conf.unitPrice)
+	serve.Flag("nl-entity-unit-price", "The price (in USD) per billable Natural Language API unit of entity sentiment analysis, used to estimate spend").Default("0.002").Envar("CENTIMENT_NL_ENTITY_UNIT_PRICE").Float64Var(&conf.entityUnitPrice)
+	cmd.Flag("project-id", "The Google Cloud project ID to use for Firestore (required, except to backtest)").Envar("CENTIMENT_PROJECT_ID").StringVar(&conf.projectID)
+	serve.Flag("run-interval", "How often an analysis run occurs").Default("10m").Envar("CENTIMENT_RUN_INTERVAL").DurationVar(&conf.runInterval)
 	cmd.Flag("search-config", "The path to the TOML file containing search terms").Default("./search.toml").Envar("CENTIMENT_SEARCH_CONFIG").StringVar(&conf.searchConfigPath)
-	cmd.Flag("hostname", "The hostname to serve requests for").Default("centiment.questionable.services").Envar("CENTIMENT_HOSTNAME").StringVar(&conf.hostname)
-	cmd.Flag("shutdown-wait", "The grace period to allow for finishing any ongoing analysis before terminating on SIGINT").Default("10s").Envar("CENTIMENT_SHUTDOWN_WAIT").DurationVar(&conf.shutdownWait)
+	serve.Flag("hostname", "The hostname to serve requests for").Default("centiment.questionable.services").Envar("CENTIMENT_HOSTNAME").StringVar(&conf.hostname)
+	serve.Flag("shutdown-wait", "The grace period to allow for saving the results of an analysis run once it is cancelled (e.g. when terminating on SIGINT)").Default("10s").Envar("CENTIMENT_SHUTDOWN_WAIT").DurationVar(&conf.shutdownWait)
+	serve.Flag("partial-runs", "Whether to save or discard the results collected by an analysis run that is cancelled before completing (e.g. on SIGINT)").Default("discard").Envar("CENTIMENT_PARTIAL_RUNS").EnumVar(&conf.partialPolicy, "discard", "save")
+	serve.Flag("record-tweets", "Record the analysis (score, magnitude & text hash) of each tweet, for auditing").Default("false").Envar("CENTIMENT_RECORD_TWEETS").BoolVar(&conf.recordTweets)
+	serve.Flag("record-tweet-text", "Also record the text of each tweet (requires --record-tweets)").Default("false").Envar("CENTIMENT_RECORD_TWEET_TEXT").BoolVar(&conf.tweetText)
+	serve.Flag("tweet-retention", "How long recorded tweets are kept for (0 to keep indefinitely)").Default("720h").Envar("CENTIMENT_TWEET_RETENTION").DurationVar(&conf.tweetRetention)
+	serve.Flag("tweet-prune-interval", "How often recorded tweets older than the retention period are pruned").Default("1h").Envar("CENTIMENT_TWEET_PRUNE_INTERVAL").DurationVar(&conf.tweetPrune)
 
 	// Twitter keys
-	cmd.Flag("twitter-consumer-key", "The Twitter consumer API key").Required().Envar("TWITTER_CONSUMER_KEY").StringVar(&conf.consumerKey)
-	cmd.Flag("twitter-consumer-secret", "The Twitter consumer API secret").Required().Envar("TWITTER_CONSUMER_SECRET").StringVar(&conf.consumerSecret)
-	cmd.Flag("twitter-access-token", "The Twitter client access token").Required().Envar("TWITTER_ACCESS_TOKEN").StringVar(&conf.accessToken)
-	cmd.Flag("twitter-access-secret", "The Twitter client access token").Required().Envar("TWITTER_ACCESS_SECRET").StringVar(&conf.accessSecret)
+	serve.Flag("twitter-consumer-key", "The Twitter consumer API key").Required().Envar("TWITTER_CONSUMER_KEY").StringVar(&conf.consumerKey)
+	serve.Flag("twitter-consumer-secret", "The Twitter consumer API secret").Required().Envar("TWITTER_CONSUMER_SECRET").StringVar(&conf.consumerSecret)
+	serve.Flag("twitter-access-token", "The Twitter client access token").Required().Envar("TWITTER_ACCESS_TOKEN").StringVar(&conf.accessToken)
+	serve.Flag("twitter-access-secret", "The Twitter client access token").Required().Envar("TWITTER_ACCESS_SECRET").StringVar(&conf.accessSecret)
 
-	_, err := cmd.Parse(os.Args[1:])
+	command, err := cmd.Parse(os.Args[1:])
 	if err != nil {
 		return nil, err
 	}
+	conf.command = command
+
+	// Backtests run offline.
+	if conf.command != "backtest" && conf.projectID == "" {
+		return nil, errors.New("required flag --project-id not provided")
+	}
+
+	if conf.queueSize < 0 {
+		return nil, errors.Errorf("--analysis-queue-size must be >= 0: got %d", conf.queueSize)
+	}
+
+	if conf.location, err = time.LoadLocation(conf.timezone); err != nil {
+		return nil, errors.Wrapf(err, "invalid timezone %q", conf.timezone)
+	}
+
+	if conf.partialPolicy != "" {
+		if conf.partialRuns, err = centiment.ParsePartialRunPolicy(conf.partialPolicy); err != nil {
+			return nil, err
+		}
+	}
 
 	return conf, nil
 }
 
+// backtestFlags configures the backtest command.
+type backtestFlags struct {
+	sentimentsPath string
+	pricesPath     string
+	rulesPath      string
+	topic          string
+	json           bool
+}
+
 type searchConfig struct {
 	SearchTerms []*centiment.SearchTerm `toml:"search"`
+	Groups      []*centiment.TopicGroup `toml:"group"`
+	Prices      []*centiment.PriceFeed  `toml:"price"`
 }
 
-func parseSearchTerms(fpath string) ([]*centiment.SearchTerm, error) {
+func parseSearchConfig(fpath string) (*searchConfig, error) {
 	var sc *searchConfig
 
 	if _, err := toml.DecodeFile(fpath, &sc); err != nil {
@@ -73,7 +212,49 @@ func parseSearchTerms(fpath string) ([]*centiment.SearchTerm, error) {
 		if count := utf8.RuneCountInString(term.Query); count < 3 {
 			return nil, errors.Errorf("search queries must be > 3 characters long: %q is only %d characters", term.Query, count)
 		}
+
+		for _, alias := range term.Aliases {
+			if strings.TrimSpace(alias) == "" {
+				return nil, errors.Errorf("aliases must not be empty: topic %q has an empty alias", term.Topic)
+			}
+		}
+	}
+
+	for _, feed := range sc.Prices {
+		var found bool
+		for _, term := range sc.SearchTerms {
+			if strings.EqualFold(strings.TrimSpace(term.Topic), strings.TrimSpace(feed.Topic)) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, errors.Errorf("price feed %q is linked to topic %q, which is not searched for", feed.Symbol, feed.Topic)
+		}
+	}
+
+	return sc, nil
+}
+
+type backtestConfig struct {
+	// The cost of each trade, as a fraction of its value.
+	Cost float64
+	// Whether Sentiments flagged as low confidence are skipped.
+	SkipLowConfidence bool
+	Rules             []*centiment.BacktestRule `toml:"rule"`
+}
+
+func parseBacktestConfig(fpath string) (*backtestConfig, error) {
+	var bc *backtestConfig
+
+	if _, err := toml.DecodeFile(fpath, &bc); err != nil {
+		return nil, err
+	}
+
+	if len(bc.Rules) == 0 {
+		return nil, errors.Errorf("no rules found in %s: add at least one [[rule]]", fpath)
 	}
 
-	return sc.SearchTerms, nil
+	return bc, nil
 }
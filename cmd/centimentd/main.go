@@ -12,6 +12,7 @@ import (
 
 	"github.com/elithrar/centiment"
 	"github.com/gorilla/mux"
+	"github.com/gosimple/slug"
 	"github.com/oklog/run"
 	"github.com/pkg/errors"
 	"github.com/rs/cors"
@@ -35,6 +36,14 @@ func main() {
 		fatal(logger, err)
 	}
 
+	if conf.command == "backtest" {
+		if err := runBacktest(os.Stdout, conf); err != nil {
+			fatal(logger, err)
+		}
+
+		return
+	}
+
 	logger.Log(
 		"msg", fmt.Sprintf("using config file at %s", conf.searchConfigPath),
 	)
@@ -54,8 +63,37 @@ func main() {
 		CollectionName: "sentiments",
 	}
 
+	rollups, err := centiment.NewRollups(
+		log.With(logger, "worker", "rollups"),
+		store,
+		conf.location,
+	)
+	if err != nil {
+		fatal(logger, err)
+	}
+
+	if conf.command == "backfill" {
+		if err := backfillRollups(ctx, logger, conf, rollups); err != nil {
+			fatal(logger, err)
+		}
+
+		return
+	}
+
+	budget, err := centiment.NewBudget(
+		log.With(logger, "worker", "budget"),
+		store,
+		conf.monthlyUnitLimit,
+		conf.dailyUnitLimit,
+		conf.unitPrice,
+		centiment.WithEntityUnitPrice(conf.entityUnitPrice),
+	)
+	if err != nil {
+		fatal(logger, err)
+	}
+
 	// Application server
-	env := &centiment.Env{DB: store, Logger: logger, Hostname: conf.hostname}
+	env := &centiment.Env{DB: store, Budget: budget, Logger: logger, Hostname: conf.hostname, Location: conf.location}
 	router := mux.NewRouter().StrictSlash(true)
 	router.Use(centiment.LogRequest(
 		log.With(logger, "worker", "web"),
@@ -65,6 +103,12 @@ func main() {
 	centiment.AddHealthCheckEndpoints(router, env)
 	centiment.AddMetricEndpoints(router, env)
 	centiment.AddSentimentEndpoints(router, env)
+	centiment.AddBudgetEndpoints(router, env)
+	centiment.AddAnomalyEndpoints(router, env)
+	centiment.AddAlertEndpoints(router, env)
+	centiment.AddGroupEndpoints(router, env)
+	centiment.AddCorrelationEndpoints(router, env)
+	centiment.AddRunEndpoints(router, env)
 	srv := &http.Server{
 		Addr:         conf.listenAddress,
 		WriteTimeout: time.Second * 15,
@@ -73,10 +117,11 @@ func main() {
 		Handler:      router,
 	}
 
-	terms, err := parseSearchTerms(conf.searchConfigPath)
+	sc, err := parseSearchConfig(conf.searchConfigPath)
 	if err != nil {
 		fatal(logger, err)
 	}
+	terms := sc.SearchTerms
 	anaconda.SetConsumerKey(conf.consumerKey)
 	anaconda.SetConsumerSecret(conf.consumerSecret)
 	twitterAPI := anaconda.NewTwitterApi(conf.accessToken, conf.accessSecret)
@@ -86,7 +131,20 @@ func main() {
 		fatal(logger, err)
 	}
 
+	var spool *centiment.Spool
+	if conf.spoolDir != "" {
+		spool, err = centiment.NewSpool(log.With(logger, "worker", "spool"), conf.spoolDir)
+		if err != nil {
+			fatal(logger, err)
+		}
+	}
+
 	// Initialize worker pools.
+	var searcherOpts []centiment.SearcherOption
+	if spool != nil {
+		searcherOpts = append(searcherOpts, centiment.WithCheckpointSpool(spool))
+	}
+
 	searcher, err := centiment.NewSearcher(
 		log.With(logger, "worker", "searcher"),
 		terms,
@@ -94,28 +152,145 @@ func main() {
 		time.Minute*15, // TODO(matt): Make this configurable
 		twitterAPI,
 		store,
+		searcherOpts...,
 	)
 	if err != nil {
 		fatal(logger, err)
 	}
 
+	analyzerOpts := []centiment.AnalyzerOption{
+		centiment.WithRetries(conf.maxRetries, conf.retryDelay),
+		centiment.WithCircuitBreaker(conf.breakerThreshold, conf.breakerCooldown),
+		centiment.WithErrorBudget(conf.maxErrorRate, conf.minErrors),
+		centiment.WithBudget(budget),
+		centiment.WithBatching(conf.batchSize, conf.batchWait),
+	}
+	if conf.adaptiveWorkers {
+		analyzerOpts = append(analyzerOpts, centiment.WithAdaptiveWorkers(conf.minWorkers, conf.maxWorkers, conf.scaleInterval, conf.maxLatency))
+	}
+	if conf.entitySentiment {
+		analyzerOpts = append(analyzerOpts, centiment.WithEntitySentiment())
+	}
+
 	analyzer, err := centiment.NewAnalyzer(
 		log.With(logger, "worker", "analyzer"),
 		nlClient,
 		conf.numWorkers,
+		analyzerOpts...,
+	)
+	if err != nil {
+		fatal(logger, err)
+	}
+
+	detector, err := centiment.NewDetector(
+		log.With(logger, "worker", "detector"),
+		store,
+		centiment.WithAnomalyBaseline(conf.anomalyWindow, conf.anomalyBaseline),
+		centiment.WithAnomalyThreshold(conf.anomalyThreshold),
 	)
 	if err != nil {
 		fatal(logger, err)
 	}
 
+	aggregatorOpts := []centiment.AggregatorOption{
+		centiment.WithRollups(rollups),
+		centiment.WithDetector(detector),
+		centiment.WithSaveRetries(conf.saveMaxRetries, conf.saveRetryDelay),
+		centiment.WithSaveTimeout(conf.shutdownWait),
+		centiment.WithPartialRuns(conf.partialRuns),
+		centiment.WithGroups(sc.Groups, terms),
+		centiment.WithExemplars(conf.exemplars),
+	}
+	if spool != nil {
+		aggregatorOpts = append(aggregatorOpts, centiment.WithSpool(spool))
+	}
+	if conf.alertWebhookURL != "" {
+		alerter, err := centiment.NewAlerter(
+			log.With(logger, "worker", "alerter"),
+			store,
+			terms,
+			conf.alertWebhookURL,
+			conf.alertSecret,
+		)
+		if err != nil {
+			fatal(logger, err)
+		}
+		aggregatorOpts = append(aggregatorOpts, centiment.WithAlerter(alerter))
+	}
+
+	if conf.priorStrength > 0 {
+		smoother, err := centiment.NewSmoother(
+			log.With(logger, "worker", "smoother"),
+			store,
+			centiment.WithPriorStrength(conf.priorStrength),
+			centiment.WithGlobalPrior(conf.globalPrior),
+			centiment.WithPriorHistory(conf.priorWindow, conf.priorMinTweets),
+		)
+		if err != nil {
+			fatal(logger, err)
+		}
+		aggregatorOpts = append(aggregatorOpts, centiment.WithSmoother(smoother))
+	}
+
+	if conf.keywords {
+		extractor, err := centiment.NewKeywordExtractor(
+			log.With(logger, "worker", "keywords"),
+			store,
+			centiment.WithKeywordCount(conf.keywordCount),
+			centiment.WithKeywordBaseline(conf.keywordBaseline),
+		)
+		if err != nil {
+			fatal(logger, err)
+		}
+		aggregatorOpts = append(aggregatorOpts, centiment.WithKeywords(extractor))
+	}
+
+	var recorder *centiment.TweetRecorder
+	if conf.recordTweets {
+		recorderOpts := []centiment.TweetRecorderOption{
+			centiment.WithTweetRetention(conf.tweetRetention),
+		}
+		if conf.tweetText {
+			recorderOpts = append(recorderOpts, centiment.WithTweetText())
+		}
+
+		recorder, err = centiment.NewTweetRecorder(
+			log.With(logger, "worker", "tweets"),
+			store,
+			recorderOpts...,
+		)
+		if err != nil {
+			fatal(logger, err)
+		}
+		aggregatorOpts = append(aggregatorOpts, centiment.WithTweetRecorder(recorder))
+	}
+
 	aggregator, err := centiment.NewAggregator(
 		log.With(logger, "worker", "aggregator"),
 		store,
+		aggregatorOpts...,
 	)
 	if err != nil {
 		fatal(logger, err)
 	}
 
+	var ingester *centiment.PriceIngester
+	if len(sc.Prices) > 0 {
+		ingester, err = centiment.NewPriceIngester(
+			log.With(logger, "worker", "prices"),
+			store,
+			sc.Prices,
+		)
+		if err != nil {
+			fatal(logger, err)
+		}
+
+		env.PriceSymbols = make(map[string]string, len(sc.Prices))
+		for _, feed := range sc.Prices {
+			env.PriceSymbols[slug.Make(feed.Topic)] = feed.Symbol
+		}
+	}
+
 	ticker := time.NewTicker(conf.runInterval)
 
 	// Run worker pools.
@@ -140,6 +315,9 @@ func main() {
 			ctx,
 			logger,
 			ticker,
+			conf.queueSize,
+			store,
+			conf.shutdownWait,
 			searcher,
 			analyzer,
 			aggregator,
@@ -150,6 +328,39 @@ func main() {
 		},
 	)
 
+	if recorder != nil && conf.tweetRetention > 0 {
+		group.Add(
+			func() error {
+				return recorder.RunPruner(ctx, conf.tweetPrune)
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+
+	if ingester != nil {
+		group.Add(
+			func() error {
+				return ingester.Run(ctx, conf.priceInterval)
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+
+	if spool != nil {
+		group.Add(
+			func() error {
+				return aggregator.RunDrainer(ctx, conf.spoolDrain)
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+
 	logger.Log(
 		"status", "starting",
 		"interval", conf.runInterval,
@@ -166,7 +377,7 @@ func main() {
 
 }
 
-func runAnalysis(ctx context.Context, logger log.Logger, ticker *time.Ticker, searcher *centiment.Searcher, analyzer *centiment.Analyzer, aggregator *centiment.Aggregator) func() error {
+func runAnalysis(ctx context.Context, logger log.Logger, ticker *time.Ticker, queueSize int, db centiment.DB, saveTimeout time.Duration, searcher *centiment.Searcher, analyzer *centiment.Analyzer, aggregator *centiment.Aggregator) func() error {
 	return func() error {
 		// Trigger an immediate first run.
 		now := make(chan struct{}, 1)
@@ -174,16 +385,64 @@ func runAnalysis(ctx context.Context, logger log.Logger, ticker *time.Ticker, se
 		defer close(now)
 
 		run := func() {
-			logger.Log("state", "running")
 			start := time.Now()
+			tracker := centiment.NewRunTracker(start)
+			logger := log.With(logger, "run", tracker.ID())
+			ctx := centiment.ContextWithRun(ctx, tracker)
+			saveRun(logger, db, tracker.Run(), saveTimeout)
+			logger.Log("state", "running")
 
-			searched := make(chan *centiment.SearchResult)
+			// Buffer search results so that the analyzer can observe the queue
+			// depth when sizing its worker pool: an unbuffered channel always
+			// appears empty, and the pool never grows to meet a backlog.
+			searched := make(chan *centiment.SearchResult, queueSize)
 			analyzed := make(chan *centiment.AnalyzerResult)
 
+			collected := make(chan []*centiment.Sentiment, 1)
+
 			go searcher.Run(ctx, searched)
-			go aggregator.Run(ctx, analyzed)
-			analyzer.Run(ctx, searched, analyzed)
+			go func() {
+				// Collect returns early (with the results collected so far) if
+				// the run is cancelled.
+				sentiments, _ := aggregator.Collect(ctx, analyzed)
+				collected <- sentiments
+			}()
+
+			err := analyzer.Run(ctx, searched, analyzed)
+			sentiments := <-collected
+			if ctx.Err() != nil {
+				// The run was cancelled (e.g. on shutdown): save or discard the
+				// results collected so far, per --partial-runs, and wait for the
+				// save to complete.
+				if err := aggregator.SavePartial(ctx, sentiments); err != nil {
+					logger.Log("err", err)
+				}
+
+				saveRun(logger, db, tracker.Finish(centiment.RunCancelled, ctx.Err()), saveTimeout)
+				logger.Log(
+					"status", "cancelled",
+					"topics", len(sentiments),
+					"duration", time.Since(start).String(),
+				)
+				return
+			}
 
+			if err != nil {
+				// Don't save the (partial) results of an aborted run.
+				saveRun(logger, db, tracker.Finish(centiment.RunAborted, err), saveTimeout)
+				logger.Log(
+					"status", "aborted",
+					"err", err,
+					"duration", time.Since(start).String(),
+				)
+				return
+			}
+
+			if err := aggregator.Save(ctx, sentiments); err != nil {
+				logger.Log("err", err)
+			}
+
+			saveRun(logger, db, tracker.Finish(centiment.RunFinished, nil), saveTimeout)
 			logger.Log(
 				"status", "finished",
 				"duration", time.Since(start).String(),
@@ -205,6 +464,53 @@ func runAnalysis(ctx context.Context, logger log.Logger, ticker *time.Ticker, se
 	}
 }
 
+// saveRun saves the record of an analysis run. Runs are saved independently of
+// the run's context, so that the outcome of a cancelled run is still recorded.
+func saveRun(logger log.Logger, db centiment.DB, run centiment.Run, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := db.SaveRun(ctx, run); err != nil {
+		logger.Log("err", errors.Wrap(err, "failed to save run"))
+	}
+}
+
+// backfillRollups recomputes the rollups for the configured topics (or every
+// topic and group in the search config).
+func backfillRollups(ctx context.Context, logger log.Logger, conf *config, rollups *centiment.Rollups) error {
+	topics := conf.backfillTopics
+	if len(topics) == 0 {
+		sc, err := parseSearchConfig(conf.searchConfigPath)
+		if err != nil {
+			return err
+		}
+
+		for _, term := range sc.SearchTerms {
+			topics = append(topics, term.Topic)
+		}
+
+		for _, group := range sc.Groups {
+			topics = append(topics, group.Name)
+		}
+	}
+
+	for _, topic := range topics {
+		n, err := rollups.Backfill(ctx, slug.Make(topic))
+		if err != nil {
+			return errors.Wrapf(err, "failed to backfill rollups for %q", topic)
+		}
+
+		logger.Log(
+			"status", "backfilled",
+			"topic", topic,
+			"rollups", n,
+			"timezone", conf.location,
+		)
+	}
+
+	return nil
+}
+
 func signalHandler(ctx context.Context) func() error {
 	return func() error {
 		c := make(chan os.Signal, 1)
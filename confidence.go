@@ -0,0 +1,118 @@
+package centiment
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMinSamples is the default minimum number of tweets for a Sentiment to
+// be considered reliable: Sentiments aggregated from fewer tweets are flagged
+// as LowConfidence.
+const DefaultMinSamples = 10
+
+// z975 is the 97.5th percentile of the standard normal distribution, for
+// two-sided 95% confidence intervals.
+const z975 = 1.959964
+
+// t975 holds the 97.5th percentiles of Student's t-distribution for 1 to 30
+// degrees of freedom (at index df-1).
+var t975 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tCritical returns the critical value of Student's t-distribution for a
+// two-sided 95% confidence interval with df degrees of freedom. Beyond the
+// table, it uses the Cornish-Fisher expansion, which is accurate to within
+// 1e-4 from 30 degrees of freedom, and tends to the normal critical value.
+func tCritical(df int64) float64 {
+	if df < 1 {
+		return math.Inf(1)
+	}
+
+	if df <= int64(len(t975)) {
+		return t975[df-1]
+	}
+
+	n := float64(df)
+	z := z975
+	return z + (math.Pow(z, 3)+z)/(4*n) + (5*math.Pow(z, 5)+16*math.Pow(z, 3)+3*z)/(96*n*n)
+}
+
+// sampleVariance returns the sample variance of count values from their sum of
+// squared differences from the mean. The variance of fewer than two values is
+// undefined, and returned as 0.
+func sampleVariance(sumOfSquares float64, count int64) float64 {
+	if count < 2 {
+		return 0
+	}
+
+	return sumOfSquares / float64(count-1)
+}
+
+// minSamples returns the minimum number of tweets for a Sentiment of this
+// search term to be considered reliable.
+func (st *SearchTerm) minSamples() int64 {
+	if st.MinSamples == 0 {
+		return DefaultMinSamples
+	}
+
+	return st.MinSamples
+}
+
+// validateMinSamples checks that the search term's minimum sample size is
+// non-negative.
+func (st *SearchTerm) validateMinSamples() error {
+	if st.MinSamples < 0 {
+		return errors.Errorf("the minimum sample size must be >= 0: topic %q has a minimum of %d", st.Topic, st.MinSamples)
+	}
+
+	return nil
+}
+
+// summarizeConfidence computes the standard error of the mean score, its 95%
+// confidence interval, and whether the Sentiment is aggregated from too few
+// tweets to be reliable.
+//
+// The interval uses Student's t-distribution, as the sample variance is itself
+// an estimate, and is clamped to the range of scores ([-1, 1]). With fewer
+// than two tweets the spread is unknown: the standard error is 0 and the
+// interval spans the full range of scores.
+func (s *Sentiment) summarizeConfidence() {
+	minSamples := s.MinSamples
+	if minSamples == 0 {
+		minSamples = DefaultMinSamples
+	}
+	s.LowConfidence = s.Count < 2 || s.Count < minSamples
+
+	if s.Count < 2 {
+		s.StdErr = 0
+		s.CILower, s.CIUpper = -1, 1
+		return
+	}
+
+	s.StdErr = s.StdDev / math.Sqrt(float64(s.Count))
+	margin := tCritical(s.Count-1) * s.StdErr
+	s.CILower = math.Max(-1, s.Score-margin)
+	s.CIUpper = math.Min(1, s.Score+margin)
+}
+
+// sanitize replaces any non-finite (NaN or infinite) statistics with 0, as
+// they can be neither stored nor encoded as JSON. These can only arise from
+// Sentiments saved before the small-sample cases were handled.
+func (s *Sentiment) sanitize() {
+	for _, v := range []*float64{
+		&s.Score, &s.StdDev, &s.Variance, &s.StdErr, &s.CILower, &s.CIUpper,
+		&s.SmoothedScore, &s.PriorScore, &s.PriorStrength,
+		&s.Magnitude, &s.MagnitudeStdDev, &s.MagnitudeVariance,
+		&s.Median, &s.P10, &s.P90,
+		&s.PositiveRatio, &s.NeutralRatio, &s.NegativeRatio, &s.NetSentiment,
+		&s.EntityScore, &s.EntityStdDev, &s.EntityVariance,
+	} {
+		if math.IsNaN(*v) || math.IsInf(*v, 0) {
+			*v = 0
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package centiment
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSentimentConfidence(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin", MinSamples: 20}
+
+	var tests = []struct {
+		name          string
+		n             int
+		lowConfidence bool
+	}{
+		{"no tweets", 0, true},
+		{"one tweet", 1, true},
+		{"two tweets", 2, true},
+		{"below minimum", 19, true},
+		{"at minimum", 20, false},
+		{"many tweets", 500, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := randomResults(rng, term, tt.n)
+			var sentiment *Sentiment
+			if tt.n == 0 {
+				sentiment = &Sentiment{}
+				sentiment.populateWithSearch(term)
+				sentiment.finalize()
+			} else {
+				sentiment = aggregate(t, results)
+			}
+
+			if sentiment.LowConfidence != tt.lowConfidence {
+				t.Errorf("lowConfidence mismatch: got %t want %t", sentiment.LowConfidence, tt.lowConfidence)
+			}
+
+			if _, err := json.Marshal(sentiment); err != nil {
+				t.Fatalf("failed to marshal sentiment: %v", err)
+			}
+
+			if tt.n < 2 {
+				if sentiment.Variance != 0 || sentiment.StdErr != 0 || sentiment.CILower != -1 || sentiment.CIUpper != 1 {
+					t.Errorf("unexpected small-sample statistics: %+v", sentiment)
+				}
+				return
+			}
+
+			if want := sentiment.StdDev / math.Sqrt(float64(tt.n)); !approxEqual(sentiment.StdErr, want) {
+				t.Errorf("stdErr mismatch: got %v want %v", sentiment.StdErr, want)
+			}
+
+			if !(sentiment.CILower <= sentiment.Score && sentiment.Score <= sentiment.CIUpper) {
+				t.Errorf("score %v outside of interval [%v, %v]", sentiment.Score, sentiment.CILower, sentiment.CIUpper)
+			}
+
+			if sentiment.CILower < -1 || sentiment.CIUpper > 1 {
+				t.Errorf("interval [%v, %v] outside of [-1, 1]", sentiment.CILower, sentiment.CIUpper)
+			}
+		})
+	}
+}
+
+func TestSentimentConfidenceMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+
+	// Runs that are each too small to be reliable are reliable combined.
+	merged := &Sentiment{}
+	for i := 0; i < 3; i++ {
+		run := aggregate(t, randomResults(rng, term, 4))
+		if !run.LowConfidence {
+			t.Fatalf("run of %d tweets not flagged as low confidence", run.Count)
+		}
+		merged.Merge(run)
+	}
+
+	if merged.MinSamples != DefaultMinSamples || merged.LowConfidence {
+		t.Errorf("merged sentiment of %d tweets flagged as low confidence (minimum %d)", merged.Count, merged.MinSamples)
+	}
+}
+
+func TestSentimentSanitize(t *testing.T) {
+	// A Sentiment saved before small samples were handled.
+	sentiment := &Sentiment{Count: 1, Score: 0.5, Variance: math.NaN(), StdDev: math.NaN(), MagnitudeVariance: math.Inf(1)}
+	sentiment.sanitize()
+
+	if _, err := json.Marshal(sentiment); err != nil {
+		t.Fatalf("failed to marshal sentiment: %v", err)
+	}
+
+	if sentiment.Score != 0.5 || sentiment.Variance != 0 || sentiment.MagnitudeVariance != 0 {
+		t.Errorf("unexpected sanitized sentiment: %+v", sentiment)
+	}
+}
+
+func TestTCritical(t *testing.T) {
+	var tests = []struct {
+		df   int64
+		want float64
+	}{
+		{1, 12.706},
+		{10, 2.228},
+		{30, 2.042},
+		{40, 2.021},
+		{120, 1.980},
+		{100000, 1.960},
+	}
+
+	for _, tt := range tests {
+		if got := tCritical(tt.df); math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("tCritical(%d): got %v want %v", tt.df, got, tt.want)
+		}
+	}
+}
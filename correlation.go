@@ -0,0 +1,208 @@
+package centiment
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// minCorrelationPairs is the fewest (score, return) pairs that a correlation
+// is computed from.
+const minCorrelationPairs = 3
+
+// Correlation is the correlation between a topic's sentiment score in each
+// period and the return of a symbol's price in the period lag periods later.
+// Positive lags test whether sentiment leads the price, and negative lags
+// whether it follows.
+type Correlation struct {
+	Lag int `json:"lag"`
+	// The number of periods with both a score and a return.
+	N int `json:"n"`
+	// The Pearson (linear) and Spearman (rank) correlation coefficients, in
+	// [-1, 1]. Both are 0 when undefined: with fewer than three pairs, or when
+	// either series is constant.
+	Pearson  float64 `json:"pearson"`
+	Spearman float64 `json:"spearman"`
+}
+
+// priceSeries looks up the closing price of a symbol at the end of each
+// (rollup) period.
+type priceSeries struct {
+	res Resolution
+	loc *time.Location
+	// The close of the latest bar in each period, keyed by the (Unix) start of
+	// the period.
+	closes map[int64]float64
+}
+
+// newPriceSeries creates a priceSeries from prices, in any order, for periods
+// of the given resolution in loc.
+func newPriceSeries(prices []*Price, res Resolution, loc *time.Location) *priceSeries {
+	sorted := append([]*Price{}, prices...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	ps := &priceSeries{res: res, loc: loc, closes: make(map[int64]float64)}
+	for _, p := range sorted {
+		if p.Close > 0 {
+			ps.closes[ps.barPeriod(p.Time).Unix()] = p.Close
+		}
+	}
+
+	return ps
+}
+
+// periodStart returns the start of the period containing t.
+func (ps *priceSeries) periodStart(t time.Time) time.Time {
+	t = t.In(ps.loc)
+	if ps.res == Daily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, ps.loc)
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, ps.loc)
+}
+
+// barPeriod returns the start of the period that a bar starting at t belongs
+// to. Daily bars are stamped with their date at midnight UTC, and belong to the
+// period of the same date in ps.loc: not to the period containing midnight UTC,
+// which is the day before (or after) in other time zones.
+func (ps *priceSeries) barPeriod(t time.Time) time.Time {
+	t = t.UTC()
+	if ps.res == Daily && t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, ps.loc)
+	}
+
+	return ps.periodStart(t)
+}
+
+// closeAt returns the price at the end of the period starting at start: the
+// close of the latest bar in that period.
+func (ps *priceSeries) closeAt(start time.Time) (float64, bool) {
+	price, ok := ps.closes[ps.periodStart(start).Unix()]
+	return price, ok
+}
+
+// periodReturn returns the (simple) return over the period starting at start:
+// from the close of the previous period, to the close of this one.
+func (ps *priceSeries) periodReturn(start time.Time) (float64, bool) {
+	open, ok := ps.closeAt(shiftPeriod(start, ps.res, -1))
+	if !ok {
+		return 0, false
+	}
+
+	last, ok := ps.closeAt(start)
+	if !ok {
+		return 0, false
+	}
+
+	return last/open - 1, true
+}
+
+// shiftPeriod returns t moved by n periods of the given resolution.
+func shiftPeriod(t time.Time, res Resolution, n int) time.Time {
+	if res == Daily {
+		return t.AddDate(0, 0, n)
+	}
+
+	return t.Add(time.Hour * time.Duration(n))
+}
+
+// Correlate computes the correlation between the score of each rollup and the
+// return of the price over the period lag periods later, for each lag. loc is
+// the location (time zone) that the rollup periods are aligned to: if nil, UTC
+// is used.
+func Correlate(rollups []*Rollup, prices []*Price, res Resolution, lags []int, loc *time.Location) []Correlation {
+	if loc == nil {
+		loc = time.UTC
+	}
+	series := newPriceSeries(prices, res, loc)
+
+	correlations := make([]Correlation, 0, len(lags))
+	for _, lag := range lags {
+		var scores, returns []float64
+		for _, r := range rollups {
+			// Periods are shifted in loc, so that daily periods remain aligned
+			// to midnight across daylight saving transitions.
+			start := shiftPeriod(r.PeriodStart.In(loc), res, lag)
+			ret, ok := series.periodReturn(start)
+			if !ok {
+				continue
+			}
+
+			scores = append(scores, r.Score)
+			returns = append(returns, ret)
+		}
+
+		c := Correlation{Lag: lag, N: len(scores)}
+		if c.N >= minCorrelationPairs {
+			c.Pearson = pearson(scores, returns)
+			c.Spearman = pearson(ranks(scores), ranks(returns))
+		}
+		correlations = append(correlations, c)
+	}
+
+	return correlations
+}
+
+// pearson returns the Pearson correlation coefficient of x and y, or 0 if it
+// is undefined.
+func pearson(x []float64, y []float64) float64 {
+	n := float64(len(x))
+	if len(x) < 2 || len(x) != len(y) {
+		return 0
+	}
+
+	var meanX, meanY float64
+	for i := range x {
+		meanX += x[i]
+		meanY += y[i]
+	}
+	meanX /= n
+	meanY /= n
+
+	var cov, varX, varY float64
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+
+	r := cov / math.Sqrt(varX*varY)
+	// Guard against rounding beyond [-1, 1].
+	return math.Max(-1, math.Min(1, r))
+}
+
+// ranks returns the (1-based) rank of each value, with tied values assigned
+// the mean of their ranks.
+func ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return values[order[i]] < values[order[j]]
+	})
+
+	ranked := make([]float64, len(values))
+	for i := 0; i < len(order); {
+		j := i
+		for j+1 < len(order) && values[order[j+1]] == values[order[i]] {
+			j++
+		}
+
+		// Positions i..j are tied: each gets the mean of ranks i+1..j+1.
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			ranked[order[k]] = rank
+		}
+		i = j + 1
+	}
+
+	return ranked
+}
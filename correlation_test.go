@@ -0,0 +1,174 @@
+package centiment
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPearson(t *testing.T) {
+	var tests = []struct {
+		name string
+		x    []float64
+		y    []float64
+		want float64
+	}{
+		{"perfectly correlated", []float64{1, 2, 3, 4}, []float64{2, 4, 6, 8}, 1},
+		{"perfectly anti-correlated", []float64{1, 2, 3, 4}, []float64{4, 3, 2, 1}, -1},
+		{"uncorrelated", []float64{1, 2, 3, 4}, []float64{1, -1, -1, 1}, 0},
+		{"constant", []float64{1, 1, 1}, []float64{1, 2, 3}, 0},
+		{"too few", []float64{1}, []float64{1}, 0},
+		{"mismatched", []float64{1, 2, 3}, []float64{1, 2}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := pearson(tt.x, tt.y); !approxEqual(got, tt.want) {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRanks(t *testing.T) {
+	got := ranks([]float64{0.5, -0.2, 0.5, 0.9, 0.5})
+	want := []float64{3, 1, 3, 5, 3}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("rank mismatch: got %v want %v", got, want)
+		}
+	}
+
+	// Spearman's correlation of a monotonic (but non-linear) relationship is 1.
+	x := []float64{1, 2, 3, 4, 5}
+	y := []float64{1, 8, 27, 64, 125}
+	if got := pearson(ranks(x), ranks(y)); !approxEqual(got, 1) {
+		t.Errorf("spearman mismatch: got %v want 1", got)
+	}
+}
+
+func TestCorrelate(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, loc := range []*time.Location{time.UTC, newYork, tokyo} {
+		t.Run(loc.String(), func(t *testing.T) {
+			testCorrelate(t, loc)
+		})
+	}
+}
+
+// testCorrelate correlates daily rollups in loc with daily bars, which are
+// stamped with their date at midnight UTC.
+func testCorrelate(t *testing.T, loc *time.Location) {
+	// The price moves in the direction of the previous day's sentiment, so that
+	// sentiment leads the price by a day.
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	days := 60
+
+	var (
+		rollups []*Rollup
+		prices  []*Price
+		last    = 100.0
+	)
+	scores := make([]float64, days)
+	for i := 0; i < days; i++ {
+		scores[i] = rng.Float64()*2 - 1
+		// Rollups are read back from the DB in UTC.
+		periodStart := time.Date(2018, 1, 1+i, 0, 0, 0, 0, loc).UTC()
+		rollups = append(rollups, &Rollup{Sentiment: Sentiment{Score: scores[i]}, Resolution: Daily, PeriodStart: periodStart})
+	}
+
+	for i := 0; i <= days+1; i++ {
+		if i >= 2 {
+			// The return over day i-1 follows the score of day i-2.
+			last *= 1 + scores[i-2]/10
+		}
+		prices = append(prices, &Price{Time: start.AddDate(0, 0, i-1), Close: last})
+	}
+
+	correlations := Correlate(rollups, prices, Daily, []int{0, 1}, loc)
+	if len(correlations) != 2 {
+		t.Fatalf("correlation count mismatch: got %d want 2", len(correlations))
+	}
+
+	lagged := correlations[1]
+	if lagged.Lag != 1 || lagged.N != days {
+		t.Errorf("unexpected lagged correlation: %+v", lagged)
+	}
+
+	if !approxEqual(lagged.Pearson, 1) || !approxEqual(lagged.Spearman, 1) {
+		t.Errorf("lagged correlation mismatch: got %+v want 1", lagged)
+	}
+
+	if same := correlations[0]; math.Abs(same.Pearson) > 0.5 || same.N != days {
+		t.Errorf("unexpected same-period correlation: %+v", same)
+	}
+
+	// Without enough prices, correlations are undefined.
+	sparse := Correlate(rollups, prices[:2], Daily, []int{0}, loc)
+	if sparse[0].N >= minCorrelationPairs || sparse[0].Pearson != 0 {
+		t.Errorf("unexpected correlation from sparse prices: %+v", sparse[0])
+	}
+}
+
+func TestPriceSeries(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Intraday bars belong to the day containing them in New York: the bar at
+	// 03:00 UTC on the 13th closes the 12th.
+	ps := newPriceSeries([]*Price{
+		{Time: time.Date(2018, 2, 12, 15, 0, 0, 0, time.UTC), Close: 100},
+		{Time: time.Date(2018, 2, 13, 3, 0, 0, 0, time.UTC), Close: 110},
+		{Time: time.Date(2018, 2, 13, 6, 0, 0, 0, time.UTC), Close: 99},
+	}, Daily, newYork)
+
+	var tests = []struct {
+		day  int
+		want float64
+		ok   bool
+	}{
+		{11, 0, false},
+		{12, 110, true},
+		{13, 99, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := ps.closeAt(time.Date(2018, 2, tt.day, 0, 0, 0, 0, newYork))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("close mismatch for the %dth: got %v (%v) want %v (%v)", tt.day, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if ret, ok := ps.periodReturn(time.Date(2018, 2, 13, 0, 0, 0, 0, newYork)); !ok || !approxEqual(ret, -0.1) {
+		t.Errorf("return mismatch: got %v (%v) want -0.1", ret, ok)
+	}
+}
+
+func TestParseLags(t *testing.T) {
+	lags, err := parseLags("0, 1,-2,1")
+	if err != nil {
+		t.Fatalf("failed to parse lags: %v", err)
+	}
+
+	if len(lags) != 3 || lags[0] != 0 || lags[1] != 1 || lags[2] != -2 {
+		t.Errorf("lag mismatch: got %v want [0 1 -2]", lags)
+	}
+
+	for _, param := range []string{"", "one", "49", "0,,1"} {
+		if _, err := parseLags(param); err == nil {
+			t.Errorf("expected %q to be invalid", param)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package centiment
+
+import (
+	"sort"
+	"strings"
+
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+)
+
+// maxCoEntities is the number of co-mentioned entities stored per Sentiment.
+const maxCoEntities = 10
+
+// EntityResult is the sentiment expressed towards an entity (e.g. a currency, a
+// person, or an organization) within a tweet.
+type EntityResult struct {
+	Name      string
+	Type      string
+	Salience  float32
+	Score     float32
+	Magnitude float32
+	// Matched is true if the entity matches the topic (or one of its aliases)
+	// the tweet was found for.
+	Matched bool
+}
+
+// CoEntity is an entity mentioned alongside a topic within a run.
+type CoEntity struct {
+	Name string `json:"name" firestore:"name"`
+	Type string `json:"type" firestore:"type"`
+	// The number of tweets the entity was mentioned in.
+	Count int64 `json:"count" firestore:"count"`
+	// The mean sentiment expressed towards the entity.
+	Score float64 `json:"score" firestore:"score"`
+}
+
+// newEntityResults converts the entities in a response, matching them against
+// the given search term.
+func newEntityResults(st *SearchTerm, entities []*languagepb.Entity) []EntityResult {
+	results := make([]EntityResult, 0, len(entities))
+	for _, e := range entities {
+		results = append(results, EntityResult{
+			Name:      e.GetName(),
+			Type:      e.GetType().String(),
+			Salience:  e.GetSalience(),
+			Score:     e.GetSentiment().GetScore(),
+			Magnitude: e.GetSentiment().GetMagnitude(),
+			Matched:   st.matchesEntity(e),
+		})
+	}
+
+	return results
+}
+
+// matchesEntity reports whether the entity (or any of its mentions) refers to
+// the topic.
+func (st *SearchTerm) matchesEntity(e *languagepb.Entity) bool {
+	names := make([]string, 0, len(e.GetMentions())+1)
+	names = append(names, e.GetName())
+	for _, m := range e.GetMentions() {
+		names = append(names, m.GetText().GetContent())
+	}
+
+	aliases := append([]string{st.Topic}, st.Aliases...)
+	for _, name := range names {
+		name = normalizeEntityName(name)
+		for _, alias := range aliases {
+			if name != "" && name == normalizeEntityName(alias) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// normalizeEntityName normalizes an entity name (or alias) for comparison:
+// case, surrounding whitespace and hashtag/cashtag prefixes are ignored.
+func normalizeEntityName(name string) string {
+	return strings.TrimLeft(strings.ToLower(strings.TrimSpace(name)), "#$")
+}
+
+// matchedEntitySentiment returns the mean sentiment expressed towards the
+// entities matching the topic, and false if there were none.
+func matchedEntitySentiment(entities []EntityResult) (score float32, magnitude float32, ok bool) {
+	var n int
+	for _, e := range entities {
+		if !e.Matched {
+			continue
+		}
+
+		score += e.Score
+		magnitude += e.Magnitude
+		n++
+	}
+
+	if n == 0 {
+		return 0, 0, false
+	}
+
+	return score / float32(n), magnitude / float32(n), true
+}
+
+// coEntityCounter accumulates the entities mentioned alongside a topic.
+type coEntityCounter map[string]*CoEntity
+
+// add records the (unmatched) entities in a tweet. Entities are counted at
+// most once per tweet.
+func (cc coEntityCounter) add(entities []EntityResult) {
+	seen := make(map[string]bool, len(entities))
+	for _, e := range entities {
+		key := normalizeEntityName(e.Name)
+		if e.Matched || key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		ce, ok := cc[key]
+		if !ok {
+			ce = &CoEntity{Name: e.Name, Type: e.Type}
+			cc[key] = ce
+		}
+
+		ce.Count++
+		ce.Score = updateAverage(e.Score, ce.Score, ce.Count)
+	}
+}
+
+// merge adds previously counted entities (e.g. from another Sentiment).
+func (cc coEntityCounter) merge(entities []CoEntity) {
+	for _, e := range entities {
+		key := normalizeEntityName(e.Name)
+		if key == "" || e.Count < 1 {
+			continue
+		}
+
+		ce, ok := cc[key]
+		if !ok {
+			ce = &CoEntity{Name: e.Name, Type: e.Type}
+			cc[key] = ce
+		}
+
+		count := ce.Count + e.Count
+		ce.Score = (ce.Score*float64(ce.Count) + e.Score*float64(e.Count)) / float64(count)
+		ce.Count = count
+	}
+}
+
+// top returns the n most frequently mentioned entities, ordered by count (and
+// then by name).
+func (cc coEntityCounter) top(n int) []CoEntity {
+	entities := make([]CoEntity, 0, len(cc))
+	for _, ce := range cc {
+		entities = append(entities, *ce)
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Count != entities[j].Count {
+			return entities[i].Count > entities[j].Count
+		}
+
+		return entities[i].Name < entities[j].Name
+	})
+
+	if len(entities) > n {
+		entities = entities[:n]
+	}
+
+	return entities
+}
@@ -0,0 +1,151 @@
+package centiment
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// maxExemplars is the maximum number of exemplar tweets kept per category.
+const maxExemplars = 50
+
+// Exemplar is a tweet that exemplifies a Sentiment: one of the most positive,
+// most negative or most intense (highest magnitude) tweets aggregated into it.
+type Exemplar struct {
+	// The ID of the tweet, serialized as a string in JSON to avoid losing
+	// precision in JavaScript clients.
+	TweetID   int64   `json:"tweetID,string" firestore:"tweetID"`
+	Score     float64 `json:"score" firestore:"score"`
+	Magnitude float64 `json:"magnitude" firestore:"magnitude"`
+}
+
+// The orderings of each category of exemplar: better exemplars sort first.
+// Ties are broken by tweet ID (newest first), so that exemplars are stable.
+var (
+	morePositive = func(a, b Exemplar) bool {
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.TweetID > b.TweetID
+	}
+	moreNegative = func(a, b Exemplar) bool {
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+		return a.TweetID > b.TweetID
+	}
+	moreIntense = func(a, b Exemplar) bool {
+		if a.Magnitude != b.Magnitude {
+			return a.Magnitude > b.Magnitude
+		}
+		return a.TweetID > b.TweetID
+	}
+)
+
+// topExemplars keeps the best k exemplars seen, as a bounded heap: the root is
+// the worst exemplar kept, which is replaced by any better exemplar once the
+// heap is full.
+type topExemplars struct {
+	k      int
+	better func(a, b Exemplar) bool
+	items  []Exemplar
+}
+
+func newTopExemplars(k int, better func(a, b Exemplar) bool) *topExemplars {
+	return &topExemplars{k: k, better: better, items: make([]Exemplar, 0, k)}
+}
+
+func (te *topExemplars) Len() int           { return len(te.items) }
+func (te *topExemplars) Less(i, j int) bool { return te.better(te.items[j], te.items[i]) }
+func (te *topExemplars) Swap(i, j int)      { te.items[i], te.items[j] = te.items[j], te.items[i] }
+
+func (te *topExemplars) Push(x interface{}) {
+	te.items = append(te.items, x.(Exemplar))
+}
+
+func (te *topExemplars) Pop() interface{} {
+	last := te.items[len(te.items)-1]
+	te.items = te.items[:len(te.items)-1]
+	return last
+}
+
+// add offers an exemplar, keeping it if it is among the best k seen.
+func (te *topExemplars) add(e Exemplar) {
+	if len(te.items) < te.k {
+		heap.Push(te, e)
+		return
+	}
+
+	if te.k > 0 && te.better(e, te.items[0]) {
+		te.items[0] = e
+		heap.Fix(te, 0)
+	}
+}
+
+// sorted returns the exemplars kept, best first.
+func (te *topExemplars) sorted() []Exemplar {
+	if len(te.items) == 0 {
+		return nil
+	}
+
+	sorted := append([]Exemplar{}, te.items...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return te.better(sorted[i], sorted[j])
+	})
+
+	return sorted
+}
+
+// exemplarSet keeps the exemplars of each category for a topic within a run.
+type exemplarSet struct {
+	positive *topExemplars
+	negative *topExemplars
+	intense  *topExemplars
+}
+
+func newExemplarSet(k int) *exemplarSet {
+	return &exemplarSet{
+		positive: newTopExemplars(k, morePositive),
+		negative: newTopExemplars(k, moreNegative),
+		intense:  newTopExemplars(k, moreIntense),
+	}
+}
+
+func (es *exemplarSet) add(res *AnalyzerResult) {
+	e := Exemplar{
+		TweetID:   res.TweetID,
+		Score:     float64(res.Score),
+		Magnitude: float64(res.Magnitude),
+	}
+
+	// Only positive tweets exemplify positive sentiment, and vice versa.
+	if e.Score > 0 {
+		es.positive.add(e)
+	}
+	if e.Score < 0 {
+		es.negative.add(e)
+	}
+	es.intense.add(e)
+}
+
+// mergeExemplars returns the best exemplars of a and b, keeping as many as the
+// longer of the two.
+func mergeExemplars(a []Exemplar, b []Exemplar, better func(a, b Exemplar) bool) []Exemplar {
+	k := len(a)
+	if len(b) > k {
+		k = len(b)
+	}
+
+	top := newTopExemplars(k, better)
+	seen := make(map[int64]bool, len(a)+len(b))
+	for _, list := range [][]Exemplar{a, b} {
+		for _, e := range list {
+			if seen[e.TweetID] {
+				continue
+			}
+			seen[e.TweetID] = true
+			top.add(e)
+		}
+	}
+
+	return top.sorted()
+}
@@ -0,0 +1,133 @@
+package centiment
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTopExemplars(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var all []Exemplar
+	top := newTopExemplars(5, morePositive)
+	for i := 0; i < 1000; i++ {
+		e := Exemplar{TweetID: int64(i), Score: float64(rng.Intn(200)-100) / 100}
+		all = append(all, e)
+		top.add(e)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return morePositive(all[i], all[j]) })
+
+	got := top.sorted()
+	if len(got) != 5 {
+		t.Fatalf("exemplar count mismatch: got %d want 5", len(got))
+	}
+
+	for i := range got {
+		if got[i] != all[i] {
+			t.Errorf("exemplar mismatch at %d: got %+v want %+v", i, got[i], all[i])
+		}
+	}
+}
+
+func TestAggregatorExemplars(t *testing.T) {
+	ag, err := NewAggregator(log.NewNopLogger(), newMemoryDB(), WithExemplars(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	tweets := []struct {
+		id        int64
+		score     float32
+		magnitude float32
+	}{
+		{962899347431616512, 0.9, 0.9},
+		{2, 0.4, 0.4},
+		{3, 0.7, 1.4},
+		{4, -0.6, 2.5},
+		{5, 0, 0.1},
+	}
+
+	results := make(chan *AnalyzerResult, len(tweets))
+	for _, tw := range tweets {
+		results <- &AnalyzerResult{TweetID: tw.id, Score: tw.score, Magnitude: tw.magnitude, SearchTerm: term}
+	}
+	close(results)
+
+	sentiments, err := ag.Collect(context.Background(), results)
+	if err != nil {
+		t.Fatalf("failed to collect: %v", err)
+	}
+
+	sentiment := sentiments[0]
+	ids := func(exemplars []Exemplar) []int64 {
+		var ids []int64
+		for _, e := range exemplars {
+			ids = append(ids, e.TweetID)
+		}
+		return ids
+	}
+
+	var tests = []struct {
+		name string
+		got  []Exemplar
+		want []int64
+	}{
+		{"most positive", sentiment.MostPositive, []int64{962899347431616512, 3}},
+		// Only one tweet is negative.
+		{"most negative", sentiment.MostNegative, []int64{4}},
+		{"most intense", sentiment.MostIntense, []int64{4, 3}},
+	}
+
+	for _, tt := range tests {
+		got := ids(tt.got)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+
+	// Tweet IDs are serialized as strings.
+	b, err := json.Marshal(sentiment)
+	if err != nil {
+		t.Fatalf("failed to marshal sentiment: %v", err)
+	}
+
+	if !strings.Contains(string(b), `"tweetID":"962899347431616512"`) {
+		t.Errorf("tweet ID not serialized as a string: %s", b)
+	}
+}
+
+func TestMergeExemplars(t *testing.T) {
+	a := []Exemplar{{TweetID: 1, Score: 0.9}, {TweetID: 2, Score: 0.5}, {TweetID: 3, Score: 0.2}}
+	b := []Exemplar{{TweetID: 4, Score: 0.7}, {TweetID: 1, Score: 0.9}}
+
+	got := mergeExemplars(a, b, morePositive)
+	want := []int64{1, 4, 2}
+	if len(got) != len(want) {
+		t.Fatalf("exemplar count mismatch: got %+v want %v", got, want)
+	}
+
+	for i := range got {
+		if got[i].TweetID != want[i] {
+			t.Errorf("exemplar mismatch at %d: got %+v want %d", i, got[i], want[i])
+		}
+	}
+
+	if got := mergeExemplars(nil, nil, morePositive); got != nil {
+		t.Errorf("unexpected exemplars: %+v", got)
+	}
+}
@@ -2,12 +2,15 @@ package centiment
 
 import (
 	"context"
+	"time"
 
 	"github.com/gosimple/slug"
 
 	"cloud.google.com/go/firestore"
 	"github.com/pkg/errors"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // SaveSentiment saves a Sentiment to the datastore, and returns generated ID of
@@ -46,6 +49,26 @@ func (fs *Firestore) GetSentimentsBySlug(ctx context.Context, topicSlug string,
 	return fs.getSentimentsByField(ctx, "slug", topicSlug, limit)
 }
 
+// GetSentimentsInRange fetches the sentiments for the given slug fetched at or
+// after after, and before before, up to limit records. Providing a limit of 0
+// (or less) will fetch all records. Records are ordered from most recent to
+// least recent.
+//
+// An error (ErrNoResultsFound) will be returned if no records were found.
+func (fs *Firestore) GetSentimentsInRange(ctx context.Context, topicSlug string, after time.Time, before time.Time, limit int) ([]*Sentiment, error) {
+	if !slug.IsSlug(topicSlug) {
+		return nil, errors.Wrapf(ErrInvalidSlug, "%s is not a valid URL slug", topicSlug)
+	}
+
+	query := fs.Store.Collection(fs.CollectionName).
+		Where("slug", "==", topicSlug).
+		Where("fetchedAt", ">=", after).
+		Where("fetchedAt", "<", before).
+		OrderBy("fetchedAt", firestore.Desc)
+
+	return fs.getSentiments(ctx, query, limit)
+}
+
 // getSentimentsByField returns a slice of Sentiments where field == name, ordered by the most recent timestamp up to limit.
 //
 // An error (ErrNoResultsFound) will be returned if no records were found.
@@ -53,12 +76,19 @@ func (fs *Firestore) getSentimentsByField(ctx context.Context, field string, nam
 	collection := fs.Store.Collection(fs.CollectionName)
 	query := collection.Where(field, "==", name).OrderBy("fetchedAt", firestore.Desc)
 
+	return fs.getSentiments(ctx, query, limit)
+}
+
+// getSentiments returns the Sentiments matching query, up to limit.
+//
+// An error (ErrNoResultsFound) will be returned if no records were found.
+func (fs *Firestore) getSentiments(ctx context.Context, query firestore.Query, limit int) ([]*Sentiment, error) {
 	if limit > 0 {
 		query = query.Limit(limit)
 	}
 
 	iter := query.Documents(ctx)
-	sentiments := make([]*Sentiment, 0, limit)
+	sentiments := make([]*Sentiment, 0)
 
 	// Fetch all Sentiments, marshalling them and appending to our
 	// result slice.
@@ -79,6 +109,7 @@ func (fs *Firestore) getSentimentsByField(ctx context.Context, field string, nam
 		}
 
 		result.ID = doc.Ref.ID
+		result.sanitize()
 		sentiments = append(sentiments, result)
 	}
 
@@ -119,3 +150,536 @@ func (fs *Firestore) GetSentimentByID(ctx context.Context, id string) (*Sentimen
 
 	return sentiment, nil
 }
+
+// SaveUsage saves (overwrites) the Natural Language API usage for a period.
+func (fs *Firestore) SaveUsage(ctx context.Context, usage Usage) error {
+	ref := fs.usageCollection().Doc(usage.Period)
+	if _, err := ref.Set(ctx, usage); err != nil {
+		return errors.Wrapf(err, "failed to save usage for period %s", usage.Period)
+	}
+
+	return nil
+}
+
+// GetUsage fetches the Natural Language API usage for a period.
+//
+// An error (ErrNoResultsFound) will be returned if no usage has been recorded
+// for the period.
+func (fs *Firestore) GetUsage(ctx context.Context, period string) (*Usage, error) {
+	doc, err := fs.usageCollection().Doc(period).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, ErrNoResultsFound
+		}
+
+		return nil, err
+	}
+
+	var usage *Usage
+	if err := doc.DataTo(&usage); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (fs *Firestore) usageCollection() *firestore.CollectionRef {
+	name := fs.UsageCollectionName
+	if name == "" {
+		name = "usage"
+	}
+
+	return fs.Store.Collection(name)
+}
+
+// SaveRollup saves (overwrites) a rollup.
+func (fs *Firestore) SaveRollup(ctx context.Context, rollup Rollup) error {
+	ref := fs.rollupCollection().Doc(rollup.ID)
+	if _, err := ref.Set(ctx, rollup); err != nil {
+		return errors.Wrapf(err, "failed to save rollup %s", rollup.ID)
+	}
+
+	return nil
+}
+
+// UpdateRollup atomically updates the rollup with the given ID, within a
+// transaction: update is called with the existing rollup (or nil, if there is
+// none), and returns the rollup to save. update may be called more than once
+// if the transaction is retried.
+func (fs *Firestore) UpdateRollup(ctx context.Context, id string, update func(existing *Rollup) (*Rollup, error)) error {
+	ref := fs.rollupCollection().Doc(id)
+	return fs.Store.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var existing *Rollup
+		doc, err := tx.Get(ref)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return err
+		default:
+			if err := doc.DataTo(&existing); err != nil {
+				return err
+			}
+			existing.ID = id
+		}
+
+		rollup, err := update(existing)
+		if err != nil {
+			return err
+		}
+
+		return tx.Set(ref, rollup)
+	})
+}
+
+// GetRollups fetches the rollups of the given resolution for a slug, for the
+// periods starting at or after after, and before before. Rollups are ordered
+// from most recent to least recent.
+//
+// An error (ErrNoResultsFound) will be returned if no rollups were found.
+func (fs *Firestore) GetRollups(ctx context.Context, topicSlug string, res Resolution, after time.Time, before time.Time) ([]*Rollup, error) {
+	if !slug.IsSlug(topicSlug) {
+		return nil, errors.Wrapf(ErrInvalidSlug, "%s is not a valid URL slug", topicSlug)
+	}
+
+	iter := fs.rollupCollection().
+		Where("slug", "==", topicSlug).
+		Where("resolution", "==", string(res)).
+		Where("periodStart", ">=", after).
+		Where("periodStart", "<", before).
+		OrderBy("periodStart", firestore.Desc).
+		Documents(ctx)
+
+	var rollups []*Rollup
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var rollup *Rollup
+		if err := doc.DataTo(&rollup); err != nil {
+			return nil, err
+		}
+
+		rollup.ID = doc.Ref.ID
+		rollup.sanitize()
+		rollups = append(rollups, rollup)
+	}
+
+	if len(rollups) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return rollups, nil
+}
+
+func (fs *Firestore) rollupCollection() *firestore.CollectionRef {
+	name := fs.RollupCollectionName
+	if name == "" {
+		name = "rollups"
+	}
+
+	return fs.Store.Collection(name)
+}
+
+// SaveAnomaly saves an Anomaly, and returns the generated ID of the new record.
+func (fs *Firestore) SaveAnomaly(ctx context.Context, anomaly Anomaly) (string, error) {
+	ref, _, err := fs.anomalyCollection().Add(ctx, anomaly)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to save anomaly (%#v)", anomaly)
+	}
+
+	return ref.ID, nil
+}
+
+// GetAnomaliesBySlug fetches the anomalies detected for the given slug, up to
+// limit records. Providing a limit of 0 (or less) will fetch all records.
+// Records are ordered from most recent to least recent.
+//
+// An error (ErrNoResultsFound) will be returned if no records were found.
+func (fs *Firestore) GetAnomaliesBySlug(ctx context.Context, topicSlug string, limit int) ([]*Anomaly, error) {
+	if !slug.IsSlug(topicSlug) {
+		return nil, errors.Wrapf(ErrInvalidSlug, "%s is not a valid URL slug", topicSlug)
+	}
+
+	query := fs.anomalyCollection().
+		Where("slug", "==", topicSlug).
+		OrderBy("detectedAt", firestore.Desc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	iter := query.Documents(ctx)
+	var anomalies []*Anomaly
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var anomaly *Anomaly
+		if err := doc.DataTo(&anomaly); err != nil {
+			return nil, err
+		}
+
+		anomaly.ID = doc.Ref.ID
+		anomalies = append(anomalies, anomaly)
+	}
+
+	if len(anomalies) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return anomalies, nil
+}
+
+func (fs *Firestore) anomalyCollection() *firestore.CollectionRef {
+	name := fs.AnomalyCollectionName
+	if name == "" {
+		name = "anomalies"
+	}
+
+	return fs.Store.Collection(name)
+}
+
+// SaveAlert saves an Alert, keyed by its ID: saving an alert again (e.g. after
+// a retried delivery) overwrites the existing record.
+func (fs *Firestore) SaveAlert(ctx context.Context, alert Alert) error {
+	if alert.ID == "" {
+		return errors.New("alerts must have an ID")
+	}
+
+	if _, err := fs.alertCollection().Doc(alert.ID).Set(ctx, alert); err != nil {
+		return errors.Wrapf(err, "failed to save alert (%#v)", alert)
+	}
+
+	return nil
+}
+
+// GetAlertsBySlug fetches the alerts triggered by the named rule for the given
+// slug, up to limit records. Providing an empty rule will fetch the alerts of
+// every rule, and a limit of 0 (or less) will fetch all records. Records are
+// ordered from most recent to least recent.
+//
+// An error (ErrNoResultsFound) will be returned if no records were found.
+func (fs *Firestore) GetAlertsBySlug(ctx context.Context, topicSlug string, rule string, limit int) ([]*Alert, error) {
+	if !slug.IsSlug(topicSlug) {
+		return nil, errors.Wrapf(ErrInvalidSlug, "%s is not a valid URL slug", topicSlug)
+	}
+
+	query := fs.alertCollection().Where("slug", "==", topicSlug)
+	if rule != "" {
+		query = query.Where("rule", "==", rule)
+	}
+
+	query = query.OrderBy("triggeredAt", firestore.Desc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	iter := query.Documents(ctx)
+	var alerts []*Alert
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var alert *Alert
+		if err := doc.DataTo(&alert); err != nil {
+			return nil, err
+		}
+
+		alert.ID = doc.Ref.ID
+		alerts = append(alerts, alert)
+	}
+
+	if len(alerts) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return alerts, nil
+}
+
+func (fs *Firestore) alertCollection() *firestore.CollectionRef {
+	name := fs.AlertCollectionName
+	if name == "" {
+		name = "alerts"
+	}
+
+	return fs.Store.Collection(name)
+}
+
+// SaveTweetAnalyses saves the given records, keyed by their IDs, in a single
+// batched write of up to 500 records.
+func (fs *Firestore) SaveTweetAnalyses(ctx context.Context, analyses []*TweetAnalysis) error {
+	if len(analyses) == 0 {
+		return nil
+	}
+
+	if len(analyses) > maxTweetBatch {
+		return errors.Errorf("cannot save more than %d tweets per batch: got %d", maxTweetBatch, len(analyses))
+	}
+
+	batch := fs.Store.Batch()
+	for _, ta := range analyses {
+		batch.Set(fs.tweetCollection().Doc(ta.ID), ta)
+	}
+
+	if _, err := batch.Commit(ctx); err != nil {
+		return errors.Wrapf(err, "failed to save %d tweets", len(analyses))
+	}
+
+	return nil
+}
+
+// GetTweetAnalysesByRun fetches the records of the tweets analyzed in the given
+// run for a topic (by slug), up to limit records. Providing an empty slug will
+// fetch the records for every topic, and a limit of 0 (or less) will fetch all
+// records.
+//
+// An error (ErrNoResultsFound) will be returned if no records were found.
+func (fs *Firestore) GetTweetAnalysesByRun(ctx context.Context, runID string, slug string, limit int) ([]*TweetAnalysis, error) {
+	query := fs.tweetCollection().Where("runID", "==", runID)
+	if slug != "" {
+		query = query.Where("slug", "==", slug)
+	}
+
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	iter := query.Documents(ctx)
+	var analyses []*TweetAnalysis
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var ta *TweetAnalysis
+		if err := doc.DataTo(&ta); err != nil {
+			return nil, err
+		}
+
+		ta.ID = doc.Ref.ID
+		analyses = append(analyses, ta)
+	}
+
+	if len(analyses) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return analyses, nil
+}
+
+// DeleteTweetAnalysesBefore deletes up to limit (at most 500) records analyzed
+// before the given time, and returns the number deleted.
+func (fs *Firestore) DeleteTweetAnalysesBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	if limit < 1 || limit > maxTweetBatch {
+		return 0, errors.Errorf("limit must be between 1 and %d", maxTweetBatch)
+	}
+
+	docs, err := fs.tweetCollection().
+		Where("analyzedAt", "<", before).
+		Limit(limit).
+		Documents(ctx).
+		GetAll()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to fetch expired tweets")
+	}
+
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	batch := fs.Store.Batch()
+	for _, doc := range docs {
+		batch.Delete(doc.Ref)
+	}
+
+	if _, err := batch.Commit(ctx); err != nil {
+		return 0, errors.Wrapf(err, "failed to delete %d expired tweets", len(docs))
+	}
+
+	return len(docs), nil
+}
+
+func (fs *Firestore) tweetCollection() *firestore.CollectionRef {
+	name := fs.TweetCollectionName
+	if name == "" {
+		name = "tweets"
+	}
+
+	return fs.Store.Collection(name)
+}
+
+// SaveRun saves a Run, keyed by its ID: saving a run again (e.g. when it
+// finishes) overwrites the existing record.
+func (fs *Firestore) SaveRun(ctx context.Context, run Run) error {
+	if run.ID == "" {
+		return errors.New("runs must have an ID")
+	}
+
+	if _, err := fs.runCollection().Doc(run.ID).Set(ctx, run); err != nil {
+		return errors.Wrapf(err, "failed to save run %s", run.ID)
+	}
+
+	return nil
+}
+
+// GetRun fetches the Run with the given ID.
+//
+// An error (ErrNoResultsFound) will be returned if no run was found.
+func (fs *Firestore) GetRun(ctx context.Context, id string) (*Run, error) {
+	doc, err := fs.runCollection().Doc(id).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, ErrNoResultsFound
+		}
+
+		return nil, errors.Wrapf(err, "failed to fetch run %s", id)
+	}
+
+	var run *Run
+	if err := doc.DataTo(&run); err != nil {
+		return nil, err
+	}
+	run.ID = doc.Ref.ID
+
+	return run, nil
+}
+
+// GetRuns fetches the most recent runs, up to limit records. Providing a limit
+// of 0 (or less) will fetch all records. Records are ordered from most recent
+// to least recent.
+//
+// An error (ErrNoResultsFound) will be returned if no records were found.
+func (fs *Firestore) GetRuns(ctx context.Context, limit int) ([]*Run, error) {
+	query := fs.runCollection().OrderBy("startedAt", firestore.Desc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	iter := query.Documents(ctx)
+	var runs []*Run
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var run *Run
+		if err := doc.DataTo(&run); err != nil {
+			return nil, err
+		}
+
+		run.ID = doc.Ref.ID
+		runs = append(runs, run)
+	}
+
+	if len(runs) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return runs, nil
+}
+
+func (fs *Firestore) runCollection() *firestore.CollectionRef {
+	name := fs.RunCollectionName
+	if name == "" {
+		name = "runs"
+	}
+
+	return fs.Store.Collection(name)
+}
+
+// SavePrices saves (or overwrites) the given prices, in a single batch.
+func (fs *Firestore) SavePrices(ctx context.Context, prices []*Price) error {
+	if len(prices) == 0 {
+		return nil
+	}
+
+	if len(prices) > maxPriceBatch {
+		return errors.Errorf("cannot save more than %d prices per batch: got %d", maxPriceBatch, len(prices))
+	}
+
+	batch := fs.Store.Batch()
+	for _, p := range prices {
+		batch.Set(fs.priceCollection().Doc(p.ID), p)
+	}
+
+	if _, err := batch.Commit(ctx); err != nil {
+		return errors.Wrapf(err, "failed to save %d prices", len(prices))
+	}
+
+	return nil
+}
+
+// GetPricesInRange fetches the prices of a symbol from the time range [after,
+// before), ordered from oldest to newest.
+//
+// An error (ErrNoResultsFound) will be returned if no prices were found.
+func (fs *Firestore) GetPricesInRange(ctx context.Context, symbol string, after time.Time, before time.Time) ([]*Price, error) {
+	iter := fs.priceCollection().
+		Where("symbol", "==", symbol).
+		Where("time", ">=", after).
+		Where("time", "<", before).
+		OrderBy("time", firestore.Asc).
+		Documents(ctx)
+
+	var prices []*Price
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var price *Price
+		if err := doc.DataTo(&price); err != nil {
+			return nil, err
+		}
+
+		price.ID = doc.Ref.ID
+		prices = append(prices, price)
+	}
+
+	if len(prices) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return prices, nil
+}
+
+func (fs *Firestore) priceCollection() *firestore.CollectionRef {
+	name := fs.PriceCollectionName
+	if name == "" {
+		name = "prices"
+	}
+
+	return fs.Store.Collection(name)
+}
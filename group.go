@@ -0,0 +1,194 @@
+package centiment
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gosimple/slug"
+	"github.com/pkg/errors"
+)
+
+// TopicGroup is a named group of topics (e.g. "Crypto"), and of other groups,
+// for which a group-level Sentiment is produced each run (see WithGroups).
+type TopicGroup struct {
+	// The human-readable name of the group.
+	Name string
+	// The topics (see SearchTerm.Topic) in the group.
+	Topics []string
+	// The names of the groups nested in the group: their topics are members of
+	// this group too.
+	Groups []string
+}
+
+// GroupMember is the breakdown of a group-level Sentiment by one of the group's
+// (direct) members: a topic, or a nested group.
+type GroupMember struct {
+	Topic string `json:"topic" firestore:"topic"`
+	Slug  string `json:"slug" firestore:"slug"`
+	// Group is set when the member is a nested group.
+	Group bool    `json:"group" firestore:"group"`
+	Count int64   `json:"count" firestore:"count"`
+	Score float64 `json:"score" firestore:"score"`
+	// The member's share of the group's tweets. Shares only sum to more than 1
+	// when nested groups share topics.
+	Share float64 `json:"share" firestore:"share"`
+}
+
+// topicGroup is a validated TopicGroup, with its members resolved to slugs.
+type topicGroup struct {
+	name string
+	slug string
+	// The slugs of the group's direct topics and nested groups.
+	topics []string
+	groups []string
+	// The slugs of every topic in the group, including those of nested groups,
+	// without duplicates.
+	leaves []string
+}
+
+// resolveGroups validates the given groups against the search terms, and
+// returns them ordered such that nested groups precede the groups they are
+// nested in.
+func resolveGroups(groups []*TopicGroup, terms []*SearchTerm) ([]*topicGroup, error) {
+	topics := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		topics[slug.Make(term.Topic)] = true
+	}
+
+	byName := make(map[string]*TopicGroup, len(groups))
+	for _, g := range groups {
+		groupSlug := slug.Make(g.Name)
+		if groupSlug == "" {
+			return nil, errors.New("group names must not be empty")
+		}
+
+		if topics[groupSlug] {
+			return nil, errors.Errorf("group %q has the same slug as a topic", g.Name)
+		}
+
+		if byName[groupSlug] != nil {
+			return nil, errors.Errorf("duplicate group %q", g.Name)
+		}
+
+		if len(g.Topics) == 0 && len(g.Groups) == 0 {
+			return nil, errors.Errorf("group %q has no topics or groups", g.Name)
+		}
+
+		for _, topic := range g.Topics {
+			if !topics[slug.Make(topic)] {
+				return nil, errors.Errorf("group %q has an unknown topic %q", g.Name, topic)
+			}
+		}
+
+		byName[groupSlug] = g
+	}
+
+	var (
+		resolved = make([]*topicGroup, 0, len(groups))
+		done     = make(map[string]*topicGroup, len(groups))
+		visiting = make(map[string]bool)
+		resolve  func(g *TopicGroup) (*topicGroup, error)
+	)
+
+	// Resolve nested groups depth-first, so that they are ordered first.
+	resolve = func(g *TopicGroup) (*topicGroup, error) {
+		groupSlug := slug.Make(g.Name)
+		if tg := done[groupSlug]; tg != nil {
+			return tg, nil
+		}
+
+		if visiting[groupSlug] {
+			return nil, errors.Errorf("group %q is nested in itself", g.Name)
+		}
+		visiting[groupSlug] = true
+
+		tg := &topicGroup{name: g.Name, slug: groupSlug}
+		leaves := make(map[string]bool)
+		for _, topic := range g.Topics {
+			topicSlug := slug.Make(topic)
+			tg.topics = append(tg.topics, topicSlug)
+			leaves[topicSlug] = true
+		}
+
+		for _, name := range g.Groups {
+			nested := byName[slug.Make(name)]
+			if nested == nil {
+				return nil, errors.Errorf("group %q has an unknown group %q", g.Name, name)
+			}
+
+			ntg, err := resolve(nested)
+			if err != nil {
+				return nil, err
+			}
+
+			tg.groups = append(tg.groups, ntg.slug)
+			for _, leaf := range ntg.leaves {
+				leaves[leaf] = true
+			}
+		}
+
+		for leaf := range leaves {
+			tg.leaves = append(tg.leaves, leaf)
+		}
+		sort.Strings(tg.leaves)
+
+		visiting[groupSlug] = false
+		done[groupSlug] = tg
+		resolved = append(resolved, tg)
+
+		return tg, nil
+	}
+
+	for _, g := range groups {
+		if _, err := resolve(g); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolved, nil
+}
+
+// aggregate produces the group-level Sentiment for a run by merging the
+// Sentiments of the group's topics, each counted once, and breaks it down by
+// the group's members. bySlug holds the run's topic Sentiments, and the
+// group-level Sentiments of nested groups. It returns nil if none of the
+// group's topics were collected.
+func (tg *topicGroup) aggregate(bySlug map[string]*Sentiment) *Sentiment {
+	group := &Sentiment{
+		Topic: strings.TrimSpace(strings.ToLower(tg.name)),
+		Slug:  tg.slug,
+		Group: true,
+	}
+
+	for _, leaf := range tg.leaves {
+		group.Merge(bySlug[leaf])
+	}
+
+	if group.Count == 0 {
+		return nil
+	}
+
+	// Groups do not search, so have no checkpoint.
+	group.LastSeenID = 0
+
+	members := make([]string, 0, len(tg.topics)+len(tg.groups))
+	members = append(members, tg.topics...)
+	members = append(members, tg.groups...)
+	for _, memberSlug := range members {
+		member := bySlug[memberSlug]
+		if member == nil {
+			continue
+		}
+
+		group.Members = append(group.Members, &GroupMember{
+			Topic: member.Topic,
+			Slug:  member.Slug,
+			Group: member.Group,
+			Count: member.Count,
+			Score: member.Score,
+			Share: float64(member.Count) / float64(group.Count),
+		})
+	}
+
+	return group
+}
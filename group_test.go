@@ -0,0 +1,133 @@
+package centiment
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+var groupTerms = []*SearchTerm{
+	{Topic: "Bitcoin", Query: "bitcoin"},
+	{Topic: "Ethereum", Query: "ethereum"},
+	{Topic: "Ripple", Query: "ripple"},
+}
+
+func TestResolveGroups(t *testing.T) {
+	var tests = []struct {
+		name   string
+		groups []*TopicGroup
+		order  []string
+		ok     bool
+	}{
+		{"flat", []*TopicGroup{{Name: "Crypto", Topics: []string{"Bitcoin", "Ethereum"}}}, []string{"crypto"}, true},
+		{"nested", []*TopicGroup{
+			{Name: "Crypto", Topics: []string{"Bitcoin"}, Groups: []string{"Altcoins"}},
+			{Name: "Altcoins", Topics: []string{"ethereum", "Ripple"}},
+		}, []string{"altcoins", "crypto"}, true},
+		{"unnamed", []*TopicGroup{{Topics: []string{"Bitcoin"}}}, nil, false},
+		{"empty", []*TopicGroup{{Name: "Crypto"}}, nil, false},
+		{"unknown topic", []*TopicGroup{{Name: "Crypto", Topics: []string{"Dogecoin"}}}, nil, false},
+		{"unknown group", []*TopicGroup{{Name: "Crypto", Groups: []string{"Altcoins"}}}, nil, false},
+		{"topic slug", []*TopicGroup{{Name: "bitcoin", Topics: []string{"Bitcoin"}}}, nil, false},
+		{"duplicate", []*TopicGroup{{Name: "Crypto", Topics: []string{"Bitcoin"}}, {Name: "crypto", Topics: []string{"Ripple"}}}, nil, false},
+		{"cycle", []*TopicGroup{
+			{Name: "A", Topics: []string{"Bitcoin"}, Groups: []string{"B"}},
+			{Name: "B", Topics: []string{"Ripple"}, Groups: []string{"A"}},
+		}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, err := resolveGroups(tt.groups, groupTerms)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got err %v, want ok %t", err, tt.ok)
+			}
+
+			if len(groups) != len(tt.order) {
+				t.Fatalf("group count mismatch: got %d want %d", len(groups), len(tt.order))
+			}
+
+			for i, tg := range groups {
+				if tg.slug != tt.order[i] {
+					t.Errorf("group order mismatch at %d: got %q want %q", i, tg.slug, tt.order[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAggregatorGroups(t *testing.T) {
+	groups := []*TopicGroup{
+		{Name: "Altcoins", Topics: []string{"Ethereum", "Ripple"}},
+		// Ethereum is a member of Crypto twice over, but only counted once.
+		{Name: "Crypto", Topics: []string{"Bitcoin", "Ethereum"}, Groups: []string{"Altcoins"}},
+	}
+
+	ag, err := NewAggregator(log.NewNopLogger(), newMemoryDB(), WithGroups(groups, groupTerms))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	var all []*AnalyzerResult
+	for i, term := range groupTerms {
+		all = append(all, randomResults(rng, term, 20*(i+1))...)
+	}
+
+	results := make(chan *AnalyzerResult, len(all))
+	for _, res := range all {
+		results <- res
+	}
+	close(results)
+
+	sentiments, err := ag.Collect(ContextWithRunID(context.Background(), "run"), results)
+	if err != nil {
+		t.Fatalf("failed to collect: %v", err)
+	}
+
+	bySlug := make(map[string]*Sentiment)
+	for _, s := range sentiments {
+		bySlug[s.Slug] = s
+	}
+
+	if len(sentiments) != 5 {
+		t.Fatalf("sentiment count mismatch: got %d want 5", len(sentiments))
+	}
+
+	crypto := bySlug["crypto"]
+	want := aggregate(t, all)
+	if !crypto.Group || crypto.RunID != "run" || crypto.Count != 120 || !approxEqual(crypto.Score, want.Score) || !approxEqual(crypto.Variance, want.Variance) {
+		t.Errorf("unexpected group sentiment: %+v", crypto)
+	}
+
+	if crypto.LastSeenID != 0 || crypto.Query != "" {
+		t.Errorf("group has search metadata: %+v", crypto)
+	}
+
+	var members = []struct {
+		slug  string
+		group bool
+		count int64
+	}{
+		{"bitcoin", false, 20},
+		{"ethereum", false, 40},
+		{"altcoins", true, 100},
+	}
+
+	if len(crypto.Members) != len(members) {
+		t.Fatalf("member count mismatch: got %d want %d", len(crypto.Members), len(members))
+	}
+
+	for i, m := range members {
+		got := crypto.Members[i]
+		if got.Slug != m.slug || got.Group != m.group || got.Count != m.count || !approxEqual(got.Share, float64(m.count)/120) {
+			t.Errorf("unexpected member: got %+v want %+v", got, m)
+		}
+	}
+
+	if altcoins := bySlug["altcoins"]; altcoins.Count != 100 || len(altcoins.Members) != 2 {
+		t.Errorf("unexpected nested group sentiment: %+v", altcoins)
+	}
+}
@@ -0,0 +1,346 @@
+package centiment
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// The kinds of keyword extracted from tweets.
+const (
+	KeywordWord    = "word"
+	KeywordPhrase  = "phrase"
+	KeywordHashtag = "hashtag"
+	KeywordCashtag = "cashtag"
+	KeywordMention = "mention"
+)
+
+// keywordKinds are the kinds of keyword, in the order they are stored.
+var keywordKinds = []string{KeywordWord, KeywordPhrase, KeywordHashtag, KeywordCashtag, KeywordMention}
+
+// Keyword is a term that people talked about in a run: a word (unigram), a
+// phrase (bigram), a hashtag, a cashtag (e.g. "$BTC") or a mention.
+type Keyword struct {
+	Term string `json:"term" firestore:"term"`
+	Kind string `json:"kind" firestore:"kind"`
+	// The number of tweets the keyword appeared in, and their share of the
+	// Sentiment's Count.
+	Count int64   `json:"count" firestore:"count"`
+	Share float64 `json:"share" firestore:"share"`
+	// The keyword's share of tweets relative to its share over the topic's
+	// previous runs (see KeywordExtractor): 2 means the keyword is twice as
+	// common as usual. Lift is 0 when the topic has no history.
+	Lift float64 `json:"lift" firestore:"lift"`
+}
+
+var (
+	urlPattern     = regexp.MustCompile(`https?://\S+`)
+	hashtagPattern = regexp.MustCompile(`#([\pL\pN_]+)`)
+	cashtagPattern = regexp.MustCompile(`\$([A-Za-z][A-Za-z0-9]{0,9})\b`)
+	mentionPattern = regexp.MustCompile(`@([A-Za-z0-9_]{1,15})`)
+	// Words are runs of letters (allowing apostrophes & hyphens within them),
+	// so that numbers, prices & punctuation are skipped. Tags are matched (and
+	// skipped) so that they aren't also counted as words.
+	wordPattern = regexp.MustCompile(`[#$@]?[\pL\pN_]+(?:['’-][\pL]+)*`)
+)
+
+// stopWords are the (English) words too common to be keywords, along with
+// Twitter-specific noise.
+var stopWords = func() map[string]bool {
+	words := strings.Fields(`
+		a about above after again against all am an and any are aren't as at be
+		because been before being below between both but by can can't cannot
+		could couldn't did didn't do does doesn't doing don't down during each
+		few for from further get gets got had hadn't has hasn't have haven't
+		having he he'd he'll he's her here here's hers herself him himself his
+		how how's i i'd i'll i'm i've if in into is isn't it it's its itself
+		just let's like me more most mustn't my myself no nor not now of off on
+		once only or other ought our ours ourselves out over own same shan't she
+		she'd she'll she's should shouldn't so some such than that that's the
+		their theirs them themselves then there there's these they they'd
+		they'll they're they've this those through to too under until up very
+		was wasn't we we'd we'll we're we've were weren't what what's when
+		when's where where's which while who who's whom why why's will with
+		won't would wouldn't you you'd you'll you're you've your yours yourself
+		yourselves also amp via rt u ur im dont cant wont ive youre thats
+		gonna wanna lol
+	`)
+
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+
+	return set
+}()
+
+// extractKeywords returns the distinct keywords in a tweet, keyed by kind and
+// term. Terms in ignore (e.g. the topic itself) are skipped.
+func extractKeywords(text string, ignore map[string]bool) map[string]string {
+	keywords := make(map[string]string)
+	add := func(kind string, term string) {
+		if !ignore[term] {
+			keywords[kind+":"+term] = kind
+		}
+	}
+
+	text = urlPattern.ReplaceAllString(text, " ")
+	for _, m := range hashtagPattern.FindAllStringSubmatch(text, -1) {
+		add(KeywordHashtag, strings.ToLower(m[1]))
+	}
+	for _, m := range cashtagPattern.FindAllStringSubmatch(text, -1) {
+		add(KeywordCashtag, strings.ToUpper(m[1]))
+	}
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		add(KeywordMention, strings.ToLower(m[1]))
+	}
+
+	// Phrases are pairs of adjacent (distinct) words, neither of which is a stop
+	// word.
+	var previous string
+	for _, token := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+		token = strings.Replace(token, "’", "'", -1)
+		if strings.ContainsAny(token[:1], "#$@") || !isWord(token) || stopWords[token] {
+			previous = ""
+			continue
+		}
+
+		add(KeywordWord, token)
+		if previous != "" && previous != token && !ignore[previous] && !ignore[token] {
+			add(KeywordPhrase, previous+" "+token)
+		}
+		previous = token
+	}
+
+	return keywords
+}
+
+// isWord reports whether a token is a word: at least two characters, and not
+// a number.
+func isWord(token string) bool {
+	if len(token) < 2 {
+		return false
+	}
+
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// topicTerms returns the terms that refer to the topic of a search term (its
+// topic & aliases), which are excluded from its keywords.
+func topicTerms(st *SearchTerm) map[string]bool {
+	terms := make(map[string]bool)
+	for _, name := range append([]string{st.Topic}, st.Aliases...) {
+		name = strings.TrimLeft(strings.TrimSpace(name), "#$@")
+		terms[strings.ToLower(name)] = true
+		terms[strings.ToUpper(name)] = true
+	}
+
+	return terms
+}
+
+// keywordCounter accumulates the keywords in the tweets of a topic.
+type keywordCounter map[string]*Keyword
+
+// add counts the keywords in a tweet. Keywords are counted at most once per
+// tweet.
+func (kc keywordCounter) add(text string, ignore map[string]bool) {
+	for key, kind := range extractKeywords(text, ignore) {
+		kw, ok := kc[key]
+		if !ok {
+			kw = &Keyword{Term: key[len(kind)+1:], Kind: kind}
+			kc[key] = kw
+		}
+		kw.Count++
+	}
+}
+
+// merge adds previously counted keywords (e.g. from another Sentiment).
+func (kc keywordCounter) merge(keywords []Keyword) {
+	for _, k := range keywords {
+		key := k.Kind + ":" + k.Term
+		kw, ok := kc[key]
+		if !ok {
+			kw = &Keyword{Term: k.Term, Kind: k.Kind}
+			kc[key] = kw
+		}
+		kw.Count += k.Count
+	}
+}
+
+// top returns the n most common keywords of each kind, ordered by kind, then
+// by count (and then by term), with their share of count tweets.
+func (kc keywordCounter) top(n int, count int64) []Keyword {
+	byKind := make(map[string][]Keyword, len(keywordKinds))
+	for _, kw := range kc {
+		byKind[kw.Kind] = append(byKind[kw.Kind], *kw)
+	}
+
+	var keywords []Keyword
+	for _, kind := range keywordKinds {
+		kws := byKind[kind]
+		sort.Slice(kws, func(i, j int) bool {
+			if kws[i].Count != kws[j].Count {
+				return kws[i].Count > kws[j].Count
+			}
+
+			return kws[i].Term < kws[j].Term
+		})
+
+		if len(kws) > n {
+			kws = kws[:n]
+		}
+
+		for _, kw := range kws {
+			if count > 0 {
+				kw.Share = float64(kw.Count) / float64(count)
+			}
+			keywords = append(keywords, kw)
+		}
+	}
+
+	return keywords
+}
+
+// maxKeywordsPerKind returns the largest number of keywords of any one kind in
+// keywords.
+func maxKeywordsPerKind(keywords []Keyword) int {
+	counts := make(map[string]int)
+	var max int
+	for _, kw := range keywords {
+		counts[kw.Kind]++
+		if counts[kw.Kind] > max {
+			max = counts[kw.Kind]
+		}
+	}
+
+	return max
+}
+
+// KeywordExtractor extracts the keywords (see Keyword) that people talked about
+// in each run, and computes their lift relative to the topic's previous runs.
+type KeywordExtractor struct {
+	logger log.Logger
+	db     DB
+	n      int
+	window int
+}
+
+// KeywordOption configures a KeywordExtractor.
+type KeywordOption func(*KeywordExtractor)
+
+// WithKeywordCount sets the number of keywords of each kind stored per run, up
+// to 50.
+func WithKeywordCount(n int) KeywordOption {
+	return func(ke *KeywordExtractor) {
+		ke.n = n
+	}
+}
+
+// WithKeywordBaseline sets the number of previous runs that keyword lift is
+// computed against.
+func WithKeywordBaseline(window int) KeywordOption {
+	return func(ke *KeywordExtractor) {
+		ke.window = window
+	}
+}
+
+// NewKeywordExtractor creates a new KeywordExtractor. By default, the top 10
+// keywords of each kind are stored per run, and their lift is computed against
+// the previous 144 runs (a day, at 10 minute intervals).
+func NewKeywordExtractor(logger log.Logger, db DB, opts ...KeywordOption) (*KeywordExtractor, error) {
+	if db == nil {
+		return nil, errors.New("keywords: db must not be nil")
+	}
+
+	ke := &KeywordExtractor{
+		logger: logger,
+		db:     db,
+		n:      10,
+		window: 144,
+	}
+
+	for _, opt := range opts {
+		opt(ke)
+	}
+
+	if ke.n < 1 || ke.n > 50 {
+		return nil, errors.New("keywords: keyword count must be between 1 and 50")
+	}
+
+	if ke.window < 1 {
+		return nil, errors.New("keywords: baseline window must be > 0")
+	}
+
+	return ke, nil
+}
+
+// Lift computes the lift of each keyword of an (unsaved) Sentiment against the
+// topic's previous runs. Partial Sentiments (from cancelled runs) are excluded
+// from the baseline.
+//
+// Only the top keywords of each run are stored, so a keyword missing from a
+// previous run is counted as absent from it: the baseline share is smoothed
+// (by one tweet) so that keywords new to the topic have a large, but finite,
+// lift.
+func (ke *KeywordExtractor) Lift(ctx context.Context, sentiment *Sentiment) error {
+	if len(sentiment.Keywords) == 0 || sentiment.Count == 0 {
+		return nil
+	}
+
+	// Fetch extra Sentiments, as the baseline excludes the Sentiment being
+	// lifted, and any partial Sentiments.
+	history, err := ke.db.GetSentimentsBySlug(ctx, sentiment.Slug, ke.window*2+1)
+	if err != nil {
+		if errors.Cause(err) == ErrNoResultsFound {
+			return nil
+		}
+
+		return errors.Wrap(err, "failed to fetch keyword baseline")
+	}
+
+	var (
+		runs     int
+		tweets   int64
+		baseline = make(keywordCounter)
+	)
+	for _, s := range history {
+		if (sentiment.ID != "" && s.ID == sentiment.ID) || s.Partial || runs == ke.window {
+			continue
+		}
+
+		runs++
+		if len(s.Keywords) == 0 {
+			continue
+		}
+
+		tweets += s.Count
+		baseline.merge(s.Keywords)
+	}
+
+	if tweets == 0 {
+		return nil
+	}
+
+	for i := range sentiment.Keywords {
+		kw := &sentiment.Keywords[i]
+		var count int64
+		if base, ok := baseline[kw.Kind+":"+kw.Term]; ok {
+			count = base.Count
+		}
+
+		share := float64(count+1) / float64(tweets+1)
+		kw.Lift = kw.Share / share
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package centiment
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestExtractKeywords(t *testing.T) {
+	var tests = []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			"words & phrases",
+			"Halving countdown: the halving is near!",
+			[]string{"phrase:halving countdown", "word:countdown", "word:halving", "word:near"},
+		},
+		{
+			"tags",
+			"Buying cheap $eth & $BTC with @Coinbase #HODL #crypto https://t.co/abc123",
+			[]string{"cashtag:ETH", "hashtag:crypto", "hashtag:hodl", "mention:coinbase", "phrase:buying cheap", "word:buying", "word:cheap"},
+		},
+		{
+			"topic excluded",
+			"Bitcoin price surges past $10,000 #bitcoin",
+			[]string{"phrase:price surges", "phrase:surges past", "word:past", "word:price", "word:surges"},
+		},
+		{
+			"stop words & numbers",
+			"RT it's 2018 and I'm still here",
+			[]string{"word:still"},
+		},
+	}
+
+	ignore := topicTerms(&SearchTerm{Topic: "Bitcoin", Aliases: []string{"$BTC", "#bitcoin"}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for key := range extractKeywords(tt.text, ignore) {
+				got = append(got, key)
+			}
+			sort.Strings(got)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("keyword mismatch: got %q want %q", got, tt.want)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("keyword mismatch: got %q want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeywordCounter(t *testing.T) {
+	kc := make(keywordCounter)
+	for _, text := range []string{
+		"halving halving #crypto",
+		"halving soon #crypto",
+		"moon soon",
+		"moon",
+	} {
+		kc.add(text, nil)
+	}
+
+	got := kc.top(2, 4)
+	want := []Keyword{
+		{Term: "halving", Kind: KeywordWord, Count: 2, Share: 0.5},
+		{Term: "moon", Kind: KeywordWord, Count: 2, Share: 0.5},
+		{Term: "halving soon", Kind: KeywordPhrase, Count: 1, Share: 0.25},
+		{Term: "moon soon", Kind: KeywordPhrase, Count: 1, Share: 0.25},
+		{Term: "crypto", Kind: KeywordHashtag, Count: 2, Share: 0.5},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("keyword mismatch: got %+v want %+v", got, want)
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("keyword mismatch at %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+
+	// Merging sums the counts of each keyword.
+	merged := &Sentiment{Count: 4, Keywords: got}
+	merged.Merge(&Sentiment{Count: 4, Keywords: got})
+	if kw := merged.Keywords[0]; kw.Term != "halving" || kw.Count != 4 || kw.Share != 0.5 {
+		t.Errorf("unexpected merged keyword: %+v", kw)
+	}
+}
+
+func TestKeywordLift(t *testing.T) {
+	db := newMemoryDB()
+	for _, s := range []Sentiment{
+		{Slug: "bitcoin", Count: 90, Keywords: []Keyword{{Term: "moon", Kind: KeywordWord, Count: 9}}},
+		{Slug: "bitcoin", Count: 9, Keywords: []Keyword{{Term: "moon", Kind: KeywordWord, Count: 0}}},
+		// Partial runs are excluded from the baseline.
+		{Slug: "bitcoin", Count: 100, Partial: true, Keywords: []Keyword{{Term: "halving", Kind: KeywordWord, Count: 50}}},
+	} {
+		if _, err := db.SaveSentiment(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ke, err := NewKeywordExtractor(log.NewNopLogger(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := &Sentiment{Slug: "bitcoin", Count: 10, Keywords: []Keyword{
+		{Term: "moon", Kind: KeywordWord, Count: 5, Share: 0.5},
+		{Term: "halving", Kind: KeywordWord, Count: 1, Share: 0.1},
+	}}
+	if err := ke.Lift(context.Background(), run); err != nil {
+		t.Fatalf("failed to compute lift: %v", err)
+	}
+
+	// The baseline share of "moon" is (9 + 1) / (99 + 1), and of "halving" is
+	// 1 / 100.
+	if got := run.Keywords[0].Lift; !approxEqual(got, 5) {
+		t.Errorf("lift mismatch: got %v want 5", got)
+	}
+
+	if got := run.Keywords[1].Lift; !approxEqual(got, 10) {
+		t.Errorf("lift mismatch: got %v want 10", got)
+	}
+
+	// Topics without history have no lift.
+	other := &Sentiment{Slug: "ethereum", Count: 10, Keywords: []Keyword{{Term: "moon", Kind: KeywordWord, Count: 5, Share: 0.5}}}
+	if err := ke.Lift(context.Background(), other); err != nil || other.Keywords[0].Lift != 0 {
+		t.Errorf("unexpected lift without history: %v (err %v)", other.Keywords[0].Lift, err)
+	}
+}
+
+func TestAggregatorKeywords(t *testing.T) {
+	ke, err := NewKeywordExtractor(log.NewNopLogger(), newMemoryDB(), WithKeywordCount(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ag, err := NewAggregator(log.NewNopLogger(), newMemoryDB(), WithKeywords(ke))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	results := make(chan *AnalyzerResult, 3)
+	for i, text := range []string{"Bitcoin halving soon", "bitcoin halving", "bitcoin crash"} {
+		results <- &AnalyzerResult{TweetID: int64(i), Content: text, SearchTerm: term}
+	}
+	close(results)
+
+	sentiments, err := ag.Collect(context.Background(), results)
+	if err != nil {
+		t.Fatalf("failed to collect: %v", err)
+	}
+
+	want := []Keyword{
+		{Term: "halving", Kind: KeywordWord, Count: 2, Share: 2.0 / 3},
+		{Term: "halving soon", Kind: KeywordPhrase, Count: 1, Share: 1.0 / 3},
+	}
+
+	got := sentiments[0].Keywords
+	if len(got) != len(want) {
+		t.Fatalf("keyword mismatch: got %+v want %+v", got, want)
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("keyword mismatch at %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package centiment
+
+import "math"
+
+// Merge combines other into s, as if the tweets aggregated by both had been
+// aggregated together: e.g. to roll runs up into hourly or daily figures, or to
+// combine topics. Both Sentiments must be finalized (as they are when saved
+// and retrieved).
+//
+// Means and variances are combined using Chan et al.'s parallel algorithm,
+// counts and histograms are summed, the score digests are merged, and the best
+// exemplar tweets of both are kept. The search metadata (ID, topic, slug and
+// query) of s is retained, and is only taken from other when unset on s.
+//
+// Ref: https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Parallel_algorithm
+func (s *Sentiment) Merge(other *Sentiment) {
+	if other == nil || other.Count == 0 {
+		return
+	}
+
+	if s.Topic == "" {
+		s.Topic = other.Topic
+		s.Slug = other.Slug
+		s.Query = other.Query
+	}
+
+	// Priors are combined as the mean of the priors of each tweet's run.
+	if s.PriorStrength == 0 {
+		s.PriorScore, s.PriorStrength = other.PriorScore, other.PriorStrength
+	} else if other.PriorStrength > 0 {
+		s.PriorScore = (float64(s.Count)*s.PriorScore + float64(other.Count)*other.PriorScore) /
+			float64(s.Count+other.Count)
+		s.PriorStrength = math.Max(s.PriorStrength, other.PriorStrength)
+	}
+
+	s.Score, s.Variance = mergeMoments(
+		s.Count, s.Score, s.Variance,
+		other.Count, other.Score, other.Variance,
+	)
+	s.Magnitude, s.MagnitudeVariance = mergeMoments(
+		s.Count, s.Magnitude, s.MagnitudeVariance,
+		other.Count, other.Magnitude, other.MagnitudeVariance,
+	)
+	s.EntityScore, s.EntityVariance = mergeMoments(
+		s.EntityCount, s.EntityScore, s.EntityVariance,
+		other.EntityCount, other.EntityScore, other.EntityVariance,
+	)
+
+	s.Count += other.Count
+	s.EntityCount += other.EntityCount
+	s.MixedCount += other.MixedCount
+	s.PositiveCount += other.PositiveCount
+	s.NeutralCount += other.NeutralCount
+	s.NegativeCount += other.NegativeCount
+
+	if len(other.Histogram) > 0 {
+		if s.Histogram == nil {
+			s.Histogram = make([]int64, HistogramBuckets)
+		}
+
+		for i := 0; i < len(s.Histogram) && i < len(other.Histogram); i++ {
+			s.Histogram[i] += other.Histogram[i]
+		}
+	}
+
+	if other.Digest != nil {
+		if s.Digest == nil {
+			s.Digest = NewDigest()
+		}
+		s.Digest.Merge(other.Digest)
+	}
+
+	if len(other.CoEntities) > 0 {
+		coEntities := make(coEntityCounter)
+		coEntities.merge(s.CoEntities)
+		coEntities.merge(other.CoEntities)
+		s.CoEntities = coEntities.top(maxCoEntities)
+	}
+
+	s.MostPositive = mergeExemplars(s.MostPositive, other.MostPositive, morePositive)
+	s.MostNegative = mergeExemplars(s.MostNegative, other.MostNegative, moreNegative)
+	s.MostIntense = mergeExemplars(s.MostIntense, other.MostIntense, moreIntense)
+
+	if len(other.Keywords) > 0 {
+		n := maxKeywordsPerKind(s.Keywords)
+		if m := maxKeywordsPerKind(other.Keywords); m > n {
+			n = m
+		}
+
+		keywords := make(keywordCounter)
+		keywords.merge(s.Keywords)
+		keywords.merge(other.Keywords)
+		s.Keywords = keywords.top(n, s.Count)
+	}
+
+	s.Partial = s.Partial || other.Partial
+
+	if other.MinSamples > s.MinSamples {
+		s.MinSamples = other.MinSamples
+	}
+
+	if other.LastSeenID > s.LastSeenID {
+		s.LastSeenID = other.LastSeenID
+	}
+
+	if other.FetchedAt.After(s.FetchedAt) {
+		s.FetchedAt = other.FetchedAt
+	}
+
+	s.summarize()
+}
+
+// mergeMoments combines the count, mean and (sample) variance of two sets of
+// values, returning the mean and variance of their union.
+func mergeMoments(countA int64, meanA float64, varianceA float64, countB int64, meanB float64, varianceB float64) (float64, float64) {
+	switch {
+	case countB == 0:
+		return meanA, varianceA
+	case countA == 0:
+		return meanB, varianceB
+	}
+
+	var (
+		nA    = float64(countA)
+		nB    = float64(countB)
+		n     = nA + nB
+		delta = meanB - meanA
+	)
+
+	mean := meanA + delta*nB/n
+	m2 := sumOfSquares(countA, varianceA) + sumOfSquares(countB, varianceB) + delta*delta*nA*nB/n
+
+	return mean, m2 / (n - 1)
+}
+
+// sumOfSquares recovers the sum of squared differences from the mean (M2) from
+// a sample variance. A single value has no spread.
+func sumOfSquares(count int64, variance float64) float64 {
+	if count < 2 {
+		return 0
+	}
+
+	return variance * float64(count-1)
+}
@@ -0,0 +1,110 @@
+package centiment
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// aggregate returns the finalized Sentiment for the given results.
+func aggregate(t *testing.T, results []*AnalyzerResult) *Sentiment {
+	t.Helper()
+
+	ag, err := NewAggregator(nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create aggregator: %v", err)
+	}
+
+	agg := newTopicAggregate()
+	for _, res := range results {
+		agg.sentiment = ag.updateAggregate(res.Score, res.Magnitude, res.TweetID, agg.sentiment)
+		agg.sentiment.addPolarity(res.Polarity())
+		agg.addEntities(res.Entities)
+		agg.sentiment.populateWithSearch(res.SearchTerm)
+	}
+
+	return agg.finalize()
+}
+
+func randomResults(rng *rand.Rand, term *SearchTerm, n int) []*AnalyzerResult {
+	results := make([]*AnalyzerResult, 0, n)
+	for i := 0; i < n; i++ {
+		score := float32(rng.Float64()*2 - 1)
+		results = append(results, &AnalyzerResult{
+			TweetID:    rng.Int63(),
+			Score:      score,
+			Magnitude:  float32(rng.Float64() * 2),
+			SearchTerm: term,
+			Entities: []EntityResult{
+				{Name: term.Topic, Score: score, Matched: true},
+				{Name: "Ethereum", Score: float32(rng.Float64()*2 - 1)},
+			},
+		})
+	}
+
+	return results
+}
+
+func TestSentimentMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+
+	for _, sizes := range [][]int{{50, 70}, {1, 30}, {30, 1}, {1, 1}, {10, 10, 10, 10}} {
+		var (
+			all    []*AnalyzerResult
+			merged = &Sentiment{}
+		)
+		for _, n := range sizes {
+			results := randomResults(rng, term, n)
+			all = append(all, results...)
+			merged.Merge(aggregate(t, results))
+		}
+
+		want := aggregate(t, all)
+
+		var tests = []struct {
+			name string
+			got  float64
+			want float64
+		}{
+			{"score", merged.Score, want.Score},
+			{"variance", merged.Variance, want.Variance},
+			{"stdDev", merged.StdDev, want.StdDev},
+			{"magnitude", merged.Magnitude, want.Magnitude},
+			{"magnitudeVariance", merged.MagnitudeVariance, want.MagnitudeVariance},
+			{"entityScore", merged.EntityScore, want.EntityScore},
+			{"entityVariance", merged.EntityVariance, want.EntityVariance},
+			{"netSentiment", merged.NetSentiment, want.NetSentiment},
+			{"coEntityScore", merged.CoEntities[0].Score, want.CoEntities[0].Score},
+		}
+
+		for _, tt := range tests {
+			if !approxEqual(tt.got, tt.want) {
+				t.Errorf("%s mismatch for %v: got %v want %v", tt.name, sizes, tt.got, tt.want)
+			}
+		}
+
+		if merged.Count != want.Count || merged.EntityCount != want.EntityCount || merged.CoEntities[0].Count != want.CoEntities[0].Count {
+			t.Errorf("count mismatch for %v: got %d/%d want %d/%d", sizes, merged.Count, merged.EntityCount, want.Count, want.EntityCount)
+		}
+
+		if merged.LastSeenID != want.LastSeenID {
+			t.Errorf("last seen ID mismatch for %v: got %d want %d", sizes, merged.LastSeenID, want.LastSeenID)
+		}
+
+		for i := range want.Histogram {
+			if merged.Histogram[i] != want.Histogram[i] {
+				t.Errorf("histogram mismatch for %v: got %v want %v", sizes, merged.Histogram, want.Histogram)
+				break
+			}
+		}
+
+		if math.Abs(merged.Median-want.Median) > 0.05 {
+			t.Errorf("median mismatch for %v: got %v want %v", sizes, merged.Median, want.Median)
+		}
+
+		if merged.Topic != "bitcoin" {
+			t.Errorf("topic mismatch: got %q want %q", merged.Topic, "bitcoin")
+		}
+	}
+}
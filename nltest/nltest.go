@@ -0,0 +1,380 @@
+// Package nltest provides an in-process fake of the Google Cloud Natural
+// Language API, for testing code that uses a *language.Client without network
+// access or credentials.
+//
+// The fake serves the LanguageService gRPC API over an in-memory listener.
+// Scores are computed by a scripted function, and errors and latency can be
+// injected per request:
+//
+//	srv, err := nltest.NewServer(
+//		nltest.WithScores(nltest.KeywordScores(map[string]float32{"moon": 0.8})),
+//		nltest.WithErrors(nltest.FailFirst(2, codes.Unavailable)),
+//	)
+//	defer srv.Close()
+//
+//	client, err := srv.Client(ctx)
+package nltest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	nl "cloud.google.com/go/language/apiv1"
+	"google.golang.org/api/option"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// The names of the methods passed to an ErrorFunc.
+const (
+	MethodAnalyzeSentiment       = "AnalyzeSentiment"
+	MethodAnalyzeEntitySentiment = "AnalyzeEntitySentiment"
+)
+
+// ScoreFunc returns the sentiment for a sentence.
+type ScoreFunc func(sentence string) (score float32, magnitude float32)
+
+// EntityFunc returns the entities (with their sentiment) within a document.
+type EntityFunc func(content string) []*languagepb.Entity
+
+// ErrorFunc is called before each request is served, with the method name and
+// the (1-indexed) number of requests made to that method so far, including
+// this one. Returning a non-nil error fails the request with that error.
+type ErrorFunc func(method string, n int) error
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithScores sets the function used to score each sentence. By default, every
+// sentence is neutral (a score and magnitude of 0).
+func WithScores(fn ScoreFunc) Option {
+	return func(s *Server) {
+		s.score = fn
+	}
+}
+
+// WithEntities sets the function used to extract entities for
+// AnalyzeEntitySentiment. By default, no entities are returned.
+func WithEntities(fn EntityFunc) Option {
+	return func(s *Server) {
+		s.entities = fn
+	}
+}
+
+// WithErrors sets the function used to inject errors.
+func WithErrors(fn ErrorFunc) Option {
+	return func(s *Server) {
+		s.errors = fn
+	}
+}
+
+// WithLatency delays each response by d (or until the request is cancelled).
+func WithLatency(d time.Duration) Option {
+	return func(s *Server) {
+		s.latency = d
+	}
+}
+
+// Server is a fake LanguageService server. Create one with NewServer, and
+// call Close when done.
+type Server struct {
+	score    ScoreFunc
+	entities EntityFunc
+	errors   ErrorFunc
+	latency  time.Duration
+
+	listener *bufconn.Listener
+	grpc     *grpc.Server
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+// NewServer starts a new fake server.
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		score: func(string) (float32, float32) {
+			return 0, 0
+		},
+		entities: func(string) []*languagepb.Entity {
+			return nil
+		},
+		errors: func(string, int) error {
+			return nil
+		},
+		listener: bufconn.Listen(1024 * 1024),
+		grpc:     grpc.NewServer(),
+		requests: make(map[string]int),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	languagepb.RegisterLanguageServiceServer(s.grpc, s)
+	go s.grpc.Serve(s.listener)
+
+	return s, nil
+}
+
+// Client returns a new client connected to the server. The caller should
+// Close the client when done.
+func (s *Server) Client(ctx context.Context) (*nl.Client, error) {
+	conn, err := grpc.Dial(
+		"bufconn",
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return s.listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return nl.NewClient(ctx, option.WithGRPCConn(conn))
+}
+
+// Requests returns the number of requests made to the given method.
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[method]
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.grpc.Stop()
+	s.listener.Close()
+}
+
+// serve records a request, and applies any injected latency or error.
+func (s *Server) serve(ctx context.Context, method string) error {
+	s.mu.Lock()
+	s.requests[method]++
+	n := s.requests[method]
+	s.mu.Unlock()
+
+	if s.latency > 0 {
+		timer := time.NewTimer(s.latency)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+			}
+
+			return status.Error(codes.Canceled, ctx.Err().Error())
+		}
+	}
+
+	return s.errors(method, n)
+}
+
+// AnalyzeSentiment implements languagepb.LanguageServiceServer. The document
+// is split into sentences, each of which is scored: the document score is the
+// mean of the sentence scores, and its magnitude the sum of the sentence
+// magnitudes.
+func (s *Server) AnalyzeSentiment(ctx context.Context, req *languagepb.AnalyzeSentimentRequest) (*languagepb.AnalyzeSentimentResponse, error) {
+	if err := s.serve(ctx, MethodAnalyzeSentiment); err != nil {
+		return nil, err
+	}
+
+	content := req.GetDocument().GetContent()
+	resp := &languagepb.AnalyzeSentimentResponse{
+		DocumentSentiment: &languagepb.Sentiment{},
+		Language:          "en",
+	}
+
+	spans := Sentences(content)
+	for _, span := range spans {
+		text := content[span.Begin:span.End]
+		score, magnitude := s.score(text)
+		resp.Sentences = append(resp.Sentences, &languagepb.Sentence{
+			Text: &languagepb.TextSpan{
+				Content:     text,
+				BeginOffset: offset(content, span.Begin, req.GetEncodingType()),
+			},
+			Sentiment: &languagepb.Sentiment{Score: score, Magnitude: magnitude},
+		})
+
+		resp.DocumentSentiment.Score += score
+		resp.DocumentSentiment.Magnitude += magnitude
+	}
+
+	if len(spans) > 0 {
+		resp.DocumentSentiment.Score /= float32(len(spans))
+	}
+
+	return resp, nil
+}
+
+// AnalyzeEntitySentiment implements languagepb.LanguageServiceServer.
+func (s *Server) AnalyzeEntitySentiment(ctx context.Context, req *languagepb.AnalyzeEntitySentimentRequest) (*languagepb.AnalyzeEntitySentimentResponse, error) {
+	if err := s.serve(ctx, MethodAnalyzeEntitySentiment); err != nil {
+		return nil, err
+	}
+
+	resp := &languagepb.AnalyzeEntitySentimentResponse{
+		Entities: s.entities(req.GetDocument().GetContent()),
+		Language: "en",
+	}
+
+	return resp, nil
+}
+
+// AnalyzeEntities implements languagepb.LanguageServiceServer. It is not
+// supported by the fake.
+func (s *Server) AnalyzeEntities(context.Context, *languagepb.AnalyzeEntitiesRequest) (*languagepb.AnalyzeEntitiesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "nltest: AnalyzeEntities is not implemented")
+}
+
+// AnalyzeSyntax implements languagepb.LanguageServiceServer. It is not
+// supported by the fake.
+func (s *Server) AnalyzeSyntax(context.Context, *languagepb.AnalyzeSyntaxRequest) (*languagepb.AnalyzeSyntaxResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "nltest: AnalyzeSyntax is not implemented")
+}
+
+// ClassifyText implements languagepb.LanguageServiceServer. It is not
+// supported by the fake.
+func (s *Server) ClassifyText(context.Context, *languagepb.ClassifyTextRequest) (*languagepb.ClassifyTextResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "nltest: ClassifyText is not implemented")
+}
+
+// AnnotateText implements languagepb.LanguageServiceServer. It is not
+// supported by the fake.
+func (s *Server) AnnotateText(context.Context, *languagepb.AnnotateTextRequest) (*languagepb.AnnotateTextResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "nltest: AnnotateText is not implemented")
+}
+
+// Span is a half-open [Begin, End) range of byte offsets within a document.
+type Span struct {
+	Begin int
+	End   int
+}
+
+// Sentences splits content into sentences: a sentence ends with terminal
+// punctuation ('.', '!', '?') followed by whitespace, or at a line break.
+// Surrounding whitespace is not included in a sentence.
+func Sentences(content string) []Span {
+	var (
+		spans []Span
+		begin = -1
+		end   = -1
+	)
+
+	closeSentence := func(at int) {
+		if begin >= 0 {
+			at = begin + len(strings.TrimRightFunc(content[begin:at], unicode.IsSpace))
+			spans = append(spans, Span{Begin: begin, End: at})
+		}
+		begin, end = -1, -1
+	}
+
+	for i, r := range content {
+		switch {
+		case r == '\n':
+			if end < 0 {
+				end = i
+			}
+			closeSentence(end)
+		case unicode.IsSpace(r):
+			if end >= 0 {
+				// Terminal punctuation followed by whitespace.
+				closeSentence(end)
+			}
+		case r == '.' || r == '!' || r == '?':
+			if begin < 0 {
+				begin = i
+			}
+			end = i + 1
+		default:
+			if begin < 0 {
+				begin = i
+			}
+			end = -1
+		}
+	}
+
+	closeSentence(len(content))
+
+	return spans
+}
+
+// offset converts a byte offset into content into an offset in the requested
+// encoding. Offsets are -1 when no encoding is requested.
+func offset(content string, byteOffset int, encoding languagepb.EncodingType) int32 {
+	prefix := content[:byteOffset]
+	switch encoding {
+	case languagepb.EncodingType_UTF8:
+		return int32(byteOffset)
+	case languagepb.EncodingType_UTF16:
+		return int32(len(utf16.Encode([]rune(prefix))))
+	case languagepb.EncodingType_UTF32:
+		return int32(utf8.RuneCountInString(prefix))
+	default:
+		return -1
+	}
+}
+
+// KeywordScores returns a ScoreFunc that scores a sentence by the mean score
+// of the keywords (matched case-insensitively) it contains. The magnitude is
+// the sum of the absolute scores of the matched keywords. Sentences without
+// any keywords are neutral.
+func KeywordScores(keywords map[string]float32) ScoreFunc {
+	return func(sentence string) (float32, float32) {
+		sentence = strings.ToLower(sentence)
+
+		var (
+			score     float32
+			magnitude float32
+			n         int
+		)
+		for keyword, s := range keywords {
+			if strings.Contains(sentence, strings.ToLower(keyword)) {
+				score += s
+				if s < 0 {
+					s = -s
+				}
+				magnitude += s
+				n++
+			}
+		}
+
+		if n == 0 {
+			return 0, 0
+		}
+
+		return score / float32(n), magnitude
+	}
+}
+
+// FailFirst returns an ErrorFunc that fails the first n requests to each
+// method with the given code.
+func FailFirst(n int, code codes.Code) ErrorFunc {
+	return func(method string, i int) error {
+		if i <= n {
+			return status.Errorf(code, "nltest: injected error %d of %d", i, n)
+		}
+
+		return nil
+	}
+}
+
+// FailAll returns an ErrorFunc that fails every request with the given code.
+func FailAll(code codes.Code) ErrorFunc {
+	return func(method string, i int) error {
+		return status.Errorf(code, "nltest: injected error")
+	}
+}
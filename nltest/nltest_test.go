@@ -0,0 +1,86 @@
+package nltest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+)
+
+func TestSentences(t *testing.T) {
+	var tests = []struct {
+		content string
+		want    []string
+	}{
+		{"", nil},
+		{"to the moon", []string{"to the moon"}},
+		{"to the moon. Or not!", []string{"to the moon.", "Or not!"}},
+		{"v1.2 is out... finally?  ", []string{"v1.2 is out...", "finally?"}},
+		{"first.\n\n second line\nthird", []string{"first.", "second line", "third"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, span := range Sentences(tt.content) {
+			got = append(got, tt.content[span.Begin:span.End])
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sentences mismatch for %q: got %q want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyzeSentimentOffsets(t *testing.T) {
+	srv, err := NewServer(WithScores(KeywordScores(map[string]float32{"moon": 0.5})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	client, err := srv.Client(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	content := "Ünïcode first. To the moon."
+	var tests = []struct {
+		encoding languagepb.EncodingType
+		want     int32
+	}{
+		{languagepb.EncodingType_NONE, -1},
+		{languagepb.EncodingType_UTF8, 17},
+		{languagepb.EncodingType_UTF32, 15},
+	}
+
+	for _, tt := range tests {
+		resp, err := client.AnalyzeSentiment(context.Background(), &languagepb.AnalyzeSentimentRequest{
+			Document: &languagepb.Document{
+				Source: &languagepb.Document_Content{Content: content},
+				Type:   languagepb.Document_PLAIN_TEXT,
+			},
+			EncodingType: tt.encoding,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Sentences) != 2 {
+			t.Fatalf("sentence count mismatch: got %d want %d", len(resp.Sentences), 2)
+		}
+
+		if got := resp.Sentences[1].Text.BeginOffset; got != tt.want {
+			t.Errorf("offset mismatch for %v: got %d want %d", tt.encoding, got, tt.want)
+		}
+
+		if got := resp.DocumentSentiment.Score; got != 0.25 {
+			t.Errorf("document score mismatch: got %v want %v", got, 0.25)
+		}
+	}
+
+	if got := srv.Requests(MethodAnalyzeSentiment); got != len(tests) {
+		t.Errorf("request count mismatch: got %d want %d", got, len(tests))
+	}
+}
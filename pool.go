@@ -0,0 +1,208 @@
+package centiment
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// analyzerMetrics exposes the state of the Analyzer's worker pool via expvar
+// (see AddMetricEndpoints).
+var analyzerMetrics = expvar.NewMap("analyzer")
+
+// WithAdaptiveWorkers grows and shrinks the number of workers in a run between
+// minWorkers and maxWorkers, based on the number of search results waiting to
+// be analyzed, worker utilization, request latency and quota errors. The pool
+// is resized every interval. The number of workers passed to NewAnalyzer is the
+// initial pool size, and must be within the bounds.
+//
+// The pool shrinks when requests take longer than maxLatency on average, or
+// (multiplicatively) on any quota (ResourceExhausted) errors.
+//
+// The queue depth is only observable if the searched channel passed to Run is
+// buffered.
+func WithAdaptiveWorkers(minWorkers int, maxWorkers int, interval time.Duration, maxLatency time.Duration) AnalyzerOption {
+	return func(az *Analyzer) {
+		az.minWorkers = minWorkers
+		az.maxWorkers = maxWorkers
+		az.scaleInterval = interval
+		az.maxLatency = maxLatency
+	}
+}
+
+// latencyTracker tracks an exponentially weighted moving average of request
+// latency.
+type latencyTracker struct {
+	mu      sync.Mutex
+	average time.Duration
+}
+
+// latencyWeight is the weight given to each new observation.
+const latencyWeight = 0.2
+
+func (lt *latencyTracker) observe(d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if lt.average == 0 {
+		lt.average = d
+		return
+	}
+
+	lt.average = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(lt.average))
+}
+
+func (lt *latencyTracker) value() time.Duration {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	return lt.average
+}
+
+// poolState tracks the size and utilization of a run's worker pool.
+type poolState struct {
+	// The number of running workers, and the number of workers the pool should
+	// be resized to.
+	workers int64
+	target  int64
+	// The total time (in nanoseconds) workers have spent processing results
+	// since the last resize.
+	busy int64
+	// drained is set once the searched channel has been closed.
+	drained int32
+}
+
+// retire reports whether the calling worker should exit to shrink the pool,
+// and if so, removes it from the pool.
+func (ps *poolState) retire() bool {
+	for {
+		n := atomic.LoadInt64(&ps.workers)
+		if n <= atomic.LoadInt64(&ps.target) {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&ps.workers, n, n-1) {
+			return true
+		}
+	}
+}
+
+func (ps *poolState) addBusy(d time.Duration) {
+	atomic.AddInt64(&ps.busy, int64(d))
+}
+
+// spawn starts a new worker, adding it to the pool.
+func (az *Analyzer) spawn(ctx context.Context, run *analysisRun, searched <-chan *SearchResult, analyzed chan<- *AnalyzerResult) {
+	atomic.AddInt64(&run.pool.workers, 1)
+	az.wg.Add(1)
+	go az.analyze(ctx, run, searched, analyzed)
+}
+
+// adaptive reports whether the pool size is adaptive.
+func (az *Analyzer) adaptive() bool {
+	return az.minWorkers < az.maxWorkers && az.scaleInterval > 0
+}
+
+// scale periodically resizes the worker pool until searched is drained, or the
+// context is done. The caller must have added scale to az.wg.
+func (az *Analyzer) scale(ctx context.Context, run *analysisRun, searched <-chan *SearchResult, analyzed chan<- *AnalyzerResult) {
+	defer az.wg.Done()
+
+	ticker := time.NewTicker(az.scaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.LoadInt32(&run.pool.drained) == 1 || run.skip() {
+				return
+			}
+
+			az.resize(ctx, run, searched, analyzed)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resize computes the new target pool size, and starts any additional workers
+// needed to reach it. Workers retire themselves when the pool is too large.
+//
+// The pool grows additively when there is a backlog of search results (or
+// workers are saturated), and shrinks when latency is high, workers are idle,
+// or (multiplicatively) when the API returns quota errors.
+func (az *Analyzer) resize(ctx context.Context, run *analysisRun, searched <-chan *SearchResult, analyzed chan<- *AnalyzerResult) {
+	var (
+		depth       = len(searched)
+		workers     = atomic.LoadInt64(&run.pool.workers)
+		target      = atomic.LoadInt64(&run.pool.target)
+		busy        = time.Duration(atomic.SwapInt64(&run.pool.busy, 0))
+		quotaErrors = atomic.SwapInt64(&az.quotaErrors, 0)
+		latency     = az.latency.value()
+		utilization float64
+	)
+
+	if workers > 0 {
+		utilization = math.Min(1, float64(busy)/float64(time.Duration(workers)*az.scaleInterval))
+	}
+
+	newTarget := target
+	switch {
+	case quotaErrors > 0:
+		newTarget = target / 2
+	case az.maxLatency > 0 && latency > az.maxLatency:
+		newTarget = target - 1
+	case depth > 0 || utilization > 0.8:
+		newTarget = target + 1
+	case utilization < 0.3:
+		newTarget = target - 1
+	}
+
+	if newTarget < int64(az.minWorkers) {
+		newTarget = int64(az.minWorkers)
+	}
+
+	if newTarget > int64(az.maxWorkers) {
+		newTarget = int64(az.maxWorkers)
+	}
+
+	atomic.StoreInt64(&run.pool.target, newTarget)
+	for n := workers; n < newTarget; n++ {
+		az.spawn(ctx, run, searched, analyzed)
+	}
+
+	az.setPoolMetrics(newTarget, utilization, depth, latency)
+
+	if newTarget != target {
+		az.logger.Log(
+			"msg", "resized worker pool",
+			"from", target,
+			"to", newTarget,
+			"utilization", utilization,
+			"queueDepth", depth,
+			"latency", latency,
+			"quotaErrors", quotaErrors,
+		)
+	}
+}
+
+func (az *Analyzer) setPoolMetrics(workers int64, utilization float64, depth int, latency time.Duration) {
+	w := new(expvar.Int)
+	w.Set(workers)
+	analyzerMetrics.Set("workers", w)
+
+	u := new(expvar.Float)
+	u.Set(utilization)
+	analyzerMetrics.Set("utilization", u)
+
+	d := new(expvar.Int)
+	d.Set(int64(depth))
+	analyzerMetrics.Set("queueDepth", d)
+
+	l := new(expvar.Float)
+	l.Set(latency.Seconds() * 1000)
+	analyzerMetrics.Set("latencyMs", l)
+}
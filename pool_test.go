@@ -0,0 +1,182 @@
+package centiment
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elithrar/centiment/nltest"
+	"github.com/go-kit/kit/log"
+)
+
+func TestAnalyzerResize(t *testing.T) {
+	srv := newTestServer(t, nltest.WithScores(testScores))
+	defer srv.Close()
+
+	const (
+		interval   = time.Second
+		maxLatency = 50 * time.Millisecond
+	)
+
+	var tests = []struct {
+		name        string
+		target      int64
+		depth       int
+		utilization float64
+		latency     time.Duration
+		quotaErrors int64
+		want        int64
+	}{
+		{"backlog grows", 2, 5, 0.5, time.Millisecond, 0, 3},
+		{"saturated grows", 2, 0, 0.9, time.Millisecond, 0, 3},
+		{"capped at max", 4, 5, 0.9, time.Millisecond, 0, 4},
+		{"steady", 3, 0, 0.5, time.Millisecond, 0, 3},
+		{"idle shrinks", 3, 0, 0.1, time.Millisecond, 0, 2},
+		{"high latency shrinks", 3, 5, 0.9, 100 * time.Millisecond, 0, 2},
+		{"quota errors halve", 4, 5, 0.9, time.Millisecond, 1, 2},
+		{"floored at min", 1, 0, 0, 100 * time.Millisecond, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			az := newTestAnalyzer(t, srv, WithAdaptiveWorkers(1, 4, interval, maxLatency))
+			az.latency.observe(tt.latency)
+			az.quotaErrors = tt.quotaErrors
+
+			// The pool starts at its target size. Only the workers spawned by
+			// resize are running.
+			run := &analysisRun{}
+			run.pool.workers = tt.target
+			run.pool.target = tt.target
+			run.pool.busy = int64(tt.utilization * float64(time.Duration(tt.target)*interval))
+
+			term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+			searched := make(chan *SearchResult, tt.depth)
+			for _, res := range newSearchResults(term, make([]string, tt.depth)...) {
+				searched <- res
+			}
+
+			analyzed := make(chan *AnalyzerResult)
+			go func() {
+				for range analyzed {
+				}
+			}()
+
+			az.resize(context.Background(), run, searched, analyzed)
+			close(searched)
+			az.wg.Wait()
+			close(analyzed)
+
+			if got := atomic.LoadInt64(&run.pool.target); got != tt.want {
+				t.Errorf("target mismatch: got %d want %d", got, tt.want)
+			}
+
+			if got := analyzerMetrics.Get("workers").String(); got != strconv.FormatInt(tt.want, 10) {
+				t.Errorf("workers metric mismatch: got %s want %d", got, tt.want)
+			}
+
+			if got := analyzerMetrics.Get("queueDepth").String(); got != strconv.Itoa(tt.depth) {
+				t.Errorf("queue depth metric mismatch: got %s want %d", got, tt.depth)
+			}
+
+			// Excess workers retire themselves until the pool is at its target.
+			run.pool.workers = 4
+			var retired int64
+			for run.pool.retire() {
+				retired++
+			}
+
+			if retired != 4-tt.want || atomic.LoadInt64(&run.pool.workers) != tt.want {
+				t.Errorf("retired %d workers: got %d workers want %d", retired, run.pool.workers, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzerAdaptiveWorkers(t *testing.T) {
+	srv := newTestServer(t, nltest.WithScores(testScores), nltest.WithLatency(2*time.Millisecond))
+	defer srv.Close()
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	texts := make([]string, 200)
+	for i := range texts {
+		texts[i] = "to the moon"
+	}
+
+	az := newTestAnalyzer(t, srv, WithAdaptiveWorkers(1, 4, 5*time.Millisecond, time.Second))
+
+	// Record the largest pool size observed while the backlog is drained.
+	done := make(chan struct{})
+	largest := make(chan int64, 1)
+	go func() {
+		var max int64
+		defer func() { largest <- max }()
+
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, err := strconv.ParseInt(analyzerMetrics.Get("workers").String(), 10, 64)
+				if err == nil && n > max {
+					max = n
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	results, err := runAnalyzer(az, newSearchResults(term, texts...))
+	close(done)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != len(texts) {
+		t.Fatalf("result count mismatch: got %d want %d", len(results), len(texts))
+	}
+
+	if max := <-largest; max <= 2 || max > 4 {
+		t.Errorf("expected the pool to grow to meet the backlog within [1, 4]: got %d workers", max)
+	}
+}
+
+func TestAnalyzerWorkerBounds(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client, err := srv.Client(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		workers  int
+		min, max int
+		valid    bool
+	}{
+		{"within bounds", 10, 1, 25, true},
+		{"at the bounds", 25, 25, 25, true},
+		{"above max", 50, 1, 25, false},
+		{"below min", 1, 5, 25, false},
+		{"inverted bounds", 10, 25, 5, false},
+		{"no workers", 0, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		_, err := NewAnalyzer(log.NewNopLogger(), client, tt.workers, WithAdaptiveWorkers(tt.min, tt.max, time.Second, time.Second))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	// Without adaptive sizing, the pool is fixed at the given size.
+	az, err := NewAnalyzer(log.NewNopLogger(), client, 50)
+	if err != nil || az.adaptive() || az.numWorkers != 50 {
+		t.Errorf("unexpected fixed pool: %+v (err %v)", az, err)
+	}
+}
@@ -0,0 +1,433 @@
+package centiment
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gosimple/slug"
+	"github.com/pkg/errors"
+)
+
+// maxPriceBatch is the maximum number of Prices saved in a single batch: the
+// limit for a Firestore batched write.
+const maxPriceBatch = 500
+
+// Price is a single OHLC (open, high, low, close) bar of the price of a symbol
+// (e.g. "BTC-USD"), linked to the topic whose sentiment it is compared with.
+type Price struct {
+	ID     string `json:"id" firestore:"id,omitempty"`
+	Symbol string `json:"symbol" firestore:"symbol"`
+	Topic  string `json:"topic" firestore:"topic"`
+	Slug   string `json:"slug" firestore:"slug"`
+	// The start of the bar.
+	Time   time.Time `json:"time" firestore:"time"`
+	Open   float64   `json:"open" firestore:"open"`
+	High   float64   `json:"high" firestore:"high"`
+	Low    float64   `json:"low" firestore:"low"`
+	Close  float64   `json:"close" firestore:"close"`
+	Volume float64   `json:"volume" firestore:"volume"`
+}
+
+// priceID returns the ID of the bar of a symbol at the given time. IDs are
+// deterministic, so that ingesting overlapping series is idempotent.
+func priceID(symbol string, t time.Time) string {
+	return fmt.Sprintf("%s-%d", slug.Make(symbol), t.Unix())
+}
+
+// PriceFeed is a source of prices for a symbol, linked to a topic: either a
+// CSV file, or an HTTP endpoint serving JSON (see ParsePriceCSV and
+// ParsePriceJSON).
+type PriceFeed struct {
+	Symbol string
+	Topic  string
+	// The path of a CSV file, or the URL of a JSON endpoint: exactly one must
+	// be set.
+	CSV string
+	URL string
+}
+
+func (pf *PriceFeed) validate() error {
+	if strings.TrimSpace(pf.Symbol) == "" {
+		return errors.New("price feeds must have a symbol")
+	}
+
+	if strings.TrimSpace(pf.Topic) == "" {
+		return errors.Errorf("price feed %q must be linked to a topic", pf.Symbol)
+	}
+
+	if (pf.CSV == "") == (pf.URL == "") {
+		return errors.Errorf("price feed %q must have exactly one of a CSV path or URL", pf.Symbol)
+	}
+
+	if pf.URL != "" {
+		if u, err := url.Parse(pf.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("price feed %q has an invalid URL %q", pf.Symbol, pf.URL)
+		}
+	}
+
+	return nil
+}
+
+// link sets the symbol & topic of the feed on each price.
+func (pf *PriceFeed) link(prices []*Price) {
+	topicSlug := slug.Make(pf.Topic)
+	for _, p := range prices {
+		p.Symbol = pf.Symbol
+		p.Topic = strings.TrimSpace(strings.ToLower(pf.Topic))
+		p.Slug = topicSlug
+		p.ID = priceID(pf.Symbol, p.Time)
+	}
+}
+
+// The layouts that price timestamps are parsed with, in addition to Unix
+// timestamps (in seconds or milliseconds).
+var priceTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func parsePriceTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		// Timestamps beyond the year 33658 in seconds are in milliseconds.
+		if n > 1e12 {
+			return time.Unix(0, n*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(n, 0).UTC(), nil
+	}
+
+	for _, layout := range priceTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, errors.Errorf("invalid timestamp %q", s)
+}
+
+// ParsePriceCSV parses the prices in a CSV file. The first row is a header
+// naming the columns (in any order, case-insensitively): "time" (or "date" or
+// "timestamp"), "open", "high", "low", "close" and, optionally, "volume".
+// Timestamps are RFC 3339, "2006-01-02 15:04:05" or "2006-01-02" (in UTC), or
+// Unix timestamps.
+func ParsePriceCSV(r io.Reader) ([]*Price, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read header")
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "date", "timestamp":
+			name = "time"
+		}
+		columns[name] = i
+	}
+
+	for _, name := range []string{"time", "open", "high", "low", "close"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.Errorf("missing %q column", name)
+		}
+	}
+
+	var prices []*Price
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+
+		p := &Price{}
+		if p.Time, err = parsePriceTime(record[columns["time"]]); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+
+		fields := []struct {
+			name  string
+			value *float64
+		}{
+			{"open", &p.Open},
+			{"high", &p.High},
+			{"low", &p.Low},
+			{"close", &p.Close},
+			{"volume", &p.Volume},
+		}
+
+		for _, f := range fields {
+			i, ok := columns[f.name]
+			if !ok {
+				continue
+			}
+
+			if *f.value, err = strconv.ParseFloat(strings.TrimSpace(record[i]), 64); err != nil {
+				return nil, errors.Wrapf(err, "line %d: invalid %s", line, f.name)
+			}
+		}
+
+		prices = append(prices, p)
+	}
+
+	return prices, nil
+}
+
+// priceJSON is a price, as served by a JSON endpoint.
+type priceJSON struct {
+	Time   json.RawMessage `json:"time"`
+	Open   float64         `json:"open"`
+	High   float64         `json:"high"`
+	Low    float64         `json:"low"`
+	Close  float64         `json:"close"`
+	Volume float64         `json:"volume"`
+}
+
+// ParsePriceJSON parses prices from a JSON array of objects with "time",
+// "open", "high", "low", "close" and (optionally) "volume" fields. Timestamps
+// are strings (in the layouts accepted by ParsePriceCSV) or Unix timestamps.
+func ParsePriceJSON(r io.Reader) ([]*Price, error) {
+	var bars []priceJSON
+	if err := json.NewDecoder(r).Decode(&bars); err != nil {
+		return nil, errors.Wrap(err, "failed to decode prices")
+	}
+
+	prices := make([]*Price, 0, len(bars))
+	for i, bar := range bars {
+		var s string
+		if err := json.Unmarshal(bar.Time, &s); err != nil {
+			// Not a string: a Unix timestamp.
+			s = string(bar.Time)
+		}
+
+		t, err := parsePriceTime(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "price %d", i)
+		}
+
+		prices = append(prices, &Price{
+			Time:   t,
+			Open:   bar.Open,
+			High:   bar.High,
+			Low:    bar.Low,
+			Close:  bar.Close,
+			Volume: bar.Volume,
+		})
+	}
+
+	return prices, nil
+}
+
+// PriceIngester ingests the prices from each PriceFeed into the DB.
+//
+// Only new bars are saved: those starting at or after the latest bar saved
+// from a feed. The latest bar is saved again, as it may have been incomplete.
+// CSV files are only re-read when they are modified.
+type PriceIngester struct {
+	logger     log.Logger
+	db         DB
+	feeds      []*PriceFeed
+	httpClient *http.Client
+
+	mu sync.Mutex
+	// The start of the latest bar saved, and the modification time of the CSV
+	// file it was read from, keyed by symbol.
+	latest   map[string]time.Time
+	modTimes map[string]time.Time
+}
+
+// PriceIngesterOption configures a PriceIngester.
+type PriceIngesterOption func(*PriceIngester)
+
+// WithPriceHTTPClient sets the HTTP client used to fetch prices from URLs.
+func WithPriceHTTPClient(client *http.Client) PriceIngesterOption {
+	return func(pi *PriceIngester) {
+		pi.httpClient = client
+	}
+}
+
+// NewPriceIngester creates a new PriceIngester for the given feeds.
+func NewPriceIngester(logger log.Logger, db DB, feeds []*PriceFeed, opts ...PriceIngesterOption) (*PriceIngester, error) {
+	if db == nil {
+		return nil, errors.New("prices: db must not be nil")
+	}
+
+	if len(feeds) == 0 {
+		return nil, errors.New("prices: feeds must not be empty")
+	}
+
+	for _, feed := range feeds {
+		if err := feed.validate(); err != nil {
+			return nil, errors.Wrap(err, "prices")
+		}
+	}
+
+	pi := &PriceIngester{
+		logger:     logger,
+		db:         db,
+		feeds:      feeds,
+		httpClient: &http.Client{Timeout: time.Second * 30},
+		latest:     make(map[string]time.Time),
+		modTimes:   make(map[string]time.Time),
+	}
+
+	for _, opt := range opts {
+		opt(pi)
+	}
+
+	return pi, nil
+}
+
+// Ingest fetches the prices from each feed and saves them, returning the number
+// of prices saved. A failing feed does not prevent the others from being
+// ingested: the first error is returned once all have been attempted.
+func (pi *PriceIngester) Ingest(ctx context.Context) (int, error) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+
+	var (
+		saved    int
+		firstErr error
+	)
+	for _, feed := range pi.feeds {
+		n, err := pi.ingest(ctx, feed)
+		saved += n
+		if err != nil {
+			err = errors.Wrapf(err, "failed to ingest prices for %q", feed.Symbol)
+			pi.logger.Log("err", err, "symbol", feed.Symbol)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return saved, firstErr
+}
+
+// ingest saves the new bars from a feed. pi.mu must be held.
+func (pi *PriceIngester) ingest(ctx context.Context, feed *PriceFeed) (int, error) {
+	var modTime time.Time
+	if feed.CSV != "" {
+		info, err := os.Stat(feed.CSV)
+		if err != nil {
+			return 0, err
+		}
+
+		modTime = info.ModTime()
+		if last, ok := pi.modTimes[feed.Symbol]; ok && modTime.Equal(last) {
+			return 0, nil
+		}
+	}
+
+	fetched, err := pi.fetch(ctx, feed)
+	if err != nil {
+		return 0, err
+	}
+
+	latest, seen := pi.latest[feed.Symbol]
+	var prices []*Price
+	for _, p := range fetched {
+		if !seen || !p.Time.Before(latest) {
+			prices = append(prices, p)
+		}
+	}
+
+	feed.link(prices)
+	for start := 0; start < len(prices); start += maxPriceBatch {
+		end := start + maxPriceBatch
+		if end > len(prices) {
+			end = len(prices)
+		}
+
+		if err := pi.db.SavePrices(ctx, prices[start:end]); err != nil {
+			return start, err
+		}
+	}
+
+	for _, p := range prices {
+		if !seen || p.Time.After(latest) {
+			latest, seen = p.Time, true
+		}
+	}
+
+	if seen {
+		pi.latest[feed.Symbol] = latest
+	}
+
+	if feed.CSV != "" {
+		pi.modTimes[feed.Symbol] = modTime
+	}
+
+	return len(prices), nil
+}
+
+func (pi *PriceIngester) fetch(ctx context.Context, feed *PriceFeed) ([]*Price, error) {
+	if feed.CSV != "" {
+		f, err := os.Open(feed.CSV)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return ParsePriceCSV(f)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, feed.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := pi.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return ParsePriceJSON(resp.Body)
+}
+
+// Run ingests prices every interval, until the context is cancelled.
+func (pi *PriceIngester) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := pi.Ingest(ctx)
+		pi.logger.Log(
+			"state", "ingested",
+			"prices", n,
+			"feeds", len(pi.feeds),
+			"err", err,
+		)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package centiment
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestParsePriceCSV(t *testing.T) {
+	var tests = []struct {
+		name    string
+		csv     string
+		want    []Price
+		wantErr bool
+	}{
+		{
+			"dates",
+			"Date,Open,High,Low,Close,Volume\n2018-02-11,8100,8500,7900,8200,1000\n2018-02-12,8200,8900,8100,8800.5,1500\n",
+			[]Price{
+				{Time: time.Date(2018, 2, 11, 0, 0, 0, 0, time.UTC), Open: 8100, High: 8500, Low: 7900, Close: 8200, Volume: 1000},
+				{Time: time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC), Open: 8200, High: 8900, Low: 8100, Close: 8800.5, Volume: 1500},
+			},
+			false,
+		},
+		{
+			"unix timestamps, reordered columns & no volume",
+			"close,timestamp,open,high,low\n8200,1518393600,8100,8500,7900\n8800,1518397200000,8200,8900,8100\n",
+			[]Price{
+				{Time: time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC), Open: 8100, High: 8500, Low: 7900, Close: 8200},
+				{Time: time.Date(2018, 2, 12, 1, 0, 0, 0, time.UTC), Open: 8200, High: 8900, Low: 8100, Close: 8800},
+			},
+			false,
+		},
+		{"missing column", "time,open,high,close\n2018-02-11,1,2,3\n", nil, true},
+		{"invalid price", "time,open,high,low,close\n2018-02-11,1,2,low,3\n", nil, true},
+		{"invalid timestamp", "time,open,high,low,close\nyesterday,1,2,1,3\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prices, err := ParsePriceCSV(strings.NewReader(tt.csv))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error mismatch: got %v want error %v", err, tt.wantErr)
+			}
+
+			if len(prices) != len(tt.want) {
+				t.Fatalf("price count mismatch: got %d want %d", len(prices), len(tt.want))
+			}
+
+			for i, p := range prices {
+				if !p.Time.Equal(tt.want[i].Time) || p.Open != tt.want[i].Open || p.High != tt.want[i].High ||
+					p.Low != tt.want[i].Low || p.Close != tt.want[i].Close || p.Volume != tt.want[i].Volume {
+					t.Errorf("price mismatch at %d: got %+v want %+v", i, *p, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePriceJSON(t *testing.T) {
+	body := `[
+		{"time": "2018-02-12T00:00:00Z", "open": 8100, "high": 8500, "low": 7900, "close": 8200, "volume": 10},
+		{"time": 1518397200, "open": 8200, "high": 8900, "low": 8100, "close": 8800}
+	]`
+
+	prices, err := ParsePriceJSON(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to parse prices: %v", err)
+	}
+
+	if len(prices) != 2 {
+		t.Fatalf("price count mismatch: got %d want 2", len(prices))
+	}
+
+	if want := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC); !prices[0].Time.Equal(want) || prices[0].Volume != 10 {
+		t.Errorf("unexpected price: %+v", *prices[0])
+	}
+
+	if want := time.Date(2018, 2, 12, 1, 0, 0, 0, time.UTC); !prices[1].Time.Equal(want) || prices[1].Close != 8800 {
+		t.Errorf("unexpected price: %+v", *prices[1])
+	}
+
+	if _, err := ParsePriceJSON(strings.NewReader(`[{"time": true, "close": 1}]`)); err == nil {
+		t.Error("expected an invalid timestamp to fail")
+	}
+}
+
+func TestPriceIngester(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centiment-prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	csvPath := filepath.Join(dir, "btc-usd.csv")
+	csv := "time,open,high,low,close\n2018-02-11,8100,8500,7900,8200\n2018-02-12,8200,8900,8100,8800\n"
+	if err := ioutil.WriteFile(csvPath, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eth-usd" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"time": "2018-02-12", "open": 800, "high": 900, "low": 780, "close": 850}]`)
+	}))
+	defer srv.Close()
+
+	db := newMemoryDB()
+	feeds := []*PriceFeed{
+		{Symbol: "BTC-USD", Topic: "Bitcoin", CSV: csvPath},
+		{Symbol: "ETH-USD", Topic: "Ethereum", URL: srv.URL + "/eth-usd"},
+		{Symbol: "XRP-USD", Topic: "Ripple", URL: srv.URL + "/missing"},
+	}
+
+	pi, err := NewPriceIngester(log.NewNopLogger(), db, feeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failing feed is reported, but does not prevent the others from being
+	// ingested.
+	n, err := pi.Ingest(context.Background())
+	if err == nil {
+		t.Error("expected the missing feed to fail")
+	}
+
+	if n != 3 {
+		t.Errorf("ingested price count mismatch: got %d want 3", n)
+	}
+
+	after := time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	btc, err := db.GetPricesInRange(context.Background(), "BTC-USD", after, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(btc) != 2 || btc[1].Close != 8800 || btc[1].Slug != "bitcoin" || btc[1].Topic != "bitcoin" {
+		t.Errorf("unexpected BTC-USD prices: %+v", btc)
+	}
+
+	eth, err := db.GetPricesInRange(context.Background(), "ETH-USD", after, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(eth) != 1 || eth[0].Slug != "ethereum" {
+		t.Errorf("unexpected ETH-USD prices: %+v", eth)
+	}
+
+	// Re-ingesting the same bars is idempotent: the unchanged CSV file is
+	// skipped, and only the latest bar from the URL is saved again.
+	if n, err = pi.Ingest(context.Background()); err == nil {
+		t.Error("expected the missing feed to fail")
+	}
+
+	if n != 1 {
+		t.Errorf("re-ingested price count mismatch: got %d want 1", n)
+	}
+
+	btc, err = db.GetPricesInRange(context.Background(), "BTC-USD", after, before)
+	if err != nil || len(btc) != 2 {
+		t.Errorf("price count mismatch after re-ingesting: got %d want 2 (err %v)", len(btc), err)
+	}
+
+	// Once the CSV file is modified, bars from the latest saved onwards are
+	// saved.
+	csv += "2018-02-13,8800,9000,8700,8900\n"
+	if err := ioutil.WriteFile(csvPath, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Now().Add(time.Minute)
+	if err := os.Chtimes(csvPath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ = pi.Ingest(context.Background()); n != 3 {
+		t.Errorf("ingested price count mismatch after modifying the CSV: got %d want 3", n)
+	}
+
+	btc, err = db.GetPricesInRange(context.Background(), "BTC-USD", after, before)
+	if err != nil || len(btc) != 3 || btc[2].Close != 8900 {
+		t.Errorf("unexpected BTC-USD prices after modifying the CSV: %+v (err %v)", btc, err)
+	}
+}
+
+func TestPriceFeedValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		feed  PriceFeed
+		valid bool
+	}{
+		{"csv", PriceFeed{Symbol: "BTC-USD", Topic: "Bitcoin", CSV: "btc.csv"}, true},
+		{"url", PriceFeed{Symbol: "BTC-USD", Topic: "Bitcoin", URL: "https://example.com/btc"}, true},
+		{"no symbol", PriceFeed{Topic: "Bitcoin", CSV: "btc.csv"}, false},
+		{"no topic", PriceFeed{Symbol: "BTC-USD", CSV: "btc.csv"}, false},
+		{"no source", PriceFeed{Symbol: "BTC-USD", Topic: "Bitcoin"}, false},
+		{"both sources", PriceFeed{Symbol: "BTC-USD", Topic: "Bitcoin", CSV: "btc.csv", URL: "https://example.com/btc"}, false},
+		{"invalid url", PriceFeed{Symbol: "BTC-USD", Topic: "Bitcoin", URL: "ftp://example.com/btc"}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.feed.validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package centiment
+
+import (
+	"math"
+	"sort"
+)
+
+// HistogramBuckets is the number of (equal width) buckets in a Sentiment's
+// score histogram. Bucket i counts the scores in [-1 + i*0.1, -1 + (i+1)*0.1),
+// with the last bucket also including a score of 1.
+const HistogramBuckets = 20
+
+// histogramBucket returns the histogram bucket for a score in [-1, 1].
+func histogramBucket(score float32) int {
+	i := int(math.Floor((float64(score) + 1) / 2 * HistogramBuckets))
+	if i < 0 {
+		return 0
+	}
+
+	if i >= HistogramBuckets {
+		return HistogramBuckets - 1
+	}
+
+	return i
+}
+
+// defaultCompression bounds the number of centroids in a Digest: higher values
+// are more accurate, at the cost of size.
+const defaultCompression = 100
+
+// maxUnmerged is the number of values buffered by a Digest before they are
+// merged into its centroids.
+const maxUnmerged = 500
+
+// Centroid is a cluster of values within a Digest.
+type Centroid struct {
+	Mean  float64 `json:"mean" firestore:"mean"`
+	Count float64 `json:"count" firestore:"count"`
+}
+
+// Digest is a mergeable sketch of a distribution (a merging t-digest), used to
+// estimate quantiles without retaining every value. Digests are accurate at
+// the tails, and can be merged (e.g. across runs) without any loss of
+// accuracy beyond that of the individual digests.
+//
+// Ref: https://github.com/tdunning/t-digest/blob/master/docs/t-digest-paper/histo.pdf
+type Digest struct {
+	Compression float64    `json:"compression" firestore:"compression"`
+	Centroids   []Centroid `json:"centroids" firestore:"centroids"`
+	Min         float64    `json:"min" firestore:"min"`
+	Max         float64    `json:"max" firestore:"max"`
+
+	unmerged []Centroid
+}
+
+// NewDigest creates a new, empty Digest.
+func NewDigest() *Digest {
+	return &Digest{Compression: defaultCompression}
+}
+
+// Count returns the total weight of the values added to the digest.
+func (d *Digest) Count() float64 {
+	var count float64
+	for _, c := range d.Centroids {
+		count += c.Count
+	}
+
+	for _, c := range d.unmerged {
+		count += c.Count
+	}
+
+	return count
+}
+
+// Add adds a value (with the given weight) to the digest.
+func (d *Digest) Add(value float64, weight float64) {
+	if weight <= 0 || math.IsNaN(value) {
+		return
+	}
+
+	if d.Count() == 0 {
+		d.Min, d.Max = value, value
+	}
+
+	d.Min = math.Min(d.Min, value)
+	d.Max = math.Max(d.Max, value)
+	d.unmerged = append(d.unmerged, Centroid{Mean: value, Count: weight})
+
+	if len(d.unmerged) >= maxUnmerged {
+		d.compress()
+	}
+}
+
+// Merge adds the values in other to the digest.
+func (d *Digest) Merge(other *Digest) {
+	if other == nil || other.Count() == 0 {
+		return
+	}
+
+	if d.Count() == 0 {
+		d.Min, d.Max = other.Min, other.Max
+	}
+
+	d.Min = math.Min(d.Min, other.Min)
+	d.Max = math.Max(d.Max, other.Max)
+	d.unmerged = append(d.unmerged, other.Centroids...)
+	d.unmerged = append(d.unmerged, other.unmerged...)
+	d.compress()
+}
+
+// Quantile returns the estimated value at quantile q (in [0, 1]), or 0 if the
+// digest is empty.
+func (d *Digest) Quantile(q float64) float64 {
+	d.compress()
+
+	n := len(d.Centroids)
+	switch {
+	case n == 0:
+		return 0
+	case q <= 0:
+		return d.Min
+	case q >= 1:
+		return d.Max
+	case n == 1:
+		return d.Centroids[0].Mean
+	}
+
+	// Each centroid's weight is treated as centered on its mean: interpolate
+	// between the centers of the neighbouring centroids (or the min/max at the
+	// tails).
+	var (
+		target     = q * d.Count()
+		cumulative float64
+	)
+
+	first := d.Centroids[0]
+	if target < first.Count/2 {
+		return interpolate(d.Min, first.Mean, target/(first.Count/2))
+	}
+
+	for i := 0; i < n-1; i++ {
+		c, next := d.Centroids[i], d.Centroids[i+1]
+		center := cumulative + c.Count/2
+		nextCenter := cumulative + c.Count + next.Count/2
+		if target < nextCenter {
+			return interpolate(c.Mean, next.Mean, (target-center)/(nextCenter-center))
+		}
+
+		cumulative += c.Count
+	}
+
+	last := d.Centroids[n-1]
+	center := cumulative + last.Count/2
+	return interpolate(last.Mean, d.Max, (target-center)/(last.Count/2))
+}
+
+// compress merges any buffered values into the digest's centroids, merging
+// adjacent centroids while their combined weight is within the size bound for
+// their quantiles.
+func (d *Digest) compress() {
+	if len(d.unmerged) == 0 {
+		return
+	}
+
+	if d.Compression <= 0 {
+		d.Compression = defaultCompression
+	}
+
+	centroids := append(d.unmerged, d.Centroids...)
+	d.unmerged = nil
+	sort.Slice(centroids, func(i, j int) bool {
+		return centroids[i].Mean < centroids[j].Mean
+	})
+
+	var total float64
+	for _, c := range centroids {
+		total += c.Count
+	}
+
+	var (
+		merged = make([]Centroid, 0, len(centroids))
+		cur    = centroids[0]
+		soFar  float64
+	)
+
+	for _, c := range centroids[1:] {
+		// Merge while the merged centroid spans at most one unit of the scale
+		// function.
+		qLeft := soFar / total
+		qRight := (soFar + cur.Count + c.Count) / total
+
+		if d.scale(qRight)-d.scale(qLeft) <= 1 {
+			cur.Count += c.Count
+			cur.Mean += (c.Mean - cur.Mean) * c.Count / cur.Count
+			continue
+		}
+
+		soFar += cur.Count
+		merged = append(merged, cur)
+		cur = c
+	}
+
+	d.Centroids = append(merged, cur)
+}
+
+// scale is the t-digest k1 scale function, which maps a quantile to a scale on
+// which each centroid spans at most one unit. It changes fastest near the
+// tails, keeping centroids there small (and accurate), and bounds the number
+// of centroids to approximately Compression.
+func (d *Digest) scale(q float64) float64 {
+	return d.Compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func interpolate(from float64, to float64, t float64) float64 {
+	t = math.Max(0, math.Min(1, t))
+	return from + (to-from)*t
+}
@@ -0,0 +1,120 @@
+package centiment
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestDigestQuantiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// A bimodal distribution of scores: the mean is near zero, but few scores
+	// are.
+	var values []float64
+	digest := NewDigest()
+	for i := 0; i < 10000; i++ {
+		v := math.Max(-1, math.Min(1, rng.NormFloat64()*0.15+0.6))
+		if i%2 == 0 {
+			v = -v
+		}
+		values = append(values, v)
+		digest.Add(v, 1)
+	}
+	sort.Float64s(values)
+
+	if got := digest.Count(); got != float64(len(values)) {
+		t.Fatalf("count mismatch: got %v want %v", got, len(values))
+	}
+
+	// The median falls in the gap between the two modes, so isn't checked.
+	for _, q := range []float64{0.01, 0.1, 0.25, 0.75, 0.9, 0.99} {
+		want := exactQuantile(values, q)
+		if got := digest.Quantile(q); math.Abs(got-want) > 0.05 {
+			t.Errorf("quantile %v mismatch: got %v want %v", q, got, want)
+		}
+	}
+
+	if got := digest.Quantile(0); got != values[0] {
+		t.Errorf("min mismatch: got %v want %v", got, values[0])
+	}
+
+	if got := digest.Quantile(1); got != values[len(values)-1] {
+		t.Errorf("max mismatch: got %v want %v", got, values[len(values)-1])
+	}
+
+	if n := len(digest.Centroids); n > defaultCompression {
+		t.Errorf("digest is too large: %d centroids", n)
+	}
+}
+
+func TestDigestMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	var (
+		values []float64
+		merged = NewDigest()
+	)
+	for shard := 0; shard < 10; shard++ {
+		digest := NewDigest()
+		for i := 0; i < 1000; i++ {
+			v := rng.Float64()*2 - 1
+			values = append(values, v)
+			digest.Add(v, 1)
+		}
+		merged.Merge(digest)
+	}
+	sort.Float64s(values)
+
+	if got := merged.Count(); got != float64(len(values)) {
+		t.Fatalf("count mismatch: got %v want %v", got, len(values))
+	}
+
+	for _, q := range []float64{0.1, 0.5, 0.9} {
+		want := exactQuantile(values, q)
+		if got := merged.Quantile(q); math.Abs(got-want) > 0.02 {
+			t.Errorf("quantile %v mismatch: got %v want %v", q, got, want)
+		}
+	}
+}
+
+func TestDigestEmpty(t *testing.T) {
+	digest := NewDigest()
+	if got := digest.Quantile(0.5); got != 0 {
+		t.Errorf("empty digest quantile: got %v want 0", got)
+	}
+
+	digest.Add(0.4, 1)
+	if got := digest.Quantile(0.5); got != 0.4 {
+		t.Errorf("single value quantile: got %v want 0.4", got)
+	}
+}
+
+func TestHistogramBucket(t *testing.T) {
+	var tests = []struct {
+		score float32
+		want  int
+	}{
+		{-1, 0},
+		{-0.95, 0},
+		{-0.9, 1},
+		{-0.01, 9},
+		{0, 10},
+		{0.55, 15},
+		{0.99, 19},
+		{1, 19},
+		{1.5, 19},
+		{-1.5, 0},
+	}
+
+	for _, tt := range tests {
+		if got := histogramBucket(tt.score); got != tt.want {
+			t.Errorf("bucket mismatch for %v: got %d want %d", tt.score, got, tt.want)
+		}
+	}
+}
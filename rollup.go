@@ -0,0 +1,180 @@
+package centiment
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gosimple/slug"
+	"github.com/pkg/errors"
+)
+
+// Resolution is the length of the period a Rollup aggregates over.
+type Resolution string
+
+// The resolutions Sentiments are rolled up into.
+const (
+	Hourly Resolution = "hour"
+	Daily  Resolution = "day"
+)
+
+// Resolutions are the resolutions maintained by Rollups, from finest to
+// coarsest.
+var Resolutions = []Resolution{Hourly, Daily}
+
+// ParseResolution parses a Resolution from its name.
+func ParseResolution(name string) (Resolution, error) {
+	for _, res := range Resolutions {
+		if string(res) == name {
+			return res, nil
+		}
+	}
+
+	return "", errors.Errorf("invalid resolution %q", name)
+}
+
+// Rollup is the aggregate of the Sentiments for a topic over an hour or day:
+// the Sentiments saved by each run within the period, combined with
+// Sentiment.Merge.
+type Rollup struct {
+	Sentiment
+	Resolution Resolution `json:"resolution" firestore:"resolution"`
+	// The start (inclusive) and end (exclusive) of the period, in the timezone
+	// used to compute day boundaries.
+	PeriodStart time.Time `json:"periodStart" firestore:"periodStart"`
+	PeriodEnd   time.Time `json:"periodEnd" firestore:"periodEnd"`
+	// The number of Sentiments (runs) aggregated.
+	Runs int64 `json:"runs" firestore:"runs"`
+}
+
+// Rollups maintains hourly and daily rollups of the Sentiments saved for each
+// topic, so that long time ranges can be read without fetching every run.
+type Rollups struct {
+	logger   log.Logger
+	db       DB
+	location *time.Location
+}
+
+// NewRollups creates a new Rollups, which computes hour and day boundaries in
+// the given location (time zone).
+func NewRollups(logger log.Logger, db DB, location *time.Location) (*Rollups, error) {
+	if db == nil {
+		return nil, errors.New("rollups: db must not be nil")
+	}
+
+	if location == nil {
+		return nil, errors.New("rollups: location must not be nil")
+	}
+
+	ru := &Rollups{
+		logger:   logger,
+		db:       db,
+		location: location,
+	}
+
+	return ru, nil
+}
+
+// Update merges a (saved) Sentiment into the hourly and daily rollups for the
+// period in which it was fetched.
+func (ru *Rollups) Update(ctx context.Context, sentiment *Sentiment) error {
+	for _, res := range Resolutions {
+		start, end := ru.period(sentiment.FetchedAt, res)
+		id := rollupID(sentiment.Slug, res, start)
+
+		err := ru.db.UpdateRollup(ctx, id, func(existing *Rollup) (*Rollup, error) {
+			rollup := existing
+			if rollup == nil {
+				rollup = ru.newRollup(id, res, start, end)
+			}
+
+			rollup.Merge(sentiment)
+			rollup.Runs++
+
+			return rollup, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update %s rollup %s", res, id)
+		}
+	}
+
+	return nil
+}
+
+// Backfill recomputes the rollups for a topic from all of the Sentiments saved
+// for it, overwriting any existing rollups. It returns the number of rollups
+// saved.
+//
+// Backfill should not be run while Sentiments for the topic are being saved
+// (and rolled up), as concurrent updates may be overwritten.
+func (ru *Rollups) Backfill(ctx context.Context, topicSlug string) (int, error) {
+	sentiments, err := ru.db.GetSentimentsBySlug(ctx, topicSlug, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	rollups := make(map[string]*Rollup)
+	// Sentiments are returned newest first: merge them in the order they were
+	// saved.
+	for i := len(sentiments) - 1; i >= 0; i-- {
+		sentiment := sentiments[i]
+		for _, res := range Resolutions {
+			start, end := ru.period(sentiment.FetchedAt, res)
+			id := rollupID(topicSlug, res, start)
+
+			rollup, ok := rollups[id]
+			if !ok {
+				rollup = ru.newRollup(id, res, start, end)
+				rollups[id] = rollup
+			}
+
+			rollup.Merge(sentiment)
+			rollup.Runs++
+		}
+	}
+
+	for id, rollup := range rollups {
+		if err := ru.db.SaveRollup(ctx, *rollup); err != nil {
+			return 0, errors.Wrapf(err, "failed to save rollup %s", id)
+		}
+	}
+
+	ru.logger.Log(
+		"state", "backfilled",
+		"slug", topicSlug,
+		"sentiments", len(sentiments),
+		"rollups", len(rollups),
+	)
+
+	return len(rollups), nil
+}
+
+func (ru *Rollups) newRollup(id string, res Resolution, start time.Time, end time.Time) *Rollup {
+	return &Rollup{
+		Sentiment:   Sentiment{ID: id},
+		Resolution:  res,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+}
+
+// period returns the start and end of the period (of the given resolution)
+// containing t.
+func (ru *Rollups) period(t time.Time, res Resolution) (time.Time, time.Time) {
+	t = t.In(ru.location)
+	switch res {
+	case Daily:
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, ru.location)
+		return start, start.AddDate(0, 0, 1)
+	default:
+		start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, ru.location)
+		return start, start.Add(time.Hour)
+	}
+}
+
+// rollupID returns the (deterministic) ID of the rollup for a topic, resolution
+// and period.
+func rollupID(topicSlug string, res Resolution, start time.Time) string {
+	return fmt.Sprintf("%s-%s-%s", slug.Make(topicSlug), res, start.UTC().Format("20060102T1504Z"))
+}
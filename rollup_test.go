@@ -0,0 +1,156 @@
+package centiment
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// saveRuns saves a Sentiment for each of the given fetch times, and returns the
+// saved Sentiments.
+func saveRuns(t *testing.T, db DB, rollups *Rollups, times ...time.Time) []*Sentiment {
+	t.Helper()
+
+	rng := rand.New(rand.NewSource(1))
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+
+	var saved []*Sentiment
+	for _, ts := range times {
+		sentiment := aggregate(t, randomResults(rng, term, 5))
+		sentiment.FetchedAt = ts
+		if _, err := db.SaveSentiment(context.Background(), *sentiment); err != nil {
+			t.Fatalf("failed to save sentiment: %v", err)
+		}
+
+		if rollups != nil {
+			if err := rollups.Update(context.Background(), sentiment); err != nil {
+				t.Fatalf("failed to update rollups: %v", err)
+			}
+		}
+
+		saved = append(saved, sentiment)
+	}
+
+	return saved
+}
+
+func TestRollupsUpdate(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+
+	db := newMemoryDB()
+	rollups, err := NewRollups(log.NewNopLogger(), db, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 04:50 UTC is 23:50 on the 11th in New York; 05:10 UTC is 00:10 on the
+	// 12th.
+	saved := saveRuns(t, db, rollups,
+		time.Date(2018, 2, 12, 4, 10, 0, 0, time.UTC),
+		time.Date(2018, 2, 12, 4, 50, 0, 0, time.UTC),
+		time.Date(2018, 2, 12, 5, 10, 0, 0, time.UTC),
+	)
+
+	var tests = []struct {
+		res   Resolution
+		start time.Time
+		runs  []*Sentiment
+	}{
+		{Daily, time.Date(2018, 2, 11, 0, 0, 0, 0, loc), saved[:2]},
+		{Daily, time.Date(2018, 2, 12, 0, 0, 0, 0, loc), saved[2:]},
+		{Hourly, time.Date(2018, 2, 11, 23, 0, 0, 0, loc), saved[:2]},
+		{Hourly, time.Date(2018, 2, 12, 0, 0, 0, 0, loc), saved[2:]},
+	}
+
+	for _, tt := range tests {
+		id := rollupID("bitcoin", tt.res, tt.start)
+		rollup, ok := db.rollups[id]
+		if !ok {
+			t.Errorf("no rollup %s", id)
+			continue
+		}
+
+		want := &Sentiment{}
+		for _, s := range tt.runs {
+			want.Merge(s)
+		}
+
+		if rollup.Runs != int64(len(tt.runs)) {
+			t.Errorf("runs mismatch for %s: got %d want %d", id, rollup.Runs, len(tt.runs))
+		}
+
+		if rollup.Count != want.Count || !approxEqual(rollup.Score, want.Score) {
+			t.Errorf("aggregate mismatch for %s: got %d/%v want %d/%v", id, rollup.Count, rollup.Score, want.Count, want.Score)
+		}
+
+		if !rollup.PeriodStart.Equal(tt.start) {
+			t.Errorf("period start mismatch for %s: got %v want %v", id, rollup.PeriodStart, tt.start)
+		}
+	}
+
+	if len(db.rollups) != len(tests) {
+		t.Errorf("rollup count mismatch: got %d want %d", len(db.rollups), len(tests))
+	}
+}
+
+func TestRollupsBackfill(t *testing.T) {
+	var times []time.Time
+	start := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		times = append(times, start.Add(time.Minute*time.Duration(i*17)))
+	}
+
+	// Rollups maintained incrementally, and backfilled after the fact, should
+	// match.
+	incremental := newMemoryDB()
+	rollups, err := NewRollups(log.NewNopLogger(), incremental, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveRuns(t, incremental, rollups, times...)
+
+	backfilled := newMemoryDB()
+	saveRuns(t, backfilled, nil, times...)
+	rollups, err = NewRollups(log.NewNopLogger(), backfilled, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := rollups.Backfill(context.Background(), "bitcoin")
+	if err != nil {
+		t.Fatalf("failed to backfill: %v", err)
+	}
+
+	if n != len(incremental.rollups) {
+		t.Fatalf("rollup count mismatch: got %d want %d", n, len(incremental.rollups))
+	}
+
+	for id, want := range incremental.rollups {
+		got, ok := backfilled.rollups[id]
+		if !ok {
+			t.Errorf("no backfilled rollup %s", id)
+			continue
+		}
+
+		if got.Runs != want.Runs || got.Count != want.Count || !approxEqual(got.Score, want.Score) || !approxEqual(got.Variance, want.Variance) {
+			t.Errorf("rollup %s mismatch: got %d/%d/%v want %d/%d/%v", id, got.Runs, got.Count, got.Score, want.Runs, want.Count, want.Score)
+		}
+	}
+
+	// Backfilling is idempotent.
+	if _, err := rollups.Backfill(context.Background(), "bitcoin"); err != nil {
+		t.Fatalf("failed to backfill: %v", err)
+	}
+
+	for id, want := range incremental.rollups {
+		if got := backfilled.rollups[id]; got.Runs != want.Runs {
+			t.Errorf("rollup %s runs mismatch after second backfill: got %d want %d", id, got.Runs, want.Runs)
+		}
+	}
+}
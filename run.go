@@ -0,0 +1,238 @@
+package centiment
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gosimple/slug"
+)
+
+type contextKey int
+
+const (
+	runIDKey contextKey = iota
+	runTrackerKey
+)
+
+// The statuses of an analysis run.
+const (
+	RunRunning   = "running"
+	RunFinished  = "finished"
+	RunAborted   = "aborted"
+	RunCancelled = "cancelled"
+)
+
+// Run is the record of an analysis run: when it ran, how it ended, what it did
+// for each search term, and the Sentiments it saved.
+type Run struct {
+	ID        string    `json:"id" firestore:"id,omitempty"`
+	StartedAt time.Time `json:"startedAt" firestore:"startedAt"`
+	// The time the run finished, or nil while it is running.
+	FinishedAt *time.Time `json:"finishedAt,omitempty" firestore:"finishedAt,omitempty"`
+	// The status of the run (e.g. RunFinished), and the error that aborted it,
+	// if any.
+	Status string     `json:"status" firestore:"status"`
+	Error  string     `json:"error,omitempty" firestore:"error,omitempty"`
+	Terms  []*RunTerm `json:"terms" firestore:"terms"`
+	// The IDs of the Sentiments saved by the run.
+	SentimentIDs []string `json:"sentimentIDs" firestore:"sentimentIDs"`
+	// The Natural Language API usage of the run, when a Budget is configured.
+	Usage *Usage `json:"usage,omitempty" firestore:"usage,omitempty"`
+}
+
+// RunTerm holds the statistics of a run for a single search term.
+type RunTerm struct {
+	Topic string `json:"topic" firestore:"topic"`
+	Slug  string `json:"slug" firestore:"slug"`
+	// The number of tweets returned by the Twitter API, collected for analysis,
+	// filtered out (e.g. as too old), and successfully analyzed.
+	Seen      int64 `json:"seen" firestore:"seen"`
+	Collected int64 `json:"collected" firestore:"collected"`
+	Filtered  int64 `json:"filtered" firestore:"filtered"`
+	Analyzed  int64 `json:"analyzed" firestore:"analyzed"`
+	// The number of failed Natural Language API requests, and the number of
+	// times searches waited for a Twitter API rate limit to reset.
+	APIErrors      int64 `json:"apiErrors" firestore:"apiErrors"`
+	RateLimitWaits int64 `json:"rateLimitWaits" firestore:"rateLimitWaits"`
+	// The ID of the Sentiment saved for the term, if any.
+	SentimentID string `json:"sentimentID,omitempty" firestore:"sentimentID,omitempty"`
+}
+
+// RunTracker tracks the statistics of an analysis run, as it is searched,
+// analyzed and saved. Pass it to each stage of the run with ContextWithRun.
+type RunTracker struct {
+	mu    sync.Mutex
+	run   Run
+	terms map[string]*RunTerm
+}
+
+// NewRunTracker creates a RunTracker for a run started at the given time.
+func NewRunTracker(start time.Time) *RunTracker {
+	return &RunTracker{
+		run: Run{
+			ID:        NewRunID(start),
+			StartedAt: start.UTC(),
+			Status:    RunRunning,
+		},
+		terms: make(map[string]*RunTerm),
+	}
+}
+
+// ID returns the ID of the run.
+func (rt *RunTracker) ID() string {
+	return rt.run.ID
+}
+
+// Run returns a snapshot of the run.
+func (rt *RunTracker) Run() Run {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	run := rt.run
+	run.SentimentIDs = append([]string{}, rt.run.SentimentIDs...)
+	run.Terms = make([]*RunTerm, 0, len(rt.terms))
+	for _, term := range rt.terms {
+		t := *term
+		run.Terms = append(run.Terms, &t)
+	}
+
+	sort.Slice(run.Terms, func(i, j int) bool {
+		return run.Terms[i].Slug < run.Terms[j].Slug
+	})
+
+	return run
+}
+
+// Finish marks the run as finished with the given status and error (if any),
+// and returns a snapshot of it.
+func (rt *RunTracker) Finish(status string, err error) Run {
+	rt.mu.Lock()
+	finishedAt := time.Now().UTC()
+	rt.run.Status = status
+	rt.run.FinishedAt = &finishedAt
+	if err != nil {
+		rt.run.Error = err.Error()
+	}
+	rt.mu.Unlock()
+
+	return rt.Run()
+}
+
+// update calls fn with the statistics for a topic, under lock. It is a no-op
+// for a nil RunTracker, so that stages of a run can be used without one.
+func (rt *RunTracker) update(topic string, fn func(term *RunTerm)) {
+	if rt == nil {
+		return
+	}
+
+	topicSlug := slug.Make(topic)
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	term, ok := rt.terms[topicSlug]
+	if !ok {
+		term = &RunTerm{Topic: topic, Slug: topicSlug}
+		rt.terms[topicSlug] = term
+	}
+
+	fn(term)
+}
+
+func (rt *RunTracker) searched(topic string, seen int, collected int) {
+	rt.update(topic, func(term *RunTerm) {
+		term.Seen += int64(seen)
+		term.Collected += int64(collected)
+		term.Filtered += int64(seen - collected)
+	})
+}
+
+func (rt *RunTracker) rateLimited(topic string) {
+	rt.update(topic, func(term *RunTerm) {
+		term.RateLimitWaits++
+	})
+}
+
+func (rt *RunTracker) analyzed(topic string) {
+	rt.update(topic, func(term *RunTerm) {
+		term.Analyzed++
+	})
+}
+
+func (rt *RunTracker) apiError(topic string) {
+	rt.update(topic, func(term *RunTerm) {
+		term.APIErrors++
+	})
+}
+
+// usage records the Natural Language API usage of the run.
+func (rt *RunTracker) usage(usage *Usage) {
+	if rt == nil {
+		return
+	}
+
+	rt.mu.Lock()
+	rt.run.Usage = usage
+	rt.mu.Unlock()
+}
+
+// saved records a Sentiment saved by the run. Sentiments saved on behalf of
+// other runs (e.g. replayed from a Spool) are ignored.
+func (rt *RunTracker) saved(sentiment *Sentiment) {
+	if rt == nil || sentiment.RunID != rt.run.ID {
+		return
+	}
+
+	if !sentiment.Group {
+		rt.update(sentiment.Topic, func(term *RunTerm) {
+			term.SentimentID = sentiment.ID
+		})
+	}
+
+	rt.mu.Lock()
+	rt.run.SentimentIDs = append(rt.run.SentimentIDs, sentiment.ID)
+	rt.mu.Unlock()
+}
+
+// ContextWithRun returns a copy of ctx carrying the RunTracker (and ID) of the
+// analysis run it belongs to.
+func ContextWithRun(ctx context.Context, rt *RunTracker) context.Context {
+	return context.WithValue(ContextWithRunID(ctx, rt.ID()), runTrackerKey, rt)
+}
+
+// runTrackerFromContext returns the RunTracker carried by ctx, or nil.
+func runTrackerFromContext(ctx context.Context) *RunTracker {
+	rt, _ := ctx.Value(runTrackerKey).(*RunTracker)
+	return rt
+}
+
+// runIDPattern matches valid run IDs (see NewRunID).
+var runIDPattern = regexp.MustCompile(`^[0-9A-Za-z-]{1,64}$`)
+
+// NewRunID returns a new, unique ID for an analysis run started at the given
+// time. Run IDs sort in the order the runs were started.
+func NewRunID(start time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// ContextWithRunID returns a copy of ctx carrying the ID of the analysis run
+// it belongs to: results collected & saved with the context are attributed to
+// the run.
+func ContextWithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey, runID)
+}
+
+// RunIDFromContext returns the analysis run ID carried by ctx, or an empty
+// string if there is none.
+func RunIDFromContext(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey).(string)
+	return runID
+}
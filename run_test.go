@@ -0,0 +1,123 @@
+package centiment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elithrar/centiment/nltest"
+	"github.com/elithrar/centiment/twittertest"
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRunTracker(t *testing.T) {
+	statuses := append(
+		newStatuses(2, 11, recent),
+		twittertest.NewStatus(1, "stale", time.Now().Add(-time.Hour)),
+	)
+	twitter := twittertest.NewServer(twittertest.WithStatuses(testTerm.Query, statuses...))
+	defer twitter.Close()
+
+	// Fail the third request with a non-retryable error.
+	nl := newTestServer(t, nltest.WithErrors(func(method string, n int) error {
+		if n == 3 {
+			return status.Error(codes.InvalidArgument, "invalid")
+		}
+		return nil
+	}))
+	defer nl.Close()
+
+	db := newMemoryDB()
+	sr := newTestSearcher(t, twitter, db, 50)
+	budget := newTestBudget(t, db, 0, 0)
+	az := newTestAnalyzer(t, nl, WithBudget(budget))
+	ag, err := NewAggregator(log.NewNopLogger(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := NewRunTracker(time.Now())
+	ctx := ContextWithRun(context.Background(), tracker)
+
+	searched := make(chan *SearchResult)
+	analyzed := make(chan *AnalyzerResult)
+	collected := make(chan []*Sentiment, 1)
+	go sr.Run(ctx, searched)
+	go func() {
+		sentiments, _ := ag.Collect(ctx, analyzed)
+		collected <- sentiments
+	}()
+
+	if err := az.Run(ctx, searched, analyzed); err != nil {
+		t.Fatalf("analysis failed: %v", err)
+	}
+
+	if err := ag.Save(ctx, <-collected); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	if running := tracker.Run(); running.FinishedAt != nil {
+		t.Errorf("unexpected finish time for a running run: %v", *running.FinishedAt)
+	}
+
+	run := tracker.Finish(RunFinished, nil)
+	if run.ID != tracker.ID() || run.Status != RunFinished || run.FinishedAt == nil || run.FinishedAt.IsZero() {
+		t.Errorf("unexpected run: %+v", run)
+	}
+
+	if len(run.Terms) != 1 {
+		t.Fatalf("term count mismatch: got %d want 1", len(run.Terms))
+	}
+
+	got := *run.Terms[0]
+	want := RunTerm{
+		Topic:     "Bitcoin",
+		Slug:      "bitcoin",
+		Seen:      11,
+		Collected: 10,
+		Filtered:  1,
+		Analyzed:  9,
+		APIErrors: 1,
+	}
+	want.SentimentID = got.SentimentID
+	if got != want {
+		t.Errorf("term mismatch:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	// The failed request is refunded.
+	if run.Usage == nil || run.Usage.Period != run.ID || run.Usage.Units != 9 || run.Usage.Topics["Bitcoin"] != 9 {
+		t.Errorf("unexpected run usage: %+v", run.Usage)
+	}
+
+	saved, err := db.GetSentimentsBySlug(context.Background(), "bitcoin", 0)
+	if err != nil {
+		t.Fatalf("failed to fetch sentiments: %v", err)
+	}
+
+	if len(run.SentimentIDs) != 1 || run.SentimentIDs[0] != saved[0].ID || got.SentimentID != saved[0].ID {
+		t.Errorf("sentiment ID mismatch: got %v (%s) want %s", run.SentimentIDs, got.SentimentID, saved[0].ID)
+	}
+
+	if saved[0].RunID != run.ID {
+		t.Errorf("run ID mismatch: got %q want %q", saved[0].RunID, run.ID)
+	}
+}
+
+func TestRunID(t *testing.T) {
+	start := time.Date(2018, 2, 12, 5, 24, 16, 0, time.UTC)
+	a, b := NewRunID(start), NewRunID(start.Add(time.Second))
+	if a >= b || !runIDPattern.MatchString(a) {
+		t.Errorf("unexpected run IDs: %q, %q", a, b)
+	}
+
+	ctx := ContextWithRunID(context.Background(), a)
+	if got := RunIDFromContext(ctx); got != a {
+		t.Errorf("run ID mismatch: got %q want %q", got, a)
+	}
+
+	if got := RunIDFromContext(context.Background()); got != "" {
+		t.Errorf("unexpected run ID: %q", got)
+	}
+}
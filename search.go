@@ -25,6 +25,23 @@ type SearchTerm struct {
 	// The Twitter search query
 	// Ref: https://developer.twitter.com/en/docs/tweets/search/guides/standard-operators
 	Query string
+	// Aliases are the names (e.g. "BTC", "#bitcoin") that entities for this topic
+	// are referred to as. Used to attribute entity-level sentiment to the topic;
+	// the topic itself is always considered an alias.
+	Aliases []string
+	// The thresholds for classifying a tweet as positive (a score at or above
+	// PositiveThreshold) or negative (at or below NegativeThreshold); tweets in
+	// between are neutral. Defaults to DefaultPositiveThreshold and
+	// DefaultNegativeThreshold when nil; a threshold of 0 is valid.
+	PositiveThreshold *float64
+	NegativeThreshold *float64
+	// The minimum number of tweets for a Sentiment to be considered reliable:
+	// Sentiments with fewer are flagged as LowConfidence. Defaults to
+	// DefaultMinSamples when zero.
+	MinSamples int64
+	// The rules to alert on for this topic. Alerts are only delivered when a
+	// webhook is configured: see Alerter.
+	Alerts []AlertRule
 }
 
 func (st *SearchTerm) buildQuery() string {
@@ -39,6 +56,7 @@ type SearchResult struct {
 	tweetID    int64
 	retweet    bool
 	content    string
+	createdAt  time.Time
 }
 
 // sentimentRequest prepares a SearchResult for sentiment analysis.
@@ -54,6 +72,21 @@ func (s *SearchResult) sentimentRequest() *languagepb.AnalyzeSentimentRequest {
 	}
 }
 
+// entitySentimentRequest prepares a SearchResult for entity-level sentiment
+// analysis.
+func (s *SearchResult) entitySentimentRequest() *languagepb.AnalyzeEntitySentimentRequest {
+	return &languagepb.AnalyzeEntitySentimentRequest{
+		Document: &languagepb.Document{
+			Source: &languagepb.Document_Content{
+				Content: string(norm.NFC.Bytes([]byte(s.content))),
+			},
+			Type:     languagepb.Document_PLAIN_TEXT,
+			Language: "en",
+		},
+		EncodingType: languagepb.EncodingType_UTF8,
+	}
+}
+
 // Searcher is a worker pool that searches Twitter for the given
 // set of search terms. Call NewSearcher to configure a new pool.
 // Pools are safe to use concurrently.
@@ -63,15 +96,55 @@ type Searcher struct {
 	twitterClient *anaconda.TwitterApi
 	db            DB
 	httpClient    *http.Client
+	baseURL       string
 	logger        log.Logger
 	wg            sync.WaitGroup
 	searchTerms   []*SearchTerm
 	minResults    int
 	maxAge        time.Duration
+	maxRateWait   time.Duration
+	spool         *Spool
+}
+
+// SearcherOption configures a Searcher.
+type SearcherOption func(*Searcher)
+
+// WithTwitterHTTPClient sets the HTTP client used to make requests to the
+// Twitter API.
+func WithTwitterHTTPClient(client *http.Client) SearcherOption {
+	return func(sr *Searcher) {
+		sr.httpClient = client
+	}
+}
+
+// WithTwitterBaseURL sets the base URL of the Twitter API (e.g. to point the
+// Searcher at a fake server for testing).
+func WithTwitterBaseURL(baseURL string) SearcherOption {
+	return func(sr *Searcher) {
+		sr.baseURL = baseURL
+	}
+}
+
+// WithRateLimitWait sets the longest the Searcher will wait for a rate limit to
+// reset before retrying a search. Searches that are rate limited for longer are
+// abandoned until the next run.
+func WithRateLimitWait(maxWait time.Duration) SearcherOption {
+	return func(sr *Searcher) {
+		sr.maxRateWait = maxWait
+	}
+}
+
+// WithCheckpointSpool resumes searches from the checkpoint (LastSeenID) of any
+// Sentiments in the given Spool that have not yet been saved, so that their
+// tweets are not fetched & analyzed again.
+func WithCheckpointSpool(spool *Spool) SearcherOption {
+	return func(sr *Searcher) {
+		sr.spool = spool
+	}
 }
 
 // NewSearcher creates a new Searcher with the given search terms. It will attempt to fetch minResults per search term and return tweets newer than maxAge.
-func NewSearcher(logger log.Logger, terms []*SearchTerm, minResults int, maxAge time.Duration, client *anaconda.TwitterApi, db DB) (*Searcher, error) {
+func NewSearcher(logger log.Logger, terms []*SearchTerm, minResults int, maxAge time.Duration, client *anaconda.TwitterApi, db DB, opts ...SearcherOption) (*Searcher, error) {
 	if terms == nil || len(terms) < 1 {
 		return nil, errors.New("searcher: terms must not be nil or empty")
 	}
@@ -85,6 +158,14 @@ func NewSearcher(logger log.Logger, terms []*SearchTerm, minResults int, maxAge
 		if t.Query == "" {
 			return nil, errors.New("searcher: search queries must not be empty")
 		}
+
+		if err := t.validateThresholds(); err != nil {
+			return nil, errors.Wrap(err, "searcher")
+		}
+
+		if err := t.validateMinSamples(); err != nil {
+			return nil, errors.Wrap(err, "searcher")
+		}
 	}
 
 	if minResults < 1 {
@@ -99,9 +180,24 @@ func NewSearcher(logger log.Logger, terms []*SearchTerm, minResults int, maxAge
 		minResults:    minResults,
 		logger:        logger,
 		searchTerms:   terms,
+		maxRateWait:   time.Second * 30,
+	}
+
+	for _, opt := range opts {
+		opt(sr)
+	}
+
+	if sr.httpClient == nil {
+		return nil, errors.New("searcher: HTTP client must not be nil")
 	}
 
 	sr.twitterClient.HttpClient = sr.httpClient
+	if sr.baseURL != "" {
+		sr.twitterClient.SetBaseUrl(strings.TrimSuffix(sr.baseURL, "/"))
+	}
+	// Handle rate limits ourselves, rather than have the client block
+	// (indefinitely) until the rate limit resets.
+	sr.twitterClient.ReturnRateLimitError(true)
 
 	_, err := sr.twitterClient.VerifyCredentials()
 	if err != nil {
@@ -129,14 +225,26 @@ func (sr *Searcher) Run(ctx context.Context, searched chan<- *SearchResult) erro
 	return nil
 }
 
+// getLastSeenID returns the ID of the most recent tweet seen for the search
+// term: the checkpoint of the most recently saved Sentiment, or of a spooled
+// (not yet saved) Sentiment if that is more recent.
 func (sr *Searcher) getLastSeenID(ctx context.Context, st SearchTerm) (int64, error) {
 	topicSlug := slug.Make(st.Topic)
+	var spooledID int64
+	if sr.spool != nil {
+		spooledID = sr.spool.LastSeenID(topicSlug)
+	}
+
 	sentiments, err := sr.db.GetSentimentsBySlug(
 		ctx,
 		topicSlug,
 		1,
 	)
 	if err != nil {
+		if spooledID > 0 {
+			return spooledID, nil
+		}
+
 		return 0, err
 	}
 
@@ -144,6 +252,10 @@ func (sr *Searcher) getLastSeenID(ctx context.Context, st SearchTerm) (int64, er
 		return 0, errors.Errorf("ambiguous number of sentiments returned: want %d, got %d", 1, len(sentiments))
 	}
 
+	if spooledID > sentiments[0].LastSeenID {
+		return spooledID, nil
+	}
+
 	return sentiments[0].LastSeenID, nil
 }
 
@@ -159,6 +271,9 @@ func (sr *Searcher) search(ctx context.Context, st SearchTerm, searched chan<- *
 	params := url.Values{}
 	params.Set("result_type", "recent")
 	params.Set("lang", "en")
+	// Without extended mode, the text of Tweets over 140 characters is
+	// truncated. anaconda requests it for every GET, but we don't rely on that.
+	params.Set("tweet_mode", "extended")
 	if sr.minResults > 100 {
 		params.Set("count", "100")
 	} else {
@@ -175,18 +290,24 @@ func (sr *Searcher) search(ctx context.Context, st SearchTerm, searched chan<- *
 	)
 
 	var (
-		collected int // Total tweets collected
-		seen      int // Total tweets seen
+		collected  int // Total tweets collected
+		seen       int // Total tweets seen
+		rateLimits int // Rate limit responses received
 		// Acts as our paginaton cursor. We use this to fetch the next set (older) results.
 		// Ref: https://developer.twitter.com/en/docs/tweets/timelines/guides/working-with-timelines
 		cursor int64 = math.MaxInt64
 	)
 
+	// Don't fetch tweets older than our checkpoint.
+	if fromID > 0 {
+		params.Set("since_id", strconv.FormatInt(fromID, 10))
+	}
+
 	// If we see 3x the minimum result count, and have not collected sufficient
 	// results, we give up the search until the next run. This may occur when we
 	// are attempting to fetch too many tweets at short intervals for a search
 	// query with minimal results.
-	for (collected < sr.minResults) || (seen >= sr.minResults*3) {
+	for collected < sr.minResults && seen < sr.minResults*3 {
 		select {
 		// Cancel before the next fetch, but still allow any fetched tweets to be
 		// processed.
@@ -198,33 +319,38 @@ func (sr *Searcher) search(ctx context.Context, st SearchTerm, searched chan<- *
 
 		// Only fetch tweets older than our cursor
 		params.Set("max_id", strconv.FormatInt(cursor-1, 10))
-		// Don't fetch tweets older than since_id
-		params.Set("since_id", strconv.FormatInt(fromID, 10))
 
-		sr.twitterClient.ReturnRateLimitError(true)
 		resp, err := sr.twitterClient.GetSearch(term, params)
 		if err != nil {
-			// TODO(matt): Inspect & log rate limit errors.
-			// TODO(matt): Implement retry logic.
-			sr.logger.Log("err", err, "msg", "Twitter API error")
+			if rateLimits < maxRateLimitRetries && sr.waitForRateLimit(ctx, st, err) {
+				rateLimits++
+				continue
+			}
+
+			sr.logger.Log("err", err, "msg", "Twitter API error", "topic", st.Topic)
 			return
 		}
 
+		// An empty page means there are no more (older) results.
+		if len(resp.Statuses) == 0 {
+			break
+		}
+
 		for _, status := range resp.Statuses {
 			// Track the oldest (lowest) tweet ID as our pagination cursor.
 			if cursor > status.Id {
 				cursor = status.Id
 			}
 
+			seen++
 			t, err := status.CreatedAtTime()
 			if err != nil {
-				seen++
+				sr.logger.Log("err", err, "msg", "invalid created_at", "topic", st.Topic, "tweetID", status.Id)
 				continue
 			}
 
 			// Skip "old" results to ensure relevance.
 			if time.Since(t) > sr.maxAge {
-				seen++
 				continue
 			}
 
@@ -233,16 +359,86 @@ func (sr *Searcher) search(ctx context.Context, st SearchTerm, searched chan<- *
 				retweet = true
 			}
 
+			// Tweets are fetched in extended mode, where the text of the Tweet is
+			// returned as full_text.
+			content := status.FullText
+			if content == "" {
+				content = status.Text
+			}
+
 			s := &SearchResult{
 				searchTerm: &st,
 				tweetID:    status.Id,
 				retweet:    retweet,
-				content:    status.Text,
+				content:    content,
+				createdAt:  t,
 			}
 
-			searched <- s
-			collected++
-			seen++
+			select {
+			case searched <- s:
+				collected++
+			case <-ctx.Done():
+				sr.logger.Log("status", "closing", "err", ctx.Err())
+				return
+			}
 		}
 	}
+
+	runTrackerFromContext(ctx).searched(st.Topic, seen, collected)
+	sr.logger.Log(
+		"status", "searched",
+		"topic", st.Topic,
+		"collected", collected,
+		"seen", seen,
+	)
+}
+
+// maxRateLimitRetries is the number of times a search is retried after being
+// rate limited, before it is abandoned until the next run.
+const maxRateLimitRetries = 3
+
+// waitForRateLimit waits for the rate limit to reset if err is a rate-limit
+// error, and the reset is within the Searcher's maximum wait. It reports
+// whether the search should be retried.
+func (sr *Searcher) waitForRateLimit(ctx context.Context, st SearchTerm, err error) bool {
+	apiErr, ok := err.(*anaconda.ApiError)
+	if !ok {
+		return false
+	}
+
+	limited, reset := apiErr.RateLimitCheck()
+	if !limited {
+		return false
+	}
+
+	wait := time.Until(reset)
+	if wait > sr.maxRateWait {
+		sr.logger.Log(
+			"msg", "rate limited: abandoning search until the next run",
+			"topic", st.Topic,
+			"reset", reset,
+		)
+		return false
+	}
+
+	runTrackerFromContext(ctx).rateLimited(st.Topic)
+	sr.logger.Log(
+		"msg", "rate limited: waiting for reset",
+		"topic", st.Topic,
+		"wait", wait,
+	)
+
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -0,0 +1,357 @@
+package centiment
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/elithrar/centiment/twittertest"
+	"github.com/go-kit/kit/log"
+)
+
+// checkpointDB is a DB that only serves the last seen Tweet ID (the search
+// checkpoint) for each slug.
+type checkpointDB struct {
+	DB
+	lastSeen map[string]int64
+}
+
+func (db *checkpointDB) GetSentimentsBySlug(ctx context.Context, slug string, limit int) ([]*Sentiment, error) {
+	id, ok := db.lastSeen[slug]
+	if !ok {
+		return nil, ErrNoResultsFound
+	}
+
+	return []*Sentiment{{Slug: slug, LastSeenID: id}}, nil
+}
+
+var testTerm = &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+
+func newTestSearcher(t *testing.T, srv *twittertest.Server, db DB, minResults int, opts ...SearcherOption) *Searcher {
+	t.Helper()
+
+	if db == nil {
+		db = &checkpointDB{}
+	}
+
+	api := anaconda.NewTwitterApi("token", "secret")
+	opts = append([]SearcherOption{
+		WithTwitterHTTPClient(srv.Client()),
+		WithTwitterBaseURL(srv.URL),
+	}, opts...)
+
+	sr, err := NewSearcher(log.NewNopLogger(), []*SearchTerm{testTerm}, minResults, time.Minute*15, api, db, opts...)
+	if err != nil {
+		t.Fatalf("failed to create searcher: %v", err)
+	}
+
+	return sr
+}
+
+// runSearcher runs the searcher, and returns the search results in the order
+// they were received.
+func runSearcher(t *testing.T, sr *Searcher) []*SearchResult {
+	t.Helper()
+
+	searched := make(chan *SearchResult)
+	done := make(chan error, 1)
+	go func() {
+		done <- sr.Run(context.Background(), searched)
+	}()
+
+	var results []*SearchResult
+	for res := range searched {
+		results = append(results, res)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+
+	return results
+}
+
+// newStatuses returns statuses with IDs [from, to], created at the time
+// returned by createdAt for each ID.
+func newStatuses(from int64, to int64, createdAt func(id int64) time.Time) []anaconda.Tweet {
+	var statuses []anaconda.Tweet
+	for id := from; id <= to; id++ {
+		statuses = append(statuses, twittertest.NewStatus(id, "tweet "+strconv.FormatInt(id, 10), createdAt(id)))
+	}
+
+	return statuses
+}
+
+func recent(int64) time.Time {
+	return time.Now().Add(-time.Minute)
+}
+
+func resultIDs(results []*SearchResult) []int64 {
+	ids := make([]int64, 0, len(results))
+	for _, res := range results {
+		ids = append(ids, res.tweetID)
+	}
+
+	return ids
+}
+
+func TestNewSearcherInvalidCredentials(t *testing.T) {
+	srv := twittertest.NewServer(twittertest.WithInvalidCredentials())
+	defer srv.Close()
+
+	api := anaconda.NewTwitterApi("token", "secret")
+	_, err := NewSearcher(
+		log.NewNopLogger(),
+		[]*SearchTerm{testTerm},
+		10,
+		time.Minute,
+		api,
+		&checkpointDB{},
+		WithTwitterHTTPClient(srv.Client()),
+		WithTwitterBaseURL(srv.URL),
+	)
+	if err == nil {
+		t.Fatal("expected an error for invalid credentials")
+	}
+}
+
+func TestSearcherPagination(t *testing.T) {
+	// Every third Tweet is too old to be collected, so the searcher must fetch
+	// more than one page.
+	statuses := newStatuses(1, 30, func(id int64) time.Time {
+		if id%3 == 0 {
+			return time.Now().Add(-time.Hour)
+		}
+		return recent(id)
+	})
+
+	srv := twittertest.NewServer(twittertest.WithStatuses(testTerm.Query, statuses...))
+	defer srv.Close()
+
+	sr := newTestSearcher(t, srv, nil, 10)
+	results := runSearcher(t, sr)
+
+	// Page 1 (30-21) yields 6 results, and page 2 (20-11) yields another 7.
+	if len(results) != 13 {
+		t.Fatalf("result count mismatch: got %d want %d (%v)", len(results), 13, resultIDs(results))
+	}
+
+	for i, res := range results {
+		if res.tweetID%3 == 0 {
+			t.Errorf("old tweet %d was collected", res.tweetID)
+		}
+
+		if i > 0 && res.tweetID >= results[i-1].tweetID {
+			t.Errorf("results out of order: %d after %d", res.tweetID, results[i-1].tweetID)
+		}
+
+		if want := "tweet " + strconv.FormatInt(res.tweetID, 10); res.content != want {
+			t.Errorf("content mismatch for %d: got %q want %q", res.tweetID, res.content, want)
+		}
+	}
+
+	searches := srv.Searches()
+	if len(searches) != 2 {
+		t.Fatalf("search count mismatch: got %d want %d", len(searches), 2)
+	}
+
+	var maxIDs = []string{strconv.FormatInt(math.MaxInt64-1, 10), "20"}
+	for i, search := range searches {
+		if got := search.Get("max_id"); got != maxIDs[i] {
+			t.Errorf("max_id mismatch for search %d: got %s want %s", i+1, got, maxIDs[i])
+		}
+
+		if got := search.Get("count"); got != "10" {
+			t.Errorf("count mismatch for search %d: got %s want %s", i+1, got, "10")
+		}
+	}
+}
+
+func TestSearcherExtendedText(t *testing.T) {
+	text := "Bitcoin " + strings.Repeat("is going to the moon, ", 10) + "and that is the full text of this tweet"
+	srv := twittertest.NewServer(twittertest.WithStatuses(testTerm.Query, twittertest.NewStatus(1, text, recent(1))))
+	defer srv.Close()
+
+	sr := newTestSearcher(t, srv, nil, 1)
+	results := runSearcher(t, sr)
+	if len(results) != 1 {
+		t.Fatalf("result count mismatch: got %d want 1", len(results))
+	}
+
+	if results[0].content != text {
+		t.Errorf("content mismatch: got %q want %q", results[0].content, text)
+	}
+
+	if got := srv.Searches()[0].Get("tweet_mode"); got != "extended" {
+		t.Errorf("tweet_mode mismatch: got %q want %q", got, "extended")
+	}
+}
+
+func TestSearcherSinceID(t *testing.T) {
+	statuses := newStatuses(1, 20, recent)
+
+	var tests = []struct {
+		name      string
+		lastSeen  map[string]int64
+		spooled   int64
+		sinceID   string
+		wantCount int
+	}{
+		{"no checkpoint", nil, 0, "", 20},
+		{"checkpoint", map[string]int64{"bitcoin": 12}, 0, "12", 8},
+		{"spooled checkpoint", map[string]int64{"bitcoin": 12}, 15, "15", 5},
+		{"stale spooled checkpoint", map[string]int64{"bitcoin": 12}, 10, "12", 8},
+		{"only spooled checkpoint", nil, 15, "15", 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := twittertest.NewServer(twittertest.WithStatuses(testTerm.Query, statuses...))
+			defer srv.Close()
+
+			var opts []SearcherOption
+			if tt.spooled > 0 {
+				spool, cleanup := newTestSpool(t)
+				defer cleanup()
+				if err := spool.Append(&Sentiment{Topic: "Bitcoin", Slug: "bitcoin", LastSeenID: tt.spooled}); err != nil {
+					t.Fatal(err)
+				}
+				opts = append(opts, WithCheckpointSpool(spool))
+			}
+
+			sr := newTestSearcher(t, srv, &checkpointDB{lastSeen: tt.lastSeen}, 50, opts...)
+			results := runSearcher(t, sr)
+
+			if len(results) != tt.wantCount {
+				t.Fatalf("result count mismatch: got %d want %d (%v)", len(results), tt.wantCount, resultIDs(results))
+			}
+
+			checkpoint, _ := strconv.ParseInt(tt.sinceID, 10, 64)
+			for _, res := range results {
+				if res.tweetID <= checkpoint {
+					t.Errorf("tweet %d is not newer than the checkpoint", res.tweetID)
+				}
+			}
+
+			// The second search returns an empty page, which ends the search.
+			searches := srv.Searches()
+			if len(searches) != 2 {
+				t.Fatalf("search count mismatch: got %d want %d", len(searches), 2)
+			}
+
+			for i, search := range searches {
+				if got := search.Get("since_id"); got != tt.sinceID {
+					t.Errorf("since_id mismatch for search %d: got %q want %q", i+1, got, tt.sinceID)
+				}
+			}
+		})
+	}
+}
+
+func TestSearcherMaxAge(t *testing.T) {
+	statuses := []anaconda.Tweet{
+		twittertest.NewStatus(6, "fresh", time.Now().Add(-time.Minute)),
+		twittertest.NewMalformedStatus(5, "malformed"),
+		twittertest.NewStatus(4, "stale", time.Now().Add(-time.Minute*16)),
+		twittertest.NewRetweet(3, twittertest.NewStatus(1, "original", time.Now()), time.Now().Add(-time.Minute*14)),
+		twittertest.NewStatus(2, "ancient", time.Now().Add(-time.Hour*24)),
+	}
+
+	srv := twittertest.NewServer(twittertest.WithStatuses(testTerm.Query, statuses...))
+	defer srv.Close()
+
+	sr := newTestSearcher(t, srv, nil, 5)
+	results := runSearcher(t, sr)
+
+	if len(results) != 2 {
+		t.Fatalf("result count mismatch: got %d want %d (%v)", len(results), 2, resultIDs(results))
+	}
+
+	if results[0].tweetID != 6 || results[0].retweet {
+		t.Errorf("unexpected first result: %d (retweet: %t)", results[0].tweetID, results[0].retweet)
+	}
+
+	if results[1].tweetID != 3 || !results[1].retweet {
+		t.Errorf("unexpected second result: %d (retweet: %t)", results[1].tweetID, results[1].retweet)
+	}
+}
+
+func TestSearcherGivesUp(t *testing.T) {
+	// None of the Tweets are recent enough: the searcher should stop after
+	// seeing 3x the minimum number of results.
+	statuses := newStatuses(1, 100, func(int64) time.Time {
+		return time.Now().Add(-time.Hour)
+	})
+
+	srv := twittertest.NewServer(twittertest.WithStatuses(testTerm.Query, statuses...))
+	defer srv.Close()
+
+	sr := newTestSearcher(t, srv, nil, 5)
+	results := runSearcher(t, sr)
+
+	if len(results) != 0 {
+		t.Fatalf("result count mismatch: got %d want %d", len(results), 0)
+	}
+
+	if got := len(srv.Searches()); got != 3 {
+		t.Fatalf("search count mismatch: got %d want %d", got, 3)
+	}
+}
+
+func TestSearcherEmptyPage(t *testing.T) {
+	srv := twittertest.NewServer(
+		twittertest.WithStatuses(testTerm.Query, newStatuses(1, 10, recent)...),
+		twittertest.WithEmptyPages(1),
+	)
+	defer srv.Close()
+
+	sr := newTestSearcher(t, srv, nil, 5)
+	results := runSearcher(t, sr)
+
+	if len(results) != 0 {
+		t.Fatalf("result count mismatch: got %d want %d", len(results), 0)
+	}
+
+	if got := len(srv.Searches()); got != 1 {
+		t.Fatalf("search count mismatch: got %d want %d", got, 1)
+	}
+}
+
+func TestSearcherRateLimit(t *testing.T) {
+	var tests = []struct {
+		name         string
+		limited      int
+		reset        time.Time
+		wantResults  int
+		wantSearches int
+	}{
+		{"reset", 1, time.Now(), 5, 2},
+		{"repeatedly limited", 10, time.Now(), 0, maxRateLimitRetries + 1},
+		{"reset too far away", 1, time.Now().Add(time.Minute * 10), 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := twittertest.NewServer(
+				twittertest.WithStatuses(testTerm.Query, newStatuses(1, 10, recent)...),
+				twittertest.WithRateLimit(tt.limited, tt.reset),
+			)
+			defer srv.Close()
+
+			sr := newTestSearcher(t, srv, nil, 5, WithRateLimitWait(time.Second))
+			results := runSearcher(t, sr)
+
+			if len(results) != tt.wantResults {
+				t.Errorf("result count mismatch: got %d want %d", len(results), tt.wantResults)
+			}
+
+			if got := len(srv.Searches()); got != tt.wantSearches {
+				t.Errorf("search count mismatch: got %d want %d", got, tt.wantSearches)
+			}
+		})
+	}
+}
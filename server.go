@@ -3,9 +3,13 @@ package centiment
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"net/http"
+	"net/url"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -19,8 +23,14 @@ import (
 // TODO(matt): Make this type Server
 type Env struct {
 	DB       DB
+	Budget   *Budget
 	Hostname string
 	Logger   log.Logger
+	// The price symbol linked to each topic (by slug), which correlations are
+	// computed against by default.
+	PriceSymbols map[string]string
+	// The location (time zone) that rollup periods are aligned to.
+	Location *time.Location
 }
 
 // Endpoint represents a application server endpoint. It bundles a
@@ -42,7 +52,18 @@ func (he HTTPError) Error() string {
 
 // JSON formats the current HTTPError as JSON.
 func (he HTTPError) JSON() ([]byte, error) {
-	return json.Marshal(he)
+	var msg string
+	if he.Err != nil {
+		msg = he.Err.Error()
+	}
+
+	return json.Marshal(struct {
+		Code int    `json:"code"`
+		Err  string `json:"error"`
+	}{
+		Code: he.Code,
+		Err:  msg,
+	})
 }
 
 // ServeHTTP implements http.Handler for an Endpoint.
@@ -54,7 +75,9 @@ func (ep *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			b, err := e.JSON()
 			if err != nil {
 				serverError(w)
+				return
 			}
+			w.WriteHeader(e.Code)
 			w.Write(b)
 		default:
 			ep.Env.Logger.Log("err", err, "msg", "serverError")
@@ -88,14 +111,77 @@ func AddSentimentEndpoints(r *mux.Router, env *Env) *mux.Router {
 		Queries("after", "{after}")
 	s.Handle("/{topicSlug}", &Endpoint{Env: env, Handler: sentimentHandler}).
 		Queries("id", "{id}")
+	s.Handle("/{topicSlug}", &Endpoint{Env: env, Handler: sentimentHandler}).
+		Queries("resolution", "{resolution}")
 
 	return s
 }
 
+// AddAnomalyEndpoints adds the anomaly endpoints to the given router, and
+// returns an instance of the Subrouter.
+func AddAnomalyEndpoints(r *mux.Router, env *Env) *mux.Router {
+	a := r.PathPrefix("/anomalies").Subrouter()
+	a.Handle("/{topicSlug}", &Endpoint{Env: env, Handler: anomalyHandler})
+
+	return a
+}
+
+// AddGroupEndpoints adds the topic group endpoints to the given router, and
+// returns an instance of the Subrouter.
+func AddGroupEndpoints(r *mux.Router, env *Env) *mux.Router {
+	g := r.PathPrefix("/groups").Subrouter()
+	g.Handle("/{groupSlug}", &Endpoint{Env: env, Handler: groupHandler})
+
+	return g
+}
+
+// AddCorrelationEndpoints adds the sentiment/price correlation endpoints to the
+// given router, and returns an instance of the Subrouter.
+func AddCorrelationEndpoints(r *mux.Router, env *Env) *mux.Router {
+	c := r.PathPrefix("/correlations").Subrouter()
+	c.Handle("/{topicSlug}", &Endpoint{Env: env, Handler: correlationHandler})
+
+	return c
+}
+
+// AddAlertEndpoints adds the alert history endpoints to the given router, and
+// returns an instance of the Subrouter.
+func AddAlertEndpoints(r *mux.Router, env *Env) *mux.Router {
+	a := r.PathPrefix("/alerts").Subrouter()
+	a.Handle("/{topicSlug}", &Endpoint{Env: env, Handler: alertHandler})
+
+	return a
+}
+
+// AddRunEndpoints adds the analysis run endpoints to the given router, and
+// returns an instance of the Subrouter.
+func AddRunEndpoints(r *mux.Router, env *Env) *mux.Router {
+	// Serve the list of runs from /runs directly, rather than redirecting to
+	// /runs/.
+	r.Handle("/runs", &Endpoint{Env: env, Handler: runsHandler})
+	rs := r.PathPrefix("/runs").Subrouter()
+	rs.Handle("/", &Endpoint{Env: env, Handler: runsHandler})
+	rs.Handle("/{runID}", &Endpoint{Env: env, Handler: runHandler})
+	rs.Handle("/{runID}/tweets", &Endpoint{Env: env, Handler: runTweetsHandler})
+
+	return rs
+}
+
+// AddBudgetEndpoints adds the Natural Language API budget endpoints to the given
+// router.
+func AddBudgetEndpoints(r *mux.Router, env *Env) *mux.Router {
+	r.Handle("/budget", &Endpoint{Env: env, Handler: budgetHandler})
+
+	return r
+}
+
 // AddMetricEndpoints adds the metric/debugging endpoints to the given router, and
 // returns an instance of the Subrouter.
 func AddMetricEndpoints(r *mux.Router, env *Env) *mux.Router {
 	m := r.PathPrefix("/metrics").Subrouter()
+	// Application metrics (e.g. the analyzer's worker pool) are exposed via
+	// expvar.
+	m.Handle("/vars", expvar.Handler())
 	m.Handle("/{profile}", &Endpoint{Env: env, Handler: metricsHandler})
 
 	return m
@@ -147,15 +233,48 @@ func sentimentHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
 		return errors.Errorf("topic too long: 100 rune limit (got %d)", count)
 	}
 
-	res, err := env.DB.GetSentimentsBySlug(
-		context.Background(),
-		topicSlug,
-		10,
-	)
+	// Time ranges return every Sentiment in the range (up to the maximum) by
+	// default.
+	query := r.URL.Query()
+	inRange := query.Get("after") != "" || query.Get("before") != ""
+	def := defaultSentimentCount
+	if inRange {
+		def = maxSentimentCount
+	}
+
+	count, err := parseCount(query, def)
 	if err != nil {
 		return err
 	}
 
+	var res interface{}
+	if !inRange {
+		sentiments, err := env.DB.GetSentimentsBySlug(r.Context(), topicSlug, count)
+		if err != nil {
+			return err
+		}
+		res = sentiments
+	} else {
+		after, before, err := parseRange(query.Get("after"), query.Get("before"))
+		if err != nil {
+			return HTTPError{Code: http.StatusBadRequest, Err: err}
+		}
+
+		resolution, err := rangeResolution(query.Get("resolution"), after, before)
+		if err != nil {
+			return HTTPError{Code: http.StatusBadRequest, Err: err}
+		}
+
+		if resolution == "" {
+			res, err = env.DB.GetSentimentsInRange(r.Context(), topicSlug, after, before, count)
+		} else {
+			res, err = env.DB.GetRollups(r.Context(), topicSlug, resolution, after, before)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
 	b, err := json.Marshal(res)
 	if err != nil {
 		return err
@@ -167,6 +286,311 @@ func sentimentHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// The number of Sentiments returned by default (for the latest Sentiments), and
+// at most, when not reading rollups.
+const (
+	defaultSentimentCount = 10
+	maxSentimentCount     = 1000
+)
+
+// The longest time ranges served from (raw) Sentiments, and from hourly
+// rollups. Longer ranges are served from daily rollups.
+const (
+	maxRawRange    = time.Hour * 24
+	maxHourlyRange = time.Hour * 24 * 14
+)
+
+// parseCount parses the "count" query parameter: the number of records to
+// return, from 1 to maxSentimentCount. def is returned if it is unset.
+func parseCount(query url.Values, def int) (int, error) {
+	v := query.Get("count")
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxSentimentCount {
+		return 0, HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("count must be between 1 and %d", maxSentimentCount)}
+	}
+
+	return n, nil
+}
+
+// parseRange parses the (RFC 3339) bounds of a time range. before defaults to
+// now, and after to a day before before.
+func parseRange(afterParam string, beforeParam string) (time.Time, time.Time, error) {
+	var (
+		after  time.Time
+		before = time.Now().UTC()
+		err    error
+	)
+
+	if beforeParam != "" {
+		if before, err = time.Parse(time.RFC3339, beforeParam); err != nil {
+			return after, before, errors.Errorf("invalid before timestamp %q: must be RFC 3339", beforeParam)
+		}
+	}
+
+	after = before.Add(-maxRawRange)
+	if afterParam != "" {
+		if after, err = time.Parse(time.RFC3339, afterParam); err != nil {
+			return after, before, errors.Errorf("invalid after timestamp %q: must be RFC 3339", afterParam)
+		}
+	}
+
+	if !after.Before(before) {
+		return after, before, errors.New("after must be before before")
+	}
+
+	return after, before, nil
+}
+
+// rangeResolution returns the resolution of the rollups to serve a time range
+// from, or an empty Resolution to serve it from Sentiments directly. The
+// resolution can be set explicitly with the name of a Resolution, or "raw".
+func rangeResolution(param string, after time.Time, before time.Time) (Resolution, error) {
+	switch {
+	case param == "raw":
+		return "", nil
+	case param != "":
+		return ParseResolution(param)
+	}
+
+	switch span := before.Sub(after); {
+	case span <= maxRawRange:
+		return "", nil
+	case span <= maxHourlyRange:
+		return Hourly, nil
+	default:
+		return Daily, nil
+	}
+}
+
+func anomalyHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	topicSlug := mux.Vars(r)["topicSlug"]
+	if !slug.IsSlug(topicSlug) {
+		return HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("not a valid topic format: %s is not slugified", topicSlug)}
+	}
+
+	count, err := parseCount(r.URL.Query(), defaultSentimentCount)
+	if err != nil {
+		return err
+	}
+
+	anomalies, err := env.DB.GetAnomaliesBySlug(r.Context(), topicSlug, count)
+	if err != nil {
+		if errors.Cause(err) == ErrNoResultsFound {
+			anomalies = []*Anomaly{}
+		} else {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(anomalies)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
+
+// groupHandler serves the latest group-level Sentiments of a topic group, with
+// their breakdowns by member.
+func groupHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	groupSlug := mux.Vars(r)["groupSlug"]
+	if !slug.IsSlug(groupSlug) {
+		return HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("not a valid group format: %s is not slugified", groupSlug)}
+	}
+
+	count, err := parseCount(r.URL.Query(), defaultSentimentCount)
+	if err != nil {
+		return err
+	}
+
+	sentiments, err := env.DB.GetSentimentsBySlug(r.Context(), groupSlug, count)
+	if err != nil && errors.Cause(err) != ErrNoResultsFound {
+		return err
+	}
+
+	groups := make([]*Sentiment, 0, len(sentiments))
+	for _, sentiment := range sentiments {
+		if sentiment.Group {
+			groups = append(groups, sentiment)
+		}
+	}
+
+	if len(groups) == 0 {
+		return HTTPError{Code: http.StatusNotFound, Err: errors.Errorf("no sentiments found for group %s", groupSlug)}
+	}
+
+	b, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
+
+// The default time range that correlations are computed over, and the bounds
+// on their lags.
+const (
+	defaultCorrelationRange = time.Hour * 24 * 90
+	defaultCorrelationLags  = "0,1"
+	maxCorrelationLag       = 48
+	maxCorrelationLags      = 20
+)
+
+// correlationResponse is the response of the correlation endpoint.
+type correlationResponse struct {
+	Slug         string        `json:"slug"`
+	Symbol       string        `json:"symbol"`
+	Resolution   Resolution    `json:"resolution"`
+	After        time.Time     `json:"after"`
+	Before       time.Time     `json:"before"`
+	Correlations []Correlation `json:"correlations"`
+}
+
+// correlationHandler serves the correlation between a topic's (rolled up)
+// sentiment score and the returns of a price series, at each requested lag.
+func correlationHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	topicSlug := mux.Vars(r)["topicSlug"]
+	if !slug.IsSlug(topicSlug) {
+		return HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("not a valid topic format: %s is not slugified", topicSlug)}
+	}
+
+	query := r.URL.Query()
+	symbol := query.Get("symbol")
+	if symbol == "" {
+		symbol = env.PriceSymbols[topicSlug]
+	}
+
+	if symbol == "" {
+		return HTTPError{Code: http.StatusNotFound, Err: errors.Errorf("no price series is linked to topic %s", topicSlug)}
+	}
+
+	after, before, err := parseRange(query.Get("after"), query.Get("before"))
+	if err != nil {
+		return HTTPError{Code: http.StatusBadRequest, Err: err}
+	}
+
+	if query.Get("after") == "" {
+		after = before.Add(-defaultCorrelationRange)
+	}
+
+	resolution := Daily
+	if v := query.Get("resolution"); v != "" {
+		if resolution, err = ParseResolution(v); err != nil {
+			return HTTPError{Code: http.StatusBadRequest, Err: err}
+		}
+	}
+
+	lagsParam := query.Get("lags")
+	if lagsParam == "" {
+		lagsParam = defaultCorrelationLags
+	}
+
+	lags, err := parseLags(lagsParam)
+	if err != nil {
+		return HTTPError{Code: http.StatusBadRequest, Err: err}
+	}
+
+	rollups, err := env.DB.GetRollups(r.Context(), topicSlug, resolution, after, before)
+	if err != nil && errors.Cause(err) != ErrNoResultsFound {
+		return err
+	}
+
+	// Returns are looked up to the largest lag (plus a period) either side of
+	// the range.
+	var maxLag int
+	for _, lag := range lags {
+		if lag < 0 {
+			lag = -lag
+		}
+		if lag > maxLag {
+			maxLag = lag
+		}
+	}
+
+	prices, err := env.DB.GetPricesInRange(
+		r.Context(),
+		symbol,
+		shiftPeriod(after, resolution, -maxLag-1),
+		shiftPeriod(before, resolution, maxLag+1),
+	)
+	if err != nil && errors.Cause(err) != ErrNoResultsFound {
+		return err
+	}
+
+	b, err := json.Marshal(&correlationResponse{
+		Slug:         topicSlug,
+		Symbol:       symbol,
+		Resolution:   resolution,
+		After:        after,
+		Before:       before,
+		Correlations: Correlate(rollups, prices, resolution, lags, env.Location),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
+
+// parseLags parses a comma-separated list of (distinct) lags, in periods.
+func parseLags(param string) ([]int, error) {
+	var (
+		lags []int
+		seen = make(map[int]bool)
+	)
+	for _, field := range strings.Split(param, ",") {
+		lag, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || lag < -maxCorrelationLag || lag > maxCorrelationLag {
+			return nil, errors.Errorf("lags must be integers between -%d and %d", maxCorrelationLag, maxCorrelationLag)
+		}
+
+		if !seen[lag] {
+			seen[lag] = true
+			lags = append(lags, lag)
+		}
+	}
+
+	if len(lags) > maxCorrelationLags {
+		return nil, errors.Errorf("at most %d lags can be requested", maxCorrelationLags)
+	}
+
+	return lags, nil
+}
+
+func budgetHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if env.Budget == nil {
+		return HTTPError{Code: http.StatusNotFound, Err: errors.New("budget tracking is not enabled")}
+	}
+
+	spend, err := env.Budget.Spend(r.Context())
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(spend)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
+
 func metricsHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	profile := vars["profile"]
@@ -210,3 +634,126 @@ func serverError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	fmt.Fprintf(w, `{"error":"application_error"}`)
 }
+
+func alertHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	topicSlug := mux.Vars(r)["topicSlug"]
+	if !slug.IsSlug(topicSlug) {
+		return HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("not a valid topic format: %s is not slugified", topicSlug)}
+	}
+
+	count, err := parseCount(r.URL.Query(), defaultSentimentCount)
+	if err != nil {
+		return err
+	}
+
+	alerts, err := env.DB.GetAlertsBySlug(r.Context(), topicSlug, "", count)
+	if err != nil {
+		if errors.Cause(err) == ErrNoResultsFound {
+			alerts = []*Alert{}
+		} else {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
+
+// runsHandler serves the most recent analysis runs.
+func runsHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	count, err := parseCount(r.URL.Query(), defaultSentimentCount)
+	if err != nil {
+		return err
+	}
+
+	runs, err := env.DB.GetRuns(r.Context(), count)
+	if err != nil {
+		if errors.Cause(err) == ErrNoResultsFound {
+			runs = []*Run{}
+		} else {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(runs)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
+
+// runHandler serves a single analysis run.
+func runHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	runID := mux.Vars(r)["runID"]
+	if !runIDPattern.MatchString(runID) {
+		return HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("not a valid run ID: %s", runID)}
+	}
+
+	run, err := env.DB.GetRun(r.Context(), runID)
+	if err != nil {
+		if errors.Cause(err) == ErrNoResultsFound {
+			return HTTPError{Code: http.StatusNotFound, Err: errors.Errorf("no run with ID %s", runID)}
+		}
+
+		return err
+	}
+
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
+
+// runTweetsHandler serves the records of the tweets analyzed in a run (when
+// recorded), optionally filtered to a single topic.
+func runTweetsHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
+	runID := mux.Vars(r)["runID"]
+	if !runIDPattern.MatchString(runID) {
+		return HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("not a valid run ID: %s", runID)}
+	}
+
+	topicSlug := r.URL.Query().Get("topic")
+	if topicSlug != "" && !slug.IsSlug(topicSlug) {
+		return HTTPError{Code: http.StatusBadRequest, Err: errors.Errorf("not a valid topic format: %s is not slugified", topicSlug)}
+	}
+
+	count, err := parseCount(r.URL.Query(), maxSentimentCount)
+	if err != nil {
+		return err
+	}
+
+	tweets, err := env.DB.GetTweetAnalysesByRun(r.Context(), runID, topicSlug, count)
+	if err != nil && errors.Cause(err) != ErrNoResultsFound {
+		return err
+	}
+
+	if tweets == nil {
+		tweets = []*TweetAnalysis{}
+	}
+
+	b, err := json.Marshal(tweets)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+
+	return nil
+}
@@ -0,0 +1,511 @@
+package centiment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/gosimple/slug"
+)
+
+// serve serves a GET request for path from a router with every endpoint, and
+// returns the response.
+func serve(t *testing.T, env *Env, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	if env.Logger == nil {
+		env.Logger = log.NewNopLogger()
+	}
+
+	router := mux.NewRouter().StrictSlash(true)
+	AddSentimentEndpoints(router, env)
+	AddBudgetEndpoints(router, env)
+	AddAnomalyEndpoints(router, env)
+	AddAlertEndpoints(router, env)
+	AddGroupEndpoints(router, env)
+	AddCorrelationEndpoints(router, env)
+	AddRunEndpoints(router, env)
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+// decode decodes a JSON response body into v, after checking its status code.
+func decode(t *testing.T, rr *httptest.ResponseRecorder, code int, v interface{}) {
+	t.Helper()
+
+	if rr.Code != code {
+		t.Fatalf("status code mismatch: got %d want %d (body %s)", rr.Code, code, rr.Body)
+	}
+
+	if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response %s: %v", rr.Body, err)
+	}
+}
+
+// wantError checks that the response is an HTTPError with the given status
+// code.
+func wantError(t *testing.T, rr *httptest.ResponseRecorder, code int) {
+	t.Helper()
+
+	var httpErr struct {
+		Code  int    `json:"code"`
+		Error string `json:"error"`
+	}
+	decode(t, rr, code, &httpErr)
+	if httpErr.Code != code || httpErr.Error == "" {
+		t.Errorf("unexpected error response: %s", rr.Body)
+	}
+}
+
+func TestSentimentHandlerRange(t *testing.T) {
+	db := newMemoryDB()
+	before := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	// A day of runs, every ten minutes.
+	for i := 0; i < 144; i++ {
+		sentiment := Sentiment{Topic: "Bitcoin", Slug: "bitcoin", Count: 10, FetchedAt: before.Add(-time.Minute * 10 * time.Duration(i+1))}
+		if _, err := db.SaveSentiment(context.Background(), sentiment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name  string
+		path  string
+		code  int
+		count int
+	}{
+		{"latest", "/sentiments/bitcoin", http.StatusOK, defaultSentimentCount},
+		{"range", "/sentiments/bitcoin?before=2018-02-12T00:00:00Z", http.StatusOK, 144},
+		{"range with count", "/sentiments/bitcoin?before=2018-02-12T00:00:00Z&count=20", http.StatusOK, 20},
+		{"invalid count", "/sentiments/bitcoin?count=0", http.StatusBadRequest, 0},
+		{"invalid range", "/sentiments/bitcoin?after=2018-02-12T00:00:00Z&before=2018-02-11T00:00:00Z", http.StatusBadRequest, 0},
+		{"invalid resolution", "/sentiments/bitcoin?before=2018-02-12T00:00:00Z&resolution=week", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, &Env{DB: db}, tt.path)
+			if tt.code != http.StatusOK {
+				wantError(t, rr, tt.code)
+				return
+			}
+
+			var sentiments []*Sentiment
+			decode(t, rr, tt.code, &sentiments)
+			if len(sentiments) != tt.count {
+				t.Errorf("sentiment count mismatch: got %d want %d", len(sentiments), tt.count)
+			}
+		})
+	}
+}
+
+func TestAnomalyHandler(t *testing.T) {
+	db := newMemoryDB()
+	detected := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		anomaly := Anomaly{Topic: "Bitcoin", Slug: "bitcoin", Metric: MetricScore, ZScore: -4, DetectedAt: detected.Add(time.Hour * time.Duration(i))}
+		if _, err := db.SaveAnomaly(context.Background(), anomaly); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name  string
+		path  string
+		code  int
+		count int
+	}{
+		{"all", "/anomalies/bitcoin", http.StatusOK, 3},
+		{"count", "/anomalies/bitcoin?count=2", http.StatusOK, 2},
+		{"no anomalies", "/anomalies/ethereum", http.StatusOK, 0},
+		{"invalid count", "/anomalies/bitcoin?count=ten", http.StatusBadRequest, 0},
+		{"count too large", "/anomalies/bitcoin?count=1001", http.StatusBadRequest, 0},
+		{"invalid slug", "/anomalies/Bitcoin", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, &Env{DB: db}, tt.path)
+			if tt.code != http.StatusOK {
+				wantError(t, rr, tt.code)
+				return
+			}
+
+			// Unknown topics have no anomalies, rather than a null response.
+			var anomalies []*Anomaly
+			decode(t, rr, tt.code, &anomalies)
+			if anomalies == nil || len(anomalies) != tt.count {
+				t.Fatalf("anomaly count mismatch: got %v want %d", anomalies, tt.count)
+			}
+
+			for i := 1; i < len(anomalies); i++ {
+				if anomalies[i].DetectedAt.After(anomalies[i-1].DetectedAt) {
+					t.Errorf("anomalies are not ordered most recent first: %+v", anomalies)
+				}
+			}
+
+			if tt.count > 0 && (anomalies[0].Slug != "bitcoin" || anomalies[0].Metric != MetricScore || anomalies[0].ID == "") {
+				t.Errorf("unexpected anomaly: %+v", anomalies[0])
+			}
+		})
+	}
+}
+
+func TestAlertHandler(t *testing.T) {
+	db := newMemoryDB()
+	triggered := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	alerts := []Alert{
+		{ID: "bitcoin-1", Topic: "Bitcoin", Slug: "bitcoin", Rule: "negative", TriggeredAt: triggered, Delivered: true, Attempts: 1},
+		{ID: "bitcoin-2", Topic: "Bitcoin", Slug: "bitcoin", Rule: "spike", TriggeredAt: triggered.Add(time.Hour), Attempts: 4, Error: "giving up"},
+	}
+	for _, alert := range alerts {
+		if err := db.SaveAlert(context.Background(), alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name  string
+		path  string
+		code  int
+		count int
+	}{
+		{"all", "/alerts/bitcoin", http.StatusOK, 2},
+		{"count", "/alerts/bitcoin?count=1", http.StatusOK, 1},
+		{"no alerts", "/alerts/ethereum", http.StatusOK, 0},
+		{"invalid count", "/alerts/bitcoin?count=-1", http.StatusBadRequest, 0},
+		{"invalid slug", "/alerts/Bitcoin", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, &Env{DB: db}, tt.path)
+			if tt.code != http.StatusOK {
+				wantError(t, rr, tt.code)
+				return
+			}
+
+			var got []map[string]interface{}
+			decode(t, rr, tt.code, &got)
+			if got == nil || len(got) != tt.count {
+				t.Fatalf("alert count mismatch: got %v want %d", got, tt.count)
+			}
+
+			if tt.count == 0 {
+				return
+			}
+
+			// The most recent alert is first, with its delivery status.
+			if got[0]["id"] != "bitcoin-2" || got[0]["delivered"] != false || got[0]["attempts"] != 4.0 || got[0]["error"] != "giving up" {
+				t.Errorf("unexpected alert: %v", got[0])
+			}
+		})
+	}
+}
+
+func TestRunTweetsHandler(t *testing.T) {
+	db := newMemoryDB()
+	runID := NewRunID(time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC))
+	var analyses []*TweetAnalysis
+	for i, topic := range []string{"Bitcoin", "Bitcoin", "Bitcoin", "Ethereum"} {
+		analyses = append(analyses, &TweetAnalysis{
+			ID:       fmt.Sprintf("%s-%d", runID, i),
+			RunID:    runID,
+			Topic:    topic,
+			Slug:     slug.Make(topic),
+			TweetID:  int64(960000000000000000 + i),
+			TextHash: "hash",
+			Score:    0.5,
+		})
+	}
+
+	if err := db.SaveTweetAnalyses(context.Background(), analyses); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name  string
+		path  string
+		code  int
+		count int
+	}{
+		{"all topics", "/runs/" + runID + "/tweets", http.StatusOK, 4},
+		{"topic", "/runs/" + runID + "/tweets?topic=bitcoin", http.StatusOK, 3},
+		{"topic & count", "/runs/" + runID + "/tweets?topic=bitcoin&count=2", http.StatusOK, 2},
+		{"no tweets", "/runs/" + runID + "/tweets?topic=ripple", http.StatusOK, 0},
+		{"unknown run", "/runs/20180101T000000Z-00000000/tweets", http.StatusOK, 0},
+		{"invalid count", "/runs/" + runID + "/tweets?count=1001", http.StatusBadRequest, 0},
+		{"invalid topic", "/runs/" + runID + "/tweets?topic=Bitcoin", http.StatusBadRequest, 0},
+		{"invalid run ID", "/runs/run_1/tweets", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, &Env{DB: db}, tt.path)
+			if tt.code != http.StatusOK {
+				wantError(t, rr, tt.code)
+				return
+			}
+
+			var got []map[string]interface{}
+			decode(t, rr, tt.code, &got)
+			if got == nil || len(got) != tt.count {
+				t.Fatalf("tweet count mismatch: got %v want %d", got, tt.count)
+			}
+
+			// Tweet IDs are serialized as strings.
+			if tt.count > 0 && (got[0]["runID"] != runID || got[0]["tweetID"] != "960000000000000000") {
+				t.Errorf("unexpected tweet: %v", got[0])
+			}
+		})
+	}
+}
+
+func TestRunHandlers(t *testing.T) {
+	db := newMemoryDB()
+	start := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		tracker := NewRunTracker(start.Add(time.Minute * 10 * time.Duration(i)))
+		ids = append(ids, tracker.ID())
+		if err := db.SaveRun(context.Background(), tracker.Finish(RunFinished, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A run that is still running has no finish time.
+	running := NewRunTracker(start.Add(time.Hour))
+	if err := db.SaveRun(context.Background(), running.Run()); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name  string
+		path  string
+		code  int
+		count int
+	}{
+		{"all", "/runs", http.StatusOK, 4},
+		{"count", "/runs?count=2", http.StatusOK, 2},
+		{"invalid count", "/runs?count=many", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, &Env{DB: db}, tt.path)
+			if tt.code != http.StatusOK {
+				wantError(t, rr, tt.code)
+				return
+			}
+
+			var runs []map[string]interface{}
+			decode(t, rr, tt.code, &runs)
+			if len(runs) != tt.count {
+				t.Fatalf("run count mismatch: got %d want %d", len(runs), tt.count)
+			}
+
+			// The most recent run is first.
+			if _, ok := runs[0]["finishedAt"]; runs[0]["id"] != running.ID() || runs[0]["status"] != RunRunning || ok {
+				t.Errorf("unexpected run: %v", runs[0])
+			}
+
+			if runs[1]["id"] != ids[2] || runs[1]["status"] != RunFinished || runs[1]["finishedAt"] == nil {
+				t.Errorf("unexpected run: %v", runs[1])
+			}
+		})
+	}
+
+	// An empty history is served as an empty list.
+	var runs []*Run
+	decode(t, serve(t, &Env{DB: newMemoryDB()}, "/runs"), http.StatusOK, &runs)
+	if runs == nil || len(runs) != 0 {
+		t.Errorf("unexpected runs for an empty history: %v", runs)
+	}
+
+	var run *Run
+	decode(t, serve(t, &Env{DB: db}, "/runs/"+ids[0]), http.StatusOK, &run)
+	if run.ID != ids[0] || run.Status != RunFinished || !run.StartedAt.Equal(start) {
+		t.Errorf("unexpected run: %+v", run)
+	}
+
+	wantError(t, serve(t, &Env{DB: db}, "/runs/20180101T000000Z-00000000"), http.StatusNotFound)
+	wantError(t, serve(t, &Env{DB: db}, "/runs/run_1"), http.StatusBadRequest)
+}
+
+func TestGroupHandler(t *testing.T) {
+	db := newMemoryDB()
+	fetched := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		group := Sentiment{
+			Topic:     "Crypto",
+			Slug:      "crypto",
+			Group:     true,
+			Count:     30,
+			FetchedAt: fetched.Add(time.Minute * 10 * time.Duration(i)),
+			Members: []*GroupMember{
+				{Topic: "Bitcoin", Slug: "bitcoin", Count: 20, Share: 2.0 / 3},
+				{Topic: "Ethereum", Slug: "ethereum", Count: 10, Share: 1.0 / 3},
+			},
+		}
+		if _, err := db.SaveSentiment(context.Background(), group); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A topic's Sentiments are not served as a group.
+	if _, err := db.SaveSentiment(context.Background(), Sentiment{Topic: "Bitcoin", Slug: "bitcoin", Count: 20, FetchedAt: fetched}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name  string
+		path  string
+		code  int
+		count int
+	}{
+		{"all", "/groups/crypto", http.StatusOK, 3},
+		{"count", "/groups/crypto?count=1", http.StatusOK, 1},
+		{"topic", "/groups/bitcoin", http.StatusNotFound, 0},
+		{"unknown group", "/groups/stocks", http.StatusNotFound, 0},
+		{"invalid count", "/groups/crypto?count=0", http.StatusBadRequest, 0},
+		{"invalid slug", "/groups/Crypto", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, &Env{DB: db}, tt.path)
+			if tt.code != http.StatusOK {
+				wantError(t, rr, tt.code)
+				return
+			}
+
+			var groups []*Sentiment
+			decode(t, rr, tt.code, &groups)
+			if len(groups) != tt.count {
+				t.Fatalf("group count mismatch: got %d want %d", len(groups), tt.count)
+			}
+
+			latest := groups[0]
+			if !latest.Group || !latest.FetchedAt.Equal(fetched.Add(time.Minute*20)) || len(latest.Members) != 2 || latest.Members[0].Slug != "bitcoin" {
+				t.Errorf("unexpected group: %+v", latest)
+			}
+		})
+	}
+}
+
+func TestCorrelationHandler(t *testing.T) {
+	db := newMemoryDB()
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	days := 30
+
+	// The price moves in the direction of the previous day's sentiment.
+	scores := make([]float64, days)
+	for i := range scores {
+		scores[i] = rng.Float64()*2 - 1
+		periodStart := start.AddDate(0, 0, i)
+		rollup := Rollup{
+			Sentiment:   Sentiment{ID: rollupID("bitcoin", Daily, periodStart), Topic: "Bitcoin", Slug: "bitcoin", Score: scores[i]},
+			Resolution:  Daily,
+			PeriodStart: periodStart,
+			PeriodEnd:   periodStart.AddDate(0, 0, 1),
+		}
+		if err := db.SaveRollup(context.Background(), rollup); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var prices []*Price
+	last := 100.0
+	for i := 0; i <= days+1; i++ {
+		if i >= 2 {
+			last *= 1 + scores[i-2]/10
+		}
+		bar := start.AddDate(0, 0, i-1)
+		prices = append(prices, &Price{ID: priceID("BTC-USD", bar), Symbol: "BTC-USD", Time: bar, Close: last})
+	}
+
+	if err := db.SavePrices(context.Background(), prices); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Env{DB: db, PriceSymbols: map[string]string{"bitcoin": "BTC-USD"}}
+	query := "?after=2018-01-01T00:00:00Z&before=2018-01-31T00:00:00Z"
+
+	var tests = []struct {
+		name   string
+		path   string
+		code   int
+		symbol string
+		n      int
+	}{
+		{"linked symbol", "/correlations/bitcoin" + query, http.StatusOK, "BTC-USD", days},
+		{"symbol without prices", "/correlations/bitcoin" + query + "&symbol=ETH-USD", http.StatusOK, "ETH-USD", 0},
+		{"no linked symbol", "/correlations/ethereum" + query, http.StatusNotFound, "", 0},
+		{"invalid lags", "/correlations/bitcoin" + query + "&lags=0,49", http.StatusBadRequest, "", 0},
+		{"invalid resolution", "/correlations/bitcoin" + query + "&resolution=week", http.StatusBadRequest, "", 0},
+		{"invalid range", "/correlations/bitcoin?after=2018-02-01T00:00:00Z&before=2018-01-01T00:00:00Z", http.StatusBadRequest, "", 0},
+		{"invalid slug", "/correlations/Bitcoin", http.StatusBadRequest, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, env, tt.path)
+			if tt.code != http.StatusOK {
+				wantError(t, rr, tt.code)
+				return
+			}
+
+			var res correlationResponse
+			decode(t, rr, tt.code, &res)
+			if res.Slug != "bitcoin" || res.Symbol != tt.symbol || res.Resolution != Daily || len(res.Correlations) != 2 {
+				t.Fatalf("unexpected response: %+v", res)
+			}
+
+			// Sentiment leads the price by a day.
+			lagged := res.Correlations[1]
+			if lagged.Lag != 1 || lagged.N != tt.n {
+				t.Errorf("unexpected lagged correlation: %+v", lagged)
+			}
+
+			if tt.n > 0 && !approxEqual(lagged.Pearson, 1) {
+				t.Errorf("lagged correlation mismatch: got %v want 1", lagged.Pearson)
+			}
+		})
+	}
+}
+
+func TestBudgetHandler(t *testing.T) {
+	wantError(t, serve(t, &Env{DB: newMemoryDB()}, "/budget"), http.StatusNotFound)
+
+	db := newMemoryDB()
+	budget, err := NewBudget(log.NewNopLogger(), db, 1000, 100, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := budget.Reserve(context.Background(), FeatureSentiment, "Bitcoin", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	var spend *Spend
+	decode(t, serve(t, &Env{DB: db, Budget: budget}, "/budget"), http.StatusOK, &spend)
+	if spend.MonthlyLimit != 1000 || spend.DailyLimit != 100 || spend.UnitPrice != 0.001 || spend.EntityUnitPrice != 0.002 {
+		t.Errorf("unexpected limits: %+v", spend)
+	}
+
+	if spend.Month.Units != 10 || spend.Day.Units != 10 || spend.Day.Topics["Bitcoin"] != 10 || !approxEqual(spend.DailyCost, 0.01) {
+		t.Errorf("unexpected usage: %+v, %+v", spend.Month, spend.Day)
+	}
+}
@@ -0,0 +1,158 @@
+package centiment
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Smoother shrinks the score of each run towards a prior, so that topics with
+// few tweets per run do not swing wildly from run to run.
+//
+// The smoothed score is the posterior mean of the score: the prior is treated
+// as if it were Strength tweets scoring the prior mean, and combined with the
+// Count tweets of the run. Runs with many tweets are barely moved, whereas
+// runs with few are pulled most of the way to the prior.
+//
+// The prior is the topic's long-run mean: the mean score (weighted by Count)
+// of its previous (non-partial) runs. Topics with too little history fall back to a global
+// prior.
+type Smoother struct {
+	logger      log.Logger
+	db          DB
+	strength    float64
+	globalPrior float64
+	window      int
+	minHistory  int64
+}
+
+// SmootherOption configures a Smoother.
+type SmootherOption func(*Smoother)
+
+// WithPriorStrength sets the strength of the prior, in tweets: the higher the
+// strength, the more each run's score is shrunk towards the prior.
+func WithPriorStrength(strength float64) SmootherOption {
+	return func(sm *Smoother) {
+		sm.strength = strength
+	}
+}
+
+// WithGlobalPrior sets the prior mean score used for topics without enough
+// history.
+func WithGlobalPrior(score float64) SmootherOption {
+	return func(sm *Smoother) {
+		sm.globalPrior = score
+	}
+}
+
+// WithPriorHistory sets the number of previous runs the long-run mean of a
+// topic is computed from (window), and the minimum number of tweets across
+// them for it to be used instead of the global prior. Providing a window of 0
+// always uses the global prior.
+func WithPriorHistory(window int, minTweets int64) SmootherOption {
+	return func(sm *Smoother) {
+		sm.window = window
+		sm.minHistory = minTweets
+	}
+}
+
+// NewSmoother creates a new Smoother. By default, the prior has a strength of
+// 20 tweets, and is the topic's mean over its previous 144 runs (a day, at 10
+// minute intervals) once they include at least 100 tweets, or a neutral score
+// of 0 until then.
+func NewSmoother(logger log.Logger, db DB, opts ...SmootherOption) (*Smoother, error) {
+	if db == nil {
+		return nil, errors.New("smoother: db must not be nil")
+	}
+
+	sm := &Smoother{
+		logger:     logger,
+		db:         db,
+		strength:   20,
+		window:     144,
+		minHistory: 100,
+	}
+
+	for _, opt := range opts {
+		opt(sm)
+	}
+
+	if sm.strength <= 0 {
+		return nil, errors.New("smoother: prior strength must be > 0")
+	}
+
+	if sm.globalPrior < -1 || sm.globalPrior > 1 {
+		return nil, errors.New("smoother: the global prior must be within [-1, 1]")
+	}
+
+	if sm.window < 0 || sm.minHistory < 0 {
+		return nil, errors.New("smoother: the prior history window and minimum must be >= 0")
+	}
+
+	return sm, nil
+}
+
+// Smooth sets the prior, and the smoothed score, of an (unsaved) Sentiment.
+// Failing to fetch the topic's history is not fatal: the global prior is used
+// instead, and the error returned.
+func (sm *Smoother) Smooth(ctx context.Context, sentiment *Sentiment) error {
+	prior, err := sm.prior(ctx, sentiment)
+	sentiment.PriorScore = prior
+	sentiment.PriorStrength = sm.strength
+	sentiment.summarize()
+
+	return err
+}
+
+// prior returns the long-run mean score of the Sentiment's topic, or the
+// global prior if it has too little history.
+func (sm *Smoother) prior(ctx context.Context, sentiment *Sentiment) (float64, error) {
+	if sm.window == 0 {
+		return sm.globalPrior, nil
+	}
+
+	// Fetch extra Sentiments, as the history excludes the Sentiment being
+	// smoothed, and any partial Sentiments (from cancelled runs).
+	history, err := sm.db.GetSentimentsBySlug(ctx, sentiment.Slug, sm.window*2+1)
+	if err != nil {
+		if errors.Cause(err) == ErrNoResultsFound {
+			return sm.globalPrior, nil
+		}
+
+		return sm.globalPrior, errors.Wrap(err, "failed to fetch prior")
+	}
+
+	var (
+		runs  int
+		count int64
+		sum   float64
+	)
+	for _, s := range history {
+		if (sentiment.ID != "" && s.ID == sentiment.ID) || s.Partial || runs == sm.window {
+			continue
+		}
+
+		runs++
+		count += s.Count
+		sum += s.Score * float64(s.Count)
+	}
+
+	if count == 0 || count < sm.minHistory {
+		return sm.globalPrior, nil
+	}
+
+	return sum / float64(count), nil
+}
+
+// smooth computes the smoothed score from the prior (see Smoother). Without a
+// prior, the smoothed score is the raw score.
+func (s *Sentiment) smooth() {
+	if s.PriorStrength <= 0 {
+		s.SmoothedScore = s.Score
+		return
+	}
+
+	s.SmoothedScore = (float64(s.Count)*s.Score + s.PriorStrength*s.PriorScore) /
+		(float64(s.Count) + s.PriorStrength)
+}
@@ -0,0 +1,197 @@
+package centiment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestSmoother(t *testing.T) {
+	var tests = []struct {
+		name     string
+		opts     []SmootherOption
+		scores   []float64
+		volumes  []int64
+		partials int
+		run      Sentiment
+		prior    float64
+		smoothed float64
+	}{
+		{
+			name:     "no history",
+			opts:     []SmootherOption{WithPriorStrength(10), WithGlobalPrior(0.1)},
+			run:      Sentiment{Count: 10, Score: 0.5},
+			prior:    0.1,
+			smoothed: 0.3,
+		},
+		{
+			name:     "too little history",
+			opts:     []SmootherOption{WithPriorStrength(10), WithPriorHistory(10, 100)},
+			scores:   []float64{0.4, 0.6},
+			volumes:  []int64{20, 20},
+			run:      Sentiment{Count: 10, Score: -0.5},
+			prior:    0,
+			smoothed: -0.25,
+		},
+		{
+			name:    "long-run mean",
+			opts:    []SmootherOption{WithPriorStrength(30), WithPriorHistory(10, 100)},
+			scores:  []float64{0.2, 0.6},
+			volumes: []int64{150, 50},
+			// The prior is weighted by the volume of each run: (30 + 30) / 200.
+			run:      Sentiment{Count: 2, Score: -1},
+			prior:    0.3,
+			smoothed: (-2 + 30*0.3) / 32,
+		},
+		{
+			name:    "partial runs excluded",
+			opts:    []SmootherOption{WithPriorStrength(30), WithPriorHistory(2, 100)},
+			scores:  []float64{0.2, 0.6},
+			volumes: []int64{150, 50},
+			// The (newer) partial runs neither skew the prior, nor take up the
+			// window.
+			partials: 3,
+			run:      Sentiment{Count: 2, Score: -1},
+			prior:    0.3,
+			smoothed: (-2 + 30*0.3) / 32,
+		},
+		{
+			name:     "global prior only",
+			opts:     []SmootherOption{WithPriorStrength(10), WithPriorHistory(0, 0)},
+			scores:   []float64{0.6},
+			volumes:  []int64{500},
+			run:      Sentiment{Count: 10, Score: 0.5},
+			prior:    0,
+			smoothed: 0.25,
+		},
+		{
+			name:     "many tweets",
+			opts:     []SmootherOption{WithPriorStrength(10)},
+			run:      Sentiment{Count: 9990, Score: 0.5},
+			prior:    0,
+			smoothed: 0.4995,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemoryDB()
+			if len(tt.scores) > 0 {
+				saveScores(t, db, tt.scores, tt.volumes)
+			}
+
+			for i := 0; i < tt.partials; i++ {
+				partial := Sentiment{
+					Topic:     "Bitcoin",
+					Slug:      "bitcoin",
+					Score:     -1,
+					Count:     1000,
+					FetchedAt: time.Now().Add(time.Minute * time.Duration(i+1)),
+					Partial:   true,
+				}
+				if _, err := db.SaveSentiment(context.Background(), partial); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sm, err := NewSmoother(log.NewNopLogger(), db, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			run := tt.run
+			run.Slug = "bitcoin"
+			if err := sm.Smooth(context.Background(), &run); err != nil {
+				t.Fatalf("failed to smooth: %v", err)
+			}
+
+			if !approxEqual(run.PriorScore, tt.prior) {
+				t.Errorf("prior mismatch: got %v want %v", run.PriorScore, tt.prior)
+			}
+
+			if !approxEqual(run.SmoothedScore, tt.smoothed) {
+				t.Errorf("smoothed score mismatch: got %v want %v", run.SmoothedScore, tt.smoothed)
+			}
+
+			if run.Score != tt.run.Score {
+				t.Errorf("raw score changed: got %v want %v", run.Score, tt.run.Score)
+			}
+		})
+	}
+}
+
+func TestSmootherMerge(t *testing.T) {
+	a := &Sentiment{Count: 10, Score: 0.5, PriorScore: 0.2, PriorStrength: 10}
+	b := &Sentiment{Count: 30, Score: 0.1, PriorScore: 0.4, PriorStrength: 10}
+	a.summarize()
+	b.summarize()
+
+	merged := &Sentiment{}
+	merged.Merge(a)
+	merged.Merge(b)
+
+	if !approxEqual(merged.PriorScore, 0.35) || merged.PriorStrength != 10 {
+		t.Errorf("prior mismatch: got %v (strength %v) want 0.35 (strength 10)", merged.PriorScore, merged.PriorStrength)
+	}
+
+	// The merged score is 0.2: (40*0.2 + 10*0.35) / 50.
+	if !approxEqual(merged.SmoothedScore, 0.23) {
+		t.Errorf("smoothed score mismatch: got %v want 0.23", merged.SmoothedScore)
+	}
+
+	// Without a prior, the smoothed score is the raw score.
+	raw := &Sentiment{Count: 5, Score: 0.7}
+	raw.summarize()
+	if raw.SmoothedScore != raw.Score {
+		t.Errorf("smoothed score mismatch: got %v want %v", raw.SmoothedScore, raw.Score)
+	}
+}
+
+func TestAggregatorSmoothing(t *testing.T) {
+	db := newMemoryDB()
+	sm, err := NewSmoother(log.NewNopLogger(), db, WithPriorStrength(10), WithGlobalPrior(-0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ag, err := NewAggregator(log.NewNopLogger(), db, WithSmoother(sm))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := &Sentiment{Topic: "bitcoin", Slug: "bitcoin", Count: 10, Score: 0.5}
+	if err := ag.Save(context.Background(), []*Sentiment{run}); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	saved, err := db.GetSentimentsBySlug(context.Background(), "bitcoin", 1)
+	if err != nil {
+		t.Fatalf("failed to fetch sentiments: %v", err)
+	}
+
+	if got := saved[0]; !approxEqual(got.SmoothedScore, 0) || got.Score != 0.5 {
+		t.Errorf("unexpected saved scores: raw %v, smoothed %v", got.Score, got.SmoothedScore)
+	}
+}
+
+func TestNewSmoother(t *testing.T) {
+	var tests = []struct {
+		name string
+		opts []SmootherOption
+		ok   bool
+	}{
+		{"defaults", nil, true},
+		{"no strength", []SmootherOption{WithPriorStrength(0)}, false},
+		{"invalid prior", []SmootherOption{WithGlobalPrior(1.5)}, false},
+		{"invalid window", []SmootherOption{WithPriorHistory(-1, 0)}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := NewSmoother(log.NewNopLogger(), newMemoryDB(), tt.opts...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got err %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
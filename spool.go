@@ -0,0 +1,256 @@
+package centiment
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// The file extensions of spooled Sentiments, and of Sentiments the DB rejected
+// (or that could not be decoded) and that are no longer replayed.
+const (
+	spoolExt    = ".sentiment"
+	rejectedExt = ".rejected"
+)
+
+// Spool is an on-disk, write-ahead queue of Sentiments that could not be saved
+// to the DB. Spooled Sentiments are replayed in the order they were spooled
+// once the DB recovers: see Aggregator.RunDrainer.
+//
+// Each Sentiment (and the records of its tweets; see WithTweetRecorder) is
+// written (atomically) to its own file in the spool directory, and removed once
+// saved, so that the spool survives restarts.
+type Spool struct {
+	logger log.Logger
+	dir    string
+
+	// draining serializes calls to Drain, so that a Sentiment is not replayed
+	// twice.
+	draining sync.Mutex
+	mu       sync.Mutex
+	seq      int64
+	entries  []*spoolEntry
+}
+
+type spoolEntry struct {
+	name      string
+	sentiment *Sentiment
+}
+
+// NewSpool creates a Spool in the given directory, creating it if needed, and
+// loads any Sentiments spooled by a previous process.
+func NewSpool(logger log.Logger, dir string) (*Spool, error) {
+	if dir == "" {
+		return nil, errors.New("spool: dir must not be empty")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "spool: failed to create dir")
+	}
+
+	sp := &Spool{
+		logger: logger,
+		dir:    dir,
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "spool: failed to list dir")
+	}
+
+	// File names sort in the order they were spooled.
+	sort.Strings(names)
+	for _, name := range names {
+		sentiment, err := readSpoolFile(name)
+		if err != nil {
+			sp.logger.Log("err", errors.Wrap(err, "spool: failed to load sentiment"), "file", name)
+			sp.reject(name)
+			continue
+		}
+
+		sp.entries = append(sp.entries, &spoolEntry{name: name, sentiment: sentiment})
+	}
+
+	return sp, nil
+}
+
+// Append adds a Sentiment to the end of the spool. The Sentiment is durably
+// written to disk before Append returns.
+func (sp *Spool) Append(sentiment *Sentiment) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(sentiment); err != nil {
+		return errors.Wrap(err, "spool: failed to encode sentiment")
+	}
+
+	// The tweets are unexported, and follow the Sentiment.
+	if len(sentiment.tweets) > 0 {
+		if err := enc.Encode(sentiment.tweets); err != nil {
+			return errors.Wrap(err, "spool: failed to encode tweets")
+		}
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	// Names are the time spooled (zero-padded so that they sort) and a sequence
+	// number, to order Sentiments spooled within the clock's resolution.
+	sp.seq++
+	name := filepath.Join(
+		sp.dir,
+		fmt.Sprintf("%020d-%06d-%s%s", time.Now().UnixNano(), sp.seq%1000000, sentiment.Slug, spoolExt),
+	)
+
+	if err := writeFileSync(name, buf.Bytes()); err != nil {
+		return errors.Wrap(err, "spool: failed to write sentiment")
+	}
+
+	spooled := *sentiment
+	sp.entries = append(sp.entries, &spoolEntry{name: name, sentiment: &spooled})
+
+	return nil
+}
+
+// Len returns the number of spooled Sentiments.
+func (sp *Spool) Len() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return len(sp.entries)
+}
+
+// LastSeenID returns the highest LastSeenID of the spooled Sentiments for the
+// given slug, or 0 if none are spooled. Searches should resume from this
+// checkpoint (if higher than the DB's), so that tweets in unsaved Sentiments
+// are not analyzed again.
+func (sp *Spool) LastSeenID(topicSlug string) int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	var lastSeenID int64
+	for _, e := range sp.entries {
+		if e.sentiment.Slug == topicSlug && e.sentiment.LastSeenID > lastSeenID {
+			lastSeenID = e.sentiment.LastSeenID
+		}
+	}
+
+	return lastSeenID
+}
+
+// Drain replays the spooled Sentiments in order, calling save for each and
+// removing it from the spool once saved. Drain stops at the first retryable
+// error, leaving the remaining Sentiments spooled; Sentiments that fail with a
+// permanent error are set aside (renamed with a ".rejected" extension) rather
+// than blocking the spool.
+//
+// Drain returns the number of Sentiments saved.
+func (sp *Spool) Drain(ctx context.Context, save func(ctx context.Context, sentiment *Sentiment) error) (int, error) {
+	sp.draining.Lock()
+	defer sp.draining.Unlock()
+
+	var saved int
+	for {
+		if err := ctx.Err(); err != nil {
+			return saved, err
+		}
+
+		sp.mu.Lock()
+		if len(sp.entries) == 0 {
+			sp.mu.Unlock()
+			return saved, nil
+		}
+		entry := sp.entries[0]
+		sp.mu.Unlock()
+
+		sentiment := *entry.sentiment
+		if err := save(ctx, &sentiment); err != nil {
+			if isRetryable(err) || ctx.Err() != nil {
+				return saved, err
+			}
+
+			sp.logger.Log(
+				"err", errors.Wrap(err, "spool: sentiment rejected"),
+				"topic", sentiment.Topic,
+				"file", entry.name,
+			)
+			sp.reject(entry.name)
+		} else {
+			saved++
+			if err := os.Remove(entry.name); err != nil && !os.IsNotExist(err) {
+				// The Sentiment is saved, so it must not be replayed again.
+				sp.logger.Log("err", errors.Wrap(err, "spool: failed to remove sentiment"), "file", entry.name)
+				sp.reject(entry.name)
+			}
+		}
+
+		sp.mu.Lock()
+		sp.entries = sp.entries[1:]
+		sp.mu.Unlock()
+	}
+}
+
+// reject sets a spool file aside, so that it is not replayed.
+func (sp *Spool) reject(name string) {
+	if err := os.Rename(name, strings.TrimSuffix(name, spoolExt)+rejectedExt); err != nil && !os.IsNotExist(err) {
+		sp.logger.Log("err", errors.Wrap(err, "spool: failed to set aside sentiment"), "file", name)
+	}
+}
+
+func readSpoolFile(name string) (*Sentiment, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	var sentiment *Sentiment
+	if err := dec.Decode(&sentiment); err != nil {
+		return nil, err
+	}
+
+	if err := dec.Decode(&sentiment.tweets); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return sentiment, nil
+}
+
+// writeFileSync writes data to a temporary file, syncs it, and renames it into
+// place, so that a crash never leaves a partially written file at name.
+func writeFileSync(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".spool-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,217 @@
+package centiment
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestSpool returns a Spool in a temporary directory, and a func to remove
+// it.
+func newTestSpool(t *testing.T) (*Spool, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "centiment-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := NewSpool(log.NewNopLogger(), dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return spool, func() { os.RemoveAll(dir) }
+}
+
+// flakyDB is a memoryDB whose saves fail with err while it is set.
+type flakyDB struct {
+	*memoryDB
+
+	mu       sync.Mutex
+	err      error
+	attempts int
+}
+
+func (db *flakyDB) fail(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.err = err
+}
+
+func (db *flakyDB) SaveSentiment(ctx context.Context, sentiment Sentiment) (string, error) {
+	db.mu.Lock()
+	db.attempts++
+	err := db.err
+	db.mu.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	return db.memoryDB.SaveSentiment(ctx, sentiment)
+}
+
+// newRun returns a Sentiment for the given run.
+func newRun(run int64) *Sentiment {
+	return &Sentiment{
+		Topic:      "Bitcoin",
+		Slug:       "bitcoin",
+		Count:      run,
+		LastSeenID: run * 100,
+		FetchedAt:  time.Unix(run*600, 0).UTC(),
+		Histogram:  make([]int64, HistogramBuckets),
+		Digest:     NewDigest(),
+	}
+}
+
+func TestAggregatorSpool(t *testing.T) {
+	spool, cleanup := newTestSpool(t)
+	defer cleanup()
+
+	db := &flakyDB{memoryDB: newMemoryDB()}
+	recorder, err := NewTweetRecorder(log.NewNopLogger(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ag, err := NewAggregator(log.NewNopLogger(), db, WithSaveRetries(2, time.Millisecond), WithSpool(spool), WithTweetRecorder(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withTweets := func(s *Sentiment) *Sentiment {
+		s.RunID = fmt.Sprintf("run-%d", s.Count)
+		s.tweets = []*TweetAnalysis{{ID: s.RunID + "-1", RunID: s.RunID, Slug: s.Slug, TweetID: s.LastSeenID}}
+		return s
+	}
+
+	// Saves fail (after retries) while the DB is unavailable, and are spooled.
+	db.fail(status.Error(codes.Unavailable, "unavailable"))
+	for run := int64(1); run <= 2; run++ {
+		if err := ag.Save(context.Background(), []*Sentiment{withTweets(newRun(run))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tweets are only recorded once their Sentiment is saved.
+	if len(db.tweets) != 0 {
+		t.Errorf("tweets recorded for unsaved sentiments: %v", db.tweets)
+	}
+
+	// The first run is retried; the second run makes a single attempt to drain
+	// the spool, and then queues behind it.
+	if db.attempts != 4 {
+		t.Errorf("save attempt mismatch: got %d want %d", db.attempts, 4)
+	}
+
+	// The spool survives a restart, and its checkpoint is the latest run's.
+	spool, err = NewSpool(log.NewNopLogger(), spool.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spool.Len() != 2 {
+		t.Fatalf("spool length mismatch: got %d want %d", spool.Len(), 2)
+	}
+
+	if got := spool.LastSeenID("bitcoin"); got != 200 {
+		t.Errorf("checkpoint mismatch: got %d want %d", got, 200)
+	}
+
+	ag, err = NewAggregator(log.NewNopLogger(), db, WithSaveRetries(0, 0), WithSpool(spool), WithTweetRecorder(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the DB recovers, the spooled runs (and their tweets) are saved before
+	// the next run.
+	db.fail(nil)
+	if err := ag.Save(context.Background(), []*Sentiment{withTweets(newRun(3))}); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 1; run <= 3; run++ {
+		if _, err := db.GetTweetAnalysesByRun(context.Background(), fmt.Sprintf("run-%d", run), "bitcoin", 0); err != nil {
+			t.Errorf("no tweets recorded for run %d: %v", run, err)
+		}
+	}
+
+	if spool.Len() != 0 {
+		t.Errorf("spool length mismatch: got %d want %d", spool.Len(), 0)
+	}
+
+	if len(db.sentiments) != 3 {
+		t.Fatalf("saved count mismatch: got %d want %d", len(db.sentiments), 3)
+	}
+
+	for i, s := range db.sentiments {
+		if s.Count != int64(i+1) || s.Digest == nil {
+			t.Errorf("sentiment %d mismatch: got run %d (digest %v)", i, s.Count, s.Digest)
+		}
+	}
+
+	names, _ := filepath.Glob(filepath.Join(spool.dir, "*"))
+	if len(names) != 0 {
+		t.Errorf("spool dir not empty: %v", names)
+	}
+}
+
+func TestSpoolDrain(t *testing.T) {
+	spool, cleanup := newTestSpool(t)
+	defer cleanup()
+
+	for run := int64(1); run <= 3; run++ {
+		if err := spool.Append(newRun(run)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Retryable errors stop the drain, leaving the remaining runs spooled, and
+	// permanent errors set the run aside.
+	var saved []int64
+	n, err := spool.Drain(context.Background(), func(ctx context.Context, s *Sentiment) error {
+		switch s.Count {
+		case 2:
+			return status.Error(codes.InvalidArgument, "invalid")
+		case 3:
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+
+		saved = append(saved, s.Count)
+		return nil
+	})
+
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if n != 1 || len(saved) != 1 || spool.Len() != 1 {
+		t.Errorf("drain mismatch: saved %d (%v), %d still spooled", n, saved, spool.Len())
+	}
+
+	rejected, _ := filepath.Glob(filepath.Join(spool.dir, "*"+rejectedExt))
+	if len(rejected) != 1 {
+		t.Errorf("rejected count mismatch: got %d want %d", len(rejected), 1)
+	}
+
+	n, err = spool.Drain(context.Background(), func(ctx context.Context, s *Sentiment) error {
+		saved = append(saved, s.Count)
+		return nil
+	})
+
+	if err != nil || n != 1 || spool.Len() != 0 {
+		t.Errorf("drain mismatch: saved %d (%v), %d still spooled: %v", n, saved, spool.Len(), err)
+	}
+}
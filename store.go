@@ -26,6 +26,24 @@ type DB interface {
 	GetSentimentByID(ctx context.Context, id string) (*Sentiment, error)
 	GetSentimentsBySlug(ctx context.Context, slug string, limit int) ([]*Sentiment, error)
 	GetSentimentsByTopic(ctx context.Context, topic string, limit int) ([]*Sentiment, error)
+	GetSentimentsInRange(ctx context.Context, slug string, after time.Time, before time.Time, limit int) ([]*Sentiment, error)
+	SaveUsage(ctx context.Context, usage Usage) error
+	GetUsage(ctx context.Context, period string) (*Usage, error)
+	SaveRollup(ctx context.Context, rollup Rollup) error
+	UpdateRollup(ctx context.Context, id string, update func(existing *Rollup) (*Rollup, error)) error
+	GetRollups(ctx context.Context, slug string, res Resolution, after time.Time, before time.Time) ([]*Rollup, error)
+	SaveAnomaly(ctx context.Context, anomaly Anomaly) (string, error)
+	GetAnomaliesBySlug(ctx context.Context, slug string, limit int) ([]*Anomaly, error)
+	SaveAlert(ctx context.Context, alert Alert) error
+	GetAlertsBySlug(ctx context.Context, slug string, rule string, limit int) ([]*Alert, error)
+	SaveTweetAnalyses(ctx context.Context, analyses []*TweetAnalysis) error
+	GetTweetAnalysesByRun(ctx context.Context, runID string, slug string, limit int) ([]*TweetAnalysis, error)
+	DeleteTweetAnalysesBefore(ctx context.Context, before time.Time, limit int) (int, error)
+	SaveRun(ctx context.Context, run Run) error
+	GetRun(ctx context.Context, id string) (*Run, error)
+	GetRuns(ctx context.Context, limit int) ([]*Run, error)
+	SavePrices(ctx context.Context, prices []*Price) error
+	GetPricesInRange(ctx context.Context, symbol string, after time.Time, before time.Time) ([]*Price, error)
 }
 
 // Firestore is an implementation of DB that uses Google Cloud Firestore.
@@ -33,6 +51,23 @@ type Firestore struct {
 	Store *firestore.Client
 	// The name of the collection.
 	CollectionName string
+	// The name of the collection for Natural Language API usage. Defaults to
+	// "usage".
+	UsageCollectionName string
+	// The name of the collection for hourly & daily rollups. Defaults to
+	// "rollups".
+	RollupCollectionName string
+	// The name of the collection for anomalies. Defaults to "anomalies".
+	AnomalyCollectionName string
+	// The name of the collection for the alert history. Defaults to "alerts".
+	AlertCollectionName string
+	// The name of the collection for per-tweet analysis records. Defaults to
+	// "tweets".
+	TweetCollectionName string
+	// The name of the collection for analysis runs. Defaults to "runs".
+	RunCollectionName string
+	// The name of the collection for price series. Defaults to "prices".
+	PriceCollectionName string
 }
 
 // Sentiment represents the aggregated result of performing sentiment analysis
@@ -48,6 +83,99 @@ type Sentiment struct {
 	Variance   float64   `json:"variance" firestore:"variance"`
 	FetchedAt  time.Time `json:"fetchedAt" firestore:"fetchedAt"`
 	LastSeenID int64     `json:"-" firestore:"lastSeenID"`
+	// The ID of the analysis run that produced the Sentiment (see Run).
+	RunID string `json:"runID,omitempty" firestore:"runID,omitempty"`
+	// Partial is set when the run was cancelled before all of its tweets were
+	// analyzed (see SavePartialRuns).
+	Partial bool `json:"partial" firestore:"partial"`
+	// Group is set for the Sentiment of a TopicGroup, which aggregates the
+	// tweets of its topics, and Members breaks it down by the group's members.
+	Group   bool           `json:"group" firestore:"group"`
+	Members []*GroupMember `json:"members,omitempty" firestore:"members,omitempty"`
+
+	// The standard error of the mean score, and its 95% confidence interval.
+	// LowConfidence is set when the Sentiment is aggregated from fewer than
+	// MinSamples tweets (see SearchTerm.MinSamples).
+	StdErr        float64 `json:"stdErr" firestore:"stdErr"`
+	CILower       float64 `json:"ciLower" firestore:"ciLower"`
+	CIUpper       float64 `json:"ciUpper" firestore:"ciUpper"`
+	MinSamples    int64   `json:"minSamples" firestore:"minSamples"`
+	LowConfidence bool    `json:"lowConfidence" firestore:"lowConfidence"`
+	// The score shrunk towards a prior mean score (see Smoother), and the prior
+	// & its strength, in tweets. Without a prior, the smoothed score is the raw
+	// score.
+	SmoothedScore float64 `json:"smoothedScore" firestore:"smoothedScore"`
+	PriorScore    float64 `json:"priorScore" firestore:"priorScore"`
+	PriorStrength float64 `json:"priorStrength" firestore:"priorStrength"`
+
+	// The mean, standard deviation & variance of the magnitude (emotional
+	// intensity, regardless of polarity) of each tweet.
+	Magnitude         float64 `json:"magnitude" firestore:"magnitude"`
+	MagnitudeStdDev   float64 `json:"magnitudeStdDev" firestore:"magnitudeStdDev"`
+	MagnitudeVariance float64 `json:"magnitudeVariance" firestore:"magnitudeVariance"`
+	// The number of "mixed" tweets: those with a high magnitude, but a
+	// near-zero score, where positive and negative sentiment cancel out.
+	MixedCount int64 `json:"mixedCount" firestore:"mixedCount"`
+
+	// The distribution of the score: the median, 10th and 90th percentiles
+	// (estimated from Digest), and the number of tweets in each score bucket
+	// (see HistogramBuckets). A mean near zero may hide a polarized, bimodal
+	// distribution that these make visible.
+	Median    float64 `json:"median" firestore:"median"`
+	P10       float64 `json:"p10" firestore:"p10"`
+	P90       float64 `json:"p90" firestore:"p90"`
+	Histogram []int64 `json:"histogram" firestore:"histogram"`
+	// The number of positive, neutral and negative tweets (as classified by the
+	// thresholds of the SearchTerm), their share of Count, and the net sentiment
+	// index: the share of positive tweets less the share of negative tweets, in
+	// [-1, 1].
+	PositiveCount int64   `json:"positiveCount" firestore:"positiveCount"`
+	NeutralCount  int64   `json:"neutralCount" firestore:"neutralCount"`
+	NegativeCount int64   `json:"negativeCount" firestore:"negativeCount"`
+	PositiveRatio float64 `json:"positiveRatio" firestore:"positiveRatio"`
+	NeutralRatio  float64 `json:"neutralRatio" firestore:"neutralRatio"`
+	NegativeRatio float64 `json:"negativeRatio" firestore:"negativeRatio"`
+	NetSentiment  float64 `json:"netSentiment" firestore:"netSentiment"`
+	// Digest is a mergeable sketch of the score distribution, retained so that
+	// quantiles can be computed across Sentiments.
+	Digest *Digest `json:"-" firestore:"digest,omitempty"`
+
+	// Entity-level sentiment: the sentiment expressed towards the entities
+	// matching the topic (see SearchTerm.Aliases), aggregated separately from
+	// the document-level sentiment above. Only populated when entity sentiment
+	// analysis is enabled.
+	EntityCount    int64      `json:"entityCount" firestore:"entityCount"`
+	EntityScore    float64    `json:"entityScore" firestore:"entityScore"`
+	EntityStdDev   float64    `json:"entityStdDev" firestore:"entityStdDev"`
+	EntityVariance float64    `json:"entityVariance" firestore:"entityVariance"`
+	CoEntities     []CoEntity `json:"coEntities,omitempty" firestore:"coEntities,omitempty"`
+
+	// The tweets that exemplify the Sentiment: the most positive, most negative
+	// and most intense (highest magnitude) tweets, best first (see
+	// WithExemplars).
+	MostPositive []Exemplar `json:"mostPositive,omitempty" firestore:"mostPositive,omitempty"`
+	MostNegative []Exemplar `json:"mostNegative,omitempty" firestore:"mostNegative,omitempty"`
+	MostIntense  []Exemplar `json:"mostIntense,omitempty" firestore:"mostIntense,omitempty"`
+
+	// The words, phrases, hashtags, cashtags & mentions most common in the
+	// tweets, and their lift over the topic's previous runs (see
+	// KeywordExtractor).
+	Keywords []Keyword `json:"keywords,omitempty" firestore:"keywords,omitempty"`
+
+	// The analysis of each tweet, when recorded (see WithTweetRecorder).
+	tweets []*TweetAnalysis
+}
+
+// addPolarity counts a tweet with the given polarity.
+func (s *Sentiment) addPolarity(p Polarity) {
+	switch p {
+	case Positive:
+		s.PositiveCount++
+	case Negative:
+		s.NegativeCount++
+	default:
+		s.NeutralCount++
+	}
 }
 
 // populateWithSearch sets the search-related metadata on the Sentiment.
@@ -55,12 +183,38 @@ func (s *Sentiment) populateWithSearch(st *SearchTerm) {
 	s.Topic = strings.TrimSpace(strings.ToLower(st.Topic))
 	// Leave the query as-is (the search query exactly)
 	s.Query = st.Query
+	s.MinSamples = st.minSamples()
 }
 
 // finalize the Sentiment for saving: finalize aggregates & sets the timestamp.
 func (s *Sentiment) finalize() {
-	s.Variance = s.Variance / float64((s.Count - 1))
-	s.StdDev = math.Sqrt(s.Variance)
+	s.Variance = sampleVariance(s.Variance, s.Count)
+	s.MagnitudeVariance = sampleVariance(s.MagnitudeVariance, s.Count)
+	s.EntityVariance = sampleVariance(s.EntityVariance, s.EntityCount)
+	s.summarize()
 	s.FetchedAt = time.Now().UTC()
 	s.Slug = slug.Make(s.Topic)
 }
+
+// summarize computes the statistics derived from the (finalized) aggregates:
+// the standard deviations, confidence interval, smoothed score, classification
+// ratios and score quantiles.
+func (s *Sentiment) summarize() {
+	s.StdDev = math.Sqrt(s.Variance)
+	s.MagnitudeStdDev = math.Sqrt(s.MagnitudeVariance)
+	s.EntityStdDev = math.Sqrt(s.EntityVariance)
+	s.summarizeConfidence()
+	s.smooth()
+	if s.Count > 0 {
+		s.PositiveRatio = float64(s.PositiveCount) / float64(s.Count)
+		s.NeutralRatio = float64(s.NeutralCount) / float64(s.Count)
+		s.NegativeRatio = float64(s.NegativeCount) / float64(s.Count)
+		s.NetSentiment = s.PositiveRatio - s.NegativeRatio
+	}
+	if s.Digest != nil {
+		s.Median = s.Digest.Quantile(0.5)
+		s.P10 = s.Digest.Quantile(0.1)
+		s.P90 = s.Digest.Quantile(0.9)
+	}
+	s.sanitize()
+}
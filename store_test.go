@@ -0,0 +1,376 @@
+package centiment
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryDB is an in-memory implementation of DB, for testing.
+type memoryDB struct {
+	mu         sync.Mutex
+	sentiments []*Sentiment
+	usage      map[string]Usage
+	rollups    map[string]Rollup
+	anomalies  []*Anomaly
+	alerts     map[string]Alert
+	tweets     map[string]TweetAnalysis
+	runs       map[string]Run
+	prices     map[string]Price
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		usage:   make(map[string]Usage),
+		rollups: make(map[string]Rollup),
+		alerts:  make(map[string]Alert),
+		tweets:  make(map[string]TweetAnalysis),
+		runs:    make(map[string]Run),
+		prices:  make(map[string]Price),
+	}
+}
+
+func (db *memoryDB) SaveSentiment(ctx context.Context, sentiment Sentiment) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	sentiment.ID = strconv.Itoa(len(db.sentiments) + 1)
+	db.sentiments = append(db.sentiments, &sentiment)
+
+	return sentiment.ID, nil
+}
+
+func (db *memoryDB) GetSentimentByID(ctx context.Context, id string) (*Sentiment, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, s := range db.sentiments {
+		if s.ID == id {
+			sentiment := *s
+			return &sentiment, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// find returns copies of the sentiments matching fn, newest first.
+func (db *memoryDB) find(limit int, fn func(s *Sentiment) bool) ([]*Sentiment, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sentiments []*Sentiment
+	for _, s := range db.sentiments {
+		if fn(s) {
+			sentiment := *s
+			sentiments = append(sentiments, &sentiment)
+		}
+	}
+
+	sort.SliceStable(sentiments, func(i, j int) bool {
+		return sentiments[i].FetchedAt.After(sentiments[j].FetchedAt)
+	})
+
+	if limit > 0 && len(sentiments) > limit {
+		sentiments = sentiments[:limit]
+	}
+
+	if len(sentiments) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return sentiments, nil
+}
+
+func (db *memoryDB) GetSentimentsBySlug(ctx context.Context, slug string, limit int) ([]*Sentiment, error) {
+	return db.find(limit, func(s *Sentiment) bool {
+		return s.Slug == slug
+	})
+}
+
+func (db *memoryDB) GetSentimentsByTopic(ctx context.Context, topic string, limit int) ([]*Sentiment, error) {
+	return db.find(limit, func(s *Sentiment) bool {
+		return s.Topic == topic
+	})
+}
+
+func (db *memoryDB) GetSentimentsInRange(ctx context.Context, slug string, after time.Time, before time.Time, limit int) ([]*Sentiment, error) {
+	return db.find(limit, func(s *Sentiment) bool {
+		return s.Slug == slug && !s.FetchedAt.Before(after) && s.FetchedAt.Before(before)
+	})
+}
+
+func (db *memoryDB) SaveUsage(ctx context.Context, usage Usage) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.usage[usage.Period] = *usage.copy()
+	return nil
+}
+
+func (db *memoryDB) GetUsage(ctx context.Context, period string) (*Usage, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	usage, ok := db.usage[period]
+	if !ok {
+		return nil, ErrNoResultsFound
+	}
+
+	return usage.copy(), nil
+}
+
+func (db *memoryDB) SaveRollup(ctx context.Context, rollup Rollup) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.rollups[rollup.ID] = rollup
+	return nil
+}
+
+func (db *memoryDB) UpdateRollup(ctx context.Context, id string, update func(existing *Rollup) (*Rollup, error)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var existing *Rollup
+	if rollup, ok := db.rollups[id]; ok {
+		existing = &rollup
+	}
+
+	rollup, err := update(existing)
+	if err != nil {
+		return err
+	}
+
+	db.rollups[id] = *rollup
+	return nil
+}
+
+func (db *memoryDB) GetRollups(ctx context.Context, slug string, res Resolution, after time.Time, before time.Time) ([]*Rollup, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var rollups []*Rollup
+	for _, r := range db.rollups {
+		if r.Slug == slug && r.Resolution == res && !r.PeriodStart.Before(after) && r.PeriodStart.Before(before) {
+			rollup := r
+			rollups = append(rollups, &rollup)
+		}
+	}
+
+	sort.Slice(rollups, func(i, j int) bool {
+		return rollups[i].PeriodStart.After(rollups[j].PeriodStart)
+	})
+
+	if len(rollups) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return rollups, nil
+}
+
+func (db *memoryDB) SaveAnomaly(ctx context.Context, anomaly Anomaly) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	anomaly.ID = strconv.Itoa(len(db.anomalies) + 1)
+	db.anomalies = append(db.anomalies, &anomaly)
+
+	return anomaly.ID, nil
+}
+
+func (db *memoryDB) GetAnomaliesBySlug(ctx context.Context, slug string, limit int) ([]*Anomaly, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var anomalies []*Anomaly
+	for i := len(db.anomalies) - 1; i >= 0; i-- {
+		if a := db.anomalies[i]; a.Slug == slug && (limit <= 0 || len(anomalies) < limit) {
+			anomaly := *a
+			anomalies = append(anomalies, &anomaly)
+		}
+	}
+
+	if len(anomalies) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return anomalies, nil
+}
+
+func (db *memoryDB) SaveAlert(ctx context.Context, alert Alert) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.alerts[alert.ID] = alert
+	return nil
+}
+
+func (db *memoryDB) GetAlertsBySlug(ctx context.Context, slug string, rule string, limit int) ([]*Alert, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var alerts []*Alert
+	for _, a := range db.alerts {
+		if a.Slug == slug && (rule == "" || a.Rule == rule) {
+			alert := a
+			alerts = append(alerts, &alert)
+		}
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].TriggeredAt.After(alerts[j].TriggeredAt)
+	})
+
+	if limit > 0 && len(alerts) > limit {
+		alerts = alerts[:limit]
+	}
+
+	if len(alerts) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return alerts, nil
+}
+
+func (db *memoryDB) SaveTweetAnalyses(ctx context.Context, analyses []*TweetAnalysis) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, ta := range analyses {
+		db.tweets[ta.ID] = *ta
+	}
+
+	return nil
+}
+
+func (db *memoryDB) GetTweetAnalysesByRun(ctx context.Context, runID string, slug string, limit int) ([]*TweetAnalysis, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var analyses []*TweetAnalysis
+	for _, ta := range db.tweets {
+		if ta.RunID == runID && (slug == "" || ta.Slug == slug) {
+			analysis := ta
+			analyses = append(analyses, &analysis)
+		}
+	}
+
+	sort.Slice(analyses, func(i, j int) bool {
+		return analyses[i].ID < analyses[j].ID
+	})
+
+	if limit > 0 && len(analyses) > limit {
+		analyses = analyses[:limit]
+	}
+
+	if len(analyses) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return analyses, nil
+}
+
+func (db *memoryDB) DeleteTweetAnalysesBefore(ctx context.Context, before time.Time, limit int) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var deleted int
+	for id, ta := range db.tweets {
+		if deleted == limit {
+			break
+		}
+
+		if ta.AnalyzedAt.Before(before) {
+			delete(db.tweets, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (db *memoryDB) SaveRun(ctx context.Context, run Run) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.runs[run.ID] = run
+	return nil
+}
+
+func (db *memoryDB) GetRun(ctx context.Context, id string) (*Run, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	run, ok := db.runs[id]
+	if !ok {
+		return nil, ErrNoResultsFound
+	}
+
+	return &run, nil
+}
+
+func (db *memoryDB) GetRuns(ctx context.Context, limit int) ([]*Run, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var runs []*Run
+	for _, r := range db.runs {
+		run := r
+		runs = append(runs, &run)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	if len(runs) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return runs, nil
+}
+
+func (db *memoryDB) SavePrices(ctx context.Context, prices []*Price) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, p := range prices {
+		db.prices[p.ID] = *p
+	}
+
+	return nil
+}
+
+func (db *memoryDB) GetPricesInRange(ctx context.Context, symbol string, after time.Time, before time.Time) ([]*Price, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var prices []*Price
+	for _, p := range db.prices {
+		if p.Symbol == symbol && !p.Time.Before(after) && p.Time.Before(before) {
+			price := p
+			prices = append(prices, &price)
+		}
+	}
+
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].Time.Before(prices[j].Time)
+	})
+
+	if len(prices) == 0 {
+		return nil, ErrNoResultsFound
+	}
+
+	return prices, nil
+}
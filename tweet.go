@@ -0,0 +1,195 @@
+package centiment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// ProviderNaturalLanguage identifies results from the Google Cloud Natural
+// Language API.
+const ProviderNaturalLanguage = "google-natural-language"
+
+// maxTweetBatch is the maximum number of TweetAnalysis records written (or
+// deleted) in a single batch: the limit for a Firestore batched write.
+const maxTweetBatch = 500
+
+// TweetAnalysis is the record of the analysis of a single tweet, as aggregated
+// into a Sentiment. These allow auditing why a topic's sentiment moved, and
+// re-scoring tweets with a different model.
+type TweetAnalysis struct {
+	ID    string `json:"id" firestore:"id,omitempty"`
+	RunID string `json:"runID" firestore:"runID"`
+	Topic string `json:"topic" firestore:"topic"`
+	Slug  string `json:"slug" firestore:"slug"`
+	// The ID of the tweet, serialized as a string in JSON to avoid losing
+	// precision in JavaScript clients.
+	TweetID int64 `json:"tweetID,string" firestore:"tweetID"`
+	// The SHA-256 hash of the tweet's text, and the text itself (only when
+	// enabled; see WithTweetText).
+	TextHash string `json:"textHash" firestore:"textHash"`
+	Text     string `json:"text,omitempty" firestore:"text,omitempty"`
+	// The score & magnitude of the tweet, and the provider (e.g.
+	// ProviderNaturalLanguage) that analyzed it.
+	Score     float64 `json:"score" firestore:"score"`
+	Magnitude float64 `json:"magnitude" firestore:"magnitude"`
+	Provider  string  `json:"provider" firestore:"provider"`
+	// When the tweet was created, and when it was analyzed.
+	CreatedAt  time.Time `json:"createdAt" firestore:"createdAt"`
+	AnalyzedAt time.Time `json:"analyzedAt" firestore:"analyzedAt"`
+}
+
+// newTweetAnalysis creates the record of an analyzed tweet.
+func newTweetAnalysis(runID string, topicSlug string, res *AnalyzerResult, withText bool) *TweetAnalysis {
+	hash := sha256.Sum256([]byte(res.Content))
+	ta := &TweetAnalysis{
+		// IDs are deterministic, so that recording a run again is idempotent.
+		ID:         fmt.Sprintf("%s-%s-%d", runID, topicSlug, res.TweetID),
+		RunID:      runID,
+		Topic:      res.SearchTerm.Topic,
+		Slug:       topicSlug,
+		TweetID:    res.TweetID,
+		TextHash:   hex.EncodeToString(hash[:]),
+		Score:      float64(res.Score),
+		Magnitude:  float64(res.Magnitude),
+		Provider:   res.Provider,
+		CreatedAt:  res.CreatedAt,
+		AnalyzedAt: time.Now().UTC(),
+	}
+
+	if withText {
+		ta.Text = res.Content
+	}
+
+	return ta
+}
+
+// TweetRecorder records the analysis of each tweet (see TweetAnalysis) in the
+// DB, and prunes records older than the retention period.
+type TweetRecorder struct {
+	logger    log.Logger
+	db        DB
+	batchSize int
+	retention time.Duration
+	withText  bool
+}
+
+// TweetRecorderOption configures a TweetRecorder.
+type TweetRecorderOption func(*TweetRecorder)
+
+// WithTweetRetention sets how long records are kept for before being pruned.
+// Providing a retention of 0 keeps records indefinitely.
+func WithTweetRetention(retention time.Duration) TweetRecorderOption {
+	return func(tr *TweetRecorder) {
+		tr.retention = retention
+	}
+}
+
+// WithTweetText stores the text of each tweet, rather than only its hash.
+func WithTweetText() TweetRecorderOption {
+	return func(tr *TweetRecorder) {
+		tr.withText = true
+	}
+}
+
+// WithTweetBatchSize sets the number of records written (or pruned) per batch,
+// up to 500.
+func WithTweetBatchSize(batchSize int) TweetRecorderOption {
+	return func(tr *TweetRecorder) {
+		tr.batchSize = batchSize
+	}
+}
+
+// NewTweetRecorder creates a new TweetRecorder. By default, records are kept
+// for 30 days, and only the hash of each tweet's text is stored.
+func NewTweetRecorder(logger log.Logger, db DB, opts ...TweetRecorderOption) (*TweetRecorder, error) {
+	if db == nil {
+		return nil, errors.New("tweet recorder: db must not be nil")
+	}
+
+	tr := &TweetRecorder{
+		logger:    logger,
+		db:        db,
+		batchSize: maxTweetBatch,
+		retention: time.Hour * 24 * 30,
+	}
+
+	for _, opt := range opts {
+		opt(tr)
+	}
+
+	if tr.batchSize < 1 || tr.batchSize > maxTweetBatch {
+		return nil, errors.Errorf("tweet recorder: batch size must be between 1 and %d", maxTweetBatch)
+	}
+
+	if tr.retention < 0 {
+		return nil, errors.New("tweet recorder: retention must be >= 0")
+	}
+
+	return tr, nil
+}
+
+// Record saves the given records, in batches.
+func (tr *TweetRecorder) Record(ctx context.Context, analyses []*TweetAnalysis) error {
+	for start := 0; start < len(analyses); start += tr.batchSize {
+		end := start + tr.batchSize
+		if end > len(analyses) {
+			end = len(analyses)
+		}
+
+		if err := tr.db.SaveTweetAnalyses(ctx, analyses[start:end]); err != nil {
+			return errors.Wrapf(err, "failed to record tweets (%d of %d recorded)", start, len(analyses))
+		}
+	}
+
+	return nil
+}
+
+// Prune deletes the records analyzed before the retention period, and returns
+// the number deleted.
+func (tr *TweetRecorder) Prune(ctx context.Context) (int, error) {
+	if tr.retention == 0 {
+		return 0, nil
+	}
+
+	before := time.Now().Add(-tr.retention)
+	var pruned int
+	for {
+		n, err := tr.db.DeleteTweetAnalysesBefore(ctx, before, tr.batchSize)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+
+		if n < tr.batchSize {
+			return pruned, nil
+		}
+	}
+}
+
+// RunPruner prunes expired records every interval, until the context is
+// cancelled.
+func (tr *TweetRecorder) RunPruner(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := tr.Prune(ctx)
+			tr.logger.Log(
+				"state", "pruned",
+				"tweets", n,
+				"retention", tr.retention,
+				"err", err,
+			)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
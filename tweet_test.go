@@ -0,0 +1,115 @@
+package centiment
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTweetRecorder(t *testing.T) {
+	var tests = []struct {
+		name     string
+		opts     []TweetRecorderOption
+		withText bool
+	}{
+		{"hash only", nil, false},
+		{"with text", []TweetRecorderOption{WithTweetText()}, true},
+	}
+
+	term := &SearchTerm{Topic: "Bitcoin", Query: "bitcoin"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemoryDB()
+			recorder, err := NewTweetRecorder(log.NewNopLogger(), db, append(tt.opts, WithTweetBatchSize(2))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ag, err := NewAggregator(log.NewNopLogger(), db, WithTweetRecorder(recorder))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			results := randomResults(rand.New(rand.NewSource(1)), term, 5)
+			analyzed := make(chan *AnalyzerResult, len(results))
+			for i, res := range results {
+				res.Content = fmt.Sprintf("tweet %d about bitcoin", i)
+				res.Provider = ProviderNaturalLanguage
+				analyzed <- res
+			}
+			close(analyzed)
+
+			ctx := ContextWithRunID(context.Background(), "20180212T052416Z-cafef00d")
+			if err := ag.Run(ctx, analyzed); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+
+			analyses, err := db.GetTweetAnalysesByRun(context.Background(), "20180212T052416Z-cafef00d", "", 0)
+			if err != nil {
+				t.Fatalf("failed to fetch tweets: %v", err)
+			}
+
+			if len(analyses) != len(results) {
+				t.Fatalf("tweet count mismatch: got %d want %d", len(analyses), len(results))
+			}
+
+			hashes := make(map[string]bool)
+			for _, ta := range analyses {
+				if ta.Slug != "bitcoin" || ta.Provider != ProviderNaturalLanguage || ta.AnalyzedAt.IsZero() {
+					t.Errorf("unexpected record: %+v", ta)
+				}
+
+				if (ta.Text != "") != tt.withText {
+					t.Errorf("text mismatch: got %q", ta.Text)
+				}
+				hashes[ta.TextHash] = true
+			}
+
+			if len(hashes) != len(results) {
+				t.Errorf("text hash collision: %d distinct hashes for %d tweets", len(hashes), len(results))
+			}
+
+			// Records can be filtered by topic, and limited.
+			limited, err := db.GetTweetAnalysesByRun(context.Background(), "20180212T052416Z-cafef00d", "bitcoin", 2)
+			if err != nil || len(limited) != 2 {
+				t.Errorf("limited tweet count mismatch: got %d want 2 (err %v)", len(limited), err)
+			}
+
+			if _, err := db.GetTweetAnalysesByRun(context.Background(), "20180212T052416Z-cafef00d", "ethereum", 0); err != ErrNoResultsFound {
+				t.Errorf("expected no tweets for another topic: got %v", err)
+			}
+		})
+	}
+}
+
+func TestTweetRecorderPrune(t *testing.T) {
+	db := newMemoryDB()
+	recorder, err := NewTweetRecorder(log.NewNopLogger(), db, WithTweetRetention(time.Hour), WithTweetBatchSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var analyses []*TweetAnalysis
+	for i := 0; i < 8; i++ {
+		// Five records are older than the retention period.
+		analyzedAt := time.Now().Add(-time.Minute * 25 * time.Duration(i))
+		analyses = append(analyses, &TweetAnalysis{ID: fmt.Sprintf("run-bitcoin-%d", i), RunID: "run", AnalyzedAt: analyzedAt})
+	}
+
+	if err := recorder.Record(context.Background(), analyses); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := recorder.Prune(context.Background())
+	if err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+
+	if n != 5 || len(db.tweets) != 3 {
+		t.Errorf("prune mismatch: pruned %d, %d remaining", n, len(db.tweets))
+	}
+}
@@ -0,0 +1,281 @@
+// Package twittertest provides a fake of the Twitter REST API, for testing
+// code that uses an *anaconda.TwitterApi without network access or
+// credentials.
+//
+// The fake serves scripted statuses from the search/tweets endpoint, honouring
+// the count, max_id, since_id and tweet_mode parameters, and can be scripted
+// to return rate-limit responses and empty pages:
+//
+//	srv := twittertest.NewServer(
+//		twittertest.WithStatuses("bitcoin", twittertest.NewStatus(1, "to the moon", time.Now())),
+//		twittertest.WithRateLimit(1, time.Now()),
+//	)
+//	defer srv.Close()
+//
+//	api := anaconda.NewTwitterApi("token", "secret")
+//	api.HttpClient = srv.Client()
+//	api.SetBaseUrl(srv.URL)
+package twittertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+// The paths served by the fake, relative to its URL.
+const (
+	PathVerifyCredentials = "/account/verify_credentials.json"
+	PathSearch            = "/search/tweets.json"
+)
+
+// maxCompatTextLength is the length that the text of Tweets is truncated to,
+// when not requested in extended mode.
+const maxCompatTextLength = 140
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithStatuses adds statuses to the results for the given search query. Queries
+// are matched exactly.
+func WithStatuses(query string, statuses ...anaconda.Tweet) Option {
+	return func(s *Server) {
+		s.statuses[query] = append(s.statuses[query], statuses...)
+	}
+}
+
+// WithRateLimit fails the first n search requests with a rate-limit (HTTP 429)
+// response, with the rate-limit window resetting at reset.
+func WithRateLimit(n int, reset time.Time) Option {
+	return func(s *Server) {
+		s.rateLimited = n
+		s.rateLimitReset = reset
+	}
+}
+
+// WithEmptyPages returns an empty page of results for the given (1-indexed)
+// search requests, regardless of the statuses available. Rate-limited requests
+// are counted.
+func WithEmptyPages(requests ...int) Option {
+	return func(s *Server) {
+		for _, n := range requests {
+			s.emptyPages[n] = true
+		}
+	}
+}
+
+// WithInvalidCredentials rejects all requests as unauthorized.
+func WithInvalidCredentials() Option {
+	return func(s *Server) {
+		s.unauthorized = true
+	}
+}
+
+// Server is a fake Twitter API server. Create one with NewServer, and call
+// Close when done.
+type Server struct {
+	*httptest.Server
+
+	statuses       map[string][]anaconda.Tweet
+	rateLimited    int
+	rateLimitReset time.Time
+	emptyPages     map[int]bool
+	unauthorized   bool
+
+	mu       sync.Mutex
+	searches []url.Values
+}
+
+// NewServer starts a new fake server.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		statuses:   make(map[string][]anaconda.Tweet),
+		emptyPages: make(map[int]bool),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathVerifyCredentials, s.verifyCredentials)
+	mux.HandleFunc(PathSearch, s.search)
+	s.Server = httptest.NewServer(s.authorize(mux))
+
+	return s
+}
+
+// Searches returns the parameters of each search request made to the server,
+// in order.
+func (s *Server) Searches() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	searches := make([]url.Values, len(s.searches))
+	copy(searches, s.searches)
+
+	return searches
+}
+
+func (s *Server) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.unauthorized {
+			writeError(w, http.StatusUnauthorized, 89, "Invalid or expired token.")
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) verifyCredentials(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, anaconda.User{Id: 1, IdStr: "1", ScreenName: "twittertest"})
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	s.mu.Lock()
+	s.searches = append(s.searches, params)
+	n := len(s.searches)
+	s.mu.Unlock()
+
+	if n <= s.rateLimited {
+		w.Header().Set("X-Rate-Limit-Limit", "180")
+		w.Header().Set("X-Rate-Limit-Remaining", "0")
+		w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(s.rateLimitReset.Unix(), 10))
+		writeError(w, http.StatusTooManyRequests, 88, "Rate limit exceeded")
+		return
+	}
+
+	query := params.Get("q")
+	resp := anaconda.SearchResponse{
+		Statuses: []anaconda.Tweet{},
+		Metadata: anaconda.SearchMetadata{Query: url.QueryEscape(query)},
+	}
+
+	if !s.emptyPages[n] {
+		page, err := s.page(query, params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, 44, err.Error())
+			return
+		}
+		resp.Statuses = page
+	}
+
+	resp.Metadata.Count = len(resp.Statuses)
+	writeJSON(w, resp)
+}
+
+// page returns the (newest first) statuses for the query that match the
+// count, max_id and since_id parameters.
+func (s *Server) page(query string, params url.Values) ([]anaconda.Tweet, error) {
+	count, err := intParam(params, "count", 15)
+	if err != nil {
+		return nil, err
+	}
+
+	maxID, err := intParam(params, "max_id", math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	sinceID, err := intParam(params, "since_id", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]anaconda.Tweet, len(s.statuses[query]))
+	copy(statuses, s.statuses[query])
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Id > statuses[j].Id
+	})
+
+	var page []anaconda.Tweet
+	for _, status := range statuses {
+		if len(page) >= int(count) {
+			break
+		}
+
+		if status.Id > maxID || status.Id <= sinceID {
+			continue
+		}
+
+		// Extended mode moves the text of a Tweet into full_text. Otherwise
+		// (in compatibility mode), text is truncated to 140 characters.
+		if params.Get("tweet_mode") == "extended" {
+			if status.FullText == "" {
+				status.FullText, status.Text = status.Text, ""
+			}
+		} else if text := []rune(status.Text); len(text) > maxCompatTextLength {
+			status.Text = string(text[:maxCompatTextLength-1]) + "…"
+		}
+
+		page = append(page, status)
+	}
+
+	return page, nil
+}
+
+// NewStatus returns a status with the given ID and text, created at createdAt.
+func NewStatus(id int64, text string, createdAt time.Time) anaconda.Tweet {
+	return anaconda.Tweet{
+		Id:        id,
+		IdStr:     strconv.FormatInt(id, 10),
+		Text:      text,
+		CreatedAt: createdAt.UTC().Format(time.RubyDate),
+		Lang:      "en",
+	}
+}
+
+// NewRetweet returns a retweet (with the given ID) of status.
+func NewRetweet(id int64, status anaconda.Tweet, createdAt time.Time) anaconda.Tweet {
+	rt := NewStatus(id, "RT "+status.Text, createdAt)
+	rt.RetweetedStatus = &status
+
+	return rt
+}
+
+// NewMalformedStatus returns a status with an unparseable created_at value.
+func NewMalformedStatus(id int64, text string) anaconda.Tweet {
+	status := NewStatus(id, text, time.Time{})
+	status.CreatedAt = "not a timestamp"
+
+	return status
+}
+
+func intParam(params url.Values, key string, def int64) (int64, error) {
+	v := params.Get(key)
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s parameter: %q", key, v)
+	}
+
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, errCode int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(anaconda.TwitterErrorResponse{
+		Errors: []anaconda.TwitterError{{Message: message, Code: errCode}},
+	})
+}